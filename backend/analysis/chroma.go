@@ -0,0 +1,157 @@
+package analysis
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+const (
+	// frameSize is the number of samples analyzed per frame
+	frameSize = 4096
+	// frameHop is the number of samples between the starts of two frames
+	frameHop = frameSize / 3
+	// Frequency range mapped to the chroma classes
+	minFrequency = 28.0
+	maxFrequency = 3520.0
+	// silenceEnergy is the mean squared amplitude under which a frame is silent
+	silenceEnergy = 1e-6
+)
+
+// FrameDuration is the time between two fingerprint frames, in seconds
+const FrameDuration = float64(frameHop) / SampleRate
+
+// Fingerprint is a sequence of 32-bit codes describing how the chroma of an
+// audio signal evolves. Similar audio yields codes with few differing bits.
+type Fingerprint struct {
+	Codes  []uint32
+	Silent []bool
+}
+
+// Duration returns the length of the fingerprinted audio, in seconds
+func (f *Fingerprint) Duration() float64 {
+	return float64(len(f.Codes)) * FrameDuration
+}
+
+// NewFingerprint computes the chroma fingerprint of mono 16-bit PCM samples at SampleRate
+func NewFingerprint(samples []int16) *Fingerprint {
+	fingerprint := &Fingerprint{}
+	if len(samples) < frameSize {
+		return fingerprint
+	}
+
+	// Precompute the Hann window and the chroma class of every FFT bin
+	window := make([]float64, frameSize)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(frameSize-1))
+	}
+	binClass := make([]int, frameSize/2)
+	for k := range binClass {
+		frequency := float64(k) * SampleRate / frameSize
+		if frequency < minFrequency || frequency > maxFrequency {
+			binClass[k] = -1
+			continue
+		}
+		note := 12*math.Log2(frequency/440) + 69
+		binClass[k] = ((int(math.Round(note)) % 12) + 12) % 12
+	}
+
+	buffer := make([]complex128, frameSize)
+	var previous [12]float64
+	for start := 0; start+frameSize <= len(samples); start += frameHop {
+		energy := 0.0
+		for i := 0; i < frameSize; i++ {
+			sample := float64(samples[start+i]) / 32768
+			energy += sample * sample
+			buffer[i] = complex(sample*window[i], 0)
+		}
+		energy /= frameSize
+		fft(buffer)
+
+		// Fold the spectrum into the 12 pitch classes
+		var chroma [12]float64
+		for k, class := range binClass {
+			if class >= 0 {
+				chroma[class] += cmplx.Abs(buffer[k])
+			}
+		}
+		normalize(&chroma)
+
+		fingerprint.Codes = append(fingerprint.Codes, chromaCode(&chroma, &previous))
+		fingerprint.Silent = append(fingerprint.Silent, energy < silenceEnergy)
+		previous = chroma
+	}
+	return fingerprint
+}
+
+// chromaCode packs comparisons between chroma classes, and between the current
+// and previous frames, into a 32-bit code
+func chromaCode(chroma, previous *[12]float64) uint32 {
+	var code uint32
+	bit := 0
+	for c := 0; c < 12; c++ {
+		if chroma[c] > previous[c] {
+			code |= 1 << bit
+		}
+		bit++
+	}
+	for c := 0; c < 12; c++ {
+		if chroma[c] > chroma[(c+1)%12] {
+			code |= 1 << bit
+		}
+		bit++
+	}
+	for c := 0; c < 8; c++ {
+		if chroma[c] > chroma[(c+3)%12] {
+			code |= 1 << bit
+		}
+		bit++
+	}
+	return code
+}
+
+// normalize scales a chroma vector to unit length
+func normalize(chroma *[12]float64) {
+	norm := 0.0
+	for _, value := range chroma {
+		norm += value * value
+	}
+	if norm == 0 {
+		return
+	}
+	norm = math.Sqrt(norm)
+	for i := range chroma {
+		chroma[i] /= norm
+	}
+}
+
+// fft computes the discrete Fourier transform of x in place. len(x) must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+
+	// Bit-reversal permutation
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	// Butterflies
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even := x[start+k]
+				odd := w * x[start+k+size/2]
+				x[start+k] = even + odd
+				x[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package analysis
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+func TestFFT(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	input := make([]complex128, 64)
+	for i := range input {
+		input[i] = complex(random.Float64()-0.5, random.Float64()-0.5)
+	}
+
+	got := append([]complex128(nil), input...)
+	fft(got)
+
+	// Compare with the definition of the discrete Fourier transform
+	for k := range input {
+		var want complex128
+		for n, x := range input {
+			want += x * cmplx.Exp(complex(0, -2*math.Pi*float64(k*n)/float64(len(input))))
+		}
+		if cmplx.Abs(got[k]-want) > 1e-9 {
+			t.Errorf("bin %d = %v, want %v", k, got[k], want)
+		}
+	}
+}
+
+func TestChromaCode(t *testing.T) {
+	var previous, chroma [12]float64
+	chroma[0] = 1
+
+	// Class 0 rose since the previous frame, is above class 1 and above class 3
+	if got, want := chromaCode(&chroma, &previous), uint32(1|1<<12|1<<24); got != want {
+		t.Errorf("chromaCode = %032b, want %032b", got, want)
+	}
+	// Nothing changes and no class is above another
+	if got := chromaCode(&chroma, &chroma); got != 1<<12|1<<24 {
+		t.Errorf("chromaCode of an unchanged frame = %032b", got)
+	}
+	if got := chromaCode(&previous, &previous); got != 0 {
+		t.Errorf("chromaCode of silence = %032b, want 0", got)
+	}
+}
+
+// tone returns samples of a sine wave at frequency, in hertz
+func tone(frequency float64, samples int) []int16 {
+	result := make([]int16, samples)
+	for i := range result {
+		result[i] = int16(8000 * math.Sin(2*math.Pi*frequency*float64(i)/SampleRate))
+	}
+	return result
+}
+
+func TestNewFingerprint(t *testing.T) {
+	if fingerprint := NewFingerprint(make([]int16, frameSize-1)); len(fingerprint.Codes) != 0 {
+		t.Errorf("fingerprint of less than a frame has %d frames", len(fingerprint.Codes))
+	}
+
+	samples := 10 * SampleRate
+	wantFrames := (samples-frameSize)/frameHop + 1
+
+	silence := NewFingerprint(make([]int16, samples))
+	if len(silence.Codes) != wantFrames || len(silence.Silent) != wantFrames {
+		t.Fatalf("fingerprint has %d codes and %d silence flags, want %d frames", len(silence.Codes), len(silence.Silent), wantFrames)
+	}
+	for i, silent := range silence.Silent {
+		if !silent {
+			t.Fatalf("frame %d of silence isn't silent", i)
+		}
+	}
+	if duration := silence.Duration(); math.Abs(duration-float64(wantFrames)*FrameDuration) > 1e-9 {
+		t.Errorf("Duration = %v, want %v", duration, float64(wantFrames)*FrameDuration)
+	}
+
+	// The same audio gives the same codes, wherever it starts on a frame boundary
+	var melody []int16
+	for _, frequency := range []float64{440, 523.25, 659.25, 392} {
+		melody = append(melody, tone(frequency, 2*SampleRate)...)
+	}
+	alone := NewFingerprint(melody)
+	for i, silent := range alone.Silent {
+		if silent {
+			t.Fatalf("frame %d of a tone is silent", i)
+		}
+	}
+	const offsetFrames = 20
+	shifted := NewFingerprint(append(tone(220, offsetFrames*frameHop), melody...))
+	// The first frame after the offset is compared with a different previous frame
+	for i := 1; i < len(alone.Codes); i++ {
+		if alone.Codes[i] != shifted.Codes[offsetFrames+i] {
+			t.Fatalf("frame %d differs after shifting the audio: %032b, %032b", i, alone.Codes[i], shifted.Codes[offsetFrames+i])
+		}
+	}
+
+	// Unrelated audio gives different codes
+	random := rand.New(rand.NewSource(2))
+	noise := make([]int16, 8*SampleRate)
+	for i := range noise {
+		noise[i] = int16(random.Intn(16000) - 8000)
+	}
+	if segment, found := FindSharedSegment(alone, NewFingerprint(noise), 2); found {
+		t.Errorf("a melody and noise share a segment: %+v", segment)
+	}
+	if segment, found := FindSharedSegment(alone, shifted, 2); !found || math.Abs(segment.StartB-segment.StartA-offsetFrames*FrameDuration) > 1e-9 {
+		t.Errorf("FindSharedSegment of shifted audio = %+v, %v; want it %d frames later", segment, found, offsetFrames)
+	}
+}
@@ -0,0 +1,39 @@
+package analysis
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// SampleRate is the sample rate audio is decoded at for fingerprinting
+const SampleRate = 11025
+
+// DecodeAudio decodes the first maxSeconds of a media file's audio track to mono
+// 16-bit PCM at SampleRate, using the ffmpeg binary at ffmpegPath
+func DecodeAudio(ctx context.Context, ffmpegPath, path string, maxSeconds float64) ([]int16, error) {
+	args := []string{
+		"-nostdin", "-v", "error",
+		"-i", path,
+		"-t", strconv.FormatFloat(maxSeconds, 'f', 3, 64),
+		"-vn", "-ac", "1", "-ar", strconv.Itoa(SampleRate),
+		"-f", "s16le", "-",
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed on %s: %w: %s", path, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	samples := make([]int16, stdout.Len()/2)
+	if err := binary.Read(&stdout, binary.LittleEndian, samples); err != nil {
+		return nil, fmt.Errorf("failed to read decoded audio: %w", err)
+	}
+	return samples, nil
+}
@@ -0,0 +1,236 @@
+package analysis
+
+import (
+	"math/bits"
+	"sort"
+)
+
+const (
+	// windowFrames is the number of frames averaged when comparing fingerprints
+	windowFrames = 8
+	// maxMeanBitErrors is the mean number of differing bits per frame, over a
+	// window, under which two fingerprints are considered the same audio.
+	// Unrelated audio differs by about 16 bits.
+	maxMeanBitErrors = 10
+	// silentDistance is the distance given to silent frames so silence never matches
+	silentDistance = 32
+	// minOverlap is how much two detected intros must overlap to agree
+	minOverlap = 0.5
+)
+
+// Segment is a stretch of audio shared by two fingerprints
+type Segment struct {
+	StartA   float64 // Start in the first fingerprint, in seconds
+	StartB   float64 // Start in the second fingerprint, in seconds
+	Duration float64 // In seconds
+	Quality  float64 // 1 for identical audio, 0 for unrelated audio
+}
+
+// FindSharedSegment returns the longest stretch of audio, at least minDuration
+// seconds long, that appears in both fingerprints
+func FindSharedSegment(a, b *Fingerprint, minDuration float64) (Segment, bool) {
+	minFrames := int(minDuration / FrameDuration)
+	if minFrames < windowFrames {
+		minFrames = windowFrames
+	}
+
+	var best Segment
+	bestFrames := 0
+	found := false
+
+	prefix := make([]int, 0, len(a.Codes)+1)
+	for offset := -(len(b.Codes) - minFrames); offset <= len(a.Codes)-minFrames; offset++ {
+		// Frame i of a lines up with frame i-offset of b
+		startA := offset
+		if startA < 0 {
+			startA = 0
+		}
+		startB := startA - offset
+		n := len(a.Codes) - startA
+		if remaining := len(b.Codes) - startB; remaining < n {
+			n = remaining
+		}
+		if n < minFrames {
+			continue
+		}
+
+		// Prefix sums of the per-frame distances
+		prefix = append(prefix[:0], 0)
+		for i := 0; i < n; i++ {
+			distance := silentDistance
+			if !a.Silent[startA+i] && !b.Silent[startB+i] {
+				distance = bits.OnesCount32(a.Codes[startA+i] ^ b.Codes[startB+i])
+			}
+			prefix = append(prefix, prefix[i]+distance)
+		}
+
+		// Keep the run if it's the longest so far
+		consider := func(runStart, runEnd int) {
+			frames := runEnd - runStart
+			if frames < minFrames || frames <= bestFrames {
+				return
+			}
+			meanDistance := float64(prefix[runEnd]-prefix[runStart]) / float64(frames)
+			best = Segment{
+				StartA:   float64(startA+runStart) * FrameDuration,
+				StartB:   float64(startB+runStart) * FrameDuration,
+				Duration: float64(frames) * FrameDuration,
+				Quality:  clamp(1-meanDistance/16, 0, 1),
+			}
+			bestFrames = frames
+			found = true
+		}
+
+		// Find the runs of matching windows
+		runStart := -1
+		for i := 0; i <= n-windowFrames; i++ {
+			matched := prefix[i+windowFrames]-prefix[i] <= maxMeanBitErrors*windowFrames
+			if matched && runStart < 0 {
+				runStart = i
+			}
+			if !matched && runStart >= 0 {
+				consider(runStart, i-1+windowFrames)
+				runStart = -1
+			}
+		}
+		if runStart >= 0 {
+			consider(runStart, n)
+		}
+	}
+
+	return best, found
+}
+
+// IntroOptions tunes intro detection
+type IntroOptions struct {
+	MinDuration float64 // Shortest intro, in seconds
+	MaxDuration float64 // Longest intro, in seconds
+	Comparisons int     // Number of other episodes each episode is compared with
+}
+
+// IntroResult is the intro detected in one episode
+type IntroResult struct {
+	Found      bool
+	Start      float64 // In seconds
+	End        float64 // In seconds
+	Confidence float64 // Between 0 and 1
+}
+
+// candidate is an intro found by comparing an episode with one other episode
+type candidate struct {
+	start, end, quality float64
+}
+
+// DetectIntros finds the intro shared by the episodes of a season. Each episode
+// is compared with its neighbours; the intro is the segment most comparisons
+// agree on, and the confidence reflects how many agree and how well they match.
+func DetectIntros(fingerprints []*Fingerprint, options IntroOptions) []IntroResult {
+	results := make([]IntroResult, len(fingerprints))
+	candidates := make([][]candidate, len(fingerprints))
+	comparisons := make([]int, len(fingerprints))
+
+	// Compare each episode with up to options.Comparisons neighbours, once per pair
+	compared := make(map[[2]int]bool)
+	for i := range fingerprints {
+		for _, j := range neighbours(i, len(fingerprints), options.Comparisons) {
+			pair := [2]int{i, j}
+			if j < i {
+				pair = [2]int{j, i}
+			}
+			if compared[pair] {
+				continue
+			}
+			compared[pair] = true
+			comparisons[pair[0]]++
+			comparisons[pair[1]]++
+
+			segment, ok := FindSharedSegment(fingerprints[pair[0]], fingerprints[pair[1]], options.MinDuration)
+			if !ok || (options.MaxDuration > 0 && segment.Duration > options.MaxDuration) {
+				continue
+			}
+			candidates[pair[0]] = append(candidates[pair[0]], candidate{segment.StartA, segment.StartA + segment.Duration, segment.Quality})
+			candidates[pair[1]] = append(candidates[pair[1]], candidate{segment.StartB, segment.StartB + segment.Duration, segment.Quality})
+		}
+	}
+
+	for i, found := range candidates {
+		if len(found) == 0 || comparisons[i] == 0 {
+			continue
+		}
+
+		// Pick the candidate the most other candidates agree with
+		var cluster []candidate
+		bestQuality := 0.0
+		for _, c := range found {
+			var agreeing []candidate
+			quality := 0.0
+			for _, other := range found {
+				if overlap(c, other) >= minOverlap {
+					agreeing = append(agreeing, other)
+					quality += other.quality
+				}
+			}
+			if len(agreeing) > len(cluster) || (len(agreeing) == len(cluster) && quality > bestQuality) {
+				cluster = agreeing
+				bestQuality = quality
+			}
+		}
+
+		starts := make([]float64, len(cluster))
+		ends := make([]float64, len(cluster))
+		for k, c := range cluster {
+			starts[k] = c.start
+			ends[k] = c.end
+		}
+		agreement := float64(len(cluster)) / float64(comparisons[i])
+		results[i] = IntroResult{
+			Found:      true,
+			Start:      median(starts),
+			End:        median(ends),
+			Confidence: clamp(agreement*bestQuality/float64(len(cluster)), 0, 1),
+		}
+	}
+	return results
+}
+
+// neighbours returns the indexes of up to count episodes around episode i,
+// closest first, wrapping around the season
+func neighbours(i, total, count int) []int {
+	var result []int
+	seen := map[int]bool{i: true}
+	for distance := 1; len(result) < count && distance < total; distance++ {
+		for _, j := range []int{(i + distance) % total, ((i-distance)%total + total) % total} {
+			if !seen[j] && len(result) < count {
+				seen[j] = true
+				result = append(result, j)
+			}
+		}
+	}
+	return result
+}
+
+// overlap returns the intersection over union of two candidates
+func overlap(a, b candidate) float64 {
+	intersection := min(a.end, b.end) - max(a.start, b.start)
+	if intersection <= 0 {
+		return 0
+	}
+	union := max(a.end, b.end) - min(a.start, b.start)
+	return intersection / union
+}
+
+// median returns the median of values
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// clamp limits value to the range [low, high]
+func clamp(value, low, high float64) float64 {
+	return max(low, min(high, value))
+}
@@ -0,0 +1,232 @@
+package analysis
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// fingerprintBuilder assembles synthetic fingerprints. Random codes differ
+// from each other by about 16 bits, like unrelated audio.
+type fingerprintBuilder struct {
+	random *rand.Rand
+}
+
+func newFingerprintBuilder(seed int64) *fingerprintBuilder {
+	return &fingerprintBuilder{random: rand.New(rand.NewSource(seed))}
+}
+
+// noise returns frames of unrelated audio
+func (b *fingerprintBuilder) noise(frames int) []uint32 {
+	codes := make([]uint32, frames)
+	for i := range codes {
+		codes[i] = b.random.Uint32()
+	}
+	return codes
+}
+
+// fingerprint joins parts into a fingerprint without silence
+func fingerprint(parts ...[]uint32) *Fingerprint {
+	result := &Fingerprint{}
+	for _, part := range parts {
+		result.Codes = append(result.Codes, part...)
+	}
+	result.Silent = make([]bool, len(result.Codes))
+	return result
+}
+
+// flipBits returns codes with the given number of bits flipped in each
+func flipBits(codes []uint32, count int) []uint32 {
+	flipped := make([]uint32, len(codes))
+	for i, code := range codes {
+		for bit := 0; bit < count; bit++ {
+			code ^= 1 << ((i + bit*7) % 32)
+		}
+		flipped[i] = code
+	}
+	return flipped
+}
+
+// near reports whether two times are within a window of frames of each other.
+// Runs may spread a few frames into the audio around them.
+func near(got, want float64) bool {
+	return math.Abs(got-want) <= windowFrames*FrameDuration
+}
+
+func TestFindSharedSegment(t *testing.T) {
+	b := newFingerprintBuilder(1)
+	intro := b.noise(200)
+
+	tests := []struct {
+		name        string
+		a, b        *Fingerprint
+		minDuration float64
+		found       bool
+		startA      float64
+		startB      float64
+		duration    float64
+		minQuality  float64
+	}{
+		{
+			name:        "identical intro",
+			a:           fingerprint(b.noise(100), intro, b.noise(300)),
+			b:           fingerprint(b.noise(40), intro, b.noise(500)),
+			minDuration: 10,
+			found:       true,
+			startA:      100 * FrameDuration,
+			startB:      40 * FrameDuration,
+			duration:    200 * FrameDuration,
+			minQuality:  0.9,
+		},
+		{
+			name:        "intro at the very start",
+			a:           fingerprint(intro, b.noise(300)),
+			b:           fingerprint(b.noise(150), intro),
+			minDuration: 10,
+			found:       true,
+			startA:      0,
+			startB:      150 * FrameDuration,
+			duration:    200 * FrameDuration,
+			minQuality:  0.9,
+		},
+		{
+			name:        "slightly different audio",
+			a:           fingerprint(b.noise(60), intro, b.noise(100)),
+			b:           fingerprint(b.noise(10), flipBits(intro, 3), b.noise(100)),
+			minDuration: 10,
+			found:       true,
+			startA:      60 * FrameDuration,
+			startB:      10 * FrameDuration,
+			duration:    200 * FrameDuration,
+			minQuality:  0.75,
+		},
+		{
+			name:        "too different",
+			a:           fingerprint(b.noise(60), intro, b.noise(100)),
+			b:           fingerprint(b.noise(10), flipBits(intro, 12), b.noise(100)),
+			minDuration: 10,
+		},
+		{
+			name:        "shorter than the minimum",
+			a:           fingerprint(b.noise(100), intro, b.noise(100)),
+			b:           fingerprint(b.noise(100), intro, b.noise(100)),
+			minDuration: 30,
+		},
+		{
+			name:        "unrelated",
+			a:           fingerprint(b.noise(400)),
+			b:           fingerprint(b.noise(400)),
+			minDuration: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			segment, found := FindSharedSegment(test.a, test.b, test.minDuration)
+			if found != test.found {
+				t.Fatalf("FindSharedSegment = %+v, %v; want found %v", segment, found, test.found)
+			}
+			if !found {
+				return
+			}
+			if !near(segment.StartA, test.startA) || !near(segment.StartB, test.startB) ||
+				math.Abs(segment.Duration-test.duration) > 2*windowFrames*FrameDuration {
+				t.Errorf("FindSharedSegment = %+v, want starts %.2f and %.2f for %.2fs", segment, test.startA, test.startB, test.duration)
+			}
+			if segment.Quality < test.minQuality || segment.Quality > 1 {
+				t.Errorf("Quality = %v, want at least %v", segment.Quality, test.minQuality)
+			}
+		})
+	}
+}
+
+func TestFindSharedSegmentIgnoresSilence(t *testing.T) {
+	b := newFingerprintBuilder(2)
+	shared := b.noise(200)
+	first := fingerprint(b.noise(50), shared, b.noise(50))
+	second := fingerprint(b.noise(50), shared, b.noise(50))
+	for i := 50; i < 250; i++ {
+		first.Silent[i] = true
+		second.Silent[i] = true
+	}
+
+	if segment, found := FindSharedSegment(first, second, 5); found {
+		t.Errorf("silence matched: %+v", segment)
+	}
+}
+
+func TestDetectIntros(t *testing.T) {
+	b := newFingerprintBuilder(3)
+	intro := b.noise(150)
+	offsets := []int{20, 50, 0, 80, 35}
+
+	var fingerprints []*Fingerprint
+	for _, offset := range offsets {
+		fingerprints = append(fingerprints, fingerprint(b.noise(offset), intro, b.noise(600-offset)))
+	}
+	// An episode without the intro
+	fingerprints = append(fingerprints, fingerprint(b.noise(750)))
+
+	options := IntroOptions{MinDuration: 5, MaxDuration: 60, Comparisons: 4}
+	results := DetectIntros(fingerprints, options)
+	if len(results) != len(fingerprints) {
+		t.Fatalf("got %d results for %d episodes", len(results), len(fingerprints))
+	}
+	for i, offset := range offsets {
+		result := results[i]
+		start := float64(offset) * FrameDuration
+		end := start + 150*FrameDuration
+		if !result.Found || !near(result.Start, start) || !near(result.End, end) {
+			t.Errorf("episode %d: %+v, want an intro from %.2f to %.2f", i, result, start, end)
+		}
+		if result.Confidence < 0.5 || result.Confidence > 1 {
+			t.Errorf("episode %d: Confidence = %v, want at least 0.5", i, result.Confidence)
+		}
+	}
+	if results[len(offsets)].Found {
+		t.Errorf("episode without the intro: %+v, want none found", results[len(offsets)])
+	}
+
+	// An intro longer than allowed isn't one
+	options.MaxDuration = 10
+	for i, result := range DetectIntros(fingerprints, options) {
+		if result.Found {
+			t.Errorf("episode %d with a shorter maximum: %+v, want none found", i, result)
+		}
+	}
+}
+
+func TestNeighbours(t *testing.T) {
+	tests := []struct {
+		i, total, count int
+		want            []int
+	}{
+		{i: 0, total: 5, count: 2, want: []int{1, 4}},
+		{i: 2, total: 5, count: 3, want: []int{3, 1, 4}},
+		{i: 4, total: 5, count: 10, want: []int{0, 3, 1, 2}},
+		{i: 0, total: 2, count: 3, want: []int{1}},
+		{i: 0, total: 1, count: 3, want: nil},
+	}
+
+	for _, test := range tests {
+		if got := neighbours(test.i, test.total, test.count); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("neighbours(%d, %d, %d) = %v, want %v", test.i, test.total, test.count, got, test.want)
+		}
+	}
+}
+
+func TestOverlapAndMedian(t *testing.T) {
+	if got := overlap(candidate{start: 0, end: 10}, candidate{start: 5, end: 15}); math.Abs(got-1.0/3) > 1e-9 {
+		t.Errorf("overlap of half shifted candidates = %v, want 1/3", got)
+	}
+	if got := overlap(candidate{start: 0, end: 10}, candidate{start: 10, end: 20}); got != 0 {
+		t.Errorf("overlap of adjacent candidates = %v, want 0", got)
+	}
+	if got := median([]float64{3, 1, 2}); got != 2 {
+		t.Errorf("median of three = %v, want 2", got)
+	}
+	if got := median([]float64{4, 1, 3, 2}); got != 2.5 {
+		t.Errorf("median of four = %v, want 2.5", got)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+
+	"comfort-player-backend/config"
+	"comfort-player-backend/services"
+)
+
+// runCommand runs the subcommand named by args[0] and returns the process exit code
+func runCommand(cfg *config.Config, args []string) int {
+	switch args[0] {
+	case "scan":
+		return runScanCommand(cfg)
+	case "detect-intros":
+		return runDetectIntrosCommand(cfg, args[1:])
+	case "help", "-h", "--help":
+		printUsage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", args[0])
+		printUsage()
+		return 2
+	}
+}
+
+// printUsage lists the available subcommands
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  comfort-player-backend                  Start the server")
+	fmt.Fprintln(os.Stderr, "  comfort-player-backend scan             Scan the media tree and update the season JSON files")
+	fmt.Fprintln(os.Stderr, "  comfort-player-backend detect-intros    Detect intros by comparing the episodes of a season")
+}
+
+// runScanCommand scans every show's media tree
+func runScanCommand(cfg *config.Config) int {
+	// Commands don't need playback state, and the server may have the state store open
+	registry := services.NewShowRegistry(cfg, services.NewMemoryStore(), services.NewWorkerPool(cfg.TranscodeWorkers))
+	results, err := registry.ScanAll()
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "SHOW\tFOUND\tADDED\tUNRECOGNIZED")
+	for _, result := range results {
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%d\n", result.ShowID, result.EpisodesFound, result.Added, len(result.Unrecognized))
+	}
+	writer.Flush()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Scan failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runDetectIntrosCommand detects intros and writes their markers to the catalog
+func runDetectIntrosCommand(cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("detect-intros", flag.ContinueOnError)
+	showID := flags.String("show", "", "show to analyze (default: the default show)")
+	season := flags.Int("season", 0, "season to analyze (default: every season)")
+	searchSeconds := flags.Float64("search", 600, "seconds at the start of each episode to search")
+	minDuration := flags.Float64("min-duration", 15, "shortest intro, in seconds")
+	maxDuration := flags.Float64("max-duration", 150, "longest intro, in seconds")
+	minConfidence := flags.Float64("min-confidence", 0.5, "confidence below which markers are not written")
+	dryRun := flags.Bool("dry-run", false, "report detected intros without writing markers")
+	overwrite := flags.Bool("overwrite", false, "replace intro markers episodes already have")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	registry := services.NewShowRegistry(cfg, services.NewMemoryStore(), services.NewWorkerPool(cfg.TranscodeWorkers))
+	if cfg.ScanOnStartup {
+		if _, err := registry.ScanAll(); err != nil {
+			fmt.Fprintf(os.Stderr, "Library scan failed: %v\n", err)
+		}
+	}
+
+	show, ok := registry.Get(*showID)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Show not found: %s\n", *showID)
+		return 1
+	}
+
+	// Stop ffmpeg on Ctrl+C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	results, err := show.Show.DetectIntros(ctx, services.IntroDetectionOptions{
+		Season:        *season,
+		SearchSeconds: *searchSeconds,
+		MinDuration:   *minDuration,
+		MaxDuration:   *maxDuration,
+		MinConfidence: *minConfidence,
+		DryRun:        *dryRun,
+		Overwrite:     *overwrite,
+	})
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "EPISODE\tINTRO START\tINTRO END\tCONFIDENCE\tWRITTEN\tERROR")
+	for _, result := range results {
+		if !result.Found {
+			fmt.Fprintf(writer, "%s\t-\t-\t-\tno\t%s\n", result.EpisodeID, result.Error)
+			continue
+		}
+		written := "no"
+		switch {
+		case result.Written:
+			written = "yes"
+		case result.Skipped:
+			written = "skipped"
+		}
+		fmt.Fprintf(writer, "%s\t%.1fs\t%.1fs\t%.0f%%\t%s\t%s\n", result.EpisodeID,
+			result.IntroStartSeconds, result.IntroEndSeconds, result.Confidence*100, written, result.Error)
+	}
+	writer.Flush()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Intro detection failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -4,17 +4,35 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 )
 
+// DefaultAPIKey is the placeholder API key used when API_KEY isn't set
+const DefaultAPIKey = "your-secret-token"
+
 // Config holds the application configuration
 type Config struct {
 	Port              string
 	MediaDir          string
 	SeasonsDir        string
+	DefaultShowID     string
 	StateFile         string
+	StateStore        string // "json" or "kv"
+	StateFlushInterval time.Duration
 	APIKey            string
+	KeysFile          string
+	StreamSigningSecret string
+	StreamURLTTL      time.Duration
+	EventsURLTTL      time.Duration
 	VideoFilePattern  string
 	SubtitleFilePattern string
+	ScanOnStartup     bool
+	FFmpegPath        string
+	CacheDir          string
+	TranscodeWorkers  int
+	TranscodeCacheMaxMB int64
+	ShutdownTimeout   time.Duration
 }
 
 // LoadConfig loads the configuration from environment variables or defaults
@@ -31,13 +49,44 @@ func LoadConfig() *Config {
 		Port:              getEnv("PORT", "8080"),
 		MediaDir:          getEnv("MEDIA_DIR", defaultMediaDir),
 		SeasonsDir:        getEnv("SEASONS_DIR", defaultSeasonsDir),
+		DefaultShowID:     getEnv("DEFAULT_SHOW_ID", "default"),
 		StateFile:         getEnv("STATE_FILE", defaultStateFile),
-		APIKey:            getEnv("API_KEY", "your-secret-token"),
+		StateStore:        getEnv("STATE_STORE", "json"),
+		StateFlushInterval: getEnvDuration("STATE_FLUSH_INTERVAL", 10*time.Second),
+		APIKey:            getEnv("API_KEY", DefaultAPIKey),
+		KeysFile:          getEnv("KEYS_FILE", ""),
+		StreamSigningSecret: getEnv("STREAM_SIGNING_SECRET", ""),
+		StreamURLTTL:      getEnvDuration("STREAM_URL_TTL", 12*time.Hour),
+		EventsURLTTL:      getEnvDuration("EVENTS_URL_TTL", 30*24*time.Hour),
 		VideoFilePattern:  getEnv("VIDEO_FILE_PATTERN", "*.mp4,*.mkv,*.avi"),
-		SubtitleFilePattern: getEnv("SUBTITLE_FILE_PATTERN", "*.srt,*.vtt"),
+		SubtitleFilePattern: getEnv("SUBTITLE_FILE_PATTERN", "*.srt,*.vtt,*.ass,*.ssa"),
+		ScanOnStartup:     getEnvBool("SCAN_ON_STARTUP", true),
+		FFmpegPath:        getEnv("FFMPEG_PATH", "ffmpeg"),
+		CacheDir:          getEnv("CACHE_DIR", ""),
+		TranscodeWorkers:  int(getEnvInt("TRANSCODE_WORKERS", 2)),
+		TranscodeCacheMaxMB: getEnvInt("TRANSCODE_CACHE_MAX_MB", 20480),
+		ShutdownTimeout:   getEnvDuration("SHUTDOWN_TIMEOUT", 8*time.Second),
+	}
+
+	// Keep the keys file next to the state file unless told otherwise
+	if config.KeysFile == "" {
+		config.KeysFile = filepath.Join(filepath.Dir(config.StateFile), "keys.json")
 	}
 
-	log.Printf("%+v\n", config)
+	// Keep generated media next to the state file unless told otherwise
+	if config.CacheDir == "" {
+		config.CacheDir = filepath.Join(filepath.Dir(config.StateFile), "cache")
+	}
+
+	// Never log the API key itself
+	redacted := *config
+	if redacted.APIKey != "" {
+		redacted.APIKey = "<redacted>"
+	}
+	if redacted.StreamSigningSecret != "" {
+		redacted.StreamSigningSecret = "<redacted>"
+	}
+	log.Printf("%+v\n", redacted)
 	return config
 }
 
@@ -48,3 +97,42 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvBool returns the boolean value of an environment variable or a default value
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("Invalid boolean for %s: %s, using default %t", key, value, defaultValue)
+			return defaultValue
+		}
+		return parsed
+	}
+	return defaultValue
+}
+
+// getEnvInt returns the integer value of an environment variable or a default value
+func getEnvInt(key string, defaultValue int64) int64 {
+	if value := os.Getenv(key); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Printf("Invalid integer for %s: %s, using default %d", key, value, defaultValue)
+			return defaultValue
+		}
+		return parsed
+	}
+	return defaultValue
+}
+
+// getEnvDuration returns the duration value of an environment variable or a default value
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Printf("Invalid duration for %s: %s, using default %v", key, value, defaultValue)
+			return defaultValue
+		}
+		return parsed
+	}
+	return defaultValue
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"comfort-player-backend/models"
+	"comfort-player-backend/services"
+	"comfort-player-backend/websocket"
+)
+
+// eventsRetry is how long EventSource clients wait before reconnecting, in milliseconds
+const eventsRetry = 5000
+
+// eventsKeepAlive is how often an idle event stream sends something, so
+// proxies keep it open and clients that went away are noticed
+const eventsKeepAlive = 30 * time.Second
+
+// EventsHandler pushes a show's state changes to clients as they happen
+type EventsHandler struct {
+	registry       *services.ShowRegistry
+	profileService *services.ProfileService
+}
+
+// NewEventsHandler creates a new events handler
+func NewEventsHandler(registry *services.ShowRegistry, profileService *services.ProfileService) *EventsHandler {
+	return &EventsHandler{
+		registry:       registry,
+		profileService: profileService,
+	}
+}
+
+// StreamEvents handles GET /api/show/events and GET /api/shows/{showId}/events.
+// Requests asking for a WebSocket get one; others get Server-Sent Events.
+func (h *EventsHandler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	log.Printf("StreamEvents: Request received")
+
+	show, ok := resolveShow(h.registry, w, r)
+	if !ok {
+		return
+	}
+	profileID, ok := resolveProfile(h.profileService, w, r)
+	if !ok {
+		return
+	}
+
+	// Subscribe before reading the state, so no change falls in between
+	events := h.registry.Events()
+	subscription := events.Subscribe(show.Show.ID(), profileID)
+	defer events.Unsubscribe(subscription)
+
+	// Start with the current state, so clients don't need to fetch it first
+	current := services.StateEvent(models.ShowEventState, show.Show.ID(), profileID, show.State.GetState(profileID))
+
+	if websocket.IsUpgrade(r) {
+		h.serveWebSocket(w, r, subscription, current)
+	} else {
+		h.serveEventStream(w, r, subscription, current)
+	}
+}
+
+// serveEventStream sends events as a Server-Sent Events stream until the client
+// goes away or falls too far behind
+func (h *EventsHandler) serveEventStream(w http.ResponseWriter, r *http.Request, subscription *services.Subscription, current models.ShowEvent) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Keep reverse proxies such as nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	controller := http.NewResponseController(w)
+	send := func(event models.ShowEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+
+	// Set the reconnection delay along with the first event
+	if _, err := fmt.Fprintf(w, "retry: %d\n", eventsRetry); err != nil {
+		return
+	}
+	if err := send(current); err != nil {
+		log.Printf("serveEventStream: Error writing event: %v", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				log.Printf("serveEventStream: Subscription ended, closing the stream")
+				return
+			}
+			if err := send(event); err != nil {
+				log.Printf("serveEventStream: Error writing event: %v", err)
+				return
+			}
+		case <-keepAlive.C:
+			// Comment lines are ignored by clients
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			if err := controller.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveWebSocket sends events as WebSocket text messages until the client goes
+// away or falls too far behind. Messages from the client are ignored.
+func (h *EventsHandler) serveWebSocket(w http.ResponseWriter, r *http.Request, subscription *services.Subscription, current models.ShowEvent) {
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		log.Printf("serveWebSocket: Handshake failed: %v", err)
+		return
+	}
+
+	send := func(event models.ShowEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return conn.WriteText(data)
+	}
+
+	if err := send(current); err != nil {
+		log.Printf("serveWebSocket: Error writing event: %v", err)
+		conn.Close(websocket.CloseServerError, "")
+		return
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				log.Printf("serveWebSocket: Subscription ended, closing the connection")
+				conn.Close(websocket.CloseGoingAway, "too far behind")
+				return
+			}
+			if err := send(event); err != nil {
+				log.Printf("serveWebSocket: Error writing event: %v", err)
+				conn.Close(websocket.CloseServerError, "")
+				return
+			}
+		case <-keepAlive.C:
+			if err := conn.Ping(); err != nil {
+				conn.Close(websocket.CloseServerError, "")
+				return
+			}
+		case <-conn.Done():
+			return
+		case <-r.Context().Done():
+			conn.Close(websocket.CloseGoingAway, "server shutting down")
+			return
+		}
+	}
+}
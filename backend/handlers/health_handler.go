@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"comfort-player-backend/services"
+)
+
+// HealthHandler answers health checks. It doesn't require an API key.
+type HealthHandler struct {
+	registry *services.ShowRegistry
+	flusher  *services.StateFlusher
+}
+
+// NewHealthHandler creates a new health handler
+func NewHealthHandler(registry *services.ShowRegistry, flusher *services.StateFlusher) *HealthHandler {
+	return &HealthHandler{
+		registry: registry,
+		flusher:  flusher,
+	}
+}
+
+// GetHealth handles GET /api/health
+func (h *HealthHandler) GetHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "ok",
+		"shows":  len(h.registry.All()),
+		"state":  h.flusher.Status(),
+	})
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"comfort-player-backend/models"
+	"comfort-player-backend/services"
+)
+
+// resolveShow returns the show named by the {showId} route variable, or the
+// default show for routes without one. It writes a 404 if the show is unknown.
+func resolveShow(registry *services.ShowRegistry, w http.ResponseWriter, r *http.Request) (*services.RegisteredShow, bool) {
+	showID := mux.Vars(r)["showId"]
+
+	show, ok := registry.Get(showID)
+	if !ok {
+		log.Printf("resolveShow: Show not found: %s", showID)
+		http.Error(w, "Show not found", http.StatusNotFound)
+		return nil, false
+	}
+	return show, true
+}
+
+// profileHeader is the request header naming the profile a request acts for
+const profileHeader = "X-Profile-ID"
+
+// resolveProfile returns the profile named by the X-Profile-ID header or the
+// "profile" query parameter. An empty ID means the default profile. It writes a
+// 404 if the profile is unknown.
+func resolveProfile(profiles *services.ProfileService, w http.ResponseWriter, r *http.Request) (string, bool) {
+	profileID := r.Header.Get(profileHeader)
+	if profileID == "" {
+		profileID = r.URL.Query().Get("profile")
+	}
+	if profileID == "" {
+		return "", true
+	}
+
+	if _, ok := profiles.Get(profileID); !ok {
+		log.Printf("resolveProfile: Profile not found: %s", profileID)
+		http.Error(w, "Profile not found", http.StatusNotFound)
+		return "", false
+	}
+	return profileID, true
+}
+
+// subtitleLanguage returns a profile's preferred subtitle language, or "" for
+// the default profile and profiles without a preference
+func subtitleLanguage(profiles *services.ProfileService, profileID string) string {
+	if profileID == "" {
+		return ""
+	}
+	profile, _ := profiles.Get(profileID)
+	return profile.SubtitleLanguage
+}
+
+// absoluteEpisodeURLs converts an episode's relative URLs to full URLs on the
+// requested host, signing them so players can fetch them without an API key.
+// The HLS URL names the profile and is signed for it, since the HLS playlists
+// resume from that profile's position and players that can't send the
+// X-Profile-ID header would otherwise get the default profile's.
+func absoluteEpisodeURLs(r *http.Request, signer *services.URLSigner, episode *models.EpisodeInfo, profileID string) {
+	host := r.Host
+	// Convert relative video URL to full URL
+	if episode.VideoURL != "" && episode.VideoURL[0] == '/' {
+		episode.VideoURL = "http://" + host + signer.SignURL(episode.VideoURL, episode.ID)
+
+		// Offer HLS for videos we serve, as long as we know how long they are
+		if episode.Media != nil && episode.Media.DurationSeconds > 0 {
+			hlsURL := withProfile(fmt.Sprintf("/api/episode/%s/hls/master.m3u8", episode.ID), profileID)
+			episode.HLSURL = "http://" + host + signer.SignURL(hlsURL, services.HLSResource(episode.ID, profileID))
+		}
+		episode.AudioURL = "http://" + host + signer.SignURL(fmt.Sprintf("/api/episode/%s/audio", episode.ID), episode.ID)
+	}
+	// Convert relative subtitle URL to full URL
+	if episode.SubtitleURL != "" && episode.SubtitleURL[0] == '/' {
+		episode.SubtitleURL = "http://" + host + signer.SignURL(episode.SubtitleURL, episode.ID)
+	}
+	for i := range episode.Subtitles {
+		if track := &episode.Subtitles[i]; track.URL != "" && track.URL[0] == '/' {
+			track.URL = "http://" + host + signer.SignURL(track.URL, episode.ID)
+		}
+	}
+}
+
+// withProfile adds the "profile" query parameter to a URL for non-default profiles
+func withProfile(rawURL, profileID string) string {
+	if profileID == "" {
+		return rawURL
+	}
+	separator := "?"
+	if strings.Contains(rawURL, "?") {
+		separator = "&"
+	}
+	return rawURL + separator + "profile=" + url.QueryEscape(profileID)
+}
+
+// writeTracker records whether anything was written to a response, so errors
+// can still be reported as a status code before the body starts
+type writeTracker struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (t *writeTracker) Write(p []byte) (int, error) {
+	t.written = true
+	return t.ResponseWriter.Write(p)
+}
+
+// Flush sends buffered data to the client, so streamed output isn't held back
+func (t *writeTracker) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
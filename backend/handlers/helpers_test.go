@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"comfort-player-backend/models"
+	"comfort-player-backend/services"
+)
+
+func TestAbsoluteEpisodeURLsProfile(t *testing.T) {
+	signer, err := services.NewURLSigner("secret", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "http://tv.local/api/show/info", nil)
+
+	for _, profileID := range []string{"", "alice b"} {
+		episode := models.EpisodeInfo{
+			ID:       "Show_S01E01",
+			VideoURL: "/api/episode/Show_S01E01/video",
+			Media:    &models.MediaInfo{DurationSeconds: 1200},
+		}
+		absoluteEpisodeURLs(r, signer, &episode, profileID)
+
+		// Only the HLS URL names the profile, and its signature covers it
+		video, err := url.Parse(episode.VideoURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if video.Query().Has("profile") {
+			t.Errorf("video URL %q names a profile", episode.VideoURL)
+		}
+		if err := signer.Verify(video.Query(), episode.ID); err != nil {
+			t.Errorf("video URL signature: %v", err)
+		}
+
+		hls, err := url.Parse(episode.HLSURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := hls.Query()
+		if got := query.Get("profile"); got != profileID {
+			t.Errorf("HLS URL profile = %q, want %q", got, profileID)
+		}
+		if err := signer.Verify(query, services.HLSResource(episode.ID, profileID)); err != nil {
+			t.Errorf("HLS URL signature: %v", err)
+		}
+		if err := signer.Verify(query, services.HLSResource(episode.ID, "mallory")); err == nil {
+			t.Error("HLS URL signature accepted for another profile")
+		}
+		if err := signer.Verify(query, episode.ID); err == nil {
+			t.Error("HLS URL signature accepted for the episode's other streams")
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"comfort-player-backend/services"
+)
+
+// HistoryHandler handles watch history and episode progress requests
+type HistoryHandler struct {
+	historyService *services.HistoryService
+	registry       *services.ShowRegistry
+	profileService *services.ProfileService
+}
+
+// NewHistoryHandler creates a new history handler
+func NewHistoryHandler(historyService *services.HistoryService, registry *services.ShowRegistry, profileService *services.ProfileService) *HistoryHandler {
+	return &HistoryHandler{
+		historyService: historyService,
+		registry:       registry,
+		profileService: profileService,
+	}
+}
+
+// GetHistory handles GET /api/history
+func (h *HistoryHandler) GetHistory(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GetHistory: Request received")
+
+	profileID, ok := resolveProfile(h.profileService, w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := services.HistoryFilter{
+		ProfileID: profileID,
+		ShowID:    query.Get("show"),
+		EpisodeID: query.Get("episode"),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = parsed
+	}
+
+	events, err := h.historyService.GetHistory(filter)
+	if err != nil {
+		log.Printf("GetHistory: Error reading history: %v", err)
+		http.Error(w, "Failed to read history", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("GetHistory: Returning %d events", len(events))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// GetEpisodeProgress handles GET /api/episode/{id}/progress
+func (h *HistoryHandler) GetEpisodeProgress(w http.ResponseWriter, r *http.Request) {
+	episodeID := mux.Vars(r)["id"]
+	log.Printf("GetEpisodeProgress: Request for episode %s", episodeID)
+
+	profileID, ok := resolveProfile(h.profileService, w, r)
+	if !ok {
+		return
+	}
+
+	// Episodes that were never played have no progress yet
+	progress, found := h.historyService.GetProgress(profileID, episodeID)
+	if !found {
+		progress.EpisodeID = episodeID
+		progress.ShowID = h.registry.ForEpisode(episodeID).Show.ID()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(progress)
+}
+
+// GetShowProgress handles GET /api/show/progress and GET /api/shows/{showId}/progress
+func (h *HistoryHandler) GetShowProgress(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GetShowProgress: Request received")
+
+	show, ok := resolveShow(h.registry, w, r)
+	if !ok {
+		return
+	}
+	profileID, ok := resolveProfile(h.profileService, w, r)
+	if !ok {
+		return
+	}
+
+	progress := h.historyService.GetShowProgress(profileID, show.Show.ID())
+
+	log.Printf("GetShowProgress: Returning progress for %d episodes", len(progress))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(progress)
+}
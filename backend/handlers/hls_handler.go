@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"comfort-player-backend/models"
+	"comfort-player-backend/services"
+	"comfort-player-backend/streaming"
+)
+
+// hlsPlaylistType is the content type of HLS playlists
+const hlsPlaylistType = "application/vnd.apple.mpegurl"
+
+// HLSHandler serves episodes as HLS playlists and segments
+type HLSHandler struct {
+	registry       *services.ShowRegistry
+	profileService *services.ProfileService
+	hlsService     *services.HLSService
+}
+
+// NewHLSHandler creates a new HLS handler
+func NewHLSHandler(registry *services.ShowRegistry, profileService *services.ProfileService, hlsService *services.HLSService) *HLSHandler {
+	return &HLSHandler{
+		registry:       registry,
+		profileService: profileService,
+		hlsService:     hlsService,
+	}
+}
+
+// hlsEpisode is the episode an HLS request is for
+type hlsEpisode struct {
+	id        string
+	show      *services.RegisteredShow
+	videoPath string
+	media     *models.MediaInfo
+}
+
+// resolveEpisode looks up the video file and media info of the {id} episode.
+// It writes an error response if the episode can't be segmented.
+func (h *HLSHandler) resolveEpisode(w http.ResponseWriter, r *http.Request) (*hlsEpisode, bool) {
+	episodeID := mux.Vars(r)["id"]
+	show := h.registry.ForEpisode(episodeID)
+
+	videoPath, err := show.Show.GetEpisodeVideoPath(episodeID)
+	if err != nil {
+		log.Printf("resolveEpisode: Error getting video path for %s: %v", episodeID, err)
+		http.Error(w, fmt.Sprintf("Episode not found: %v", err), http.StatusNotFound)
+		return nil, false
+	}
+
+	info, err := show.Show.GetEpisodeMediaInfo(episodeID)
+	if err != nil {
+		log.Printf("resolveEpisode: Error probing %s: %v", videoPath, err)
+		http.Error(w, "Failed to read video file", http.StatusInternalServerError)
+		return nil, false
+	}
+	if info.DurationSeconds <= 0 {
+		log.Printf("resolveEpisode: Duration of %s is unknown", videoPath)
+		http.Error(w, "Episode duration is unknown, HLS is not available", http.StatusUnprocessableEntity)
+		return nil, false
+	}
+
+	return &hlsEpisode{id: episodeID, show: show, videoPath: videoPath, media: info}, true
+}
+
+// resumeOffset returns the segment boundary to start playback at, if the
+// requesting profile is currently watching this episode. A signed URL only
+// vouches for the profile in its query, so without an API key the
+// X-Profile-ID header can't name another one.
+func (h *HLSHandler) resumeOffset(w http.ResponseWriter, r *http.Request, episode *hlsEpisode) (float64, bool) {
+	if _, ok := services.APIKeyFromContext(r.Context()); !ok {
+		if header := r.Header.Get(profileHeader); header != "" && header != r.URL.Query().Get("profile") {
+			http.Error(w, "Profile doesn't match the signed URL", http.StatusForbidden)
+			return 0, false
+		}
+	}
+	profileID, ok := resolveProfile(h.profileService, w, r)
+	if !ok {
+		return 0, false
+	}
+
+	state := episode.show.State.GetState(profileID)
+	if state.CurrentEpisodeID != episode.id {
+		return 0, true
+	}
+	return services.ResumeOffset(state.PlaybackTimeSeconds, episode.media.DurationSeconds), true
+}
+
+// ServeMasterPlaylist handles GET /api/episode/{id}/hls/master.m3u8
+func (h *HLSHandler) ServeMasterPlaylist(w http.ResponseWriter, r *http.Request) {
+	log.Printf("ServeMasterPlaylist: Request for episode %s", mux.Vars(r)["id"])
+
+	episode, ok := h.resolveEpisode(w, r)
+	if !ok {
+		return
+	}
+	offset, ok := h.resumeOffset(w, r, episode)
+	if !ok {
+		return
+	}
+
+	var fileSize int64
+	if stat, err := os.Stat(episode.videoPath); err == nil {
+		fileSize = stat.Size()
+	}
+
+	log.Printf("ServeMasterPlaylist: Starting %s at %.0fs", episode.id, offset)
+	writePlaylist(w, h.hlsService.MasterPlaylist(episode.media, fileSize, offset, r.URL.RawQuery))
+}
+
+// ServeMediaPlaylist handles GET /api/episode/{id}/hls/index.m3u8
+func (h *HLSHandler) ServeMediaPlaylist(w http.ResponseWriter, r *http.Request) {
+	log.Printf("ServeMediaPlaylist: Request for episode %s", mux.Vars(r)["id"])
+
+	episode, ok := h.resolveEpisode(w, r)
+	if !ok {
+		return
+	}
+	offset, ok := h.resumeOffset(w, r, episode)
+	if !ok {
+		return
+	}
+
+	playlist, err := h.hlsService.MediaPlaylist(episode.media.DurationSeconds, offset, r.URL.RawQuery)
+	if err != nil {
+		log.Printf("ServeMediaPlaylist: Error building playlist for %s: %v", episode.id, err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	log.Printf("ServeMediaPlaylist: %d segments for %s", services.SegmentCount(episode.media.DurationSeconds), episode.id)
+	writePlaylist(w, playlist)
+}
+
+// ServeSegment handles GET /api/episode/{id}/hls/segment-{index}.ts
+func (h *HLSHandler) ServeSegment(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(mux.Vars(r)["index"])
+	if err != nil {
+		http.Error(w, "Invalid segment number", http.StatusBadRequest)
+		return
+	}
+	log.Printf("ServeSegment: Request for segment %d of episode %s", index, mux.Vars(r)["id"])
+
+	episode, ok := h.resolveEpisode(w, r)
+	if !ok {
+		return
+	}
+
+	// Encode the segment, or reuse the cached one. The encode finishes for other
+	// requests if the client goes away; the request only stops waiting for it.
+	path, err := h.hlsService.Segment(r.Context(), episode.id, episode.videoPath, episode.media.DurationSeconds, index)
+	if errors.Is(err, services.ErrSegmentOutOfRange) {
+		http.Error(w, "Segment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("ServeSegment: Error encoding segment %d of %s: %v", index, episode.id, err)
+		http.Error(w, "Failed to encode segment", http.StatusInternalServerError)
+		return
+	}
+
+	streaming.ServeFile(w, r, path, "video/mp2t")
+}
+
+// writePlaylist writes an HLS playlist. Playlists aren't cached since the
+// resume point changes as the episode is watched.
+func writePlaylist(w http.ResponseWriter, playlist string) {
+	w.Header().Set("Content-Type", hlsPlaylistType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(playlist))
+}
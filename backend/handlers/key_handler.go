@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"comfort-player-backend/models"
+	"comfort-player-backend/services"
+)
+
+// KeyHandler handles API key management requests
+type KeyHandler struct {
+	keyService *services.KeyService
+}
+
+// NewKeyHandler creates a new key handler
+func NewKeyHandler(keyService *services.KeyService) *KeyHandler {
+	return &KeyHandler{
+		keyService: keyService,
+	}
+}
+
+// ListKeys handles GET /api/keys
+func (h *KeyHandler) ListKeys(w http.ResponseWriter, r *http.Request) {
+	log.Printf("ListKeys: Request received")
+
+	keys := h.keyService.List()
+
+	log.Printf("ListKeys: Returning %d keys", len(keys))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// CreateKey handles POST /api/keys
+func (h *KeyHandler) CreateKey(w http.ResponseWriter, r *http.Request) {
+	log.Printf("CreateKey: Request received")
+
+	var request models.CreateAPIKeyRequest
+
+	// Decode request body
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Printf("CreateKey: Error decoding JSON: %v", err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields
+	if request.Name == "" {
+		log.Printf("CreateKey: Name is required")
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	created, err := h.keyService.Create(request.Name, request.Scope)
+	if errors.Is(err, services.ErrInvalidScope) {
+		log.Printf("CreateKey: Invalid scope: %s", request.Scope)
+		http.Error(w, "Scope must be read, playback or admin", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("CreateKey: Error creating key: %v", err)
+		http.Error(w, "Failed to create key", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("CreateKey: Created key %s", created.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// RevokeKey handles DELETE /api/keys/{keyId}
+func (h *KeyHandler) RevokeKey(w http.ResponseWriter, r *http.Request) {
+	keyID := mux.Vars(r)["keyId"]
+	log.Printf("RevokeKey: Request received for key %s", keyID)
+
+	err := h.keyService.Revoke(keyID)
+	if errors.Is(err, services.ErrKeyNotFound) {
+		log.Printf("RevokeKey: Key not found: %s", keyID)
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("RevokeKey: Error revoking key: %v", err)
+		http.Error(w, "Failed to revoke key", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("RevokeKey: Revoked key %s", keyID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"comfort-player-backend/models"
+	"comfort-player-backend/services"
+)
+
+// ProfileHandler handles profile management requests
+type ProfileHandler struct {
+	profileService *services.ProfileService
+	registry       *services.ShowRegistry
+	historyService *services.HistoryService
+}
+
+// NewProfileHandler creates a new profile handler
+func NewProfileHandler(profileService *services.ProfileService, registry *services.ShowRegistry, historyService *services.HistoryService) *ProfileHandler {
+	return &ProfileHandler{
+		profileService: profileService,
+		registry:       registry,
+		historyService: historyService,
+	}
+}
+
+// ListProfiles handles GET /api/profiles
+func (h *ProfileHandler) ListProfiles(w http.ResponseWriter, r *http.Request) {
+	log.Printf("ListProfiles: Request received")
+
+	profiles := h.profileService.List()
+
+	log.Printf("ListProfiles: Returning %d profiles", len(profiles))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profiles)
+}
+
+// CreateProfile handles POST /api/profiles
+func (h *ProfileHandler) CreateProfile(w http.ResponseWriter, r *http.Request) {
+	log.Printf("CreateProfile: Request received")
+
+	var request models.CreateProfileRequest
+
+	// Decode request body
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Printf("CreateProfile: Error decoding JSON: %v", err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields
+	if request.Name == "" {
+		log.Printf("CreateProfile: Name is required")
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	profile, err := h.profileService.Create(request.Name, request.SubtitleLanguage)
+	if errors.Is(err, services.ErrProfileExists) {
+		log.Printf("CreateProfile: Profile already exists: %s", request.Name)
+		http.Error(w, "Profile already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("CreateProfile: Error creating profile: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("CreateProfile: Created profile %s", profile.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(profile)
+}
+
+// UpdatePreferences handles PUT /api/profiles/{profileId}/preferences
+func (h *ProfileHandler) UpdatePreferences(w http.ResponseWriter, r *http.Request) {
+	profileID := mux.Vars(r)["profileId"]
+	log.Printf("UpdatePreferences: Request for profile %s", profileID)
+
+	var request models.ProfilePreferencesRequest
+
+	// Decode request body
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Printf("UpdatePreferences: Error decoding JSON: %v", err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	profile, err := h.profileService.SetSubtitleLanguage(profileID, request.SubtitleLanguage)
+	if errors.Is(err, services.ErrProfileNotFound) {
+		http.Error(w, "Profile not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, services.ErrInvalidLanguage) {
+		log.Printf("UpdatePreferences: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("UpdatePreferences: Error updating profile: %v", err)
+		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("UpdatePreferences: Updated profile %s", profile.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+// DeleteProfile handles DELETE /api/profiles/{profileId}
+func (h *ProfileHandler) DeleteProfile(w http.ResponseWriter, r *http.Request) {
+	profileID := mux.Vars(r)["profileId"]
+	log.Printf("DeleteProfile: Request for profile %s", profileID)
+
+	if err := h.profileService.Delete(profileID); err != nil {
+		if errors.Is(err, services.ErrProfileNotFound) {
+			http.Error(w, "Profile not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("DeleteProfile: Error deleting profile: %v", err)
+		http.Error(w, "Failed to delete profile", http.StatusInternalServerError)
+		return
+	}
+
+	// Drop the profile's playback state in every show
+	for _, show := range h.registry.All() {
+		if err := show.State.DeleteProfile(profileID); err != nil {
+			log.Printf("DeleteProfile: Error deleting state for show %s: %v", show.Show.ID(), err)
+		}
+	}
+	if err := h.historyService.DeleteProfile(profileID); err != nil {
+		log.Printf("DeleteProfile: Error deleting progress: %v", err)
+	}
+
+	log.Printf("DeleteProfile: Deleted profile %s", profileID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"comfort-player-backend/services"
+)
+
+// RadioHandler serves the continuous audio stream of a show
+type RadioHandler struct {
+	registry       *services.ShowRegistry
+	profileService *services.ProfileService
+	radioService   *services.RadioService
+}
+
+// NewRadioHandler creates a new radio handler
+func NewRadioHandler(registry *services.ShowRegistry, profileService *services.ProfileService, radioService *services.RadioService) *RadioHandler {
+	return &RadioHandler{
+		registry:       registry,
+		profileService: profileService,
+		radioService:   radioService,
+	}
+}
+
+// StreamRadio handles GET /api/show/radio and GET /api/shows/{showId}/radio
+func (h *RadioHandler) StreamRadio(w http.ResponseWriter, r *http.Request) {
+	log.Printf("StreamRadio: Request received")
+
+	show, ok := resolveShow(h.registry, w, r)
+	if !ok {
+		return
+	}
+	profileID, ok := resolveProfile(h.profileService, w, r)
+	if !ok {
+		return
+	}
+
+	// The stream has no end, so it can't be cached or seeked
+	w.Header().Set("Content-Type", "audio/mpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Accept-Ranges", "none")
+
+	tracker := &flushingWriter{writeTracker: writeTracker{ResponseWriter: w}}
+	if err := h.radioService.Stream(r.Context(), tracker, show, profileID); err != nil {
+		log.Printf("StreamRadio: Radio stopped: %v", err)
+		if !tracker.written {
+			http.Error(w, "Failed to play the show", http.StatusInternalServerError)
+		}
+	}
+}
+
+// flushingWriter sends every write to the client right away, so a live stream
+// isn't held back in the response buffer
+type flushingWriter struct {
+	writeTracker
+}
+
+func (f *flushingWriter) Write(p []byte) (int, error) {
+	n, err := f.writeTracker.Write(p)
+	f.Flush()
+	return n, err
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"comfort-player-backend/services"
+	"comfort-player-backend/subtitles"
+)
+
+// SearchHandler handles subtitle search requests
+type SearchHandler struct {
+	searchService *services.SearchService
+	registry      *services.ShowRegistry
+}
+
+// NewSearchHandler creates a new search handler
+func NewSearchHandler(searchService *services.SearchService, registry *services.ShowRegistry) *SearchHandler {
+	return &SearchHandler{
+		searchService: searchService,
+		registry:      registry,
+	}
+}
+
+// Search handles GET /api/search
+func (h *SearchHandler) Search(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	log.Printf("Search: Request for %q", params.Get("q"))
+
+	query := services.SearchQuery{
+		Text:    params.Get("q"),
+		ShowID:  params.Get("show"),
+		Context: services.DefaultSearchContext,
+	}
+	if query.ShowID != "" {
+		if _, ok := h.registry.Get(query.ShowID); !ok {
+			http.Error(w, "Show not found", http.StatusNotFound)
+			return
+		}
+	}
+	if lang := params.Get("lang"); lang != "" {
+		language, ok := subtitles.NormalizeLanguage(lang)
+		if !ok {
+			http.Error(w, "Unknown language: "+lang, http.StatusBadRequest)
+			return
+		}
+		query.Language = language
+	}
+	if limit := params.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		query.Limit = parsed
+	}
+	if context := params.Get("context"); context != "" {
+		parsed, err := strconv.Atoi(context)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid context", http.StatusBadRequest)
+			return
+		}
+		query.Context = parsed
+	}
+
+	response, err := h.searchService.Search(query)
+	if errors.Is(err, services.ErrEmptySearch) {
+		http.Error(w, "Query parameter q is required", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Search: Error searching subtitles: %v", err)
+		http.Error(w, "Failed to search subtitles", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Search: Returning %d of %d matches", len(response.Results), response.Total)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
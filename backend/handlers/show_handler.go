@@ -1,206 +1,287 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
-	"strconv"
-	"strings"
 
+	"github.com/gorilla/mux"
+
+	"comfort-player-backend/media"
+	"comfort-player-backend/models"
 	"comfort-player-backend/services"
+	"comfort-player-backend/streaming"
 )
 
 // ShowHandler handles show-related requests
 type ShowHandler struct {
-	showService *services.ShowService
+	registry       *services.ShowRegistry
+	profileService *services.ProfileService
+	signer         *services.URLSigner
+	transcoder     *services.TranscodeService
 }
 
 // NewShowHandler creates a new show handler
-func NewShowHandler(showService *services.ShowService) *ShowHandler {
+func NewShowHandler(registry *services.ShowRegistry, profileService *services.ProfileService, signer *services.URLSigner, transcoder *services.TranscodeService) *ShowHandler {
 	return &ShowHandler{
-		showService: showService,
+		registry:       registry,
+		profileService: profileService,
+		signer:         signer,
+		transcoder:     transcoder,
 	}
 }
 
-// ServeEpisodeVideo handles GET /api/episode/{id}/video
+// ListShows handles GET /api/shows
+func (h *ShowHandler) ListShows(w http.ResponseWriter, r *http.Request) {
+	log.Printf("ListShows: Request received")
+
+	profileID, ok := resolveProfile(h.profileService, w, r)
+	if !ok {
+		return
+	}
+
+	shows := []models.ShowSummary{}
+	for _, show := range h.registry.All() {
+		episodes, err := show.Show.GetAllEpisodes()
+		if err != nil {
+			log.Printf("ListShows: Error getting episodes for %s: %v", show.Show.ID(), err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		shows = append(shows, models.ShowSummary{
+			ID:               show.Show.ID(),
+			Name:             show.Show.Name(),
+			Default:          h.registry.IsDefault(show),
+			EpisodeCount:     len(episodes),
+			CurrentEpisodeID: show.State.GetState(profileID).CurrentEpisodeID,
+		})
+	}
+
+	log.Printf("ListShows: Returning %d shows", len(shows))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shows)
+}
+
+// ServeEpisodeVideo handles GET and HEAD /api/episode/{id}/video
 func (h *ShowHandler) ServeEpisodeVideo(w http.ResponseWriter, r *http.Request) {
-	// Extract episode ID from URL
-	episodeID := strings.TrimPrefix(r.URL.Path, "/api/episode/")
-	episodeID = strings.TrimSuffix(episodeID, "/video")
-	
+	episodeID := mux.Vars(r)["id"]
 	log.Printf("ServeEpisodeVideo: Request for episode %s", episodeID)
 
 	// Get video file path
-	videoPath, err := h.showService.GetEpisodeVideoPath(episodeID)
+	show := h.registry.ForEpisode(episodeID)
+	videoPath, err := show.Show.GetEpisodeVideoPath(episodeID)
 	if err != nil {
 		log.Printf("ServeEpisodeVideo: Error getting video path for %s: %v", episodeID, err)
 		http.Error(w, fmt.Sprintf("Episode not found: %v", err), http.StatusNotFound)
 		return
 	}
-	
+
 	log.Printf("ServeEpisodeVideo: Found video path %s", videoPath)
 
-	// Check if file exists
-	if _, err := os.Stat(videoPath); os.IsNotExist(err) {
-		log.Printf("ServeEpisodeVideo: Video file not found at %s", videoPath)
-		http.Error(w, "Video file not found", http.StatusNotFound)
+	// Transcode for devices that can't play the source file
+	if profileName := r.URL.Query().Get("transcode"); profileName != "" {
+		h.serveTranscodedVideo(w, r, episodeID, videoPath, profileName)
 		return
 	}
 
-	// Open video file
-	file, err := os.Open(videoPath)
-	if err != nil {
-		log.Printf("ServeEpisodeVideo: Error opening video file %s: %v", videoPath, err)
-		http.Error(w, "Failed to open video file", http.StatusInternalServerError)
-		return
+	// Pick the content type from the container, not just the extension
+	contentType := media.MimeType("", videoPath)
+	if info, err := show.Show.GetEpisodeMediaInfo(episodeID); err == nil {
+		contentType = info.MimeType
+	} else {
+		log.Printf("ServeEpisodeVideo: Error probing %s, using extension: %v", videoPath, err)
 	}
-	defer file.Close()
 
-	// Get file info
-	fileInfo, err := file.Stat()
-	if err != nil {
-		log.Printf("ServeEpisodeVideo: Error getting file info for %s: %v", videoPath, err)
-		http.Error(w, "Failed to get file info", http.StatusInternalServerError)
-		return
-	}
+	log.Printf("ServeEpisodeVideo: Content type %s", contentType)
+
+	// Serve the file, honouring Range and conditional headers
+	streaming.ServeFile(w, r, videoPath, contentType)
+}
 
-	// Get file size
-	fileSize := fileInfo.Size()
-	log.Printf("ServeEpisodeVideo: File size %d bytes", fileSize)
+// ServeEpisodeAudio handles GET /api/episode/{id}/audio, the episode's first
+// audio track as MP3
+func (h *ShowHandler) ServeEpisodeAudio(w http.ResponseWriter, r *http.Request) {
+	episodeID := mux.Vars(r)["id"]
+	log.Printf("ServeEpisodeAudio: Request for episode %s", episodeID)
 
-	// Handle range requests for seeking
-	rangeHeader := r.Header.Get("Range")
-	if rangeHeader != "" {
-		log.Printf("ServeEpisodeVideo: Range request: %s", rangeHeader)
-		h.servePartialContent(w, r, file, fileSize, rangeHeader)
+	// Get video file path
+	show := h.registry.ForEpisode(episodeID)
+	videoPath, err := show.Show.GetEpisodeVideoPath(episodeID)
+	if err != nil {
+		log.Printf("ServeEpisodeAudio: Error getting video path for %s: %v", episodeID, err)
+		http.Error(w, fmt.Sprintf("Episode not found: %v", err), http.StatusNotFound)
 		return
 	}
 
-	// Serve full file
-	log.Printf("ServeEpisodeVideo: Serving full file")
-	h.serveFullContent(w, r, file, fileSize)
+	// Audio is extracted and cached like any other transcode
+	h.serveTranscodedVideo(w, r, episodeID, videoPath, services.AudioProfile)
 }
 
-// servePartialContent serves a portion of the file for range requests
-func (h *ShowHandler) servePartialContent(w http.ResponseWriter, r *http.Request, file *os.File, fileSize int64, rangeHeader string) {
-	log.Printf("servePartialContent: File size %d, Range header: %s", fileSize, rangeHeader)
-	
-	// Parse range header
-	rangeParts := strings.Split(rangeHeader, "=")
-	if len(rangeParts) != 2 || rangeParts[0] != "bytes" {
-		log.Printf("servePartialContent: Invalid range header format")
-		http.Error(w, "Invalid range header", http.StatusBadRequest)
+// serveTranscodedVideo serves an episode transcoded with the named profile. Cached
+// transcodes support range requests; live transcodes are streamed as they're produced.
+func (h *ShowHandler) serveTranscodedVideo(w http.ResponseWriter, r *http.Request, episodeID, videoPath, profileName string) {
+	profile, ok := services.LookupTranscodeProfile(profileName)
+	if !ok {
+		log.Printf("serveTranscodedVideo: Unknown transcode profile %s", profileName)
+		http.Error(w, fmt.Sprintf("Unknown transcode profile: %s", profileName), http.StatusBadRequest)
 		return
 	}
 
-	// Parse range values
-	rangeValues := strings.Split(rangeParts[1], "-")
-	if len(rangeValues) != 2 {
-		log.Printf("servePartialContent: Invalid range values format")
-		http.Error(w, "Invalid range values", http.StatusBadRequest)
+	// Serve a finished transcode from the cache
+	if path, ok := h.transcoder.Cached(episodeID, videoPath, profile); ok {
+		log.Printf("serveTranscodedVideo: Serving cached transcode %s", path)
+		streaming.ServeFile(w, r, path, profile.ContentType)
 		return
 	}
 
-	// Parse start position
-	startPos, err := strconv.ParseInt(rangeValues[0], 10, 64)
-	if err != nil {
-		log.Printf("servePartialContent: Invalid start position: %s", rangeValues[0])
-		http.Error(w, "Invalid start position", http.StatusBadRequest)
+	// The length of a live transcode isn't known, so ranges can't be served
+	w.Header().Set("Content-Type", profile.ContentType)
+	w.Header().Set("Accept-Ranges", "none")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	// Parse end position or set to end of file
-	var endPos int64
-	if rangeValues[1] == "" {
-		endPos = fileSize - 1
-		log.Printf("servePartialContent: End position not specified, using %d", endPos)
-	} else {
-		endPos, err = strconv.ParseInt(rangeValues[1], 10, 64)
-		if err != nil {
-			log.Printf("servePartialContent: Invalid end position: %s", rangeValues[1])
-			http.Error(w, "Invalid end position", http.StatusBadRequest)
+	// Stopping the transcode when the last client watching it goes away frees its worker
+	tracked := &writeTracker{ResponseWriter: w}
+	err := h.transcoder.Stream(r.Context(), tracked, episodeID, videoPath, profile)
+	if err != nil && !tracked.written && r.Context().Err() == nil {
+		log.Printf("serveTranscodedVideo: Error transcoding %s: %v", episodeID, err)
+		w.Header().Del("Accept-Ranges")
+		http.Error(w, "Failed to transcode video", http.StatusInternalServerError)
+	}
+}
+
+// ListTranscodeProfiles handles GET /api/transcode/profiles
+func (h *ShowHandler) ListTranscodeProfiles(w http.ResponseWriter, r *http.Request) {
+	log.Printf("ListTranscodeProfiles: Request received")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(services.TranscodeProfiles())
+}
+
+// ServeEpisodeSubtitle handles GET and HEAD /api/episode/{id}/subtitle
+func (h *ShowHandler) ServeEpisodeSubtitle(w http.ResponseWriter, r *http.Request) {
+	episodeID := mux.Vars(r)["id"]
+	log.Printf("ServeEpisodeSubtitle: Request for episode %s", episodeID)
+
+	// Get subtitle file path
+	show := h.registry.ForEpisode(episodeID)
+	subtitlePath, err := show.Show.GetEpisodeSubtitlePath(episodeID)
+	if err != nil {
+		log.Printf("ServeEpisodeSubtitle: Error getting subtitle path for %s: %v", episodeID, err)
+		if errors.Is(err, services.ErrSubtitleExtraction) {
+			http.Error(w, "Failed to extract subtitle", http.StatusInternalServerError)
 			return
 		}
+		http.Error(w, fmt.Sprintf("Subtitle not found: %v", err), http.StatusNotFound)
+		return
 	}
 
-	// Validate range
-	if startPos < 0 || endPos >= fileSize || startPos > endPos {
-		log.Printf("servePartialContent: Invalid range - Start: %d, End: %d, FileSize: %d", startPos, endPos, fileSize)
-		http.Error(w, "Invalid range", http.StatusRequestedRangeNotSatisfiable)
+	log.Printf("ServeEpisodeSubtitle: Found subtitle path %s", subtitlePath)
+
+	serveSubtitleFile(w, r, subtitlePath, show.Show.SubtitleDelay(episodeID))
+}
+
+// ServeEpisodeSubtitleTrack handles GET /api/episode/{id}/subtitle/{lang}. The
+// track is named by its ID ("fr.forced") or just a language ("fr").
+func (h *ShowHandler) ServeEpisodeSubtitleTrack(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	episodeID, trackID := vars["id"], vars["lang"]
+	log.Printf("ServeEpisodeSubtitleTrack: Request for episode %s, track %s", episodeID, trackID)
+
+	show := h.registry.ForEpisode(episodeID)
+	subtitlePath, err := show.Show.GetEpisodeSubtitleTrackPath(episodeID, trackID)
+	if err != nil {
+		log.Printf("ServeEpisodeSubtitleTrack: Error getting subtitle path for %s: %v", episodeID, err)
+		if errors.Is(err, services.ErrSubtitleExtraction) {
+			http.Error(w, "Failed to extract subtitle", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Subtitle not found: %v", err), http.StatusNotFound)
 		return
 	}
 
-	// Calculate content length
-	contentLength := endPos - startPos + 1
-	log.Printf("servePartialContent: Serving bytes %d-%d, Content length: %d", startPos, endPos, contentLength)
+	log.Printf("ServeEpisodeSubtitleTrack: Found subtitle path %s", subtitlePath)
 
-	// Set response headers for partial content
-	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", startPos, endPos, fileSize))
-	w.Header().Set("Accept-Ranges", "bytes")
-	w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
-	w.Header().Set("Content-Type", "video/mp4")
-	w.WriteHeader(http.StatusPartialContent)
+	serveSubtitleFile(w, r, subtitlePath, show.Show.SubtitleDelay(episodeID))
+}
 
-	// Seek to start position
-	file.Seek(startPos, 0)
+// ScanLibrary handles POST /api/library/scan
+func (h *ShowHandler) ScanLibrary(w http.ResponseWriter, r *http.Request) {
+	log.Printf("ScanLibrary: Request received")
 
-	// Copy the requested range to response
-	io.CopyN(w, file, contentLength)
-}
+	results, err := h.registry.ScanAll()
+	if err != nil {
+		log.Printf("ScanLibrary: Error scanning library: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to scan library: %v", err), http.StatusInternalServerError)
+		return
+	}
 
-// serveFullContent serves the entire file
-func (h *ShowHandler) serveFullContent(w http.ResponseWriter, r *http.Request, file *os.File, fileSize int64) {
-	log.Printf("serveFullContent: Serving full file of size %d bytes", fileSize)
-	
-	// Set response headers
-	w.Header().Set("Content-Length", strconv.FormatInt(fileSize, 10))
-	w.Header().Set("Content-Type", "video/mp4")
-	w.Header().Set("Accept-Ranges", "bytes")
-
-	// Copy file to response
-	io.Copy(w, file)
+	log.Printf("ScanLibrary: Scanned %d shows", len(results))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
 }
 
-// ServeEpisodeSubtitle handles GET /api/episode/{id}/subtitle
-func (h *ShowHandler) ServeEpisodeSubtitle(w http.ResponseWriter, r *http.Request) {
-	// Extract episode ID from URL
-	episodeID := strings.TrimPrefix(r.URL.Path, "/api/episode/")
-	episodeID = strings.TrimSuffix(episodeID, "/subtitle")
-	
-	log.Printf("ServeEpisodeSubtitle: Request for episode %s", episodeID)
+// UpdateEpisodeMarkers handles PUT /api/episode/{id}/markers
+func (h *ShowHandler) UpdateEpisodeMarkers(w http.ResponseWriter, r *http.Request) {
+	episodeID := mux.Vars(r)["id"]
+	log.Printf("UpdateEpisodeMarkers: Request for episode %s", episodeID)
 
-	// Get subtitle file path
-	subtitlePath, err := h.showService.GetEpisodeSubtitlePath(episodeID)
-	if err != nil {
-		log.Printf("ServeEpisodeSubtitle: Error getting subtitle path for %s: %v", episodeID, err)
-		http.Error(w, fmt.Sprintf("Subtitle not found: %v", err), http.StatusNotFound)
+	var markers models.EpisodeMarkers
+
+	// Decode request body
+	if err := json.NewDecoder(r.Body).Decode(&markers); err != nil {
+		log.Printf("UpdateEpisodeMarkers: Error decoding JSON: %v", err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-	
-	log.Printf("ServeEpisodeSubtitle: Found subtitle path %s", subtitlePath)
 
-	// Check if file exists
-	if _, err := os.Stat(subtitlePath); os.IsNotExist(err) {
-		log.Printf("ServeEpisodeSubtitle: Subtitle file not found at %s", subtitlePath)
-		http.Error(w, "Subtitle file not found", http.StatusNotFound)
+	if err := validateMarkers(&markers); err != nil {
+		log.Printf("UpdateEpisodeMarkers: Invalid markers: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Determine content type based on file extension
-	contentType := "text/plain"
-	if strings.HasSuffix(subtitlePath, ".vtt") {
-		contentType = "text/vtt"
-	} else if strings.HasSuffix(subtitlePath, ".srt") {
-		contentType = "application/x-subrip"
+	// An empty body clears the markers
+	var update *models.EpisodeMarkers
+	if markers != (models.EpisodeMarkers{}) {
+		update = &markers
+	}
+
+	show := h.registry.ForEpisode(episodeID)
+	episode, err := show.Show.UpdateEpisodeMarkers(episodeID, update)
+	if errors.Is(err, services.ErrEpisodeNotFound) {
+		http.Error(w, "Episode not found", http.StatusNotFound)
+		return
 	}
-	
-	log.Printf("ServeEpisodeSubtitle: Content type %s", contentType)
+	if err != nil {
+		log.Printf("UpdateEpisodeMarkers: Error saving markers: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to save markers: %v", err), http.StatusInternalServerError)
+		return
+	}
+	absoluteEpisodeURLs(r, h.signer, &episode, "")
 
-	// Set response headers
-	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(episode)
+}
 
-	// Serve file
-	http.ServeFile(w, r, subtitlePath)
+// validateMarkers checks that markers are positive and that ranges don't end before they start
+func validateMarkers(markers *models.EpisodeMarkers) error {
+	for _, value := range []*float64{markers.IntroStartSeconds, markers.IntroEndSeconds,
+		markers.RecapStartSeconds, markers.RecapEndSeconds, markers.CreditsStartSeconds} {
+		if value != nil && *value < 0 {
+			return fmt.Errorf("markers must not be negative")
+		}
+	}
+	if markers.IntroStartSeconds != nil && markers.IntroEndSeconds != nil && *markers.IntroEndSeconds < *markers.IntroStartSeconds {
+		return fmt.Errorf("intro must not end before it starts")
+	}
+	if markers.RecapStartSeconds != nil && markers.RecapEndSeconds != nil && *markers.RecapEndSeconds < *markers.RecapStartSeconds {
+		return fmt.Errorf("recap must not end before it starts")
+	}
+	return nil
 }
@@ -2,8 +2,15 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
 
 	"comfort-player-backend/models"
 	"comfort-player-backend/services"
@@ -11,50 +18,69 @@ import (
 
 // StateHandler handles playback state related requests
 type StateHandler struct {
-	stateService *services.StateService
-	showService  *services.ShowService
+	registry       *services.ShowRegistry
+	profileService *services.ProfileService
+	historyService *services.HistoryService
+	signer         *services.URLSigner
+	eventsURLTTL   time.Duration
 }
 
 // NewStateHandler creates a new state handler
-func NewStateHandler(stateService *services.StateService, showService *services.ShowService) *StateHandler {
+func NewStateHandler(registry *services.ShowRegistry, profileService *services.ProfileService, historyService *services.HistoryService, signer *services.URLSigner, eventsURLTTL time.Duration) *StateHandler {
 	return &StateHandler{
-		stateService: stateService,
-		showService:  showService,
+		registry:       registry,
+		profileService: profileService,
+		historyService: historyService,
+		signer:         signer,
+		eventsURLTTL:   eventsURLTTL,
 	}
 }
 
-// GetShowInfo handles GET /api/show/info
+// GetShowInfo handles GET /api/show/info and GET /api/shows/{showId}/info
 func (h *StateHandler) GetShowInfo(w http.ResponseWriter, r *http.Request) {
 	log.Printf("GetShowInfo: Request received")
+
+	show, ok := resolveShow(h.registry, w, r)
+	if !ok {
+		return
+	}
+	profileID, ok := resolveProfile(h.profileService, w, r)
+	if !ok {
+		return
+	}
 	
 	// Get all episodes
-	showInfo, err := h.showService.GetShowInfo()
+	showInfo, err := show.Show.GetShowInfo()
 	if err != nil {
 		log.Printf("GetShowInfo: Error getting episodes: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Convert relative URLs to full URLs
-	host := r.Host
+	// Pick each episode's subtitle track and convert relative URLs to full URLs
+	language := subtitleLanguage(h.profileService, profileID)
 	for i := range showInfo.Episodes {
-		// Convert relative video URL to full URL
-		if showInfo.Episodes[i].VideoURL != "" && showInfo.Episodes[i].VideoURL[0] == '/' {
-			showInfo.Episodes[i].VideoURL = "http://" + host + showInfo.Episodes[i].VideoURL
-		}
-		// Convert relative subtitle URL to full URL
-		if showInfo.Episodes[i].SubtitleURL != "" && showInfo.Episodes[i].SubtitleURL[0] == '/' {
-			showInfo.Episodes[i].SubtitleURL = "http://" + host + showInfo.Episodes[i].SubtitleURL
-		}
+		services.SelectSubtitleTrack(&showInfo.Episodes[i], language)
+		absoluteEpisodeURLs(r, h.signer, &showInfo.Episodes[i], profileID)
 	}
 
 	// Get current state
-	state := h.stateService.GetState()
-	log.Printf("GetShowInfo: Current state - EpisodeID: %s, PlaybackTime: %d", state.CurrentEpisodeID, state.PlaybackTimeSeconds)
+	state := show.State.GetState(profileID)
+	log.Printf("GetShowInfo: Current state - Profile: %q, EpisodeID: %s, PlaybackTime: %d", profileID, state.CurrentEpisodeID, state.PlaybackTimeSeconds)
 
 	// Set current episode and playback time in response
+	showInfo.ProfileID = profileID
 	showInfo.CurrentEpisodeID = state.CurrentEpisodeID
 	showInfo.PlaybackTimeSeconds = state.PlaybackTimeSeconds
+	showInfo.Revision = state.Revision
+	showInfo.PlaybackMode = state.PlaybackMode
+	showInfo.Favorites = state.Favorites
+	if showInfo.PlaybackMode == "" {
+		showInfo.PlaybackMode = models.PlaybackModeSequential
+	}
+	if showInfo.Favorites == nil {
+		showInfo.Favorites = []string{}
+	}
 
 	// If no current episode is set, set the first episode as current
 	if showInfo.CurrentEpisodeID == "" && len(showInfo.Episodes) > 0 {
@@ -62,14 +88,38 @@ func (h *StateHandler) GetShowInfo(w http.ResponseWriter, r *http.Request) {
 		log.Printf("GetShowInfo: Setting first episode as current: %s", showInfo.CurrentEpisodeID)
 	}
 
+	// Offer the radio to callers that are allowed to move the profile along
+	if key, ok := services.APIKeyFromContext(r.Context()); ok && services.ScopeAllows(key.Scope, models.ScopePlayback) {
+		radioURL := withProfile(fmt.Sprintf("/api/shows/%s/radio", show.Show.ID()), profileID)
+		showInfo.RadioURL = "http://" + r.Host + h.signer.SignURL(radioURL, services.RadioResource(show.Show.ID(), profileID))
+	}
+
+	// Signed, since browsers can't send an Authorization header with EventSource or
+	// WebSocket. Clients keep reconnecting to it, so it stays valid for longer.
+	eventsURL := withProfile(fmt.Sprintf("/api/shows/%s/events", show.Show.ID()), profileID)
+	showInfo.EventsURL = "http://" + r.Host + h.signer.SignURLWithTTL(eventsURL, services.EventsResource(show.Show.ID(), profileID), h.eventsURLTTL)
+
 	log.Printf("GetShowInfo: Returning %d episodes", len(showInfo.Episodes))
 	w.Header().Set("Content-Type", "application/json")
+	// The ETag is the state revision, for If-Match on state updates. It doesn't
+	// change when the catalog does, so the response must not be cached by it.
+	w.Header().Set("ETag", stateETag(state.Revision))
+	w.Header().Set("Cache-Control", "no-cache")
 	json.NewEncoder(w).Encode(showInfo)
 }
 
-// UpdatePlaybackState handles POST /api/show/state
+// UpdatePlaybackState handles POST /api/show/state and POST /api/shows/{showId}/state
 func (h *StateHandler) UpdatePlaybackState(w http.ResponseWriter, r *http.Request) {
 	log.Printf("UpdatePlaybackState: Request received")
+
+	show, ok := resolveShow(h.registry, w, r)
+	if !ok {
+		return
+	}
+	profileID, ok := resolveProfile(h.profileService, w, r)
+	if !ok {
+		return
+	}
 	
 	var request models.PlaybackStateUpdateRequest
 
@@ -89,8 +139,26 @@ func (h *StateHandler) UpdatePlaybackState(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Only apply the update to the revision the client last saw, if it says which
+	baseRevision := request.BaseRevision
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		revision, ok := parseStateETag(ifMatch)
+		if !ok {
+			log.Printf("UpdatePlaybackState: Invalid If-Match header: %s", ifMatch)
+			http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+			return
+		}
+		baseRevision = revision
+	}
+
 	// Update state
-	if err := h.stateService.UpdateState(request.EpisodeID, request.PlaybackTimeSeconds); err != nil {
+	state, episodeChanged, err := show.State.UpdateState(profileID, request.EpisodeID, request.PlaybackTimeSeconds, baseRevision)
+	if errors.Is(err, services.ErrStateConflict) {
+		// Let the client decide whether to adopt the current state or override it
+		writePlaybackState(w, http.StatusConflict, state)
+		return
+	}
+	if err != nil {
 		log.Printf("UpdatePlaybackState: Error updating state: %v", err)
 		http.Error(w, "Failed to update state", http.StatusInternalServerError)
 		return
@@ -98,7 +166,209 @@ func (h *StateHandler) UpdatePlaybackState(w http.ResponseWriter, r *http.Reques
 	
 	log.Printf("UpdatePlaybackState: State updated successfully")
 
+	// Record progress in the watch history
+	if err := h.historyService.RecordProgress(services.PlaybackReport{
+		ShowID:          show.Show.ID(),
+		ProfileID:       profileID,
+		EpisodeID:       request.EpisodeID,
+		PositionSeconds: request.PlaybackTimeSeconds,
+		DurationSeconds: request.DurationSeconds,
+		Finished:        request.Finished,
+		EpisodeChanged:  episodeChanged,
+	}); err != nil {
+		log.Printf("UpdatePlaybackState: Error recording history: %v", err)
+	}
+
 	// Return success response
+	writePlaybackState(w, http.StatusOK, state)
+}
+
+// writePlaybackState writes a profile's playback state and its revision as
+// the ETag. Anything but 200 OK is a failed update.
+func writePlaybackState(w http.ResponseWriter, status int, state models.ServerState) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", stateETag(state.Revision))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(models.PlaybackStateResponse{
+		Success:             status == http.StatusOK,
+		Revision:            state.Revision,
+		CurrentEpisodeID:    state.CurrentEpisodeID,
+		PlaybackTimeSeconds: state.PlaybackTimeSeconds,
+		LastUpdated:         state.LastUpdated,
+	})
+}
+
+// stateETag returns the ETag of a playback state revision
+func stateETag(revision int64) string {
+	return fmt.Sprintf("\"%d\"", revision)
+}
+
+// parseStateETag reads the revision of an If-Match header holding a single
+// ETag. "*" matches any revision, so nil is returned for it.
+func parseStateETag(header string) (*int64, bool) {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return nil, true
+	}
+	header = strings.TrimPrefix(header, "W/")
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		return nil, false
+	}
+	revision, err := strconv.ParseInt(header[1:len(header)-1], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	return &revision, true
+}
+
+// AdvanceEpisode handles POST /api/show/advance and POST /api/shows/{showId}/advance
+func (h *StateHandler) AdvanceEpisode(w http.ResponseWriter, r *http.Request) {
+	log.Printf("AdvanceEpisode: Request received")
+	h.moveEpisode(w, r, services.PickNextEpisode)
+}
+
+// RewindEpisode handles POST /api/show/rewind and POST /api/shows/{showId}/rewind
+func (h *StateHandler) RewindEpisode(w http.ResponseWriter, r *http.Request) {
+	log.Printf("RewindEpisode: Request received")
+	h.moveEpisode(w, r, services.PickPreviousEpisode)
+}
+
+// moveEpisode moves the profile to the episode chosen by step and writes the new episode's info
+func (h *StateHandler) moveEpisode(w http.ResponseWriter, r *http.Request, step func(state *models.ServerState, episodes []models.EpisodeInfo) (string, error)) {
+	show, ok := resolveShow(h.registry, w, r)
+	if !ok {
+		return
+	}
+	profileID, ok := resolveProfile(h.profileService, w, r)
+	if !ok {
+		return
+	}
+
+	// Read the episodes before the state is locked for the move
+	episodes, err := show.Show.GetAllEpisodes()
+	if err != nil {
+		log.Printf("moveEpisode: Error getting episodes: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to change episode: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	state, err := show.State.MoveToEpisode(profileID, func(state *models.ServerState) (string, error) {
+		// Without a current episode the client shows the first one, so step from there
+		if state.CurrentEpisodeID == "" && len(episodes) > 0 {
+			state.CurrentEpisodeID = episodes[0].ID
+		}
+		return step(state, episodes)
+	})
+	if errors.Is(err, services.ErrNoEpisodes) {
+		log.Printf("moveEpisode: Show %s has no episodes", show.Show.ID())
+		http.Error(w, "The show has no episodes", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("moveEpisode: Error moving to another episode: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to change episode: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Record the start of the new episode in the watch history
+	if err := h.historyService.RecordProgress(services.PlaybackReport{
+		ShowID:         show.Show.ID(),
+		ProfileID:      profileID,
+		EpisodeID:      state.CurrentEpisodeID,
+		EpisodeChanged: true,
+	}); err != nil {
+		log.Printf("moveEpisode: Error recording history: %v", err)
+	}
+
+	episode, err := show.Show.GetEpisode(state.CurrentEpisodeID)
+	if err != nil {
+		log.Printf("moveEpisode: Error getting episode %s: %v", state.CurrentEpisodeID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	services.SelectSubtitleTrack(&episode, subtitleLanguage(h.profileService, profileID))
+	absoluteEpisodeURLs(r, h.signer, &episode, profileID)
+
+	log.Printf("moveEpisode: Now playing %s", episode.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(episode)
+}
+
+// SetPlaybackMode handles PUT /api/show/mode and PUT /api/shows/{showId}/mode
+func (h *StateHandler) SetPlaybackMode(w http.ResponseWriter, r *http.Request) {
+	log.Printf("SetPlaybackMode: Request received")
+
+	show, ok := resolveShow(h.registry, w, r)
+	if !ok {
+		return
+	}
+	profileID, ok := resolveProfile(h.profileService, w, r)
+	if !ok {
+		return
+	}
+
+	var request models.PlaybackModeRequest
+
+	// Decode request body
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Printf("SetPlaybackMode: Error decoding JSON: %v", err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if !services.IsValidPlaybackMode(request.Mode) {
+		log.Printf("SetPlaybackMode: Unknown playback mode: %s", request.Mode)
+		http.Error(w, "Unknown playback mode", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := show.State.SetPlaybackMode(profileID, request.Mode); err != nil {
+		log.Printf("SetPlaybackMode: Error updating state: %v", err)
+		http.Error(w, "Failed to update state", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(request)
+}
+
+// AddFavorite handles PUT /api/show/favorites/{id} and PUT /api/shows/{showId}/favorites/{id}
+func (h *StateHandler) AddFavorite(w http.ResponseWriter, r *http.Request) {
+	h.setFavorite(w, r, true)
+}
+
+// RemoveFavorite handles DELETE /api/show/favorites/{id} and DELETE /api/shows/{showId}/favorites/{id}
+func (h *StateHandler) RemoveFavorite(w http.ResponseWriter, r *http.Request) {
+	h.setFavorite(w, r, false)
+}
+
+// setFavorite adds or removes an episode from the profile's favorites and writes the new list
+func (h *StateHandler) setFavorite(w http.ResponseWriter, r *http.Request, favorite bool) {
+	episodeID := mux.Vars(r)["id"]
+	log.Printf("setFavorite: Episode %s favorite=%t", episodeID, favorite)
+
+	show, ok := resolveShow(h.registry, w, r)
+	if !ok {
+		return
+	}
+	profileID, ok := resolveProfile(h.profileService, w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := show.Show.GetEpisode(episodeID); err != nil {
+		log.Printf("setFavorite: %v", err)
+		http.Error(w, "Episode not found", http.StatusNotFound)
+		return
+	}
+
+	state, err := show.State.SetFavorite(profileID, episodeID, favorite)
+	if err != nil {
+		log.Printf("setFavorite: Error updating state: %v", err)
+		http.Error(w, "Failed to update state", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	json.NewEncoder(w).Encode(state.Favorites)
 }
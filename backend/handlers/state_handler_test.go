@@ -0,0 +1,47 @@
+package handlers
+
+import "testing"
+
+func TestParseStateETag(t *testing.T) {
+	revision := func(r int64) *int64 { return &r }
+
+	tests := []struct {
+		header   string
+		revision *int64
+		ok       bool
+	}{
+		{header: `"42"`, revision: revision(42), ok: true},
+		{header: `  "1700000000000" `, revision: revision(1700000000000), ok: true},
+		{header: `W/"42"`, revision: revision(42), ok: true},
+		{header: `"0"`, revision: revision(0), ok: true},
+		{header: `*`, revision: nil, ok: true},
+		{header: `42`},
+		{header: `"42`},
+		{header: `""`},
+		{header: `"`},
+		{header: `"abc"`},
+		{header: `"4 2"`},
+		{header: `"1", "2"`},
+		{header: `W/`},
+	}
+
+	for _, test := range tests {
+		got, ok := parseStateETag(test.header)
+		if ok != test.ok {
+			t.Errorf("parseStateETag(%q) ok = %v, want %v", test.header, ok, test.ok)
+			continue
+		}
+		if (got == nil) != (test.revision == nil) || (got != nil && *got != *test.revision) {
+			t.Errorf("parseStateETag(%q) = %v, want %v", test.header, got, test.revision)
+		}
+	}
+}
+
+func TestStateETagRoundTrip(t *testing.T) {
+	for _, revision := range []int64{0, 1, 1700000000000} {
+		got, ok := parseStateETag(stateETag(revision))
+		if !ok || got == nil || *got != revision {
+			t.Errorf("parseStateETag(stateETag(%d)) = %v, %v", revision, got, ok)
+		}
+	}
+}
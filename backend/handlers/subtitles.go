@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"comfort-player-backend/models"
+	"comfort-player-backend/services"
+	"comfort-player-backend/streaming"
+	"comfort-player-backend/subtitles"
+)
+
+// serveSubtitleFile serves a subtitle file as UTF-8, converted to the format
+// named by the "format" query parameter or preferred by the Accept header and
+// delayed by offset. It keeps the file's own format if the client doesn't ask for one.
+func serveSubtitleFile(w http.ResponseWriter, r *http.Request, path string, offset time.Duration) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("serveSubtitleFile: File not found at %s", path)
+		http.Error(w, "Subtitle not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("serveSubtitleFile: Error reading %s: %v", path, err)
+		http.Error(w, "Failed to read subtitle", http.StatusInternalServerError)
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Printf("serveSubtitleFile: Error getting file info for %s: %v", path, err)
+		http.Error(w, "Failed to read subtitle", http.StatusInternalServerError)
+		return
+	}
+
+	source := subtitles.DetectFormat(path, data)
+	target, ok := subtitleFormat(w, r, source)
+	if !ok {
+		return
+	}
+
+	log.Printf("serveSubtitleFile: Serving %s (%s) as %s, offset %v", path, source, target, offset)
+
+	converted, err := subtitles.Convert(data, source, target, offset)
+	if err != nil {
+		log.Printf("serveSubtitleFile: Error converting %s to %s: %v", path, target, err)
+		http.Error(w, fmt.Sprintf("Failed to convert subtitle: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// The same URL returns different formats depending on Accept. The entity tag
+	// covers the format and offset; Last-Modified is left out because changing the
+	// offset doesn't touch the file.
+	w.Header().Add("Vary", "Accept")
+	streaming.Serve(w, r, streaming.Content{
+		Name:        path,
+		ContentType: subtitles.ContentType(target),
+		Size:        int64(len(converted)),
+		ETag:        fmt.Sprintf(`%s-%s-%d"`, strings.TrimSuffix(streaming.FileETag(info), `"`), target, offset.Milliseconds()),
+	}, bytes.NewReader(converted))
+}
+
+// subtitleFormat returns the format a subtitle in the source format should be
+// served as. It writes a 400 if the requested format isn't available.
+func subtitleFormat(w http.ResponseWriter, r *http.Request, source string) (string, bool) {
+	offers := []string{subtitles.FormatSRT, subtitles.FormatVTT}
+	if !subtitles.IsWritable(source) {
+		offers = append(offers, source)
+	}
+
+	if format := strings.ToLower(r.URL.Query().Get("format")); format != "" {
+		for _, offer := range offers {
+			if format == offer {
+				return format, true
+			}
+		}
+		log.Printf("subtitleFormat: Unsupported format %q requested for %s subtitle", format, source)
+		http.Error(w, fmt.Sprintf("Unsupported subtitle format: %s", format), http.StatusBadRequest)
+		return "", false
+	}
+
+	if format := subtitles.Negotiate(r.Header.Get("Accept"), offers); format != "" {
+		return format, true
+	}
+	return source, true
+}
+
+// GetSubtitleOffset handles GET /api/episode/{id}/subtitle-offset
+func (h *ShowHandler) GetSubtitleOffset(w http.ResponseWriter, r *http.Request) {
+	episodeID := mux.Vars(r)["id"]
+	log.Printf("GetSubtitleOffset: Request for episode %s", episodeID)
+
+	show := h.registry.ForEpisode(episodeID)
+	offset, err := show.Show.GetSubtitleOffset(episodeID)
+	if err != nil {
+		h.writeSubtitleOffsetError(w, episodeID, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(offset)
+}
+
+// UpdateSubtitleOffset handles PUT /api/episode/{id}/subtitle-offset
+func (h *ShowHandler) UpdateSubtitleOffset(w http.ResponseWriter, r *http.Request) {
+	episodeID := mux.Vars(r)["id"]
+	log.Printf("UpdateSubtitleOffset: Request for episode %s", episodeID)
+
+	var request models.SubtitleOffsetRequest
+
+	// Decode request body
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Printf("UpdateSubtitleOffset: Error decoding JSON: %v", err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	show := h.registry.ForEpisode(episodeID)
+	offset, err := show.Show.SetSubtitleOffset(episodeID, request.OffsetSeconds, request.Season)
+	if err != nil {
+		h.writeSubtitleOffsetError(w, episodeID, err)
+		return
+	}
+
+	log.Printf("UpdateSubtitleOffset: Subtitles of %s now offset by %.3fs", episodeID, offset.OffsetSeconds)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(offset)
+}
+
+// NudgeSubtitleOffset handles POST /api/episode/{id}/subtitle-offset/nudge
+func (h *ShowHandler) NudgeSubtitleOffset(w http.ResponseWriter, r *http.Request) {
+	episodeID := mux.Vars(r)["id"]
+	log.Printf("NudgeSubtitleOffset: Request for episode %s", episodeID)
+
+	var request models.SubtitleNudgeRequest
+
+	// Decode request body
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Printf("NudgeSubtitleOffset: Error decoding JSON: %v", err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	show := h.registry.ForEpisode(episodeID)
+	offset, err := show.Show.NudgeSubtitleOffset(episodeID, request.DeltaSeconds)
+	if err != nil {
+		h.writeSubtitleOffsetError(w, episodeID, err)
+		return
+	}
+
+	log.Printf("NudgeSubtitleOffset: Subtitles of %s now offset by %.3fs", episodeID, offset.OffsetSeconds)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(offset)
+}
+
+// writeSubtitleOffsetError writes the status code matching a subtitle offset error
+func (h *ShowHandler) writeSubtitleOffsetError(w http.ResponseWriter, episodeID string, err error) {
+	log.Printf("writeSubtitleOffsetError: Subtitle offset of %s: %v", episodeID, err)
+	switch {
+	case errors.Is(err, services.ErrEpisodeNotFound):
+		http.Error(w, "Episode not found", http.StatusNotFound)
+	case errors.Is(err, services.ErrInvalidSubtitleOffset):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, fmt.Sprintf("Failed to update subtitle offset: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"comfort-player-backend/subtitles"
+)
+
+func TestSubtitleFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		accept string
+		source string
+		want   string
+		status int
+	}{
+		{name: "source kept", source: subtitles.FormatSRT, want: subtitles.FormatSRT},
+		{name: "query parameter", query: "?format=vtt", source: subtitles.FormatSRT, want: subtitles.FormatVTT},
+		{name: "query parameter case", query: "?format=VTT", source: subtitles.FormatASS, want: subtitles.FormatVTT},
+		{name: "query before Accept", query: "?format=srt", accept: "text/vtt", source: subtitles.FormatASS, want: subtitles.FormatSRT},
+		{name: "Accept", accept: "text/vtt", source: subtitles.FormatSRT, want: subtitles.FormatVTT},
+		{name: "Accept wildcard", accept: "*/*", source: subtitles.FormatASS, want: subtitles.FormatASS},
+		{name: "source format requested", query: "?format=ass", source: subtitles.FormatASS, want: subtitles.FormatASS},
+		{name: "unwritable format", query: "?format=ass", source: subtitles.FormatSRT, status: http.StatusBadRequest},
+		{name: "unknown format", query: "?format=sub", source: subtitles.FormatSRT, status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/episode/Show_S01E01/subtitle"+test.query, nil)
+			if test.accept != "" {
+				r.Header.Set("Accept", test.accept)
+			}
+			w := httptest.NewRecorder()
+
+			got, ok := subtitleFormat(w, r, test.source)
+			if test.status != 0 {
+				if ok || w.Code != test.status {
+					t.Errorf("subtitleFormat = %q, %v with status %d; want status %d", got, ok, w.Code, test.status)
+				}
+				return
+			}
+			if !ok || got != test.want {
+				t.Errorf("subtitleFormat = %q, %v; want %q", got, ok, test.want)
+			}
+		})
+	}
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -12,6 +19,7 @@ import (
 
 	"comfort-player-backend/config"
 	"comfort-player-backend/handlers"
+	"comfort-player-backend/models"
 	"comfort-player-backend/services"
 	"comfort-player-backend/utils"
 )
@@ -20,19 +28,75 @@ func main() {
 	// Load configuration
 	cfg := config.LoadConfig()
 
+	// Run a subcommand instead of the server if one is given
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(cfg, os.Args[1:]))
+	}
+
 	// Ensure data directory exists for state file
 	dataDir := filepath.Dir(cfg.StateFile)
 	if err := utils.EnsureDir(dataDir); err != nil {
 		log.Fatalf("Failed to create data directory: %v", err)
 	}
 
+	// Open the store holding playback state, profiles and history
+	store, err := services.OpenStateStore(cfg)
+	if err != nil {
+		log.Fatalf("Failed to open state store: %v", err)
+	}
+
 	// Initialize services
-	stateService := services.NewStateService(cfg.StateFile)
-	showService := services.NewShowService(cfg)
+	transcodePool := services.NewWorkerPool(cfg.TranscodeWorkers)
+	registry := services.NewShowRegistry(cfg, store, transcodePool)
+	profileService := services.NewProfileService(store)
+	historyService := services.NewHistoryService(store)
+	// The placeholder key is public, so it's never accepted
+	bootstrapKey := cfg.APIKey
+	if bootstrapKey == config.DefaultAPIKey {
+		bootstrapKey = ""
+	}
+	keyService, err := services.NewKeyService(cfg.KeysFile, bootstrapKey)
+	if err != nil {
+		log.Fatalf("Failed to load API keys: %v", err)
+	}
+	if err := keyService.EnsureAdminKey(filepath.Join(filepath.Dir(cfg.KeysFile), "bootstrap.key")); err != nil {
+		log.Fatalf("Failed to set up an admin key: %v", err)
+	}
+	cachePruner := services.NewCachePruner(cfg)
+	hlsService := services.NewHLSService(cfg, transcodePool, cachePruner)
+	transcodeService := services.NewTranscodeService(cfg, transcodePool, cachePruner)
+	radioService := services.NewRadioService(cfg, historyService)
+	searchService := services.NewSearchService(registry)
+	stateFlusher := services.NewStateFlusher(registry, historyService, cfg.StateFlushInterval)
+	signer, err := services.NewURLSigner(cfg.StreamSigningSecret, filepath.Join(dataDir, "signing.key"), cfg.StreamURLTTL)
+	if err != nil {
+		log.Fatalf("Failed to set up stream URL signing: %v", err)
+	}
+
+	// Scan the media tree so new files show up without editing the season JSON files
+	if cfg.ScanOnStartup {
+		if _, err := registry.ScanAll(); err != nil {
+			log.Printf("Library scan failed: %v", err)
+		}
+	}
+
+	// Index subtitles in the background; searches wait for the first build
+	go searchService.Rebuild()
+
+	// Write playback progress in batches rather than on every update
+	stateFlusher.Start()
 
 	// Initialize handlers
-	stateHandler := handlers.NewStateHandler(stateService, showService)
-	showHandler := handlers.NewShowHandler(showService)
+	stateHandler := handlers.NewStateHandler(registry, profileService, historyService, signer, cfg.EventsURLTTL)
+	showHandler := handlers.NewShowHandler(registry, profileService, signer, transcodeService)
+	profileHandler := handlers.NewProfileHandler(profileService, registry, historyService)
+	historyHandler := handlers.NewHistoryHandler(historyService, registry, profileService)
+	keyHandler := handlers.NewKeyHandler(keyService)
+	healthHandler := handlers.NewHealthHandler(registry, stateFlusher)
+	hlsHandler := handlers.NewHLSHandler(registry, profileService, hlsService)
+	radioHandler := handlers.NewRadioHandler(registry, profileService, radioService)
+	searchHandler := handlers.NewSearchHandler(searchService, registry)
+	eventsHandler := handlers.NewEventsHandler(registry, profileService)
 
 	// Create router
 	r := mux.NewRouter()
@@ -42,19 +106,114 @@ func main() {
 	r.Use(loggingMiddleware)
 
 
+	// Set up API key authentication. Each route requires a minimum key scope.
+	requireRead := createAPIKeyMiddleware(keyService, models.ScopeRead)
+	requirePlayback := createAPIKeyMiddleware(keyService, models.ScopePlayback)
+	requireAdmin := createAPIKeyMiddleware(keyService, models.ScopeAdmin)
+
+	// Stream routes also accept a signed URL in place of an API key
+	requireStream := createSignedURLMiddleware(signer, requireRead, func(r *http.Request) string {
+		return mux.Vars(r)["id"]
+	})
+	// HLS playlists resume from the profile's position, so the signature covers the profile too
+	requireHLS := createSignedURLMiddleware(signer, requireRead, func(r *http.Request) string {
+		return services.HLSResource(mux.Vars(r)["id"], r.URL.Query().Get("profile"))
+	})
+	// ffmpeg and event streams never end on their own, so they're stopped when
+	// shutdown starts rather than holding it up; the radio saves its position as it stops
+	streams, stopStreams := context.WithCancel(context.Background())
+	stopOnShutdown := createStreamMiddleware(streams)
+
+	requireRadio := createSignedURLMiddleware(signer, requirePlayback, func(r *http.Request) string {
+		showID := mux.Vars(r)["showId"]
+		if showID == "" {
+			showID = cfg.DefaultShowID
+		}
+		return services.RadioResource(showID, r.URL.Query().Get("profile"))
+	})
+	requireEvents := createSignedURLMiddleware(signer, requireRead, func(r *http.Request) string {
+		showID := mux.Vars(r)["showId"]
+		if showID == "" {
+			showID = cfg.DefaultShowID
+		}
+		return services.EventsResource(showID, r.URL.Query().Get("profile"))
+	})
+
 	// Set up routes
-	// Show info and state routes
-	r.HandleFunc("/api/show/info", stateHandler.GetShowInfo).Methods("GET")
-	r.HandleFunc("/api/show/state", stateHandler.UpdatePlaybackState).Methods("POST")
+	// Health check, open to anyone
+	r.HandleFunc("/api/health", healthHandler.GetHealth).Methods("GET")
+
+	// Show info and state routes for the default show
+	r.Handle("/api/show/info", requireRead(stateHandler.GetShowInfo)).Methods("GET")
+	r.Handle("/api/show/state", requirePlayback(stateHandler.UpdatePlaybackState)).Methods("POST")
+	r.Handle("/api/show/advance", requirePlayback(stateHandler.AdvanceEpisode)).Methods("POST")
+	r.Handle("/api/show/rewind", requirePlayback(stateHandler.RewindEpisode)).Methods("POST")
+	r.Handle("/api/show/mode", requirePlayback(stateHandler.SetPlaybackMode)).Methods("PUT")
+	r.Handle("/api/show/favorites/{id}", requirePlayback(stateHandler.AddFavorite)).Methods("PUT")
+	r.Handle("/api/show/favorites/{id}", requirePlayback(stateHandler.RemoveFavorite)).Methods("DELETE")
+	r.Handle("/api/show/radio", stopOnShutdown(requireRadio(radioHandler.StreamRadio))).Methods("GET")
+	r.Handle("/api/show/events", stopOnShutdown(requireEvents(eventsHandler.StreamEvents))).Methods("GET")
+
+	// Show info and state routes for any show in the library
+	r.Handle("/api/shows", requireRead(showHandler.ListShows)).Methods("GET")
+	r.Handle("/api/shows/{showId}/info", requireRead(stateHandler.GetShowInfo)).Methods("GET")
+	r.Handle("/api/shows/{showId}/state", requirePlayback(stateHandler.UpdatePlaybackState)).Methods("POST")
+	r.Handle("/api/shows/{showId}/advance", requirePlayback(stateHandler.AdvanceEpisode)).Methods("POST")
+	r.Handle("/api/shows/{showId}/rewind", requirePlayback(stateHandler.RewindEpisode)).Methods("POST")
+	r.Handle("/api/shows/{showId}/mode", requirePlayback(stateHandler.SetPlaybackMode)).Methods("PUT")
+	r.Handle("/api/shows/{showId}/favorites/{id}", requirePlayback(stateHandler.AddFavorite)).Methods("PUT")
+	r.Handle("/api/shows/{showId}/favorites/{id}", requirePlayback(stateHandler.RemoveFavorite)).Methods("DELETE")
+	r.Handle("/api/shows/{showId}/radio", stopOnShutdown(requireRadio(radioHandler.StreamRadio))).Methods("GET")
+	r.Handle("/api/shows/{showId}/events", stopOnShutdown(requireEvents(eventsHandler.StreamEvents))).Methods("GET")
+
+	// Watch history and progress routes
+	r.Handle("/api/history", requireRead(historyHandler.GetHistory)).Methods("GET")
+	r.Handle("/api/show/progress", requireRead(historyHandler.GetShowProgress)).Methods("GET")
+	r.Handle("/api/shows/{showId}/progress", requireRead(historyHandler.GetShowProgress)).Methods("GET")
+	r.Handle("/api/episode/{id}/progress", requireRead(historyHandler.GetEpisodeProgress)).Methods("GET")
+
+	// Subtitle search
+	r.Handle("/api/search", requireRead(searchHandler.Search)).Methods("GET")
+
+	// Profile routes
+	r.Handle("/api/profiles", requireRead(profileHandler.ListProfiles)).Methods("GET")
+	r.Handle("/api/profiles", requireAdmin(profileHandler.CreateProfile)).Methods("POST")
+	r.Handle("/api/profiles/{profileId}", requireAdmin(profileHandler.DeleteProfile)).Methods("DELETE")
+	r.Handle("/api/profiles/{profileId}/preferences", requirePlayback(profileHandler.UpdatePreferences)).Methods("PUT")
 
 	// Episode streaming routes
-	r.HandleFunc("/api/episode/{id}/video", showHandler.ServeEpisodeVideo).Methods("GET")
-	r.HandleFunc("/api/episode/{id}/subtitle", showHandler.ServeEpisodeSubtitle).Methods("GET")
+	r.Handle("/api/episode/{id}/video", stopOnShutdown(requireStream(showHandler.ServeEpisodeVideo))).Methods("GET", "HEAD")
+	r.Handle("/api/episode/{id}/subtitle", requireStream(showHandler.ServeEpisodeSubtitle)).Methods("GET", "HEAD")
+	r.Handle("/api/episode/{id}/subtitle-offset", requireRead(showHandler.GetSubtitleOffset)).Methods("GET")
+	r.Handle("/api/episode/{id}/subtitle-offset", requirePlayback(showHandler.UpdateSubtitleOffset)).Methods("PUT")
+	r.Handle("/api/episode/{id}/subtitle-offset/nudge", requirePlayback(showHandler.NudgeSubtitleOffset)).Methods("POST")
+	r.Handle("/api/episode/{id}/subtitle/{lang}", requireStream(showHandler.ServeEpisodeSubtitleTrack)).Methods("GET", "HEAD")
+	r.Handle("/api/episode/{id}/audio", stopOnShutdown(requireStream(showHandler.ServeEpisodeAudio))).Methods("GET", "HEAD")
+
+	// Transcoding routes
+	r.Handle("/api/transcode/profiles", requireRead(showHandler.ListTranscodeProfiles)).Methods("GET")
+
+	// HLS routes
+	r.Handle("/api/episode/{id}/hls/master.m3u8", requireHLS(hlsHandler.ServeMasterPlaylist)).Methods("GET")
+	r.Handle("/api/episode/{id}/hls/index.m3u8", requireHLS(hlsHandler.ServeMediaPlaylist)).Methods("GET")
+	r.Handle("/api/episode/{id}/hls/segment-{index:[0-9]+}.ts", requireHLS(hlsHandler.ServeSegment)).Methods("GET", "HEAD")
+
+	// Episode metadata routes
+	r.Handle("/api/episode/{id}/markers", requireAdmin(showHandler.UpdateEpisodeMarkers)).Methods("PUT")
+
+	// Library routes
+	r.Handle("/api/library/scan", requireAdmin(showHandler.ScanLibrary)).Methods("POST")
+
+	// API key management routes
+	r.Handle("/api/keys", requireAdmin(keyHandler.ListKeys)).Methods("GET")
+	r.Handle("/api/keys", requireAdmin(keyHandler.CreateKey)).Methods("POST")
+	r.Handle("/api/keys/{keyId}", requireAdmin(keyHandler.RevokeKey)).Methods("DELETE")
 
 	// Set up CORS
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"GET", "POST", "OPTIONS"},
+		AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"},
+		ExposedHeaders: []string{"Content-Range", "Content-Length", "Accept-Ranges", "ETag", "Last-Modified"},
 		AllowedHeaders: []string{"*"},
 	})
 
@@ -64,20 +223,69 @@ func main() {
 		Addr:    ":" + cfg.Port,
 		Handler: handler,
 	}
+	server.RegisterOnShutdown(stopStreams)
 
 	// Start server
 	fmt.Printf("Starting server on port %s\n", cfg.Port)
 	fmt.Printf("Media directory: %s\n", cfg.MediaDir)
 	fmt.Printf("Seasons directory: %s\n", cfg.SeasonsDir)
+	fmt.Printf("Shows: %d\n", len(registry.All()))
 	fmt.Printf("State file: %s\n", cfg.StateFile)
-	fmt.Printf("API Key: %s\n", cfg.APIKey)
+	fmt.Printf("State store: %s\n", cfg.StateStore)
+	fmt.Printf("State flush interval: %v\n", cfg.StateFlushInterval)
+	fmt.Printf("Keys file: %s\n", cfg.KeysFile)
+	fmt.Printf("Shutdown timeout: %v\n", cfg.ShutdownTimeout)
+
+	// Serve until SIGINT or SIGTERM, or until the server fails to start
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	exitCode := 0
+	select {
+	case <-ctx.Done():
+		log.Printf("Shutting down, waiting up to %v for requests to finish", cfg.ShutdownTimeout)
+	case err := <-serverErr:
+		log.Printf("Server failed: %v", err)
+		exitCode = 1
+	}
+	// A second signal kills the server right away
+	stop()
 
-	log.Fatal(server.ListenAndServe())
+	shutdown(server, cfg.ShutdownTimeout, registry, hlsService, transcodeService, stateFlusher, store)
+	log.Printf("Server stopped")
+	os.Exit(exitCode)
 }
 
-// createAPIKeyMiddleware creates middleware for API key authentication
-func createAPIKeyMiddleware(expectedKey string) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
+// shutdown stops accepting connections, waits until timeout for running
+// requests to finish, stops background work, then writes pending state and
+// closes the state store
+func shutdown(server *http.Server, timeout time.Duration, registry *services.ShowRegistry, hlsService *services.HLSService, transcodeService *services.TranscodeService, stateFlusher *services.StateFlusher, store services.StateStore) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: Requests still running after %v, closing their connections: %v", timeout, err)
+		server.Close()
+	}
+
+	registry.StopJobs()
+	hlsService.StopJobs()
+	transcodeService.StopJobs()
+
+	if err := stateFlusher.Stop(); err != nil {
+		log.Printf("shutdown: Failed to write pending state: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		log.Printf("shutdown: Failed to close state store: %v", err)
+	}
+}
+
+// createAPIKeyMiddleware creates middleware for API key authentication. Requests
+// must present a key whose scope is at least the required scope.
+func createAPIKeyMiddleware(keyService *services.KeyService, requiredScope string) func(http.HandlerFunc) http.Handler {
+	return func(next http.HandlerFunc) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Skip authentication for OPTIONS requests
 			if r.Method == "OPTIONS" {
@@ -102,13 +310,61 @@ func createAPIKeyMiddleware(expectedKey string) func(http.Handler) http.Handler
 			apiKey := authHeader[7:]
 
 			// Validate API key
-			if apiKey != expectedKey {
+			key, ok := keyService.Authenticate(apiKey)
+			if !ok {
 				http.Error(w, "Invalid API key", http.StatusUnauthorized)
 				return
 			}
 
-			// Continue with request
-			next.ServeHTTP(w, r)
+			// Check the key is allowed to use this route
+			if !services.ScopeAllows(key.Scope, requiredScope) {
+				log.Printf("AUTH: Key %s (%s) lacks %s scope for %s %s", key.ID, key.Scope, requiredScope, r.Method, r.URL.Path)
+				http.Error(w, "API key does not have the required scope", http.StatusForbidden)
+				return
+			}
+
+			// Continue with request, letting handlers see which key was used
+			next.ServeHTTP(w, r.WithContext(services.ContextWithAPIKey(r.Context(), key)))
+		})
+	}
+}
+
+// createSignedURLMiddleware creates middleware that accepts requests carrying a
+// valid signature for the resource named by the request. Unsigned requests fall
+// back to API key authentication.
+func createSignedURLMiddleware(signer *services.URLSigner, fallback func(http.HandlerFunc) http.Handler, resource func(r *http.Request) string) func(http.HandlerFunc) http.Handler {
+	return func(next http.HandlerFunc) http.Handler {
+		withAPIKey := fallback(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			signed := resource(r)
+
+			err := signer.Verify(r.URL.Query(), signed)
+			switch {
+			case err == nil:
+				next.ServeHTTP(w, r)
+			case errors.Is(err, services.ErrSignatureMissing):
+				withAPIKey.ServeHTTP(w, r)
+			case errors.Is(err, services.ErrSignatureExpired):
+				http.Error(w, "Stream URL has expired", http.StatusForbidden)
+			default:
+				log.Printf("AUTH: Invalid stream signature for %s", signed)
+				http.Error(w, "Invalid stream URL signature", http.StatusForbidden)
+			}
+		})
+	}
+}
+
+// createStreamMiddleware creates middleware that cancels a request's context
+// when streams is cancelled, for responses that would otherwise run for a long time
+func createStreamMiddleware(streams context.Context) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			stopWatching := context.AfterFunc(streams, cancel)
+			defer stopWatching()
+
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
@@ -146,3 +402,19 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.statusCode = code
 	rw.ResponseWriter.WriteHeader(code)
 }
+
+// Flush passes flushes through, so streamed responses reach the client as they're written
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack passes the connection through, so WebSocket handlers can take it over
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err == nil {
+		rw.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"comfort-player-backend/models"
+	"comfort-player-backend/services"
+)
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	keyService, err := services.NewKeyService(filepath.Join(t.TempDir(), "keys.json"), "bootstrap-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readKey, err := keyService.Create("Read", models.ScopeRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	playbackKey, err := keyService.Create("Playback", models.ScopePlayback)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler answers with the ID of the key the request was authenticated with
+	requirePlayback := createAPIKeyMiddleware(keyService, models.ScopePlayback)
+	handler := requirePlayback(func(w http.ResponseWriter, r *http.Request) {
+		key, _ := services.APIKeyFromContext(r.Context())
+		w.Write([]byte(key.ID))
+	})
+
+	tests := []struct {
+		name          string
+		method        string
+		authorization string
+		status        int
+		keyID         string
+	}{
+		{name: "no header", authorization: "", status: http.StatusUnauthorized},
+		{name: "not a bearer token", authorization: "Basic " + playbackKey.Key, status: http.StatusUnauthorized},
+		{name: "unknown key", authorization: "Bearer cpk_unknown", status: http.StatusUnauthorized},
+		{name: "scope too low", authorization: "Bearer " + readKey.Key, status: http.StatusForbidden},
+		{name: "required scope", authorization: "Bearer " + playbackKey.Key, status: http.StatusOK, keyID: playbackKey.ID},
+		{name: "higher scope", authorization: "Bearer bootstrap-secret", status: http.StatusOK, keyID: "bootstrap"},
+		{name: "preflight", method: http.MethodOptions, status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			r := httptest.NewRequest(method, "/api/show/state", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d", w.Code, test.status)
+			}
+			if test.status == http.StatusOK && w.Body.String() != test.keyID {
+				t.Errorf("handler saw key %q, want %q", w.Body.String(), test.keyID)
+			}
+		})
+	}
+}
+
+func TestSignedURLMiddleware(t *testing.T) {
+	signer, err := services.NewURLSigner("test-secret", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unsigned requests fall back to this, which marks them as such
+	fallback := func(next http.HandlerFunc) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("api key "))
+			next(w, r)
+		})
+	}
+	episodeID := func(r *http.Request) string {
+		return r.URL.Query().Get("episode")
+	}
+	handler := createSignedURLMiddleware(signer, fallback, episodeID)(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("served"))
+	})
+
+	tests := []struct {
+		name   string
+		url    string
+		status int
+		body   string
+	}{
+		{name: "signed", url: signer.SignURL("/video?episode=E1", "E1"), status: http.StatusOK, body: "served"},
+		{name: "unsigned", url: "/video?episode=E1", status: http.StatusOK, body: "api key served"},
+		{name: "other episode", url: strings.Replace(signer.SignURL("/video?episode=E1", "E1"), "E1", "E2", 1), status: http.StatusForbidden},
+		{name: "expired", url: signer.SignURLWithTTL("/video?episode=E1", "E1", -time.Minute), status: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.url, nil))
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d", w.Code, test.status)
+			}
+			if test.body != "" && w.Body.String() != test.body {
+				t.Errorf("body = %q, want %q", w.Body.String(), test.body)
+			}
+		})
+	}
+}
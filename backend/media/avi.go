@@ -0,0 +1,126 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// maxAVIHeaderSize caps how much of an AVI header list is read into memory
+const maxAVIHeaderSize = 1 << 20
+
+// riffChunk is a chunk parsed out of RIFF data held in memory
+type riffChunk struct {
+	id       string
+	listType string // Set for LIST chunks
+	data     []byte
+}
+
+// riffChunks splits RIFF data into chunks. Chunks are padded to an even size.
+func riffChunks(data []byte) []riffChunk {
+	var chunks []riffChunk
+	for len(data) >= 8 {
+		id := string(data[:4])
+		size := int(binary.LittleEndian.Uint32(data[4:8]))
+		if size > len(data)-8 {
+			break
+		}
+
+		chunk := riffChunk{id: id, data: data[8 : 8+size]}
+		if id == "LIST" && size >= 4 {
+			chunk.listType = string(chunk.data[:4])
+			chunk.data = chunk.data[4:]
+		}
+		chunks = append(chunks, chunk)
+
+		size += size & 1
+		if size > len(data)-8 {
+			break
+		}
+		data = data[8+size:]
+	}
+	return chunks
+}
+
+// probeAVI reads the duration and stream list from an AVI header list
+func probeAVI(file *os.File, info *Info) error {
+	// RIFF header, then the hdrl list comes first
+	var header [24]byte
+	if _, err := io.ReadFull(file, header[:]); err != nil {
+		return err
+	}
+	if string(header[12:16]) != "LIST" || string(header[20:24]) != "hdrl" {
+		return errors.New("missing AVI header list")
+	}
+	size := int64(binary.LittleEndian.Uint32(header[16:20])) - 4
+	if size < 0 || size > maxAVIHeaderSize {
+		return fmt.Errorf("invalid AVI header list size %d", size)
+	}
+	hdrl := make([]byte, size)
+	if _, err := io.ReadFull(file, hdrl); err != nil {
+		return err
+	}
+
+	for _, chunk := range riffChunks(hdrl) {
+		switch {
+		case chunk.id == "avih" && len(chunk.data) >= 20:
+			// Main header: microseconds per frame and total frames
+			microSecPerFrame := binary.LittleEndian.Uint32(chunk.data[0:4])
+			totalFrames := binary.LittleEndian.Uint32(chunk.data[16:20])
+			info.DurationSeconds = float64(microSecPerFrame) * float64(totalFrames) / 1e6
+		case chunk.listType == "strl":
+			if track, ok := parseAVIStream(chunk.data, len(info.Tracks)); ok {
+				info.Tracks = append(info.Tracks, track)
+			}
+		}
+	}
+	return nil
+}
+
+// parseAVIStream reads a stream header list into a track
+func parseAVIStream(data []byte, index int) (Track, bool) {
+	track := Track{Number: index}
+	var streamType string
+	for _, chunk := range riffChunks(data) {
+		switch chunk.id {
+		case "strh":
+			if len(chunk.data) >= 8 {
+				streamType = string(chunk.data[:4])
+				track.CodecID = strings.TrimRight(string(chunk.data[4:8]), "\x00 ")
+			}
+		case "strf":
+			switch {
+			case streamType == "vids" && len(chunk.data) >= 20:
+				// BITMAPINFOHEADER: the compression FourCC is more reliable than the handler
+				track.Width = int(int32(binary.LittleEndian.Uint32(chunk.data[4:8])))
+				height := int(int32(binary.LittleEndian.Uint32(chunk.data[8:12])))
+				track.Height = max(height, -height)
+				if compression := strings.TrimRight(string(chunk.data[16:20]), "\x00 "); compression != "" {
+					track.CodecID = compression
+				}
+			case streamType == "auds" && len(chunk.data) >= 4:
+				// WAVEFORMATEX
+				formatTag := binary.LittleEndian.Uint16(chunk.data[0:2])
+				track.CodecID = fmt.Sprintf("0x%04x", formatTag)
+				track.Codec = aviAudioCodecs[formatTag]
+				track.Channels = int(binary.LittleEndian.Uint16(chunk.data[2:4]))
+			}
+		}
+	}
+
+	switch streamType {
+	case "vids":
+		track.Type = TrackVideo
+		track.Codec = aviVideoCodecs[strings.ToLower(track.CodecID)]
+	case "auds":
+		track.Type = TrackAudio
+	case "txts":
+		track.Type = TrackSubtitle
+	default:
+		return Track{}, false
+	}
+	return track, true
+}
@@ -0,0 +1,138 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// riff encodes a RIFF chunk, padded to an even size
+func riff(id string, content ...[]byte) []byte {
+	data := bytes.Join(content, nil)
+	chunk := append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// riffList encodes a LIST chunk of the given type
+func riffList(listType string, chunks ...[]byte) []byte {
+	return riff("LIST", []byte(listType), bytes.Join(chunks, nil))
+}
+
+// le32 encodes little-endian 32 bit values
+func le32(values ...uint32) []byte {
+	var data []byte
+	for _, value := range values {
+		data = binary.LittleEndian.AppendUint32(data, value)
+	}
+	return data
+}
+
+// testAVI is an AVI file with a 100 second top-down Xvid video stream, an odd
+// sized MP3 audio format chunk and a text stream
+func testAVI() []byte {
+	avih := make([]byte, 56)
+	copy(avih, le32(40000, 0, 0, 0, 2500)) // 40ms per frame, 2500 frames
+
+	videoHeader := make([]byte, 56)
+	copy(videoHeader, "vidsxvid")
+	videoFormat := make([]byte, 40)
+	height := int32(-480)
+	copy(videoFormat, le32(40, 640, uint32(height), 0x00180001))
+	copy(videoFormat[16:], "XVID")
+
+	audioHeader := make([]byte, 56)
+	copy(audioHeader, "auds\x00\x00\x00\x00")
+	audioFormat := make([]byte, 17)
+	binary.LittleEndian.PutUint16(audioFormat, 0x0055)
+	binary.LittleEndian.PutUint16(audioFormat[2:], 2)
+
+	textHeader := make([]byte, 56)
+	copy(textHeader, "txts")
+
+	hdrl := riffList("hdrl",
+		riff("avih", avih),
+		riffList("strl", riff("strh", videoHeader), riff("strf", videoFormat)),
+		riffList("strl", riff("strh", audioHeader), riff("strf", audioFormat)),
+		riffList("strl", riff("strh", textHeader)),
+		riffList("strl", riff("strh", []byte("mids"))),
+	)
+	return riff("RIFF", []byte("AVI "), hdrl, riffList("movi"))
+}
+
+func TestRIFFChunks(t *testing.T) {
+	data := concat(riff("abcd", []byte("odd")), riffList("strl", riff("strh", []byte("vids"))), riff("last", nil))
+	chunks := riffChunks(data)
+
+	var got []string
+	for _, chunk := range chunks {
+		got = append(got, chunk.id+"/"+chunk.listType)
+	}
+	if want := []string{"abcd/", "LIST/strl", "last/"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("chunks = %q, want %q", got, want)
+	}
+	if string(chunks[0].data) != "odd" {
+		t.Errorf("first chunk data = %q, want %q", chunks[0].data, "odd")
+	}
+
+	// A chunk claiming more data than there is ends the list
+	truncated := concat(riff("good", []byte("ok")), []byte("bad!"), le32(1000), []byte("xx"))
+	if chunks := riffChunks(truncated); len(chunks) != 1 || chunks[0].id != "good" {
+		t.Errorf("truncated chunks = %+v, want only the first", chunks)
+	}
+}
+
+func TestProbeAVI(t *testing.T) {
+	tests := []struct {
+		name string
+		file []byte
+		err  bool
+	}{
+		{name: "header list", file: testAVI()},
+		{name: "no header list", file: riff("RIFF", []byte("AVI "), riffList("movi")), err: true},
+		{name: "truncated header list", file: testAVI()[:100], err: true},
+	}
+
+	want := []Track{
+		{Number: 0, Type: TrackVideo, Codec: "mpeg4", CodecID: "XVID", Width: 640, Height: 480},
+		{Number: 1, Type: TrackAudio, Codec: "mp3", CodecID: "0x0055", Channels: 2},
+		{Number: 2, Type: TrackSubtitle},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "video.avi")
+			if err := os.WriteFile(path, test.file, 0644); err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			var info Info
+			err = probeAVI(file, &info)
+			if test.err {
+				if err == nil {
+					t.Fatalf("probeAVI succeeded with %+v, want an error", info)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("probeAVI error: %v", err)
+			}
+			if info.DurationSeconds != 100 {
+				t.Errorf("DurationSeconds = %v, want 100", info.DurationSeconds)
+			}
+			if !reflect.DeepEqual(info.Tracks, want) {
+				t.Errorf("Tracks = %+v, want %+v", info.Tracks, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package media
+
+import "strings"
+
+// mp4Codecs maps MP4/QuickTime sample entry types to codec names
+var mp4Codecs = map[string]string{
+	"avc1": "h264",
+	"avc3": "h264",
+	"hvc1": "hevc",
+	"hev1": "hevc",
+	"av01": "av1",
+	"vp08": "vp8",
+	"vp09": "vp9",
+	"mp4v": "mpeg4",
+	"mp4a": "aac",
+	"ac-3": "ac3",
+	"ec-3": "eac3",
+	"Opus": "opus",
+	"fLaC": "flac",
+	".mp3": "mp3",
+	"alac": "alac",
+	"tx3g": "mov_text",
+	"wvtt": "webvtt",
+	"stpp": "ttml",
+	"c608": "eia_608",
+}
+
+// matroskaCodecs maps Matroska codec ID prefixes to codec names
+var matroskaCodecs = []struct {
+	prefix string
+	codec  string
+}{
+	{"V_MPEG4/ISO/AVC", "h264"},
+	{"V_MPEGH/ISO/HEVC", "hevc"},
+	{"V_AV1", "av1"},
+	{"V_VP8", "vp8"},
+	{"V_VP9", "vp9"},
+	{"V_MPEG4/", "mpeg4"},
+	{"V_MPEG2", "mpeg2video"},
+	{"V_MS/VFW/FOURCC", "vfw"},
+	{"V_THEORA", "theora"},
+	{"A_AAC", "aac"},
+	{"A_AC3", "ac3"},
+	{"A_EAC3", "eac3"},
+	{"A_DTS", "dts"},
+	{"A_TRUEHD", "truehd"},
+	{"A_MPEG/L3", "mp3"},
+	{"A_MPEG/L2", "mp2"},
+	{"A_OPUS", "opus"},
+	{"A_VORBIS", "vorbis"},
+	{"A_FLAC", "flac"},
+	{"A_PCM", "pcm"},
+	{"S_TEXT/UTF8", "subrip"},
+	{"S_TEXT/ASCII", "subrip"},
+	{"S_TEXT/ASS", "ass"},
+	{"S_TEXT/SSA", "ssa"},
+	{"S_ASS", "ass"},
+	{"S_SSA", "ssa"},
+	{"S_TEXT/WEBVTT", "webvtt"},
+	{"D_WEBVTT", "webvtt"},
+	{"S_HDMV/PGS", "hdmv_pgs_subtitle"},
+	{"S_VOBSUB", "dvd_subtitle"},
+	{"S_DVBSUB", "dvb_subtitle"},
+}
+
+// aviVideoCodecs maps AVI video compression FourCCs, lowercased, to codec names
+var aviVideoCodecs = map[string]string{
+	"xvid": "mpeg4",
+	"divx": "mpeg4",
+	"dx50": "mpeg4",
+	"fmp4": "mpeg4",
+	"mp4v": "mpeg4",
+	"h264": "h264",
+	"x264": "h264",
+	"avc1": "h264",
+	"hevc": "hevc",
+	"h265": "hevc",
+	"mjpg": "mjpeg",
+	"wmv3": "wmv3",
+}
+
+// aviAudioCodecs maps WAVEFORMATEX format tags to codec names
+var aviAudioCodecs = map[uint16]string{
+	0x0001: "pcm",
+	0x0050: "mp2",
+	0x0055: "mp3",
+	0x00FF: "aac",
+	0x1610: "aac",
+	0x2000: "ac3",
+	0x2001: "dts",
+	0x0161: "wmav2",
+}
+
+// matroskaCodec returns the codec name for a Matroska codec ID
+func matroskaCodec(codecID string) string {
+	for _, entry := range matroskaCodecs {
+		if strings.HasPrefix(codecID, entry.prefix) {
+			return entry.codec
+		}
+	}
+	return ""
+}
+
+// IsTextSubtitle reports whether a codec name is a text subtitle format that
+// can be converted to SRT or WebVTT
+func IsTextSubtitle(codec string) bool {
+	switch codec {
+	case "subrip", "ass", "ssa", "webvtt", "mov_text":
+		return true
+	}
+	return false
+}
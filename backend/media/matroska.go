@@ -0,0 +1,385 @@
+package media
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Matroska element IDs, with their length marker bits kept
+const (
+	ebmlHeaderID      = 0x1A45DFA3
+	ebmlDocTypeID     = 0x4282
+	mkvSegmentID      = 0x18538067
+	mkvInfoID         = 0x1549A966
+	mkvTimecodeScale  = 0x2AD7B1
+	mkvDurationID     = 0x4489
+	mkvTracksID       = 0x1654AE6B
+	mkvTrackEntryID   = 0xAE
+	mkvTrackNumberID  = 0xD7
+	mkvTrackTypeID    = 0x83
+	mkvCodecID        = 0x86
+	mkvLanguageID     = 0x22B59C
+	mkvLanguageIETFID = 0x22B59D
+	mkvNameID         = 0x536E
+	mkvFlagDefaultID  = 0x88
+	mkvFlagForcedID   = 0x55AA
+	mkvVideoID        = 0xE0
+	mkvPixelWidthID   = 0xB0
+	mkvPixelHeightID  = 0xBA
+	mkvAudioID        = 0xE1
+	mkvChannelsID     = 0x9F
+	mkvClusterID      = 0x1F43B675
+)
+
+// Matroska track types
+const (
+	mkvTrackTypeVideo    = 1
+	mkvTrackTypeAudio    = 2
+	mkvTrackTypeSubtitle = 0x11
+)
+
+// maxMatroskaElement caps how much of a header element is read into memory
+const maxMatroskaElement = 16 << 20
+
+// unknownSize marks an element whose size isn't known, as used by live streams
+const unknownSize = -1
+
+// ebmlElement is an element header found while walking a Matroska file
+type ebmlElement struct {
+	id   uint64
+	size int64
+}
+
+// readVint reads an EBML variable-length integer. Element IDs keep their length
+// marker; sizes have it removed.
+func readVint(r io.ByteReader, keepMarker bool) (uint64, int, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	length := 1
+	for mask := byte(0x80); length <= 8 && first&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, 0, errors.New("invalid EBML variable-length integer")
+	}
+
+	value := uint64(first)
+	if !keepMarker {
+		value &= uint64(0xFF >> length)
+	}
+	for i := 1; i < length; i++ {
+		next, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		value = value<<8 | uint64(next)
+	}
+	return value, length, nil
+}
+
+// readElementHeader reads an element ID and size
+func readElementHeader(r io.ByteReader) (ebmlElement, int, error) {
+	id, idLength, err := readVint(r, true)
+	if err != nil {
+		return ebmlElement{}, 0, err
+	}
+	size, sizeLength, err := readVint(r, false)
+	if err != nil {
+		return ebmlElement{}, 0, err
+	}
+
+	element := ebmlElement{id: id, size: int64(size)}
+	// All data bits set means the size is unknown
+	if size == uint64(1)<<(7*sizeLength)-1 {
+		element.size = unknownSize
+	}
+	return element, idLength + sizeLength, nil
+}
+
+// byteCounter wraps a buffered reader and counts the bytes consumed
+type byteCounter struct {
+	*bufio.Reader
+	offset int64
+}
+
+func (c *byteCounter) ReadByte() (byte, error) {
+	b, err := c.Reader.ReadByte()
+	if err == nil {
+		c.offset++
+	}
+	return b, err
+}
+
+func (c *byteCounter) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.offset += int64(n)
+	return n, err
+}
+
+// probeMatroska reads the document type, duration and track list of a Matroska
+// or WebM file. It stops at the first cluster, since the headers come before
+// the media data.
+func probeMatroska(file *os.File, info *Info) error {
+	reader := &byteCounter{Reader: bufio.NewReader(file)}
+
+	// EBML header: the document type tells WebM and Matroska apart
+	header, _, err := readElementHeader(reader)
+	if err != nil {
+		return err
+	}
+	if header.id != ebmlHeaderID || header.size == unknownSize {
+		return errors.New("missing EBML header")
+	}
+	headerData, err := readElementData(reader, header)
+	if err != nil {
+		return err
+	}
+	for _, child := range ebmlChildren(headerData) {
+		if child.id == ebmlDocTypeID {
+			switch string(child.data) {
+			case "webm":
+				info.Container = ContainerWebM
+			case "matroska":
+				info.Container = ContainerMatroska
+			}
+		}
+	}
+
+	// Segment: walk its children until the tracks are found
+	segment, _, err := readElementHeader(reader)
+	if err != nil {
+		return err
+	}
+	if segment.id != mkvSegmentID {
+		return errors.New("missing Matroska segment")
+	}
+	segmentEnd := int64(math.MaxInt64)
+	if segment.size != unknownSize {
+		segmentEnd = reader.offset + segment.size
+	}
+
+	var timecodeScale uint64 = 1000000
+	var duration float64
+	foundTracks := false
+	for reader.offset < segmentEnd && !foundTracks {
+		element, _, err := readElementHeader(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch element.id {
+		case mkvInfoID:
+			data, err := readElementData(reader, element)
+			if err != nil {
+				return err
+			}
+			for _, child := range ebmlChildren(data) {
+				switch child.id {
+				case mkvTimecodeScale:
+					timecodeScale = ebmlUint(child.data)
+				case mkvDurationID:
+					duration = ebmlFloat(child.data)
+				}
+			}
+		case mkvTracksID:
+			data, err := readElementData(reader, element)
+			if err != nil {
+				return err
+			}
+			info.Tracks = parseMatroskaTracks(data)
+			foundTracks = true
+		case mkvClusterID:
+			// Media data starts here; the tracks should have come first
+			return errors.New("tracks not found before media data")
+		default:
+			if element.size == unknownSize {
+				return fmt.Errorf("element %x has unknown size", element.id)
+			}
+			if err := skipBytes(file, reader, element.size); err != nil {
+				return err
+			}
+		}
+	}
+
+	info.DurationSeconds = duration * float64(timecodeScale) / 1e9
+	if !foundTracks {
+		return errors.New("tracks not found")
+	}
+	return nil
+}
+
+// readElementData reads the content of an element into memory
+func readElementData(reader *byteCounter, element ebmlElement) ([]byte, error) {
+	if element.size == unknownSize || element.size > maxMatroskaElement {
+		return nil, fmt.Errorf("element %x too large to read", element.id)
+	}
+	data := make([]byte, element.size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// skipBytes moves past n bytes, seeking the file when the buffer doesn't hold them
+func skipBytes(file *os.File, reader *byteCounter, n int64) error {
+	if n <= int64(reader.Buffered()) {
+		_, err := reader.Discard(int(n))
+		reader.offset += n
+		return err
+	}
+
+	target := reader.offset + n
+	if _, err := file.Seek(target, io.SeekStart); err != nil {
+		return err
+	}
+	reader.Reset(file)
+	reader.offset = target
+	return nil
+}
+
+// ebmlChild is an element parsed out of a master element held in memory
+type ebmlChild struct {
+	id   uint64
+	data []byte
+}
+
+// ebmlChildren splits the content of a master element into its children
+func ebmlChildren(data []byte) []ebmlChild {
+	var children []ebmlChild
+	reader := &sliceReader{data: data}
+	for reader.pos < len(data) {
+		element, _, err := readElementHeader(reader)
+		if err != nil || element.size == unknownSize || element.size > int64(len(data)-reader.pos) {
+			break
+		}
+		end := reader.pos + int(element.size)
+		children = append(children, ebmlChild{id: element.id, data: data[reader.pos:end]})
+		reader.pos = end
+	}
+	return children
+}
+
+// parseMatroskaTracks reads the entries of a Tracks element
+func parseMatroskaTracks(data []byte) []Track {
+	var tracks []Track
+	for _, entry := range ebmlChildren(data) {
+		if entry.id != mkvTrackEntryID {
+			continue
+		}
+
+		// Matroska defaults: enabled by default, English, not forced
+		track := Track{Default: true, Language: "eng"}
+		var trackType uint64
+		languageIETF := ""
+		for _, field := range ebmlChildren(entry.data) {
+			switch field.id {
+			case mkvTrackNumberID:
+				track.Number = int(ebmlUint(field.data))
+			case mkvTrackTypeID:
+				trackType = ebmlUint(field.data)
+			case mkvCodecID:
+				track.CodecID = ebmlString(field.data)
+			case mkvLanguageID:
+				track.Language = ebmlString(field.data)
+			case mkvLanguageIETFID:
+				languageIETF = ebmlString(field.data)
+			case mkvNameID:
+				track.Name = ebmlString(field.data)
+			case mkvFlagDefaultID:
+				track.Default = ebmlUint(field.data) != 0
+			case mkvFlagForcedID:
+				track.Forced = ebmlUint(field.data) != 0
+			case mkvVideoID:
+				for _, video := range ebmlChildren(field.data) {
+					switch video.id {
+					case mkvPixelWidthID:
+						track.Width = int(ebmlUint(video.data))
+					case mkvPixelHeightID:
+						track.Height = int(ebmlUint(video.data))
+					}
+				}
+			case mkvAudioID:
+				for _, audio := range ebmlChildren(field.data) {
+					if audio.id == mkvChannelsID {
+						track.Channels = int(ebmlUint(audio.data))
+					}
+				}
+			}
+		}
+
+		switch trackType {
+		case mkvTrackTypeVideo:
+			track.Type = TrackVideo
+		case mkvTrackTypeAudio:
+			track.Type = TrackAudio
+		case mkvTrackTypeSubtitle:
+			track.Type = TrackSubtitle
+		default:
+			continue
+		}
+		if languageIETF != "" {
+			track.Language = languageIETF
+		}
+		if track.Language == "und" {
+			track.Language = ""
+		}
+		track.Codec = matroskaCodec(track.CodecID)
+		tracks = append(tracks, track)
+	}
+	return tracks
+}
+
+// ebmlUint decodes an unsigned integer element
+func ebmlUint(data []byte) uint64 {
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// ebmlFloat decodes a 4 or 8 byte float element
+func ebmlFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	}
+	return 0
+}
+
+// ebmlString decodes a string element, which may be padded with zero bytes
+func ebmlString(data []byte) string {
+	for i, b := range data {
+		if b == 0 {
+			return string(data[:i])
+		}
+	}
+	return string(data)
+}
+
+// sliceReader reads bytes from a slice, tracking its position
+type sliceReader struct {
+	data []byte
+	pos  int
+}
+
+func (s *sliceReader) ReadByte() (byte, error) {
+	if s.pos >= len(s.data) {
+		return 0, io.EOF
+	}
+	b := s.data[s.pos]
+	s.pos++
+	return b, nil
+}
@@ -0,0 +1,162 @@
+package media
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ebml encodes an element with a known size
+func ebml(id uint64, data ...[]byte) []byte {
+	content := bytes.Join(data, nil)
+	element := ebmlID(id)
+	// Eight byte sizes are valid for any length
+	size := uint64(len(content)) | 1<<56
+	for shift := 56; shift >= 0; shift -= 8 {
+		element = append(element, byte(size>>shift))
+	}
+	return append(element, content...)
+}
+
+// ebmlUnknown encodes an element whose size is marked unknown
+func ebmlUnknown(id uint64, data ...[]byte) []byte {
+	element := append(ebmlID(id), 0xFF)
+	return append(element, bytes.Join(data, nil)...)
+}
+
+// ebmlID encodes an element ID, which keeps its length marker
+func ebmlID(id uint64) []byte {
+	var encoded []byte
+	for ; id > 0; id >>= 8 {
+		encoded = append([]byte{byte(id)}, encoded...)
+	}
+	return encoded
+}
+
+func TestReadElementHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  []byte
+		id     uint64
+		size   int64
+		length int
+		err    bool
+	}{
+		{name: "one byte size", input: []byte{0xAE, 0x85}, id: 0xAE, size: 5, length: 2},
+		{name: "two byte size", input: []byte{0xAE, 0x40, 0x80}, id: 0xAE, size: 128, length: 3},
+		{name: "four byte id", input: []byte{0x18, 0x53, 0x80, 0x67, 0x82}, id: mkvSegmentID, size: 2, length: 5},
+		{name: "eight byte size", input: []byte{0xAE, 0x01, 0, 0, 0, 0, 0, 0x01, 0x00}, id: 0xAE, size: 256, length: 9},
+		{name: "unknown one byte size", input: []byte{0x1F, 0x43, 0xB6, 0x75, 0xFF}, id: mkvClusterID, size: unknownSize, length: 5},
+		{name: "unknown two byte size", input: []byte{0xAE, 0x7F, 0xFF}, id: 0xAE, size: unknownSize, length: 3},
+		{name: "unknown eight byte size", input: []byte{0xAE, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, id: 0xAE, size: unknownSize, length: 9},
+		{name: "all ones in a longer size is known", input: []byte{0xAE, 0x40, 0x7F}, id: 0xAE, size: 127, length: 3},
+		{name: "invalid length marker", input: []byte{0x00, 0x81}, err: true},
+		{name: "truncated size", input: []byte{0xAE, 0x40}, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			element, length, err := readElementHeader(&sliceReader{data: test.input})
+			if test.err {
+				if err == nil {
+					t.Fatalf("readElementHeader(% x) succeeded, want an error", test.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readElementHeader(% x) error: %v", test.input, err)
+			}
+			if element.id != test.id || element.size != test.size || length != test.length {
+				t.Errorf("readElementHeader(% x) = id %x, size %d, length %d; want id %x, size %d, length %d",
+					test.input, element.id, element.size, length, test.id, test.size, test.length)
+			}
+		})
+	}
+}
+
+func TestEBMLChildrenStopsAtUnknownSize(t *testing.T) {
+	data := bytes.Join([][]byte{
+		ebml(mkvTrackNumberID, []byte{1}),
+		ebmlUnknown(mkvVideoID, ebml(mkvPixelWidthID, []byte{2})),
+	}, nil)
+
+	children := ebmlChildren(data)
+	if len(children) != 1 || children[0].id != mkvTrackNumberID {
+		t.Errorf("ebmlChildren = %v, want only the track number", children)
+	}
+}
+
+func TestProbeMatroska(t *testing.T) {
+	header := ebml(ebmlHeaderID, ebml(ebmlDocTypeID, []byte("matroska")))
+	info := ebml(mkvInfoID,
+		ebml(mkvTimecodeScale, []byte{0x0F, 0x42, 0x40}),
+		ebml(mkvDurationID, []byte{0x40, 0x8F, 0x40, 0x00, 0x00, 0x00, 0x00, 0x00}), // 1000.0
+	)
+	tracks := ebml(mkvTracksID,
+		ebml(mkvTrackEntryID,
+			ebml(mkvTrackNumberID, []byte{1}),
+			ebml(mkvTrackTypeID, []byte{mkvTrackTypeSubtitle}),
+			ebml(mkvCodecID, []byte("S_TEXT/UTF8")),
+			ebml(mkvLanguageID, []byte("fre")),
+			ebml(mkvFlagForcedID, []byte{1}),
+		),
+	)
+	void := ebml(0xEC, make([]byte, 600))
+	cluster := ebmlUnknown(mkvClusterID, ebml(0xE7, []byte{0}))
+
+	tests := []struct {
+		name string
+		file []byte
+		err  string
+	}{
+		{name: "known sizes", file: concat(header, ebml(mkvSegmentID, info, void, tracks))},
+		{name: "unknown segment size", file: concat(header, ebmlUnknown(mkvSegmentID, info, void, tracks, cluster))},
+		{name: "unknown size element before tracks", file: concat(header, ebmlUnknown(mkvSegmentID, info, ebmlUnknown(0xEC), tracks)), err: "unknown size"},
+		{name: "unknown size tracks", file: concat(header, ebmlUnknown(mkvSegmentID, info, ebmlUnknown(mkvTracksID)), cluster), err: "too large"},
+		{name: "cluster before tracks", file: concat(header, ebmlUnknown(mkvSegmentID, info, cluster, tracks)), err: "before media data"},
+		{name: "unknown size header", file: concat(ebmlUnknown(ebmlHeaderID), ebml(mkvSegmentID, tracks)), err: "missing EBML header"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "video.mkv")
+			if err := os.WriteFile(path, test.file, 0644); err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			var probed Info
+			err = probeMatroska(file, &probed)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("probeMatroska error = %v, want one containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("probeMatroska error: %v", err)
+			}
+
+			if probed.Container != ContainerMatroska {
+				t.Errorf("Container = %q, want %q", probed.Container, ContainerMatroska)
+			}
+			if probed.DurationSeconds != 1 {
+				t.Errorf("DurationSeconds = %v, want 1", probed.DurationSeconds)
+			}
+			want := Track{Number: 1, Type: TrackSubtitle, Codec: "subrip", CodecID: "S_TEXT/UTF8", Language: "fre", Default: true, Forced: true}
+			if len(probed.Tracks) != 1 || probed.Tracks[0] != want {
+				t.Errorf("Tracks = %+v, want [%+v]", probed.Tracks, want)
+			}
+		})
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
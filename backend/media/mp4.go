@@ -0,0 +1,219 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// maxMoovSize caps how much of an MP4 movie box is read into memory
+const maxMoovSize = 64 << 20
+
+// mp4Box is a box header found while walking an MP4 file
+type mp4Box struct {
+	boxType    string
+	size       int64 // Including the header
+	headerSize int64
+}
+
+// readBoxHeader reads an MP4 box header from the current position
+func readBoxHeader(r io.Reader, remaining int64) (mp4Box, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return mp4Box{}, err
+	}
+
+	box := mp4Box{
+		boxType:    string(header[4:8]),
+		size:       int64(binary.BigEndian.Uint32(header[:4])),
+		headerSize: 8,
+	}
+	switch box.size {
+	case 0:
+		// The box runs to the end of the file
+		box.size = remaining
+	case 1:
+		// 64-bit size follows the type
+		var large [8]byte
+		if _, err := io.ReadFull(r, large[:]); err != nil {
+			return mp4Box{}, err
+		}
+		box.size = int64(binary.BigEndian.Uint64(large[:]))
+		box.headerSize = 16
+	}
+	if box.size < box.headerSize {
+		return mp4Box{}, fmt.Errorf("invalid %q box size %d", box.boxType, box.size)
+	}
+	return box, nil
+}
+
+// probeMP4 finds the movie box, wherever it is in the file, and reads the
+// duration and track list from it
+func probeMP4(file *os.File, info *Info) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Walk the top-level boxes until the movie box turns up
+	offset := int64(0)
+	for offset < stat.Size() {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		box, err := readBoxHeader(file, stat.Size()-offset)
+		if err != nil {
+			return err
+		}
+
+		if box.boxType == "moov" {
+			contentSize := box.size - box.headerSize
+			if contentSize > maxMoovSize {
+				return fmt.Errorf("movie box too large: %d bytes", contentSize)
+			}
+			moov := make([]byte, contentSize)
+			if _, err := io.ReadFull(file, moov); err != nil {
+				return err
+			}
+			return parseMoov(moov, info)
+		}
+		offset += box.size
+	}
+	return errors.New("movie box not found")
+}
+
+// mp4Children splits the content of a container box into its child boxes
+func mp4Children(data []byte) map[string][][]byte {
+	children := make(map[string][][]byte)
+	for len(data) >= 8 {
+		size := int64(binary.BigEndian.Uint32(data[:4]))
+		boxType := string(data[4:8])
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			size = int64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return children
+			}
+			size = int64(binary.BigEndian.Uint64(data[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize || size > int64(len(data)) {
+			return children
+		}
+		children[boxType] = append(children[boxType], data[headerSize:size])
+		data = data[size:]
+	}
+	return children
+}
+
+// firstChild returns the first child box of the given type, following a path of box types
+func firstChild(data []byte, path ...string) []byte {
+	for _, boxType := range path {
+		boxes := mp4Children(data)[boxType]
+		if len(boxes) == 0 {
+			return nil
+		}
+		data = boxes[0]
+	}
+	return data
+}
+
+// parseMoov reads the duration and tracks out of a movie box
+func parseMoov(moov []byte, info *Info) error {
+	children := mp4Children(moov)
+
+	// The movie header holds the overall duration
+	if mvhd := firstChild(moov, "mvhd"); len(mvhd) >= 20 {
+		var timescale, duration uint64
+		if mvhd[0] == 1 && len(mvhd) >= 32 {
+			timescale = uint64(binary.BigEndian.Uint32(mvhd[20:24]))
+			duration = binary.BigEndian.Uint64(mvhd[24:32])
+		} else {
+			timescale = uint64(binary.BigEndian.Uint32(mvhd[12:16]))
+			duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+		}
+		if timescale > 0 {
+			info.DurationSeconds = float64(duration) / float64(timescale)
+		}
+	}
+
+	for i, trak := range children["trak"] {
+		track := Track{Number: i + 1}
+
+		// Track header: track ID
+		if tkhd := firstChild(trak, "tkhd"); len(tkhd) >= 24 {
+			if tkhd[0] == 1 {
+				track.Number = int(binary.BigEndian.Uint32(tkhd[20:24]))
+			} else {
+				track.Number = int(binary.BigEndian.Uint32(tkhd[12:16]))
+			}
+			// Bit 0 of the flags marks an enabled track
+			track.Default = tkhd[3]&1 != 0
+		}
+
+		// Handler: track type
+		if hdlr := firstChild(trak, "mdia", "hdlr"); len(hdlr) >= 12 {
+			switch string(hdlr[8:12]) {
+			case "vide":
+				track.Type = TrackVideo
+			case "soun":
+				track.Type = TrackAudio
+			case "sbtl", "subt", "text", "clcp":
+				track.Type = TrackSubtitle
+			}
+		}
+		if track.Type == "" {
+			// Skip hint, metadata and timecode tracks
+			continue
+		}
+
+		// Media header: language
+		if mdhd := firstChild(trak, "mdia", "mdhd"); len(mdhd) >= 24 {
+			languageOffset := 20
+			if mdhd[0] == 1 {
+				languageOffset = 32
+			}
+			if len(mdhd) >= languageOffset+2 {
+				track.Language = mp4Language(binary.BigEndian.Uint16(mdhd[languageOffset:]))
+			}
+		}
+
+		// Sample description: codec and dimensions
+		if stsd := firstChild(trak, "mdia", "minf", "stbl", "stsd"); len(stsd) >= 16 {
+			entry := stsd[8:]
+			track.CodecID = string(entry[4:8])
+			track.Codec = mp4Codecs[track.CodecID]
+			switch {
+			case track.Type == TrackVideo && len(entry) >= 36:
+				track.Width = int(binary.BigEndian.Uint16(entry[32:34]))
+				track.Height = int(binary.BigEndian.Uint16(entry[34:36]))
+			case track.Type == TrackAudio && len(entry) >= 26:
+				track.Channels = int(binary.BigEndian.Uint16(entry[24:26]))
+			}
+		}
+
+		info.Tracks = append(info.Tracks, track)
+	}
+	return nil
+}
+
+// mp4Language decodes a packed ISO 639-2/T language code. Undetermined
+// languages are returned as an empty string.
+func mp4Language(packed uint16) string {
+	if packed == 0 || packed == 0x7FFF {
+		return ""
+	}
+	code := []byte{
+		byte(packed>>10&0x1F) + 0x60,
+		byte(packed>>5&0x1F) + 0x60,
+		byte(packed&0x1F) + 0x60,
+	}
+	if string(code) == "und" {
+		return ""
+	}
+	return string(code)
+}
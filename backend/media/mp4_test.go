@@ -0,0 +1,176 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// box encodes an MP4 box with a 32 bit size
+func box(boxType string, content ...[]byte) []byte {
+	data := bytes.Join(content, nil)
+	header := binary.BigEndian.AppendUint32(nil, uint32(8+len(data)))
+	return append(append(header, boxType...), data...)
+}
+
+// fullBox returns a zeroed version 0 box body of the given size with some
+// big-endian 32 bit fields set at their offsets
+func fullBox(size int, fields map[int]uint32) []byte {
+	data := make([]byte, size)
+	for offset, value := range fields {
+		binary.BigEndian.PutUint32(data[offset:], value)
+	}
+	return data
+}
+
+// mp4Track encodes a trak box with a handler, language and sample entry
+func mp4Track(id uint32, handler string, language uint16, entry []byte) []byte {
+	hdlr := make([]byte, 24)
+	copy(hdlr[8:], handler)
+	mdhd := fullBox(24, nil)
+	binary.BigEndian.PutUint16(mdhd[20:], language)
+	stsd := append(fullBox(8, map[int]uint32{4: 1}), entry...)
+
+	return box("trak",
+		box("tkhd", fullBox(84, map[int]uint32{0: 1, 12: id})), // Flags: enabled
+		box("mdia",
+			box("mdhd", mdhd),
+			box("hdlr", hdlr),
+			box("minf", box("stbl", box("stsd", stsd))),
+		),
+	)
+}
+
+// testMoov is a movie box with a 90 second H.264 video track, an untagged AAC
+// audio track and a hint track
+func testMoov() []byte {
+	video := make([]byte, 86)
+	binary.BigEndian.PutUint32(video, 86)
+	copy(video[4:], "avc1")
+	binary.BigEndian.PutUint16(video[32:], 1920)
+	binary.BigEndian.PutUint16(video[34:], 1080)
+
+	audio := make([]byte, 36)
+	binary.BigEndian.PutUint32(audio, 36)
+	copy(audio[4:], "mp4a")
+	binary.BigEndian.PutUint16(audio[24:], 2)
+
+	return box("moov",
+		box("mvhd", fullBox(100, map[int]uint32{12: 1000, 16: 90000})),
+		mp4Track(1, "vide", 0x15C7, video), // "eng"
+		mp4Track(2, "soun", 0x55C4, audio), // "und"
+		mp4Track(3, "hint", 0, nil),
+	)
+}
+
+func TestReadBoxHeader(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     []byte
+		remaining int64
+		want      mp4Box
+		err       bool
+	}{
+		{name: "32 bit size", input: []byte{0, 0, 0, 16, 'f', 't', 'y', 'p'}, remaining: 100, want: mp4Box{"ftyp", 16, 8}},
+		{name: "64 bit size", input: []byte{0, 0, 0, 1, 'm', 'd', 'a', 't', 0, 0, 0, 1, 0, 0, 0, 0}, remaining: 1 << 33, want: mp4Box{"mdat", 1 << 32, 16}},
+		{name: "to the end of the file", input: []byte{0, 0, 0, 0, 'm', 'd', 'a', 't'}, remaining: 500, want: mp4Box{"mdat", 500, 8}},
+		{name: "smaller than its header", input: []byte{0, 0, 0, 4, 'f', 'r', 'e', 'e'}, remaining: 100, err: true},
+		{name: "64 bit size smaller than its header", input: []byte{0, 0, 0, 1, 'm', 'd', 'a', 't', 0, 0, 0, 0, 0, 0, 0, 8}, remaining: 100, err: true},
+		{name: "truncated", input: []byte{0, 0, 0, 1, 'm', 'd', 'a', 't', 0, 0}, remaining: 100, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readBoxHeader(bytes.NewReader(test.input), test.remaining)
+			if test.err {
+				if err == nil {
+					t.Fatalf("readBoxHeader succeeded with %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readBoxHeader error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("readBoxHeader = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProbeMP4(t *testing.T) {
+	ftyp := box("ftyp", []byte("isom\x00\x00\x02\x00isomavc1"))
+	mdat := box("mdat", make([]byte, 5000))
+	largeMdat := append([]byte{0, 0, 0, 1, 'm', 'd', 'a', 't'}, binary.BigEndian.AppendUint64(nil, 16+5000)...)
+	largeMdat = append(largeMdat, make([]byte, 5000)...)
+
+	tests := []struct {
+		name string
+		file []byte
+		err  bool
+	}{
+		{name: "movie box first", file: concat(ftyp, testMoov(), mdat)},
+		{name: "movie box last", file: concat(ftyp, mdat, testMoov())},
+		{name: "after a 64 bit media box", file: concat(ftyp, largeMdat, testMoov())},
+		{name: "no movie box", file: concat(ftyp, mdat), err: true},
+		{name: "media box to the end of the file", file: concat(ftyp, []byte{0, 0, 0, 0, 'm', 'd', 'a', 't'}, make([]byte, 100)), err: true},
+		{name: "truncated movie box", file: concat(ftyp, testMoov()[:100]), err: true},
+	}
+
+	want := []Track{
+		{Number: 1, Type: TrackVideo, Codec: "h264", CodecID: "avc1", Language: "eng", Default: true, Width: 1920, Height: 1080},
+		{Number: 2, Type: TrackAudio, Codec: "aac", CodecID: "mp4a", Default: true, Channels: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "video.mp4")
+			if err := os.WriteFile(path, test.file, 0644); err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			var info Info
+			err = probeMP4(file, &info)
+			if test.err {
+				if err == nil {
+					t.Fatalf("probeMP4 succeeded with %+v, want an error", info)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("probeMP4 error: %v", err)
+			}
+			if info.DurationSeconds != 90 {
+				t.Errorf("DurationSeconds = %v, want 90", info.DurationSeconds)
+			}
+			if !reflect.DeepEqual(info.Tracks, want) {
+				t.Errorf("Tracks = %+v, want %+v", info.Tracks, want)
+			}
+		})
+	}
+}
+
+func TestMP4Language(t *testing.T) {
+	tests := []struct {
+		packed uint16
+		want   string
+	}{
+		{0x15C7, "eng"},
+		{0x1A41, "fra"},
+		{0x55C4, ""}, // und
+		{0x7FFF, ""},
+		{0, ""},
+	}
+	for _, test := range tests {
+		if got := mp4Language(test.packed); got != test.want {
+			t.Errorf("mp4Language(%#x) = %q, want %q", test.packed, got, test.want)
+		}
+	}
+}
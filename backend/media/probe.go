@@ -0,0 +1,195 @@
+// Package media identifies video containers and the tracks they hold by
+// reading file headers, without decoding any media.
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Container names returned by Probe
+const (
+	ContainerMP4       = "mp4"
+	ContainerQuickTime = "mov"
+	ContainerMatroska  = "matroska"
+	ContainerWebM      = "webm"
+	ContainerAVI       = "avi"
+	ContainerASF       = "asf"
+	ContainerFLV       = "flv"
+	ContainerMPEGTS    = "mpegts"
+	ContainerMPEGPS    = "mpeg"
+)
+
+// Track types
+const (
+	TrackVideo    = "video"
+	TrackAudio    = "audio"
+	TrackSubtitle = "subtitle"
+)
+
+// sniffLength is how many bytes are read to recognize a container
+const sniffLength = 512
+
+// Info describes a media file's container and tracks
+type Info struct {
+	Container       string
+	MimeType        string
+	DurationSeconds float64
+	Tracks          []Track
+}
+
+// Track describes one stream in a container
+type Track struct {
+	Number   int    // Track number or stream index, as used by the container
+	Type     string // TrackVideo, TrackAudio or TrackSubtitle
+	Codec    string // Normalized codec name, e.g. h264, aac, subrip
+	CodecID  string // Codec identifier as stored in the container
+	Language string
+	Name     string
+	Default  bool
+	Forced   bool
+	Width    int
+	Height   int
+	Channels int
+}
+
+// mimeTypes maps container names to the MIME type they're served as
+var mimeTypes = map[string]string{
+	ContainerMP4:       "video/mp4",
+	ContainerQuickTime: "video/quicktime",
+	ContainerMatroska:  "video/x-matroska",
+	ContainerWebM:      "video/webm",
+	ContainerAVI:       "video/x-msvideo",
+	ContainerASF:       "video/x-ms-asf",
+	ContainerFLV:       "video/x-flv",
+	ContainerMPEGTS:    "video/mp2t",
+	ContainerMPEGPS:    "video/mpeg",
+}
+
+// extensionContainers maps file extensions to the container they usually hold
+var extensionContainers = map[string]string{
+	".mp4":  ContainerMP4,
+	".m4v":  ContainerMP4,
+	".mov":  ContainerQuickTime,
+	".mkv":  ContainerMatroska,
+	".webm": ContainerWebM,
+	".avi":  ContainerAVI,
+	".wmv":  ContainerASF,
+	".asf":  ContainerASF,
+	".flv":  ContainerFLV,
+	".ts":   ContainerMPEGTS,
+	".m2ts": ContainerMPEGTS,
+	".mpg":  ContainerMPEGPS,
+	".mpeg": ContainerMPEGPS,
+}
+
+// asfHeaderGUID starts every ASF (WMV/WMA) file
+var asfHeaderGUID = []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11, 0xA6, 0xD9, 0x00, 0xAA, 0x00, 0x62, 0xCE, 0x6C}
+
+// Probe identifies a media file's container from its magic bytes, falling back
+// to its extension, and reads the track list for containers it can parse.
+// Errors while reading tracks are not fatal: the container is still reported.
+func Probe(path string) (*Info, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, header)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		// Files shorter than the sniff length are sniffed as they are
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	header = header[:n]
+
+	container := Sniff(header)
+	if container == "" {
+		container = extensionContainers[strings.ToLower(filepath.Ext(path))]
+	}
+
+	info := &Info{Container: container}
+
+	// Read the track list for the containers we understand
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	switch container {
+	case ContainerMP4, ContainerQuickTime:
+		err = probeMP4(file, info)
+	case ContainerMatroska, ContainerWebM:
+		err = probeMatroska(file, info)
+	case ContainerAVI:
+		err = probeAVI(file, info)
+	}
+
+	info.MimeType = MimeType(container, path)
+	if err != nil {
+		return info, fmt.Errorf("failed to read tracks of %s: %w", path, err)
+	}
+	return info, nil
+}
+
+// Sniff recognizes a container from the first bytes of a file. It returns an
+// empty string if the bytes match no known container.
+func Sniff(header []byte) string {
+	switch {
+	case len(header) >= 12 && string(header[4:8]) == "ftyp":
+		if string(header[8:12]) == "qt  " {
+			return ContainerQuickTime
+		}
+		return ContainerMP4
+	case len(header) >= 8 && isQuickTimeAtom(string(header[4:8])):
+		// Old QuickTime files start straight with a movie or data atom
+		return ContainerQuickTime
+	case bytes.HasPrefix(header, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		// Matroska and WebM share the EBML header; the DocType tells them apart
+		if bytes.Contains(header, []byte("webm")) {
+			return ContainerWebM
+		}
+		return ContainerMatroska
+	case len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "AVI ":
+		return ContainerAVI
+	case bytes.HasPrefix(header, asfHeaderGUID):
+		return ContainerASF
+	case bytes.HasPrefix(header, []byte("FLV\x01")):
+		return ContainerFLV
+	case len(header) > 188 && header[0] == 0x47 && header[188] == 0x47:
+		return ContainerMPEGTS
+	case bytes.HasPrefix(header, []byte{0x00, 0x00, 0x01, 0xBA}):
+		return ContainerMPEGPS
+	}
+	return ""
+}
+
+// MimeType returns the MIME type for a container. Unknown containers fall back
+// to the file extension, then to a generic binary type.
+func MimeType(container, path string) string {
+	if container == ContainerASF && strings.EqualFold(filepath.Ext(path), ".wmv") {
+		return "video/x-ms-wmv"
+	}
+	if mimeType, ok := mimeTypes[container]; ok {
+		return mimeType
+	}
+	if mimeType, ok := mimeTypes[extensionContainers[strings.ToLower(filepath.Ext(path))]]; ok {
+		return mimeType
+	}
+	return "application/octet-stream"
+}
+
+// isQuickTimeAtom reports whether a box type can start a QuickTime file without ftyp
+func isQuickTimeAtom(boxType string) bool {
+	switch boxType {
+	case "moov", "mdat", "free", "wide", "skip", "pnot":
+		return true
+	}
+	return false
+}
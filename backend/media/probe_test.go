@@ -0,0 +1,102 @@
+package media
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSniff(t *testing.T) {
+	transportStream := make([]byte, 189)
+	transportStream[0], transportStream[188] = 0x47, 0x47
+
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{name: "mp4", header: []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00"), want: ContainerMP4},
+		{name: "quicktime brand", header: []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00"), want: ContainerQuickTime},
+		{name: "quicktime without ftyp", header: []byte("\x00\x00\x00\x08wide\x00\x00\x10\x00mdat"), want: ContainerQuickTime},
+		{name: "matroska", header: []byte("\x1A\x45\xDF\xA3\x9F\x42\x82\x88matroska"), want: ContainerMatroska},
+		{name: "webm", header: []byte("\x1A\x45\xDF\xA3\x9F\x42\x82\x84webm"), want: ContainerWebM},
+		{name: "avi", header: []byte("RIFF\x00\x10\x00\x00AVI LIST"), want: ContainerAVI},
+		{name: "wave is not avi", header: []byte("RIFF\x00\x10\x00\x00WAVEfmt "), want: ""},
+		{name: "asf", header: append(append([]byte{}, asfHeaderGUID...), 0, 0), want: ContainerASF},
+		{name: "flv", header: []byte("FLV\x01\x05\x00\x00\x00\x09"), want: ContainerFLV},
+		{name: "mpeg transport stream", header: transportStream, want: ContainerMPEGTS},
+		{name: "one sync byte is not enough", header: transportStream[:188], want: ""},
+		{name: "mpeg program stream", header: []byte{0x00, 0x00, 0x01, 0xBA, 0x44}, want: ContainerMPEGPS},
+		{name: "text", header: []byte("1\n00:00:01,000 --> 00:00:02,000\n"), want: ""},
+		{name: "empty", header: nil, want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Sniff(test.header); got != test.want {
+				t.Errorf("Sniff = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMimeType(t *testing.T) {
+	tests := []struct {
+		container string
+		path      string
+		want      string
+	}{
+		{ContainerMP4, "episode.mp4", "video/mp4"},
+		{ContainerMatroska, "episode.webm", "video/x-matroska"},
+		{ContainerASF, "episode.wmv", "video/x-ms-wmv"},
+		{ContainerASF, "episode.asf", "video/x-ms-asf"},
+		{"", "episode.MKV", "video/x-matroska"},
+		{"", "episode.bin", "application/octet-stream"},
+	}
+	for _, test := range tests {
+		if got := MimeType(test.container, test.path); got != test.want {
+			t.Errorf("MimeType(%q, %q) = %q, want %q", test.container, test.path, got, test.want)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		data      []byte
+		container string
+		mimeType  string
+		tracks    int
+		err       bool
+	}{
+		{name: "mp4", file: "a.mkv", data: concat(box("ftyp", []byte("isom")), testMoov()), container: ContainerMP4, mimeType: "video/mp4", tracks: 2},
+		{name: "avi", file: "a.avi", data: testAVI(), container: ContainerAVI, mimeType: "video/x-msvideo", tracks: 3},
+		{name: "unrecognized contents use the extension", file: "a.ts", data: []byte("not a video"), container: ContainerMPEGTS, mimeType: "video/mp2t"},
+		{name: "unknown", file: "a.bin", data: []byte("not a video"), mimeType: "application/octet-stream"},
+		{name: "container kept when tracks can't be read", file: "a.mkv", data: []byte("\x1A\x45\xDF\xA3\x84matr"), container: ContainerMatroska, mimeType: "video/x-matroska", err: true},
+		{name: "empty", file: "a.mp4", data: nil, container: ContainerMP4, mimeType: "video/mp4", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), test.file)
+			if err := os.WriteFile(path, test.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := Probe(path)
+			if (err != nil) != test.err {
+				t.Fatalf("Probe error = %v, want error: %v", err, test.err)
+			}
+			if info.Container != test.container || info.MimeType != test.mimeType || len(info.Tracks) != test.tracks {
+				t.Errorf("Probe = %s, %s, %d tracks; want %s, %s, %d tracks",
+					info.Container, info.MimeType, len(info.Tracks), test.container, test.mimeType, test.tracks)
+			}
+		})
+	}
+
+	if _, err := Probe(filepath.Join(t.TempDir(), "missing.mp4")); err == nil {
+		t.Error("Probe of a missing file succeeded")
+	}
+}
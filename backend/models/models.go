@@ -2,28 +2,313 @@ package models
 
 // EpisodeInfo represents a single episode's information
 type EpisodeInfo struct {
-	ID          string `json:"id"`          // e.g., "Show_S01E01"
-	Title       string `json:"title"`       // Optional: "The First Episode"
-	VideoURL    string `json:"videoUrl"`
-	SubtitleURL string `json:"subtitleUrl"` // URL for the .srt or .vtt file
+	ID                    string          `json:"id"`    // e.g., "Show_S01E01"
+	Title                 string          `json:"title"` // Optional: "The First Episode"
+	VideoURL              string          `json:"videoUrl"`
+	SubtitleURL           string          `json:"subtitleUrl"`                     // URL for the .srt or .vtt file
+	HLSURL                string          `json:"hlsUrl,omitempty"`                // HLS master playlist, set when serving
+	AudioURL              string          `json:"audioUrl,omitempty"`              // Audio-only MP3 stream, set when serving
+	Subtitles             []SubtitleTrack `json:"subtitles,omitempty"`             // Found next to the video or in the subtitles tree, never stored
+	Markers               *EpisodeMarkers `json:"markers,omitempty"`               // Optional: intro, recap and credits positions
+	SubtitleOffsetSeconds *float64        `json:"subtitleOffsetSeconds,omitempty"` // Optional: delays subtitles, overrides the season offset
+	Media                 *MediaInfo      `json:"media,omitempty"`                 // Detected from the video file, never stored
+}
+
+// SeasonCatalog is the object form of a season JSON file, for seasons with
+// settings of their own. Season files without settings are a plain episode array.
+type SeasonCatalog struct {
+	SubtitleOffsetSeconds *float64      `json:"subtitleOffsetSeconds,omitempty"` // Default for the season's episodes
+	Episodes              []EpisodeInfo `json:"episodes"`
+}
+
+// SubtitleOffset describes how much an episode's subtitles are delayed. Negative
+// offsets show them earlier.
+type SubtitleOffset struct {
+	EpisodeID            string   `json:"episodeId"`
+	OffsetSeconds        float64  `json:"offsetSeconds"`                  // The offset applied when serving
+	EpisodeOffsetSeconds *float64 `json:"episodeOffsetSeconds,omitempty"` // Set for this episode
+	SeasonOffsetSeconds  *float64 `json:"seasonOffsetSeconds,omitempty"`  // Default of the episode's season file
+}
+
+// SubtitleOffsetRequest represents the body of a subtitle offset change
+type SubtitleOffsetRequest struct {
+	OffsetSeconds *float64 `json:"offsetSeconds"`    // null clears the offset
+	Season        bool     `json:"season,omitempty"` // Set the season default instead of the episode's offset
+}
+
+// SubtitleNudgeRequest represents the body of a subtitle offset nudge
+type SubtitleNudgeRequest struct {
+	DeltaSeconds float64 `json:"deltaSeconds"`
+}
+
+// SubtitleTrack is one of an episode's subtitle files
+type SubtitleTrack struct {
+	ID       string `json:"id"`                 // Language and flags, e.g. "en" or "fr.forced"; "und" for untagged files; "embedded-N" for tracks of the video file
+	Language string `json:"language,omitempty"` // e.g. "en" or "pt-BR"; empty for untagged files
+	Label    string `json:"label"`              // e.g. "French (Forced)"
+	Format   string `json:"format"`             // srt, vtt, ass or ssa
+	Forced   bool   `json:"forced"`             // Only covers foreign dialogue and on-screen text
+	SDH      bool   `json:"sdh"`                // Includes sound descriptions for the deaf and hard of hearing
+	Default  bool   `json:"default"`            // The track subtitleUrl points to
+	Embedded bool   `json:"embedded,omitempty"` // Extracted from the video file
+	URL      string `json:"url"`
+}
+
+// MediaInfo describes the container and tracks of an episode's video file, so
+// clients can tell whether they can play it directly
+type MediaInfo struct {
+	Container       string       `json:"container"` // e.g. "mp4", "matroska", "avi"
+	MimeType        string       `json:"mimeType"`
+	DurationSeconds float64      `json:"durationSeconds,omitempty"`
+	VideoCodec      string       `json:"videoCodec,omitempty"`  // Codec of the first video track
+	AudioCodecs     []string     `json:"audioCodecs,omitempty"` // Codecs of every audio track
+	Tracks          []MediaTrack `json:"tracks,omitempty"`
+}
+
+// MediaTrack describes one stream in a video file
+type MediaTrack struct {
+	Index    int    `json:"index"` // Position among the tracks of the same type
+	Type     string `json:"type"`  // "video", "audio" or "subtitle"
+	Codec    string `json:"codec,omitempty"`
+	CodecID  string `json:"codecId,omitempty"`
+	Language string `json:"language,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Default  bool   `json:"default,omitempty"`
+	Forced   bool   `json:"forced,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	Channels int    `json:"channels,omitempty"`
+}
+
+// EpisodeMarkers holds an episode's optional chapter markers, in seconds from the start
+type EpisodeMarkers struct {
+	IntroStartSeconds   *float64 `json:"introStartSeconds,omitempty"`
+	IntroEndSeconds     *float64 `json:"introEndSeconds,omitempty"`
+	RecapStartSeconds   *float64 `json:"recapStartSeconds,omitempty"`
+	RecapEndSeconds     *float64 `json:"recapEndSeconds,omitempty"`
+	CreditsStartSeconds *float64 `json:"creditsStartSeconds,omitempty"`
 }
 
 // ShowInfoResponse represents the overall show information and current state
 type ShowInfoResponse struct {
-	Episodes             []EpisodeInfo `json:"episodes"`
-	CurrentEpisodeID     string        `json:"currentEpisodeId"`
-	PlaybackTimeSeconds  int64         `json:"playbackTimeSeconds"`
+	ShowID              string        `json:"showId"`
+	ProfileID           string        `json:"profileId,omitempty"`
+	Episodes            []EpisodeInfo `json:"episodes"`
+	CurrentEpisodeID    string        `json:"currentEpisodeId"`
+	PlaybackTimeSeconds int64         `json:"playbackTimeSeconds"`
+	Revision            int64         `json:"revision"` // Playback state revision, also sent as the ETag
+	PlaybackMode        string        `json:"playbackMode"`
+	Favorites           []string      `json:"favorites"`
+	RadioURL            string        `json:"radioUrl,omitempty"`  // Continuous audio stream, for keys that may control playback
+	EventsURL           string        `json:"eventsUrl,omitempty"` // Server-Sent Events or WebSocket stream of state changes
 }
 
 // PlaybackStateUpdateRequest represents the state to be sent to the server
 type PlaybackStateUpdateRequest struct {
 	EpisodeID           string `json:"episodeId"`
 	PlaybackTimeSeconds int64  `json:"playbackTimeSeconds"`
+	DurationSeconds     int64  `json:"durationSeconds,omitempty"` // Optional: used to detect finished episodes
+	Finished            bool   `json:"finished,omitempty"`        // Optional: the client reached the end of the episode
+	BaseRevision        *int64 `json:"baseRevision,omitempty"`    // Optional: only update if the state is still at this revision
+}
+
+// PlaybackStateResponse is a profile's playback state after an update. It's
+// also sent with 409 Conflict when the update was based on an old revision.
+type PlaybackStateResponse struct {
+	Success             bool   `json:"success"`
+	Revision            int64  `json:"revision"`
+	CurrentEpisodeID    string `json:"currentEpisodeId"`
+	PlaybackTimeSeconds int64  `json:"playbackTimeSeconds"`
+	LastUpdated         int64  `json:"lastUpdated"`
 }
 
+// Playback modes decide which episode comes next
+const (
+	PlaybackModeSequential        = "sequential"
+	PlaybackModeShuffle           = "shuffle"
+	PlaybackModeShuffleNoRepeat   = "shuffle-no-repeat-until-all-seen"
+	PlaybackModeFavoritesWeighted = "favorites-weighted"
+)
+
 // ServerState represents the server's current state
 type ServerState struct {
-	CurrentEpisodeID    string `json:"currentEpisodeId"`
+	CurrentEpisodeID    string   `json:"currentEpisodeId"`
+	PlaybackTimeSeconds int64    `json:"playbackTimeSeconds"`
+	LastUpdated         int64    `json:"lastUpdated"`            // Unix timestamp
+	Revision            int64    `json:"revision,omitempty"`     // Goes up with every change
+	PlaybackMode        string   `json:"playbackMode,omitempty"` // Empty means sequential
+	ShuffleQueue        []string `json:"shuffleQueue,omitempty"` // Episodes not yet seen in the current shuffle cycle
+	RecentEpisodes      []string `json:"recentEpisodes,omitempty"`
+	Favorites           []string `json:"favorites,omitempty"`
+}
+
+// LibraryScanResult summarizes what a library scan found and wrote
+type LibraryScanResult struct {
+	ShowID        string   `json:"showId"`
+	EpisodesFound int      `json:"episodesFound"`
+	Added         int      `json:"added"`
+	FilesWritten  []string `json:"filesWritten"`
+	Unrecognized  []string `json:"unrecognized"`
+}
+
+// ShowSummary describes a show in the library
+type ShowSummary struct {
+	ID               string `json:"id"`
+	Name             string `json:"name"`
+	Default          bool   `json:"default"`
+	EpisodeCount     int    `json:"episodeCount"`
+	CurrentEpisodeID string `json:"currentEpisodeId"`
+}
+
+// PersistedState is the content of a state file. The default profile's state sits
+// at the top level so state files written before profiles existed still load.
+type PersistedState struct {
+	ServerState
+	Profiles map[string]ServerState `json:"profiles,omitempty"`
+}
+
+// Profile represents a named viewer with their own playback state
+type Profile struct {
+	ID               string `json:"id"`
+	Name             string `json:"name"`
+	CreatedAt        int64  `json:"createdAt"`                  // Unix timestamp
+	SubtitleLanguage string `json:"subtitleLanguage,omitempty"` // Preferred subtitle language, e.g. "en"
+}
+
+// PlaybackModeRequest represents the body of a playback mode change
+type PlaybackModeRequest struct {
+	Mode string `json:"mode"`
+}
+
+// CreateProfileRequest represents the body of a profile creation request
+type CreateProfileRequest struct {
+	Name             string `json:"name"`
+	SubtitleLanguage string `json:"subtitleLanguage,omitempty"`
+}
+
+// ProfilePreferencesRequest represents the body of a profile preferences update
+type ProfilePreferencesRequest struct {
+	SubtitleLanguage string `json:"subtitleLanguage"` // Empty clears the preference
+}
+
+// History event types
+const (
+	HistoryEventStarted  = "started"
+	HistoryEventFinished = "finished"
+)
+
+// HistoryEvent is a single entry of the watch history log
+type HistoryEvent struct {
+	Type            string `json:"type"` // "started" or "finished"
+	ShowID          string `json:"showId"`
+	ProfileID       string `json:"profileId,omitempty"`
+	EpisodeID       string `json:"episodeId"`
+	Timestamp       int64  `json:"timestamp"` // Unix timestamp
+	PositionSeconds int64  `json:"positionSeconds"`
+	FurthestSeconds int64  `json:"furthestSeconds"`
+}
+
+// EpisodeProgress is a profile's progress through a single episode
+type EpisodeProgress struct {
+	EpisodeID       string `json:"episodeId"`
+	ShowID          string `json:"showId"`
+	PositionSeconds int64  `json:"positionSeconds"` // Last reported position, kept once finished
+	FurthestSeconds int64  `json:"furthestSeconds"` // Furthest position reached in the current viewing
+	DurationSeconds int64  `json:"durationSeconds,omitempty"`
+	Finished        bool   `json:"finished"`    // The current viewing reached the end
+	WatchCount      int    `json:"watchCount"`  // Number of times the episode was finished
+	LastWatched     int64  `json:"lastWatched"` // Unix timestamp
+}
+
+// IntroDetectionResult is the outcome of intro detection for one episode
+type IntroDetectionResult struct {
+	EpisodeID         string  `json:"episodeId"`
+	Season            int     `json:"season"`
+	Found             bool    `json:"found"`
+	IntroStartSeconds float64 `json:"introStartSeconds"`
+	IntroEndSeconds   float64 `json:"introEndSeconds"`
+	Confidence        float64 `json:"confidence"` // Between 0 and 1
+	Written           bool    `json:"written"`    // The markers were saved to the catalog
+	Skipped           bool    `json:"skipped"`    // The episode already had intro markers, which were kept
+	Error             string  `json:"error,omitempty"`
+}
+
+// API key scopes, from least to most privileged. Each scope includes the ones before it.
+const (
+	ScopeRead     = "read"     // Read show info and stream episodes
+	ScopePlayback = "playback" // Also update playback state
+	ScopeAdmin    = "admin"    // Also manage the library, profiles and keys
+)
+
+// APIKey is an API key as stored in the keys file. Only the hash of the key is kept.
+type APIKey struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Scope     string `json:"scope"`
+	Hash      string `json:"hash,omitempty"`      // Hex SHA-256 of the key
+	CreatedAt int64  `json:"createdAt"`           // Unix timestamp
+	RevokedAt int64  `json:"revokedAt,omitempty"` // Unix timestamp
+}
+
+// CreateAPIKeyRequest represents the body of an API key creation request
+type CreateAPIKeyRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+// CreateAPIKeyResponse is returned once when a key is created. The key itself
+// can't be retrieved later.
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// SearchResult is a subtitle line matching a search, with the lines around it
+type SearchResult struct {
+	ShowID              string   `json:"showId"`
+	EpisodeID           string   `json:"episodeId"`
+	EpisodeTitle        string   `json:"episodeTitle,omitempty"`
+	Language            string   `json:"language,omitempty"` // Language of the subtitle track; empty for untagged files
+	StartSeconds        float64  `json:"startSeconds"`       // When the line appears in the video, subtitle offset included
+	EndSeconds          float64  `json:"endSeconds"`
+	PlaybackTimeSeconds int64    `json:"playbackTimeSeconds"` // Start in whole seconds, ready for a playback state update
+	Text                string   `json:"text"`                // The matching line, or two lines if the match spans them
+	Before              []string `json:"before"`              // Lines shown before, oldest first
+	After               []string `json:"after"`               // Lines shown after
+	Score               int      `json:"score"`               // Higher for exact phrases and matches within one line
+}
+
+// SearchResponse is the result of a subtitle search
+type SearchResponse struct {
+	Query   string         `json:"query"`
+	Total   int            `json:"total"` // Matches found, before the limit
+	Results []SearchResult `json:"results"`
+}
+
+// StateFlushStatus tells how far the state on disk lags behind the state in memory
+type StateFlushStatus struct {
+	LastFlushed          int64 `json:"lastFlushed,omitempty"` // Unix time of the last write, if any
+	Pending              int   `json:"pending"`               // Documents changed since they were last written
+	FlushIntervalSeconds int64 `json:"flushIntervalSeconds"`
+}
+
+// Show event types
+const (
+	ShowEventState   = "state"   // A profile's playback state changed
+	ShowEventEpisode = "episode" // A profile moved to another episode
+	ShowEventCatalog = "catalog" // The show's episodes were rescanned or edited
+)
+
+// ShowEvent is pushed to clients following a show. State and episode events
+// carry the profile's new state; catalog events only name the edited episode,
+// if there is one, and clients fetch the show info again.
+type ShowEvent struct {
+	Type                string `json:"type"`
+	ShowID              string `json:"showId"`
+	ProfileID           string `json:"profileId,omitempty"`
+	EpisodeID           string `json:"episodeId,omitempty"`
 	PlaybackTimeSeconds int64  `json:"playbackTimeSeconds"`
-	LastUpdated         int64  `json:"lastUpdated"` // Unix timestamp
+	PlaybackMode        string `json:"playbackMode,omitempty"`
+	Revision            int64  `json:"revision"`
+	Timestamp           int64  `json:"timestamp"` // Unix timestamp
 }
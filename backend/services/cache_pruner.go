@@ -0,0 +1,115 @@
+package services
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"comfort-player-backend/config"
+)
+
+// Directories under CACHE_DIR holding generated media
+const (
+	transcodeCacheName = "transcode"
+	hlsCacheName       = "hls"
+)
+
+// CachePruner trims the transcode and HLS caches to a maximum size, deleting
+// the least recently used files first. Cache hits should touch their file so
+// it counts as recently used.
+type CachePruner struct {
+	dirs    []string
+	maxSize int64
+	mutex   sync.Mutex
+	// size is the size of the caches at the last walk plus the files added
+	// since, so Added only walks them once they may have outgrown maxSize
+	size   int64
+	walked bool
+}
+
+// NewCachePruner creates a pruner for the generated media under CACHE_DIR,
+// which together may take up TRANSCODE_CACHE_MAX_MB
+func NewCachePruner(config *config.Config) *CachePruner {
+	return &CachePruner{
+		dirs: []string{
+			filepath.Join(config.CacheDir, transcodeCacheName),
+			filepath.Join(config.CacheDir, hlsCacheName),
+		},
+		maxSize: config.TranscodeCacheMaxMB << 20,
+	}
+}
+
+// Added records a file of the given size added to the caches, and prunes them
+// if that may take them past their maximum size. Unlike Prune it doesn't walk
+// the caches every time, so it suits files added often, such as HLS segments.
+func (p *CachePruner) Added(size int64) {
+	if p == nil || p.maxSize <= 0 {
+		return
+	}
+
+	p.mutex.Lock()
+	if p.walked {
+		p.size += size
+		if p.size <= p.maxSize {
+			p.mutex.Unlock()
+			return
+		}
+	}
+	p.mutex.Unlock()
+	p.Prune()
+}
+
+// Prune deletes the least recently used files until the caches fit their
+// maximum size. Files still being written, ending in .tmp, are left alone.
+func (p *CachePruner) Prune() {
+	if p == nil || p.maxSize <= 0 {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	type cachedFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []cachedFile
+	var total int64
+	for _, dir := range p.dirs {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || filepath.Ext(path) == ".tmp" {
+				return nil
+			}
+			files = append(files, cachedFile{path: path, size: info.Size(), modTime: info.ModTime()})
+			total += info.Size()
+			return nil
+		})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, file := range files {
+		if total <= p.maxSize {
+			break
+		}
+		log.Printf("CachePruner.Prune: Removing %s from the cache", file.path)
+		if err := os.Remove(file.path); err != nil {
+			log.Printf("CachePruner.Prune: Error removing %s: %v", file.path, err)
+			continue
+		}
+		total -= file.size
+	}
+	p.size = total
+	p.walked = true
+}
+
+// touchCached marks a cached file as recently used so pruning keeps it
+func touchCached(path string) {
+	now := time.Now()
+	os.Chtimes(path, now, now)
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"comfort-player-backend/utils"
+)
+
+func TestCachePrunerAdded(t *testing.T) {
+	dir := t.TempDir()
+	pruner := &CachePruner{dirs: []string{dir}, maxSize: 100}
+
+	// add writes a cached file, each one more recently used than the last
+	modTime := time.Now().Add(-time.Hour)
+	add := func(name string, size int) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(strings.Repeat("x", size)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Minute)
+		os.Chtimes(path, modTime, modTime)
+		pruner.Added(int64(size))
+	}
+
+	add("first", 60)
+	add("second", 30)
+
+	// A file the pruner wasn't told about is only noticed at the next walk
+	if err := os.WriteFile(filepath.Join(dir, "unknown"), []byte(strings.Repeat("x", 5)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	add("third", 5)
+	if !utils.FileExists(filepath.Join(dir, "first")) {
+		t.Fatal("first was pruned before the tracked size passed the limit")
+	}
+
+	// Passing the limit walks the caches and removes the oldest files
+	add("fourth", 30)
+	for name, want := range map[string]bool{"first": false, "second": true, "third": true, "unknown": true, "fourth": true} {
+		if got := utils.FileExists(filepath.Join(dir, name)); got != want {
+			t.Errorf("%s kept = %v, want %v", name, got, want)
+		}
+	}
+	if pruner.size != 70 {
+		t.Errorf("tracked size = %d, want 70", pruner.size)
+	}
+}
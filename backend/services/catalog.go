@@ -0,0 +1,187 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"comfort-player-backend/models"
+	"comfort-player-backend/utils"
+)
+
+// catalogFile is a single season JSON file and the episodes it holds
+type catalogFile struct {
+	path     string
+	episodes []models.EpisodeInfo
+	// Subtitle offset for every episode in the file that doesn't set its own
+	subtitleOffset *float64
+	dirty          bool
+}
+
+// catalog is the set of season JSON files found in a seasons directory
+type catalog struct {
+	dir   string
+	files []*catalogFile
+	byID  map[string]*catalogFile
+}
+
+// loadCatalog reads every season JSON file found in dir
+func loadCatalog(dir string) (*catalog, error) {
+	c := &catalog{
+		dir:  dir,
+		byID: make(map[string]*catalogFile),
+	}
+
+	// Return an empty catalog if the directory doesn't exist
+	if !utils.FileExists(dir) {
+		log.Printf("loadCatalog: Seasons directory not found: %s", dir)
+		return c, nil
+	}
+
+	// Find all JSON files in the seasons directory
+	jsonFiles, err := utils.FindFiles(dir, "*.json")
+	if err != nil {
+		log.Printf("loadCatalog: Error finding JSON files: %v", err)
+		return nil, fmt.Errorf("failed to find JSON files: %w", err)
+	}
+	sort.Strings(jsonFiles)
+
+	log.Printf("loadCatalog: Found %d JSON files", len(jsonFiles))
+
+	// Process each JSON file
+	for _, jsonFile := range jsonFiles {
+		// Read JSON file
+		file, err := readCatalogFile(jsonFile)
+		if err != nil {
+			log.Printf("loadCatalog: Error reading JSON file %s: %v", jsonFile, err)
+			// Skip files that can't be read or parsed
+			continue
+		}
+
+		log.Printf("loadCatalog: Found %d episodes in %s", len(file.episodes), jsonFile)
+
+		c.files = append(c.files, file)
+		for _, episode := range file.episodes {
+			if _, exists := c.byID[episode.ID]; !exists {
+				c.byID[episode.ID] = file
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// readCatalogFile reads a season file, either a plain episode array or a
+// models.SeasonCatalog object
+func readCatalogFile(path string) (*catalogFile, error) {
+	var raw json.RawMessage
+	if err := utils.ReadJSON(path, &raw); err != nil {
+		return nil, err
+	}
+
+	file := &catalogFile{path: path}
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '{' {
+		var season models.SeasonCatalog
+		if err := json.Unmarshal(raw, &season); err != nil {
+			return nil, err
+		}
+		file.episodes = season.Episodes
+		file.subtitleOffset = season.SubtitleOffsetSeconds
+		return file, nil
+	}
+
+	if err := json.Unmarshal(raw, &file.episodes); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// episodes returns every episode in the catalog
+func (c *catalog) episodes() []models.EpisodeInfo {
+	var episodes []models.EpisodeInfo
+	for _, file := range c.files {
+		episodes = append(episodes, file.episodes...)
+	}
+	return episodes
+}
+
+// find returns a pointer to the stored episode with the given ID
+func (c *catalog) find(episodeID string) (*models.EpisodeInfo, *catalogFile) {
+	file, ok := c.byID[episodeID]
+	if !ok {
+		return nil, nil
+	}
+	for i := range file.episodes {
+		if file.episodes[i].ID == episodeID {
+			return &file.episodes[i], file
+		}
+	}
+	return nil, nil
+}
+
+// fileNamed returns the season file with the given name, or nil if there is none
+func (c *catalog) fileNamed(fileName string) *catalogFile {
+	path := filepath.Join(c.dir, fileName)
+	for _, file := range c.files {
+		if file.path == path {
+			return file
+		}
+	}
+	return nil
+}
+
+// add inserts an episode into the season file with the given name, creating it
+// if needed. It goes before the first episode with a later ID, so a sorted file
+// stays sorted and a file ordered by hand keeps its order.
+func (c *catalog) add(fileName string, episode models.EpisodeInfo) {
+	file := c.fileNamed(fileName)
+	if file == nil {
+		file = &catalogFile{path: filepath.Join(c.dir, fileName)}
+		c.files = append(c.files, file)
+	}
+
+	position := len(file.episodes)
+	for i, existing := range file.episodes {
+		if existing.ID > episode.ID {
+			position = i
+			break
+		}
+	}
+	file.episodes = append(file.episodes, models.EpisodeInfo{})
+	copy(file.episodes[position+1:], file.episodes[position:])
+	file.episodes[position] = episode
+	file.dirty = true
+	c.byID[episode.ID] = file
+}
+
+// save writes every modified season file back to disk and returns their paths.
+// Episodes are written in the order they're in.
+func (c *catalog) save() ([]string, error) {
+	var written []string
+	for _, file := range c.files {
+		if !file.dirty {
+			continue
+		}
+
+		// Only seasons with settings need the object form
+		var content interface{} = file.episodes
+		if file.subtitleOffset != nil {
+			content = models.SeasonCatalog{
+				SubtitleOffsetSeconds: file.subtitleOffset,
+				Episodes:              file.episodes,
+			}
+		}
+
+		log.Printf("catalog.save: Writing %d episodes to %s", len(file.episodes), file.path)
+		if err := utils.WriteJSON(file.path, content); err != nil {
+			log.Printf("catalog.save: Error writing %s: %v", file.path, err)
+			return written, fmt.Errorf("failed to write %s: %w", file.path, err)
+		}
+		file.dirty = false
+		written = append(written, file.path)
+	}
+	return written, nil
+}
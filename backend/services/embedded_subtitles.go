@@ -0,0 +1,222 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"comfort-player-backend/media"
+	"comfort-player-backend/models"
+	"comfort-player-backend/subtitles"
+	"comfort-player-backend/utils"
+)
+
+// extractTimeout bounds how long ffmpeg may take to pull a subtitle track out of
+// a video file, which means reading the whole file
+const extractTimeout = 10 * time.Minute
+
+// ErrSubtitleExtraction is returned when an embedded subtitle track can't be extracted
+var ErrSubtitleExtraction = errors.New("failed to extract subtitle")
+
+// extractJob is an embedded subtitle track being extracted. Requests for the
+// same track wait for it.
+type extractJob struct {
+	done chan struct{}
+	err  error
+}
+
+// embeddedSubtitle is a text subtitle track inside a video file
+type embeddedSubtitle struct {
+	videoPath string
+	index     int    // Position among the file's subtitle tracks, as ffmpeg counts them
+	codec     string // Codec name from the probe, e.g. subrip or ass
+}
+
+// embeddedSubtitleFiles lists the text subtitle tracks of a video file. Image
+// based tracks such as PGS can't be converted and are left out. Without probe,
+// only a file probed before is looked at.
+func (s *ShowService) embeddedSubtitleFiles(episodeID, videoPath string, probe bool) []subtitleFile {
+	var info *models.MediaInfo
+	if probe {
+		probed, err := s.mediaInfo.probeEpisode(episodeID, videoPath)
+		if err != nil {
+			return nil
+		}
+		info = probed
+	} else if cached, ok := s.mediaInfo.cachedEpisode(episodeID); ok {
+		info = cached
+	} else {
+		return nil
+	}
+
+	var files []subtitleFile
+	for _, mediaTrack := range info.Tracks {
+		if mediaTrack.Type != media.TrackSubtitle || !media.IsTextSubtitle(mediaTrack.Codec) {
+			continue
+		}
+
+		track := models.SubtitleTrack{
+			Forced: mediaTrack.Forced,
+			SDH:    isSDHTrackName(mediaTrack.Name),
+		}
+		if language, ok := subtitles.NormalizeLanguage(mediaTrack.Language); ok {
+			track.Language = language
+		}
+		track = finishTrack(track)
+		track.ID = fmt.Sprintf("embedded-%d", mediaTrack.Index)
+		track.Label += " - Embedded"
+		track.Format = extractedFormat(mediaTrack.Codec)
+		track.Embedded = true
+		track.URL = fmt.Sprintf("/api/episode/%s/subtitle/%s", episodeID, track.ID)
+
+		files = append(files, subtitleFile{
+			track:    track,
+			embedded: &embeddedSubtitle{videoPath: videoPath, index: mediaTrack.Index, codec: mediaTrack.Codec},
+		})
+	}
+	return files
+}
+
+// isSDHTrackName reports whether a track name marks subtitles for the deaf and hard of hearing
+func isSDHTrackName(name string) bool {
+	name = strings.ToLower(name)
+	return strings.Contains(name, "sdh") || strings.Contains(name, "hearing")
+}
+
+// extractedFormat returns the format an embedded track is extracted as. ASS
+// tracks keep their styling; everything else becomes SubRip.
+func extractedFormat(codec string) string {
+	switch codec {
+	case "ass", "ssa":
+		return subtitles.FormatASS
+	case "webvtt":
+		return subtitles.FormatVTT
+	}
+	return subtitles.FormatSRT
+}
+
+// subtitleFilePath returns the path of a subtitle track, extracting embedded
+// tracks from the video file first
+func (s *ShowService) subtitleFilePath(episodeID string, file subtitleFile) (string, error) {
+	if file.embedded == nil {
+		return file.path, nil
+	}
+	return s.extractSubtitle(episodeID, file)
+}
+
+// extractedSubtitlePath returns where an embedded track is cached once
+// extracted. The name changes when the video file does.
+func (s *ShowService) extractedSubtitlePath(episodeID string, file subtitleFile) (string, error) {
+	stat, err := os.Stat(file.embedded.videoPath)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", file.embedded.videoPath, stat.Size(), stat.ModTime().UnixNano())))
+	name := fmt.Sprintf("%s-%d.%s", hex.EncodeToString(hash[:8]), file.embedded.index, file.track.Format)
+	return filepath.Join(s.config.CacheDir, "subtitles", episodeID, name), nil
+}
+
+// extractSubtitle returns the path of an extracted embedded subtitle track,
+// extracting it if it isn't cached. Requests for a track that's being
+// extracted wait for that extraction.
+func (s *ShowService) extractSubtitle(episodeID string, file subtitleFile) (string, error) {
+	path, err := s.extractedSubtitlePath(episodeID, file)
+	if err != nil {
+		return "", err
+	}
+	if utils.FileExists(path) {
+		log.Printf("extractSubtitle: Using cached track %s", path)
+		return path, nil
+	}
+
+	// Join an extraction already running for this track, or start one. The
+	// track may have been extracted since it was looked for.
+	s.extractMutex.Lock()
+	job, running := s.extractJobs[path]
+	if !running {
+		if utils.FileExists(path) {
+			s.extractMutex.Unlock()
+			return path, nil
+		}
+		if err := s.jobs.Err(); err != nil {
+			s.extractMutex.Unlock()
+			return "", fmt.Errorf("%w: %v", ErrSubtitleExtraction, err)
+		}
+		job = &extractJob{done: make(chan struct{})}
+		s.extractJobs[path] = job
+		s.extracting.Add(1)
+	}
+	s.extractMutex.Unlock()
+
+	if !running {
+		job.err = s.runExtraction(episodeID, file, path)
+		s.extractMutex.Lock()
+		delete(s.extractJobs, path)
+		s.extractMutex.Unlock()
+		close(job.done)
+		s.extracting.Done()
+	}
+
+	<-job.done
+	if job.err != nil {
+		return "", job.err
+	}
+	return path, nil
+}
+
+// runExtraction extracts an embedded subtitle track with ffmpeg and caches it
+// at path. Extraction isn't tied to the request, so if the client gives up a
+// retry still finds the track cached. It waits for a free worker and stops
+// when the show's jobs are stopped.
+func (s *ShowService) runExtraction(episodeID string, file subtitleFile, path string) error {
+	ctx, cancel := context.WithTimeout(s.jobs, extractTimeout)
+	defer cancel()
+	if err := s.pool.Acquire(ctx); err != nil {
+		return fmt.Errorf("%w: %v", ErrSubtitleExtraction, err)
+	}
+	defer s.pool.Release()
+
+	if err := utils.EnsureDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("%w: %v", ErrSubtitleExtraction, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "extract-*.tmp")
+	if err != nil {
+		return fmt.Errorf("%w: failed to create cache file: %v", ErrSubtitleExtraction, err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	log.Printf("runExtraction: Extracting %s subtitle track %d of %s", file.embedded.codec, file.embedded.index, file.embedded.videoPath)
+	args := []string{"-i", file.embedded.videoPath, "-map", fmt.Sprintf("0:s:%d", file.embedded.index)}
+	switch file.track.Format {
+	case subtitles.FormatASS:
+		args = append(args, "-c:s", "ass", "-f", "ass")
+	case subtitles.FormatVTT:
+		args = append(args, "-c:s", "webvtt", "-f", "webvtt")
+	default:
+		args = append(args, "-c:s", "srt", "-f", "srt")
+	}
+	args = append(args, "pipe:1")
+
+	if err := runFFmpeg(ctx, s.config.FFmpegPath, args, tmp); err != nil {
+		log.Printf("runExtraction: Error extracting track %d of %s: %v", file.embedded.index, episodeID, err)
+		return fmt.Errorf("%w: %v", ErrSubtitleExtraction, err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("%w: failed to write cache file: %v", ErrSubtitleExtraction, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("%w: failed to cache subtitle: %v", ErrSubtitleExtraction, err)
+	}
+
+	log.Printf("runExtraction: Cached %s", path)
+	return nil
+}
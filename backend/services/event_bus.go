@@ -0,0 +1,123 @@
+package services
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"comfort-player-backend/models"
+)
+
+// eventBufferSize is how many events a subscriber may fall behind before it's dropped
+const eventBufferSize = 32
+
+// EventsResource is the resource a signed events URL grants access to
+func EventsResource(showID, profileID string) string {
+	return "events:" + showID + ":" + profileID
+}
+
+// EventBus passes show events on to the clients following them. Publishing
+// never blocks: a subscriber that doesn't keep up is dropped, and its client
+// reconnects and starts over from the current state.
+type EventBus struct {
+	subscribers map[*Subscription]bool
+	mutex       sync.Mutex
+}
+
+// Subscription receives the events of one show for one profile
+type Subscription struct {
+	showID    string
+	profileID string
+	events    chan models.ShowEvent
+}
+
+// NewEventBus creates an event bus without subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[*Subscription]bool)}
+}
+
+// Subscribe starts receiving a show's catalog events and the state events of a profile
+func (b *EventBus) Subscribe(showID, profileID string) *Subscription {
+	subscription := &Subscription{
+		showID:    showID,
+		profileID: profileID,
+		events:    make(chan models.ShowEvent, eventBufferSize),
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscribers[subscription] = true
+	log.Printf("EventBus.Subscribe: Following show %s, profile %q (%d subscribers)", showID, profileID, len(b.subscribers))
+	return subscription
+}
+
+// Unsubscribe stops a subscription and closes its channel
+func (b *EventBus) Unsubscribe(subscription *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subscribers[subscription] {
+		delete(b.subscribers, subscription)
+		close(subscription.events)
+	}
+}
+
+// Events returns the subscription's events. The channel is closed when the
+// subscription ends or falls too far behind.
+func (s *Subscription) Events() <-chan models.ShowEvent {
+	return s.events
+}
+
+// Publish sends an event to every subscriber following its show and profile.
+// A nil bus drops the event.
+func (b *EventBus) Publish(event models.ShowEvent) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for subscription := range b.subscribers {
+		if subscription.showID != event.ShowID {
+			continue
+		}
+		if event.Type != models.ShowEventCatalog && subscription.profileID != event.ProfileID {
+			continue
+		}
+
+		select {
+		case subscription.events <- event:
+		default:
+			log.Printf("EventBus.Publish: Dropping subscriber to show %s, profile %q that fell behind", subscription.showID, subscription.profileID)
+			delete(b.subscribers, subscription)
+			close(subscription.events)
+		}
+	}
+}
+
+// StateEvent describes a profile's playback state as an event
+func StateEvent(eventType, showID, profileID string, state models.ServerState) models.ShowEvent {
+	mode := state.PlaybackMode
+	if mode == "" {
+		mode = models.PlaybackModeSequential
+	}
+	return models.ShowEvent{
+		Type:                eventType,
+		ShowID:              showID,
+		ProfileID:           profileID,
+		EpisodeID:           state.CurrentEpisodeID,
+		PlaybackTimeSeconds: state.PlaybackTimeSeconds,
+		PlaybackMode:        mode,
+		Revision:            state.Revision,
+		Timestamp:           time.Now().Unix(),
+	}
+}
+
+// catalogEvent describes a change to a show's episodes
+func catalogEvent(showID, episodeID string) models.ShowEvent {
+	return models.ShowEvent{
+		Type:      models.ShowEventCatalog,
+		ShowID:    showID,
+		EpisodeID: episodeID,
+		Timestamp: time.Now().Unix(),
+	}
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+)
+
+// WorkerPool bounds how many ffmpeg processes run at once. Callers wait for a
+// free slot, or give up when their context is cancelled.
+type WorkerPool struct {
+	slots chan struct{}
+}
+
+// NewWorkerPool creates a worker pool with the given number of slots
+func NewWorkerPool(size int) *WorkerPool {
+	return &WorkerPool{slots: make(chan struct{}, max(size, 1))}
+}
+
+// Acquire waits for a free slot
+func (p *WorkerPool) Acquire(ctx context.Context) error {
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken by Acquire
+func (p *WorkerPool) Release() {
+	<-p.slots
+}
+
+// runFFmpeg runs ffmpeg with the given arguments, writing its standard output
+// to stdout. The process is killed when ctx is cancelled.
+func runFFmpeg(ctx context.Context, ffmpegPath string, args []string, stdout io.Writer) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpegPath, append([]string{"-nostdin", "-v", "error", "-y"}, args...)...)
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	// Don't hold the worker if output pipes outlive a killed process
+	cmd.WaitDelay = 5 * time.Second
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"comfort-player-backend/models"
+)
+
+// finishedFraction is how far into an episode playback must get to count as finished
+const finishedFraction = 0.95
+
+// PlaybackReport is a playback position reported by a client
+type PlaybackReport struct {
+	ShowID          string
+	ProfileID       string
+	EpisodeID       string
+	PositionSeconds int64
+	DurationSeconds int64
+	Finished        bool
+	EpisodeChanged  bool // The profile switched to this episode from another one
+}
+
+// HistoryService keeps the append-only watch history log ("history") and the
+// per-episode resume points ("progress") in the state store. Like playback
+// state, resume points are written on Flush unless an episode starts or finishes.
+type HistoryService struct {
+	store StateStore
+	// Progress by profile ID, then episode ID. The default profile is "".
+	progress map[string]map[string]models.EpisodeProgress
+	mutex    sync.RWMutex
+	writes   *writeBehind
+}
+
+// NewHistoryService creates a new history service
+func NewHistoryService(store StateStore) *HistoryService {
+	service := &HistoryService{
+		store:    store,
+		progress: make(map[string]map[string]models.EpisodeProgress),
+		writes:   newWriteBehind(store, progressKey),
+	}
+
+	// Load existing progress if there is any
+	service.loadProgress()
+	return service
+}
+
+// RecordProgress updates an episode's progress and logs started/finished events
+func (s *HistoryService) RecordProgress(report PlaybackReport) error {
+	logged, err := s.updateProgress(report)
+	if err != nil || !logged {
+		return err
+	}
+
+	// Write the resume points along with the history events
+	if err := s.Flush(); err != nil {
+		log.Printf("RecordProgress: Error saving progress: %v", err)
+		return err
+	}
+	return nil
+}
+
+// updateProgress updates an episode's progress in memory and reports whether
+// an event was added to the history
+func (s *HistoryService) updateProgress(report PlaybackReport) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	logged := false
+
+	now := time.Now().Unix()
+	episodes, ok := s.progress[report.ProfileID]
+	if !ok {
+		episodes = make(map[string]models.EpisodeProgress)
+		s.progress[report.ProfileID] = episodes
+	}
+
+	progress, exists := episodes[report.EpisodeID]
+	if !exists || report.EpisodeChanged {
+		// A new viewing of the episode starts
+		progress = models.EpisodeProgress{
+			EpisodeID:       report.EpisodeID,
+			ShowID:          report.ShowID,
+			PositionSeconds: progress.PositionSeconds,
+			DurationSeconds: progress.DurationSeconds,
+			WatchCount:      progress.WatchCount,
+		}
+		if err := s.appendEvent(models.HistoryEvent{
+			Type:            models.HistoryEventStarted,
+			ShowID:          report.ShowID,
+			ProfileID:       report.ProfileID,
+			EpisodeID:       report.EpisodeID,
+			Timestamp:       now,
+			PositionSeconds: report.PositionSeconds,
+		}); err != nil {
+			return false, err
+		}
+		logged = true
+	}
+
+	progress.PositionSeconds = report.PositionSeconds
+	progress.LastWatched = now
+	if report.PositionSeconds > progress.FurthestSeconds {
+		progress.FurthestSeconds = report.PositionSeconds
+	}
+	if report.DurationSeconds > 0 {
+		progress.DurationSeconds = report.DurationSeconds
+	}
+
+	// Detect the end of the episode
+	reachedEnd := report.Finished ||
+		(progress.DurationSeconds > 0 && float64(report.PositionSeconds) >= finishedFraction*float64(progress.DurationSeconds))
+	if reachedEnd && !progress.Finished {
+		log.Printf("RecordProgress: Episode %s finished by profile %q", report.EpisodeID, report.ProfileID)
+		progress.Finished = true
+		progress.WatchCount++
+		if err := s.appendEvent(models.HistoryEvent{
+			Type:            models.HistoryEventFinished,
+			ShowID:          report.ShowID,
+			ProfileID:       report.ProfileID,
+			EpisodeID:       report.EpisodeID,
+			Timestamp:       now,
+			PositionSeconds: report.PositionSeconds,
+			FurthestSeconds: progress.FurthestSeconds,
+		}); err != nil {
+			return logged, err
+		}
+		logged = true
+	}
+
+	// The position is kept once finished; Finished tells clients to start over
+	episodes[report.EpisodeID] = progress
+	s.writes.changed()
+	return logged, nil
+}
+
+// Flush writes the resume points to the store if they changed since they were last written
+func (s *HistoryService) Flush() error {
+	s.writes.writeMutex.Lock()
+	defer s.writes.writeMutex.Unlock()
+
+	if !s.writes.take() {
+		return nil
+	}
+
+	s.mutex.RLock()
+	data, err := json.Marshal(s.progress)
+	s.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	return s.writes.save(json.RawMessage(data))
+}
+
+// FlushStatus returns when the resume points were last written and whether they have changed since
+func (s *HistoryService) FlushStatus() (time.Time, bool) {
+	return s.writes.status()
+}
+
+// GetProgress returns a profile's progress through an episode
+func (s *HistoryService) GetProgress(profileID, episodeID string) (models.EpisodeProgress, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	progress, ok := s.progress[profileID][episodeID]
+	return progress, ok
+}
+
+// GetShowProgress returns a profile's progress through every episode of a show
+func (s *HistoryService) GetShowProgress(profileID, showID string) []models.EpisodeProgress {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	progress := []models.EpisodeProgress{}
+	for _, episode := range s.progress[profileID] {
+		if episode.ShowID == showID {
+			progress = append(progress, episode)
+		}
+	}
+	sort.Slice(progress, func(i, j int) bool {
+		return progress[i].EpisodeID < progress[j].EpisodeID
+	})
+	return progress
+}
+
+// HistoryFilter narrows down the events returned by GetHistory
+type HistoryFilter struct {
+	ProfileID string
+	ShowID    string // Optional
+	EpisodeID string // Optional
+	Limit     int    // Optional: 0 returns every event
+}
+
+// GetHistory returns the matching history events, newest first
+func (s *HistoryService) GetHistory(filter HistoryFilter) ([]models.HistoryEvent, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	events := []models.HistoryEvent{}
+	err := s.store.Scan(historyKey, func(record []byte) error {
+		var event models.HistoryEvent
+		if err := json.Unmarshal(record, &event); err != nil {
+			log.Printf("GetHistory: Skipping unreadable history record: %v", err)
+			return nil
+		}
+		if event.ProfileID != filter.ProfileID ||
+			(filter.ShowID != "" && event.ShowID != filter.ShowID) ||
+			(filter.EpisodeID != "" && event.EpisodeID != filter.EpisodeID) {
+			return nil
+		}
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	// Newest first
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+// DeleteProfile removes a profile's resume points. Its history is kept.
+func (s *HistoryService) DeleteProfile(profileID string) error {
+	s.writes.writeMutex.Lock()
+	defer s.writes.writeMutex.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.progress[profileID]; !exists {
+		return nil
+	}
+	delete(s.progress, profileID)
+	s.writes.take()
+	return s.writes.save(s.progress)
+}
+
+// appendEvent appends an event to the history log. Callers must hold the write lock.
+func (s *HistoryService) appendEvent(event models.HistoryEvent) error {
+	log.Printf("appendEvent: %s %s (profile %q)", event.Type, event.EpisodeID, event.ProfileID)
+
+	if err := s.store.Append(historyKey, event); err != nil {
+		log.Printf("appendEvent: Error writing history: %v", err)
+		return err
+	}
+	return nil
+}
+
+// loadProgress loads the resume points from the store
+func (s *HistoryService) loadProgress() {
+	log.Printf("loadProgress: Loading progress")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	found, err := s.store.Load(progressKey, &s.progress)
+	if err != nil {
+		log.Printf("loadProgress: Error reading progress: %v", err)
+		s.progress = make(map[string]map[string]models.EpisodeProgress)
+	} else if !found {
+		log.Printf("loadProgress: No progress saved, starting empty")
+	}
+}
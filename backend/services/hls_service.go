@@ -0,0 +1,353 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"comfort-player-backend/config"
+	"comfort-player-backend/models"
+	"comfort-player-backend/utils"
+)
+
+// HLSSegmentSeconds is the duration of every HLS segment but the last
+const HLSSegmentSeconds = 6
+
+// segmentEncodeTimeout bounds how long a segment encode may take, waiting for a
+// worker included
+const segmentEncodeTimeout = 5 * time.Minute
+
+// Segments are encoded as H.264 High profile, level 4.0, with AAC-LC audio.
+// The master playlist announces the same codecs. Larger or faster sources are
+// scaled down to 1080p and 30 frames per second, and the bitrate is capped, so
+// every stream stays within the announced level.
+const (
+	hlsVideoProfile = "high"
+	hlsVideoLevel   = "4.0"
+	hlsVideoCodec   = "avc1.640028"
+	hlsAudioCodec   = "mp4a.40.2"
+	hlsMaxWidth     = 1920
+	hlsMaxHeight    = 1080
+	hlsMaxFrameRate = 30
+	hlsVideoMaxRate = 20000000 // Bits per second
+	hlsVideoBufSize = 25000000 // Bits
+	hlsAudioBitrate = 160000   // Bits per second
+	hlsMaxBandwidth = hlsVideoMaxRate + hlsAudioBitrate
+)
+
+// ErrDurationUnknown is returned when an episode can't be segmented because its duration is unknown
+var ErrDurationUnknown = errors.New("duration unknown")
+
+// ErrSegmentOutOfRange is returned for segment numbers past the end of the episode
+var ErrSegmentOutOfRange = errors.New("segment out of range")
+
+// segmentJob is a segment being encoded. Requests for the same segment wait for it.
+type segmentJob struct {
+	done chan struct{}
+	err  error
+}
+
+// HLSService packages episodes as HLS. Segments are cut and encoded by ffmpeg
+// when first requested, then cached on disk along with the transcodes.
+type HLSService struct {
+	config   *config.Config
+	pool     *WorkerPool
+	pruner   *CachePruner
+	cacheDir string
+	jobs     map[string]*segmentJob
+	mutex    sync.Mutex
+	// jobsContext runs encodes, which outlive the request that started them
+	jobsContext context.Context
+	stopJobs    context.CancelFunc
+	running     sync.WaitGroup
+}
+
+// NewHLSService creates a new HLS service. Segment encodes share the worker
+// pool with other transcodes.
+func NewHLSService(config *config.Config, pool *WorkerPool, pruner *CachePruner) *HLSService {
+	jobsContext, stopJobs := context.WithCancel(context.Background())
+	return &HLSService{
+		config:      config,
+		pool:        pool,
+		pruner:      pruner,
+		cacheDir:    filepath.Join(config.CacheDir, hlsCacheName),
+		jobs:        make(map[string]*segmentJob),
+		jobsContext: jobsContext,
+		stopJobs:    stopJobs,
+	}
+}
+
+// StopJobs cancels the segment encodes still running and waits for them to end
+func (s *HLSService) StopJobs() {
+	s.stopJobs()
+
+	// Encodes only start while holding the lock, so none starts after this
+	s.mutex.Lock()
+	s.mutex.Unlock()
+	s.running.Wait()
+}
+
+// HLSResource returns the resource an HLS URL is signed for. The profile is
+// part of it, since the playlists resume from that profile's position.
+func HLSResource(episodeID, profileID string) string {
+	return "hls:" + episodeID + ":" + profileID
+}
+
+// SegmentCount returns the number of segments an episode of the given duration is cut into
+func SegmentCount(durationSeconds float64) int {
+	return int(math.Ceil(durationSeconds / HLSSegmentSeconds))
+}
+
+// ResumeOffset returns the start of the segment holding the playback position,
+// so playback resumes on a segment boundary
+func ResumeOffset(playbackTimeSeconds int64, durationSeconds float64) float64 {
+	if playbackTimeSeconds <= 0 || durationSeconds <= 0 {
+		return 0
+	}
+	index := min(int(playbackTimeSeconds)/HLSSegmentSeconds, SegmentCount(durationSeconds)-1)
+	return float64(index * HLSSegmentSeconds)
+}
+
+// MasterPlaylist returns the master playlist of an episode. The query string is
+// appended to the variant URL so signed URLs keep working.
+func (s *HLSService) MasterPlaylist(info *models.MediaInfo, fileSize int64, resumeOffset float64, query string) string {
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n")
+	playlist.WriteString("#EXT-X-VERSION:3\n")
+	playlist.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if resumeOffset > 0 {
+		fmt.Fprintf(&playlist, "#EXT-X-START:TIME-OFFSET=%.3f,PRECISE=YES\n", resumeOffset)
+	}
+
+	// Estimate the bandwidth from the source bitrate, up to what the encode allows
+	bandwidth := int64(2000000)
+	if info.DurationSeconds > 0 && fileSize > 0 {
+		bandwidth = min(int64(float64(fileSize*8)/info.DurationSeconds), hlsMaxBandwidth)
+	}
+	fmt.Fprintf(&playlist, "#EXT-X-STREAM-INF:BANDWIDTH=%d", bandwidth)
+	if codecs := hlsCodecs(info); codecs != "" {
+		fmt.Fprintf(&playlist, ",CODECS=\"%s\"", codecs)
+	}
+	for _, track := range info.Tracks {
+		if track.Type == "video" && track.Width > 0 && track.Height > 0 {
+			width, height := hlsOutputSize(track.Width, track.Height)
+			fmt.Fprintf(&playlist, ",RESOLUTION=%dx%d", width, height)
+			break
+		}
+	}
+	playlist.WriteString("\n")
+	playlist.WriteString(withQuery("index.m3u8", query) + "\n")
+	return playlist.String()
+}
+
+// hlsOutputSize returns the size segments of a video of the given size are
+// encoded at. It works out what the scale filter in segmentArgs does: the
+// video is fit within 1080p, keeping its aspect ratio, and rounded down to
+// even dimensions. Smaller videos keep their size.
+func hlsOutputSize(width, height int) (int, int) {
+	boxWidth, boxHeight := min(width, hlsMaxWidth), min(height, hlsMaxHeight)
+	// Like av_rescale, round to the nearest pixel
+	fitWidth := (boxHeight*width + height/2) / height
+	fitHeight := (boxWidth*height + width/2) / width
+	return min(fitWidth, boxWidth) / 2 * 2, min(fitHeight, boxHeight) / 2 * 2
+}
+
+// hlsCodecs returns the CODECS attribute for an episode's segments. Audio is
+// only announced if the source has an audio track. If the tracks weren't probed
+// it returns "", since announcing the wrong codecs makes strict players refuse
+// the stream.
+func hlsCodecs(info *models.MediaInfo) string {
+	if len(info.Tracks) == 0 {
+		return ""
+	}
+	for _, track := range info.Tracks {
+		if track.Type == "audio" {
+			return hlsVideoCodec + "," + hlsAudioCodec
+		}
+	}
+	return hlsVideoCodec
+}
+
+// MediaPlaylist returns the VOD media playlist of an episode
+func (s *HLSService) MediaPlaylist(durationSeconds float64, resumeOffset float64, query string) (string, error) {
+	if durationSeconds <= 0 {
+		return "", ErrDurationUnknown
+	}
+
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n")
+	playlist.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&playlist, "#EXT-X-TARGETDURATION:%d\n", HLSSegmentSeconds)
+	playlist.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	playlist.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	playlist.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if resumeOffset > 0 {
+		fmt.Fprintf(&playlist, "#EXT-X-START:TIME-OFFSET=%.3f,PRECISE=YES\n", resumeOffset)
+	}
+
+	count := SegmentCount(durationSeconds)
+	for i := 0; i < count; i++ {
+		_, length := segmentBounds(i, durationSeconds)
+		fmt.Fprintf(&playlist, "#EXTINF:%.3f,\n", length)
+		playlist.WriteString(withQuery(fmt.Sprintf("segment-%05d.ts", i), query) + "\n")
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+	return playlist.String(), nil
+}
+
+// Segment returns the path of an encoded segment, encoding it if it isn't cached
+func (s *HLSService) Segment(ctx context.Context, episodeID, videoPath string, durationSeconds float64, index int) (string, error) {
+	if durationSeconds <= 0 {
+		return "", ErrDurationUnknown
+	}
+	if index < 0 || index >= SegmentCount(durationSeconds) {
+		return "", fmt.Errorf("%w: %d", ErrSegmentOutOfRange, index)
+	}
+
+	dir, err := s.segmentDir(episodeID, videoPath)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("segment-%05d.ts", index))
+	if utils.FileExists(path) {
+		// Mark the segment as recently used so pruning keeps it
+		touchCached(path)
+		return path, nil
+	}
+
+	// Join an encode already running for this segment, or start one. The
+	// encode isn't tied to any request, so it finishes for the others if the
+	// client that started it goes away; ctx only bounds this caller's wait.
+	s.mutex.Lock()
+	job, running := s.jobs[path]
+	if !running {
+		if err := s.jobsContext.Err(); err != nil {
+			s.mutex.Unlock()
+			return "", err
+		}
+		job = &segmentJob{done: make(chan struct{})}
+		s.jobs[path] = job
+		start, length := segmentBounds(index, durationSeconds)
+		s.running.Add(1)
+		go func() {
+			defer s.running.Done()
+			encodeCtx, cancel := context.WithTimeout(s.jobsContext, segmentEncodeTimeout)
+			defer cancel()
+			job.err = s.encodeSegment(encodeCtx, videoPath, path, start, length)
+
+			s.mutex.Lock()
+			delete(s.jobs, path)
+			s.mutex.Unlock()
+			close(job.done)
+		}()
+	}
+	s.mutex.Unlock()
+
+	select {
+	case <-job.done:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	if job.err != nil {
+		return "", job.err
+	}
+	return path, nil
+}
+
+// encodeSegment cuts one segment out of a video file and encodes it as an
+// MPEG-TS file. Timestamps are offset so segments play back as one timeline.
+func (s *HLSService) encodeSegment(ctx context.Context, videoPath, path string, start, length float64) error {
+	log.Printf("encodeSegment: Encoding %s from %.3fs for %.3fs", path, start, length)
+
+	if err := s.pool.Acquire(ctx); err != nil {
+		return err
+	}
+	defer s.pool.Release()
+
+	tmpPath := path + ".tmp"
+	args := segmentArgs(videoPath, tmpPath, start, length)
+
+	if err := runFFmpeg(ctx, s.config.FFmpegPath, args, nil); err != nil {
+		os.Remove(tmpPath)
+		log.Printf("encodeSegment: Error encoding %s: %v", path, err)
+		return fmt.Errorf("failed to encode segment: %w", err)
+	}
+
+	var size int64
+	if stat, err := os.Stat(tmpPath); err == nil {
+		size = stat.Size()
+	}
+
+	// Only complete segments ever appear under their final name
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to cache segment: %w", err)
+	}
+	s.pruner.Added(size)
+	return nil
+}
+
+// segmentArgs returns the ffmpeg arguments encoding one segment of a video file
+// to output. Each segment is an encode of its own, so it starts on a keyframe;
+// only its first frame is forced to be one, so the rest compress as usual.
+// Video is scaled and capped to stay within the announced H.264 level.
+func segmentArgs(videoPath, output string, start, length float64) []string {
+	return []string{
+		"-ss", formatSeconds(start),
+		"-i", videoPath,
+		"-t", formatSeconds(length),
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-vf", fmt.Sprintf("scale=w='min(iw,%d)':h='min(ih,%d)':force_original_aspect_ratio=decrease:force_divisible_by=2", hlsMaxWidth, hlsMaxHeight),
+		"-fpsmax", strconv.Itoa(hlsMaxFrameRate),
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", hlsVideoProfile, "-level", hlsVideoLevel, "-pix_fmt", "yuv420p",
+		"-maxrate", strconv.Itoa(hlsVideoMaxRate), "-bufsize", strconv.Itoa(hlsVideoBufSize),
+		"-force_key_frames", "expr:eq(n,0)",
+		"-c:a", "aac", "-ac", "2", "-b:a", strconv.Itoa(hlsAudioBitrate),
+		"-output_ts_offset", formatSeconds(start), "-muxdelay", "0",
+		"-f", "mpegts", output,
+	}
+}
+
+// segmentDir returns the cache directory for a video file's segments. The
+// directory changes when the file does, so stale segments are never served.
+func (s *HLSService) segmentDir(episodeID, videoPath string) (string, error) {
+	stat, err := os.Stat(videoPath)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", videoPath, stat.Size(), stat.ModTime().UnixNano())))
+	dir := filepath.Join(s.cacheDir, episodeID, hex.EncodeToString(hash[:8]))
+	if err := utils.EnsureDir(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// segmentBounds returns the start and length of a segment, in seconds
+func segmentBounds(index int, durationSeconds float64) (float64, float64) {
+	start := float64(index * HLSSegmentSeconds)
+	return start, math.Min(HLSSegmentSeconds, durationSeconds-start)
+}
+
+// formatSeconds formats a time in seconds for ffmpeg
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 3, 64)
+}
+
+// withQuery appends a query string to a relative URL
+func withQuery(url, query string) string {
+	if query == "" {
+		return url
+	}
+	return url + "?" + query
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"comfort-player-backend/models"
+)
+
+func TestSegmentCount(t *testing.T) {
+	tests := []struct {
+		duration float64
+		want     int
+	}{
+		{duration: 0, want: 0},
+		{duration: 0.5, want: 1},
+		{duration: 6, want: 1},
+		{duration: 6.001, want: 2},
+		{duration: 1320.4, want: 221},
+	}
+
+	for _, test := range tests {
+		if got := SegmentCount(test.duration); got != test.want {
+			t.Errorf("SegmentCount(%v) = %d, want %d", test.duration, got, test.want)
+		}
+	}
+}
+
+func TestSegmentBounds(t *testing.T) {
+	tests := []struct {
+		index    int
+		duration float64
+		start    float64
+		length   float64
+	}{
+		{index: 0, duration: 20, start: 0, length: 6},
+		{index: 2, duration: 20, start: 12, length: 6},
+		{index: 3, duration: 20, start: 18, length: 2},
+		{index: 0, duration: 4.5, start: 0, length: 4.5},
+		{index: 1, duration: 12, start: 6, length: 6},
+	}
+
+	for _, test := range tests {
+		start, length := segmentBounds(test.index, test.duration)
+		if start != test.start || length != test.length {
+			t.Errorf("segmentBounds(%d, %v) = %v, %v; want %v, %v", test.index, test.duration, start, length, test.start, test.length)
+		}
+	}
+}
+
+func TestResumeOffset(t *testing.T) {
+	tests := []struct {
+		name     string
+		position int64
+		duration float64
+		want     float64
+	}{
+		{name: "start", position: 0, duration: 20, want: 0},
+		{name: "first segment", position: 5, duration: 20, want: 0},
+		{name: "segment boundary", position: 6, duration: 20, want: 6},
+		{name: "inside a segment", position: 13, duration: 20, want: 12},
+		{name: "last short segment", position: 19, duration: 20, want: 18},
+		{name: "past the end", position: 100, duration: 20, want: 18},
+		{name: "negative position", position: -5, duration: 20, want: 0},
+		{name: "unknown duration", position: 13, duration: 0, want: 0},
+	}
+
+	for _, test := range tests {
+		if got := ResumeOffset(test.position, test.duration); got != test.want {
+			t.Errorf("%s: ResumeOffset(%d, %v) = %v, want %v", test.name, test.position, test.duration, got, test.want)
+		}
+	}
+}
+
+func TestMediaPlaylist(t *testing.T) {
+	service := &HLSService{}
+
+	playlist, err := service.MediaPlaylist(14.5, 6, "expires=1&signature=abc")
+	if err != nil {
+		t.Fatalf("MediaPlaylist error: %v", err)
+	}
+	want := "#EXTM3U\n" +
+		"#EXT-X-VERSION:3\n" +
+		"#EXT-X-TARGETDURATION:6\n" +
+		"#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXT-X-PLAYLIST-TYPE:VOD\n" +
+		"#EXT-X-INDEPENDENT-SEGMENTS\n" +
+		"#EXT-X-START:TIME-OFFSET=6.000,PRECISE=YES\n" +
+		"#EXTINF:6.000,\nsegment-00000.ts?expires=1&signature=abc\n" +
+		"#EXTINF:6.000,\nsegment-00001.ts?expires=1&signature=abc\n" +
+		"#EXTINF:2.500,\nsegment-00002.ts?expires=1&signature=abc\n" +
+		"#EXT-X-ENDLIST\n"
+	if playlist != want {
+		t.Errorf("MediaPlaylist =\n%s\nwant\n%s", playlist, want)
+	}
+
+	// Without a resume point or a query, playback starts at the beginning
+	playlist, err = service.MediaPlaylist(6, 0, "")
+	if err != nil {
+		t.Fatalf("MediaPlaylist error: %v", err)
+	}
+	want = "#EXTM3U\n" +
+		"#EXT-X-VERSION:3\n" +
+		"#EXT-X-TARGETDURATION:6\n" +
+		"#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXT-X-PLAYLIST-TYPE:VOD\n" +
+		"#EXT-X-INDEPENDENT-SEGMENTS\n" +
+		"#EXTINF:6.000,\nsegment-00000.ts\n" +
+		"#EXT-X-ENDLIST\n"
+	if playlist != want {
+		t.Errorf("MediaPlaylist =\n%s\nwant\n%s", playlist, want)
+	}
+
+	if _, err := service.MediaPlaylist(0, 0, ""); !errors.Is(err, ErrDurationUnknown) {
+		t.Errorf("MediaPlaylist without a duration error = %v, want %v", err, ErrDurationUnknown)
+	}
+}
+
+func TestMasterPlaylistCodecs(t *testing.T) {
+	service := &HLSService{}
+	video := models.MediaTrack{Type: "video", Codec: "hevc", Width: 1920, Height: 1080}
+	audio := models.MediaTrack{Type: "audio", Codec: "ac3"}
+
+	tests := []struct {
+		name   string
+		tracks []models.MediaTrack
+		want   string
+	}{
+		{name: "video and audio", tracks: []models.MediaTrack{video, audio},
+			want: "#EXT-X-STREAM-INF:BANDWIDTH=800,CODECS=\"avc1.640028,mp4a.40.2\",RESOLUTION=1920x1080\n"},
+		{name: "no audio", tracks: []models.MediaTrack{video},
+			want: "#EXT-X-STREAM-INF:BANDWIDTH=800,CODECS=\"avc1.640028\",RESOLUTION=1920x1080\n"},
+		{name: "scaled down", tracks: []models.MediaTrack{{Type: "video", Width: 3840, Height: 2160}, audio},
+			want: "#EXT-X-STREAM-INF:BANDWIDTH=800,CODECS=\"avc1.640028,mp4a.40.2\",RESOLUTION=1920x1080\n"},
+		{name: "tracks unknown", tracks: nil,
+			want: "#EXT-X-STREAM-INF:BANDWIDTH=800\n"},
+	}
+
+	for _, test := range tests {
+		info := &models.MediaInfo{DurationSeconds: 10, Tracks: test.tracks}
+		playlist := service.MasterPlaylist(info, 1000, 0, "")
+		want := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-INDEPENDENT-SEGMENTS\n" + test.want + "index.m3u8\n"
+		if playlist != want {
+			t.Errorf("%s: MasterPlaylist =\n%s\nwant\n%s", test.name, playlist, want)
+		}
+	}
+}
+
+func TestSegmentOutOfRange(t *testing.T) {
+	service := &HLSService{}
+
+	for _, index := range []int{-1, 4, 10} {
+		if _, err := service.Segment(context.Background(), "Show_S01E01", "video.mkv", 20, index); !errors.Is(err, ErrSegmentOutOfRange) {
+			t.Errorf("Segment(%d) error = %v, want %v", index, err, ErrSegmentOutOfRange)
+		}
+	}
+	if _, err := service.Segment(context.Background(), "Show_S01E01", "video.mkv", 0, 0); !errors.Is(err, ErrDurationUnknown) {
+		t.Errorf("Segment without a duration error = %v, want %v", err, ErrDurationUnknown)
+	}
+}
+
+func TestHLSOutputSize(t *testing.T) {
+	tests := []struct {
+		width, height int
+		want          [2]int
+	}{
+		{1920, 1080, [2]int{1920, 1080}},
+		{1280, 720, [2]int{1280, 720}},
+		{640, 480, [2]int{640, 480}},
+		{3840, 2160, [2]int{1920, 1080}},
+		{1920, 1200, [2]int{1728, 1080}},
+		{4096, 1716, [2]int{1920, 804}},
+		{1080, 1920, [2]int{608, 1080}},
+		{721, 481, [2]int{720, 480}},
+	}
+
+	for _, test := range tests {
+		width, height := hlsOutputSize(test.width, test.height)
+		if got := [2]int{width, height}; got != test.want {
+			t.Errorf("hlsOutputSize(%d, %d) = %v, want %v", test.width, test.height, got, test.want)
+		}
+	}
+}
+
+func TestMasterPlaylistBandwidth(t *testing.T) {
+	service := &HLSService{}
+	// A 4K source at 60 Mbit/s is announced at the capped encode bitrate
+	info := &models.MediaInfo{DurationSeconds: 100}
+	playlist := service.MasterPlaylist(info, 60000000/8*100, 0, "")
+	if want := "#EXT-X-STREAM-INF:BANDWIDTH=20160000\n"; !strings.Contains(playlist, want) {
+		t.Errorf("MasterPlaylist =\n%s\nwant %q", playlist, want)
+	}
+}
+
+func TestSegmentArgs(t *testing.T) {
+	args := segmentArgs("/media/episode.mkv", "/cache/segment-00002.ts.tmp", 12, 6)
+
+	want := map[string]string{
+		"-ss":               "12.000",
+		"-i":                "/media/episode.mkv",
+		"-t":                "6.000",
+		"-c:v":              "libx264",
+		"-c:a":              "aac",
+		"-force_key_frames": "expr:eq(n,0)",
+		"-vf":               "scale=w='min(iw,1920)':h='min(ih,1080)':force_original_aspect_ratio=decrease:force_divisible_by=2",
+		"-fpsmax":           "30",
+		"-profile:v":        "high",
+		"-level":            "4.0",
+		"-maxrate":          "20000000",
+		"-output_ts_offset": "12.000",
+		"-f":                "mpegts",
+	}
+	got := make(map[string]string)
+	for i := 0; i+1 < len(args); i++ {
+		if strings.HasPrefix(args[i], "-") {
+			got[args[i]] = args[i+1]
+		}
+	}
+	for flag, value := range want {
+		if got[flag] != value {
+			t.Errorf("%s = %q, want %q", flag, got[flag], value)
+		}
+	}
+	if last := args[len(args)-1]; last != "/cache/segment-00002.ts.tmp" {
+		t.Errorf("output = %q, want the temporary segment", last)
+	}
+	// The seek goes before the input so ffmpeg doesn't decode what comes before
+	if args[0] != "-ss" || args[2] != "-i" {
+		t.Errorf("args start with %q, want -ss before -i", args[:4])
+	}
+}
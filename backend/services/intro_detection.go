@@ -0,0 +1,166 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"comfort-player-backend/analysis"
+	"comfort-player-backend/models"
+)
+
+// IntroDetectionOptions tunes ShowService.DetectIntros
+type IntroDetectionOptions struct {
+	Season        int     // Season to analyze, 0 for every season
+	SearchSeconds float64 // How much of the start of each episode is searched
+	MinDuration   float64 // Shortest intro, in seconds
+	MaxDuration   float64 // Longest intro, in seconds
+	MinConfidence float64 // Markers below this confidence aren't written
+	DryRun        bool    // Report without writing markers
+	Overwrite     bool    // Replace intro markers episodes already have
+}
+
+// errIntroMarked is returned when an episode already has intro markers and
+// detection may not replace them
+var errIntroMarked = errors.New("episode already has intro markers")
+
+// DetectIntros finds the intro shared by the episodes of each season by comparing
+// their audio fingerprints, and writes the intro markers of confident detections
+// to the catalog. Episodes that already have intro markers keep them unless
+// options.Overwrite is set.
+func (s *ShowService) DetectIntros(ctx context.Context, options IntroDetectionOptions) ([]models.IntroDetectionResult, error) {
+	episodes, err := s.GetAllEpisodes()
+	if err != nil {
+		return nil, err
+	}
+
+	// Group episodes by season
+	seasons := make(map[int][]models.EpisodeInfo)
+	for _, episode := range episodes {
+		season, _, ok := s.EpisodeNumbers(episode.ID)
+		if !ok {
+			log.Printf("DetectIntros: Skipping episode with unknown season: %s", episode.ID)
+			continue
+		}
+		if options.Season == 0 || season == options.Season {
+			seasons[season] = append(seasons[season], episode)
+		}
+	}
+	if len(seasons) == 0 && options.Season == 0 {
+		return nil, errors.New("no episodes with a season number found")
+	}
+	if len(seasons) == 0 {
+		return nil, fmt.Errorf("no episodes found for season %d", options.Season)
+	}
+
+	var seasonNumbers []int
+	for season := range seasons {
+		seasonNumbers = append(seasonNumbers, season)
+	}
+	sort.Ints(seasonNumbers)
+
+	var results []models.IntroDetectionResult
+	for _, season := range seasonNumbers {
+		seasonResults, err := s.detectSeasonIntros(ctx, season, seasons[season], options)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, seasonResults...)
+	}
+	return results, nil
+}
+
+// detectSeasonIntros runs intro detection on the episodes of a single season
+func (s *ShowService) detectSeasonIntros(ctx context.Context, season int, episodes []models.EpisodeInfo, options IntroDetectionOptions) ([]models.IntroDetectionResult, error) {
+	log.Printf("detectSeasonIntros: Analyzing %d episodes of season %d", len(episodes), season)
+
+	results := make([]models.IntroDetectionResult, len(episodes))
+	var fingerprints []*analysis.Fingerprint
+	var analyzed []int
+	for i, episode := range episodes {
+		results[i] = models.IntroDetectionResult{EpisodeID: episode.ID, Season: season}
+
+		videoPath, err := s.GetEpisodeVideoPath(episode.ID)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+
+		log.Printf("detectSeasonIntros: Fingerprinting %s", videoPath)
+		samples, err := analysis.DecodeAudio(ctx, s.config.FFmpegPath, videoPath, options.SearchSeconds)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			log.Printf("detectSeasonIntros: Error decoding %s: %v", videoPath, err)
+			results[i].Error = err.Error()
+			continue
+		}
+
+		fingerprints = append(fingerprints, analysis.NewFingerprint(samples))
+		analyzed = append(analyzed, i)
+	}
+
+	// Intros can only be found by comparing at least two episodes
+	if len(fingerprints) < 2 {
+		log.Printf("detectSeasonIntros: Not enough episodes to compare in season %d", season)
+		return results, nil
+	}
+
+	detected := analysis.DetectIntros(fingerprints, analysis.IntroOptions{
+		MinDuration: options.MinDuration,
+		MaxDuration: options.MaxDuration,
+		Comparisons: 4,
+	})
+
+	for k, intro := range detected {
+		result := &results[analyzed[k]]
+		if !intro.Found {
+			continue
+		}
+		result.Found = true
+		result.IntroStartSeconds = intro.Start
+		result.IntroEndSeconds = intro.End
+		result.Confidence = intro.Confidence
+
+		if options.DryRun || intro.Confidence < options.MinConfidence {
+			continue
+		}
+
+		err := s.saveIntroMarkers(result.EpisodeID, intro.Start, intro.End, options.Overwrite)
+		if errors.Is(err, errIntroMarked) {
+			log.Printf("detectSeasonIntros: Keeping the intro markers of %s", result.EpisodeID)
+			result.Skipped = true
+			continue
+		}
+		if err != nil {
+			log.Printf("detectSeasonIntros: Error saving markers for %s: %v", result.EpisodeID, err)
+			result.Error = err.Error()
+			continue
+		}
+		result.Written = true
+	}
+	return results, nil
+}
+
+// saveIntroMarkers writes detected intro markers to an episode's catalog entry.
+// Unless overwrite is set, markers the episode already has, such as ones entered
+// through the API, are kept and errIntroMarked is returned.
+func (s *ShowService) saveIntroMarkers(episodeID string, start, end float64, overwrite bool) error {
+	_, err := s.editCatalog(episodeID, func(episode *models.EpisodeInfo, file *catalogFile) error {
+		markers := models.EpisodeMarkers{}
+		if episode.Markers != nil {
+			markers = *episode.Markers
+		}
+		if !overwrite && (markers.IntroStartSeconds != nil || markers.IntroEndSeconds != nil) {
+			return errIntroMarked
+		}
+		markers.IntroStartSeconds = &start
+		markers.IntroEndSeconds = &end
+		episode.Markers = &markers
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"comfort-player-backend/config"
+)
+
+func TestDetectIntrosWithoutEpisodes(t *testing.T) {
+	mediaDir := t.TempDir()
+	cfg := &config.Config{
+		MediaDir:      mediaDir,
+		SeasonsDir:    filepath.Join(mediaDir, "shows"),
+		DefaultShowID: "default",
+	}
+	show := NewShowRegistry(cfg, NewMemoryStore(), NewWorkerPool(1)).Default()
+
+	tests := []struct {
+		season int
+		want   string
+	}{
+		{season: 0, want: "no episodes with a season number found"},
+		{season: 2, want: "no episodes found for season 2"},
+	}
+	for _, test := range tests {
+		_, err := show.Show.DetectIntros(context.Background(), IntroDetectionOptions{Season: test.season})
+		if err == nil || err.Error() != test.want {
+			t.Errorf("DetectIntros of season %d error = %v, want %q", test.season, err, test.want)
+		}
+	}
+}
+
+func TestSaveIntroMarkers(t *testing.T) {
+	mediaDir := t.TempDir()
+	seasonsDir := filepath.Join(mediaDir, "shows")
+	if err := os.MkdirAll(seasonsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	catalog := `{"episodes": [
+		{"id": "Show_S01E01", "title": "Pilot", "markers": {"introStartSeconds": 5, "introEndSeconds": 35}},
+		{"id": "Show_S01E02", "title": "Second", "markers": {"creditsStartSeconds": 1300}}
+	]}`
+	if err := os.WriteFile(filepath.Join(seasonsDir, "season-01.json"), []byte(catalog), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		MediaDir:      mediaDir,
+		SeasonsDir:    seasonsDir,
+		DefaultShowID: "default",
+	}
+	show := NewShowRegistry(cfg, NewMemoryStore(), NewWorkerPool(1)).Default().Show
+
+	intro := func(episodeID string) (float64, float64) {
+		t.Helper()
+		episode, err := show.GetEpisode(episodeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if episode.Markers == nil || episode.Markers.IntroStartSeconds == nil || episode.Markers.IntroEndSeconds == nil {
+			t.Fatalf("%s has no intro markers", episodeID)
+		}
+		return *episode.Markers.IntroStartSeconds, *episode.Markers.IntroEndSeconds
+	}
+
+	// Markers entered by hand are kept
+	if err := show.saveIntroMarkers("Show_S01E01", 60, 90, false); !errors.Is(err, errIntroMarked) {
+		t.Errorf("saveIntroMarkers over existing markers error = %v, want %v", err, errIntroMarked)
+	}
+	if start, end := intro("Show_S01E01"); start != 5 || end != 35 {
+		t.Errorf("intro after skipping = %v-%v, want 5-35", start, end)
+	}
+
+	// Other markers don't stop the intro from being written, and are kept
+	if err := show.saveIntroMarkers("Show_S01E02", 60, 90, false); err != nil {
+		t.Fatalf("saveIntroMarkers error: %v", err)
+	}
+	if start, end := intro("Show_S01E02"); start != 60 || end != 90 {
+		t.Errorf("intro = %v-%v, want 60-90", start, end)
+	}
+	if episode, _ := show.GetEpisode("Show_S01E02"); episode.Markers.CreditsStartSeconds == nil {
+		t.Error("credits marker was dropped")
+	}
+
+	// Overwriting replaces them
+	if err := show.saveIntroMarkers("Show_S01E01", 60, 90, true); err != nil {
+		t.Fatalf("saveIntroMarkers with overwrite error: %v", err)
+	}
+	if start, end := intro("Show_S01E01"); start != 60 || end != 90 {
+		t.Errorf("intro after overwriting = %v-%v, want 60-90", start, end)
+	}
+}
@@ -0,0 +1,277 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"comfort-player-backend/models"
+	"comfort-player-backend/utils"
+)
+
+var (
+	// ErrKeyNotFound is returned when an API key ID is unknown
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrInvalidScope is returned when an API key scope is unknown
+	ErrInvalidScope = errors.New("invalid scope")
+)
+
+// keyPrefix starts every generated API key so they're easy to recognize
+const keyPrefix = "cpk_"
+
+// scopeLevels orders the scopes from least to most privileged
+var scopeLevels = map[string]int{
+	models.ScopeRead:     1,
+	models.ScopePlayback: 2,
+	models.ScopeAdmin:    3,
+}
+
+// ScopeAllows reports whether a key with the given scope may use a route requiring required
+func ScopeAllows(scope, required string) bool {
+	level, ok := scopeLevels[scope]
+	return ok && level >= scopeLevels[required]
+}
+
+// apiKeyContextKey is the context key holding the API key a request was authenticated with
+type apiKeyContextKey struct{}
+
+// ContextWithAPIKey returns a copy of ctx carrying the authenticated API key
+func ContextWithAPIKey(ctx context.Context, key models.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+// APIKeyFromContext returns the API key a request was authenticated with. Requests
+// authenticated by a signed URL carry no key.
+func APIKeyFromContext(ctx context.Context) (models.APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey{}).(models.APIKey)
+	return key, ok
+}
+
+// KeyService manages the API keys stored in the keys file. The configured
+// bootstrap key is always accepted as an admin key.
+type KeyService struct {
+	keysFile     string
+	bootstrapKey [sha256.Size]byte
+	hasBootstrap bool
+	keys         []models.APIKey
+	mutex        sync.RWMutex
+}
+
+// NewKeyService creates a new key service. It fails if the keys file exists
+// but can't be read, since the next save would replace every key in it.
+func NewKeyService(keysFile, bootstrapKey string) (*KeyService, error) {
+	service := &KeyService{
+		keysFile: keysFile,
+	}
+	if bootstrapKey != "" {
+		service.bootstrapKey = sha256.Sum256([]byte(bootstrapKey))
+		service.hasBootstrap = true
+	}
+
+	// Load existing keys if there are any
+	if err := service.loadKeys(); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// EnsureAdminKey makes sure some admin key can be used. Without a bootstrap key
+// or an active stored admin key, a random bootstrap key is generated once, kept
+// in path, so the server never runs with a publicly known key.
+func (s *KeyService) EnsureAdminKey(path string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.hasBootstrap {
+		return nil
+	}
+	for _, key := range s.keys {
+		if key.Scope == models.ScopeAdmin && key.RevokedAt == 0 {
+			return nil
+		}
+	}
+
+	if data, err := os.ReadFile(path); err == nil {
+		if key := strings.TrimSpace(string(data)); key != "" {
+			log.Printf("EnsureAdminKey: API_KEY is not set, using the admin key in %s", path)
+			s.bootstrapKey = sha256.Sum256([]byte(key))
+			s.hasBootstrap = true
+			return nil
+		}
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	key := keyPrefix + secret
+	if err := utils.EnsureDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write admin key: %w", err)
+	}
+	s.bootstrapKey = sha256.Sum256([]byte(key))
+	s.hasBootstrap = true
+
+	// The key itself is never logged, since logs end up in places like docker logs
+	log.Printf("EnsureAdminKey: API_KEY is not set, generated an admin key in %s", path)
+	return nil
+}
+
+// Authenticate returns the key matching a presented API key. Every stored hash
+// is compared in constant time so timing doesn't reveal which keys exist.
+func (s *KeyService) Authenticate(presented string) (models.APIKey, bool) {
+	hash := sha256.Sum256([]byte(presented))
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var match models.APIKey
+	found := false
+	if s.hasBootstrap && subtle.ConstantTimeCompare(hash[:], s.bootstrapKey[:]) == 1 {
+		match = models.APIKey{ID: "bootstrap", Name: "API_KEY", Scope: models.ScopeAdmin}
+		found = true
+	}
+	for _, key := range s.keys {
+		stored, err := hex.DecodeString(key.Hash)
+		if err != nil {
+			continue
+		}
+		if subtle.ConstantTimeCompare(hash[:], stored) == 1 && key.RevokedAt == 0 {
+			match = key
+			found = true
+		}
+	}
+	return match, found
+}
+
+// List returns every key, without their hashes, oldest first
+func (s *KeyService) List() []models.APIKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	keys := make([]models.APIKey, len(s.keys))
+	for i, key := range s.keys {
+		key.Hash = ""
+		keys[i] = key
+	}
+	return keys
+}
+
+// Create generates a new key. The returned key is the only copy of the secret.
+func (s *KeyService) Create(name, scope string) (models.CreateAPIKeyResponse, error) {
+	if _, ok := scopeLevels[scope]; !ok {
+		return models.CreateAPIKeyResponse{}, fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return models.CreateAPIKeyResponse{}, err
+	}
+	id, err := randomToken(6)
+	if err != nil {
+		return models.CreateAPIKeyResponse{}, err
+	}
+
+	plain := keyPrefix + secret
+	hash := sha256.Sum256([]byte(plain))
+	key := models.APIKey{
+		ID:        id,
+		Name:      name,
+		Scope:     scope,
+		Hash:      hex.EncodeToString(hash[:]),
+		CreatedAt: time.Now().Unix(),
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.keys = append(s.keys, key)
+	if err := s.saveKeys(); err != nil {
+		s.keys = s.keys[:len(s.keys)-1]
+		return models.CreateAPIKeyResponse{}, err
+	}
+
+	log.Printf("Create: Created %s key %s (%s)", scope, id, name)
+	key.Hash = ""
+	return models.CreateAPIKeyResponse{APIKey: key, Key: plain}, nil
+}
+
+// Revoke disables a key. Revoked keys stay listed so their use can be traced.
+func (s *KeyService) Revoke(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := range s.keys {
+		if s.keys[i].ID != id {
+			continue
+		}
+		if s.keys[i].RevokedAt != 0 {
+			return nil
+		}
+
+		s.keys[i].RevokedAt = time.Now().Unix()
+		if err := s.saveKeys(); err != nil {
+			s.keys[i].RevokedAt = 0
+			return err
+		}
+		log.Printf("Revoke: Revoked key %s (%s)", id, s.keys[i].Name)
+		return nil
+	}
+	return ErrKeyNotFound
+}
+
+// saveKeys writes the keys to file. Callers must hold the write lock.
+func (s *KeyService) saveKeys() error {
+	sort.SliceStable(s.keys, func(i, j int) bool {
+		return s.keys[i].CreatedAt < s.keys[j].CreatedAt
+	})
+	if err := utils.WriteJSON(s.keysFile, s.keys); err != nil {
+		log.Printf("saveKeys: Error saving keys to file: %v", err)
+		return err
+	}
+	return nil
+}
+
+// loadKeys loads the keys from file
+func (s *KeyService) loadKeys() error {
+	log.Printf("loadKeys: Loading keys from file: %s", s.keysFile)
+
+	if !utils.FileExists(s.keysFile) {
+		log.Printf("loadKeys: Keys file not found, only the API_KEY key is accepted")
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var keys []models.APIKey
+	if err := utils.ReadJSON(s.keysFile, &keys); err != nil {
+		log.Printf("loadKeys: Error reading keys file: %v", err)
+		return fmt.Errorf("failed to read keys file %s: %w", s.keysFile, err)
+	}
+	s.keys = keys
+	log.Printf("loadKeys: Loaded %d keys", len(s.keys))
+	return nil
+}
+
+// randomToken returns n random bytes encoded as unpadded URL-safe base64
+func randomToken(n int) (string, error) {
+	buffer := make([]byte, n)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", fmt.Errorf("failed to generate random token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
@@ -0,0 +1,209 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"comfort-player-backend/models"
+)
+
+func TestScopeAllows(t *testing.T) {
+	tests := []struct {
+		scope    string
+		required string
+		want     bool
+	}{
+		{models.ScopeRead, models.ScopeRead, true},
+		{models.ScopeRead, models.ScopePlayback, false},
+		{models.ScopeRead, models.ScopeAdmin, false},
+		{models.ScopePlayback, models.ScopeRead, true},
+		{models.ScopePlayback, models.ScopePlayback, true},
+		{models.ScopePlayback, models.ScopeAdmin, false},
+		{models.ScopeAdmin, models.ScopeRead, true},
+		{models.ScopeAdmin, models.ScopeAdmin, true},
+		{"", models.ScopeRead, false},
+		{"root", models.ScopeRead, false},
+	}
+
+	for _, test := range tests {
+		if got := ScopeAllows(test.scope, test.required); got != test.want {
+			t.Errorf("ScopeAllows(%q, %q) = %v, want %v", test.scope, test.required, got, test.want)
+		}
+	}
+}
+
+// newTestKeyService creates a key service, failing the test if the keys can't be loaded
+func newTestKeyService(t *testing.T, keysFile, bootstrapKey string) *KeyService {
+	t.Helper()
+	service, err := NewKeyService(keysFile, bootstrapKey)
+	if err != nil {
+		t.Fatalf("NewKeyService error: %v", err)
+	}
+	return service
+}
+
+func TestKeyServiceAuthenticate(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "keys.json")
+	service := newTestKeyService(t, keysFile, "bootstrap-secret")
+
+	created, err := service.Create("Living room TV", models.ScopeRead)
+	if err != nil {
+		t.Fatalf("Create error: %v", err)
+	}
+	if !strings.HasPrefix(created.Key, keyPrefix) || created.Hash != "" {
+		t.Errorf("Create = %+v, want a %s key and no hash", created, keyPrefix)
+	}
+	if _, err := service.Create("Phone", "root"); !errors.Is(err, ErrInvalidScope) {
+		t.Errorf("Create with an unknown scope error = %v, want %v", err, ErrInvalidScope)
+	}
+
+	// Only the hash of the key is stored
+	data, err := os.ReadFile(keysFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), created.Key) {
+		t.Error("keys file holds the key itself")
+	}
+
+	check := func(service *KeyService, presented, wantID, wantScope string) {
+		t.Helper()
+		key, ok := service.Authenticate(presented)
+		if wantID == "" {
+			if ok {
+				t.Errorf("Authenticate(%q) = %+v, want no key", presented, key)
+			}
+			return
+		}
+		if !ok || key.ID != wantID || key.Scope != wantScope {
+			t.Errorf("Authenticate(%q) = %+v, %v; want key %s with scope %s", presented, key, ok, wantID, wantScope)
+		}
+	}
+	check(service, created.Key, created.ID, models.ScopeRead)
+	check(service, "bootstrap-secret", "bootstrap", models.ScopeAdmin)
+	check(service, created.Key+"x", "", "")
+	check(service, "", "", "")
+
+	// Keys are looked up by their hash after a restart
+	service = newTestKeyService(t, keysFile, "")
+	check(service, created.Key, created.ID, models.ScopeRead)
+	check(service, "bootstrap-secret", "", "")
+	for _, key := range service.List() {
+		if key.Hash != "" {
+			t.Errorf("List returned the hash of key %s", key.ID)
+		}
+	}
+
+	// Revoked keys stay listed but are no longer accepted
+	if err := service.Revoke(created.ID); err != nil {
+		t.Fatalf("Revoke error: %v", err)
+	}
+	check(service, created.Key, "", "")
+	if keys := service.List(); len(keys) != 1 || keys[0].RevokedAt == 0 {
+		t.Errorf("List after revoking = %+v, want the revoked key", keys)
+	}
+	check(newTestKeyService(t, keysFile, ""), created.Key, "", "")
+	if err := service.Revoke("unknown"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Revoke of an unknown key error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestEnsureAdminKey(t *testing.T) {
+	t.Run("bootstrap key set", func(t *testing.T) {
+		dir := t.TempDir()
+		adminKeyFile := filepath.Join(dir, "admin.key")
+		service := newTestKeyService(t, filepath.Join(dir, "keys.json"), "bootstrap-secret")
+		if err := service.EnsureAdminKey(adminKeyFile); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(adminKeyFile); !os.IsNotExist(err) {
+			t.Errorf("admin key written although API_KEY is set: %v", err)
+		}
+	})
+
+	t.Run("stored admin key", func(t *testing.T) {
+		dir := t.TempDir()
+		adminKeyFile := filepath.Join(dir, "admin.key")
+		service := newTestKeyService(t, filepath.Join(dir, "keys.json"), "")
+		if _, err := service.Create("Admin", models.ScopeAdmin); err != nil {
+			t.Fatal(err)
+		}
+		if err := service.EnsureAdminKey(adminKeyFile); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(adminKeyFile); !os.IsNotExist(err) {
+			t.Errorf("admin key written although an admin key is stored: %v", err)
+		}
+	})
+
+	t.Run("generated", func(t *testing.T) {
+		dir := t.TempDir()
+		keysFile := filepath.Join(dir, "keys.json")
+		adminKeyFile := filepath.Join(dir, "data", "admin.key")
+		service := newTestKeyService(t, keysFile, "")
+
+		// A revoked admin key doesn't count
+		admin, err := service.Create("Old admin", models.ScopeAdmin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		service.Revoke(admin.ID)
+		if err := service.EnsureAdminKey(adminKeyFile); err != nil {
+			t.Fatalf("EnsureAdminKey error: %v", err)
+		}
+
+		data, err := os.ReadFile(adminKeyFile)
+		if err != nil {
+			t.Fatalf("admin key not written: %v", err)
+		}
+		generated := strings.TrimSpace(string(data))
+		if !strings.HasPrefix(generated, keyPrefix) {
+			t.Errorf("generated key = %q, want a %s key", generated, keyPrefix)
+		}
+		if info, err := os.Stat(adminKeyFile); err == nil && info.Mode().Perm() != 0600 {
+			t.Errorf("admin key file mode = %v, want 0600", info.Mode().Perm())
+		}
+		if key, ok := service.Authenticate(generated); !ok || key.Scope != models.ScopeAdmin {
+			t.Errorf("Authenticate(generated key) = %+v, %v; want an admin key", key, ok)
+		}
+
+		// The next start uses the same key
+		service = newTestKeyService(t, keysFile, "")
+		if err := service.EnsureAdminKey(adminKeyFile); err != nil {
+			t.Fatal(err)
+		}
+		if again, _ := os.ReadFile(adminKeyFile); string(again) != string(data) {
+			t.Errorf("admin key changed from %q to %q", data, again)
+		}
+		if key, ok := service.Authenticate(generated); !ok || key.Scope != models.ScopeAdmin {
+			t.Errorf("Authenticate(generated key) after a restart = %+v, %v; want an admin key", key, ok)
+		}
+	})
+}
+
+func TestKeyServiceUnreadableKeysFile(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "keys.json")
+	service := newTestKeyService(t, keysFile, "")
+	if _, err := service.Create("Living room TV", models.ScopeRead); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(keysFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A damaged keys file stops startup instead of being replaced by the next save
+	damaged := data[:len(data)/2]
+	if err := os.WriteFile(keysFile, damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKeyService(keysFile, ""); err == nil {
+		t.Fatal("NewKeyService with a damaged keys file succeeded")
+	}
+	if got, _ := os.ReadFile(keysFile); string(got) != string(damaged) {
+		t.Errorf("keys file = %q, want it left as it was", got)
+	}
+}
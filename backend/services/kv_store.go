@@ -0,0 +1,329 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"comfort-player-backend/utils"
+)
+
+// kvMagic starts every key-value database file
+const kvMagic = "CPKV1\n"
+
+// Record operations
+const (
+	kvPut    byte = 1 // Replace a document
+	kvAppend byte = 2 // Add a record to a log
+)
+
+// kvCompactMinSize is the file size below which replaced documents are left in place
+const kvCompactMinSize = 1 << 20
+
+// errKVClosed is returned when writing to a closed database
+var errKVClosed = errors.New("state database is closed")
+
+// KVStore is an embedded key-value database kept in a single append-only file.
+// Every write appends a checksummed record and syncs it to disk, so a crash
+// can lose at most the record being written; a damaged tail is cut off when
+// the file is opened. Everything is also held in memory. Once replaced
+// documents take up more than half of the file, it's rewritten without them.
+// Only one process may have the file open.
+type KVStore struct {
+	path      string
+	file      *os.File
+	documents map[string][]byte
+	logs      map[string][][]byte
+	size      int64 // Bytes in the file
+	garbage   int64 // Bytes taken by replaced documents
+	mutex     sync.RWMutex
+}
+
+// OpenKVStore opens or creates a key-value database
+func OpenKVStore(path string) (*KVStore, error) {
+	if err := utils.EnsureDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	created := len(data) == 0
+
+	store := &KVStore{
+		path:      path,
+		documents: make(map[string][]byte),
+		logs:      make(map[string][][]byte),
+	}
+	valid := int64(len(kvMagic))
+	if !created {
+		if !bytes.HasPrefix(data, []byte(kvMagic)) {
+			return nil, fmt.Errorf("%s is not a state database", path)
+		}
+		if valid, err = store.replay(data); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if valid < int64(len(data)) {
+			log.Printf("OpenKVStore: Discarding %d damaged bytes at the end of %s", int64(len(data))-valid, path)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		if _, err := file.WriteAt([]byte(kvMagic), 0); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if err := file.Truncate(valid); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	store.file = file
+	store.size = valid
+
+	log.Printf("OpenKVStore: Opened %s with %d documents and %d logs", path, len(store.documents), len(store.logs))
+	return store, nil
+}
+
+// replay applies the records of a database file and returns the offset of the
+// first damaged or incomplete record, or the end of the data
+func (s *KVStore) replay(data []byte) (int64, error) {
+	offset := len(kvMagic)
+	for offset+8 <= len(data) {
+		length := int(binary.LittleEndian.Uint32(data[offset:]))
+		checksum := binary.LittleEndian.Uint32(data[offset+4:])
+		if length < 1 || offset+8+length > len(data) {
+			break
+		}
+		body := data[offset+8 : offset+8+length]
+		if crc32.ChecksumIEEE(body) != checksum {
+			break
+		}
+
+		keyLength, n := binary.Uvarint(body[1:])
+		if n <= 0 || uint64(len(body)-1-n) < keyLength {
+			break
+		}
+		key := string(body[1+n : 1+n+int(keyLength)])
+		value := append([]byte(nil), body[1+n+int(keyLength):]...)
+		if err := s.apply(body[0], key, value); err != nil {
+			return 0, err
+		}
+		offset += 8 + length
+	}
+	return int64(offset), nil
+}
+
+// apply updates the in-memory data with a record. Callers must hold the write lock.
+func (s *KVStore) apply(op byte, key string, value []byte) error {
+	switch op {
+	case kvPut:
+		if previous, ok := s.documents[key]; ok {
+			s.garbage += kvRecordSize(key, previous)
+		}
+		s.documents[key] = value
+	case kvAppend:
+		s.logs[key] = append(s.logs[key], value)
+	default:
+		return fmt.Errorf("unknown record type %d", op)
+	}
+	return nil
+}
+
+// encodeKVRecord encodes a record: body length and CRC-32 of the body, then a
+// body made of the operation, the key length as a varint, the key and the value
+func encodeKVRecord(op byte, key string, value []byte) []byte {
+	record := make([]byte, 8, kvRecordSize(key, value))
+	record = append(record, op)
+	record = binary.AppendUvarint(record, uint64(len(key)))
+	record = append(record, key...)
+	record = append(record, value...)
+
+	body := record[8:]
+	binary.LittleEndian.PutUint32(record[0:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(body))
+	return record
+}
+
+// kvRecordSize returns the encoded size of a record
+func kvRecordSize(key string, value []byte) int64 {
+	var varint [binary.MaxVarintLen64]byte
+	return int64(8 + 1 + binary.PutUvarint(varint[:], uint64(len(key))) + len(key) + len(value))
+}
+
+// write appends a record to the file, syncs it and applies it
+func (s *KVStore) write(op byte, key string, value []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return errKVClosed
+	}
+
+	record := encodeKVRecord(op, key, value)
+	if _, err := s.file.Write(record); err != nil {
+		// Cut off whatever part was written, so later records follow a valid one
+		return s.rollback(err)
+	}
+	if err := s.file.Sync(); err != nil {
+		// The record may not be on disk; drop it so the file matches what's in memory
+		return s.rollback(err)
+	}
+	s.size += int64(len(record))
+	s.apply(op, key, value)
+
+	// The record is already saved, so a failed compaction isn't the caller's
+	// error; the old file stays in use and the next write tries again
+	if s.size > kvCompactMinSize && s.garbage*2 > s.size {
+		if err := s.compact(); err != nil {
+			log.Printf("KVStore.write: Error compacting %s: %v", s.path, err)
+		}
+	}
+	return nil
+}
+
+// rollback cuts the file back to the last complete record after a failed
+// write. If that fails too, records written later would follow a damaged one
+// and be dropped when the file is opened, so the database stops taking writes.
+// Callers must hold the write lock.
+func (s *KVStore) rollback(writeErr error) error {
+	err := s.file.Truncate(s.size)
+	if err == nil {
+		_, err = s.file.Seek(s.size, io.SeekStart)
+	}
+	if err != nil {
+		log.Printf("KVStore.rollback: Error cutting off a failed write to %s, closing it: %v", s.path, err)
+		s.file.Close()
+		s.file = nil
+		return errors.Join(writeErr, fmt.Errorf("failed to cut off the failed record: %w", err))
+	}
+	return writeErr
+}
+
+// compact rewrites the file with only the current documents and the logs.
+// Callers must hold the write lock.
+func (s *KVStore) compact() error {
+	log.Printf("KVStore.compact: Compacting %s (%d of %d bytes unused)", s.path, s.garbage, s.size)
+
+	var buf bytes.Buffer
+	buf.WriteString(kvMagic)
+	keys := make([]string, 0, len(s.documents))
+	for key := range s.documents {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf.Write(encodeKVRecord(kvPut, key, s.documents[key]))
+	}
+	for key, records := range s.logs {
+		for _, record := range records {
+			buf.Write(encodeKVRecord(kvAppend, key, record))
+		}
+	}
+
+	// Write the new file next to the old one and keep it open, so the old
+	// handle is only let go once the new file is in place and writable. Until
+	// then a failure leaves the old file in use.
+	dir := filepath.Dir(s.path)
+	file, err := os.CreateTemp(dir, "."+filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf.Bytes()); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), s.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	utils.SyncDir(dir)
+
+	s.file.Close()
+	s.file = file
+	s.size = int64(buf.Len())
+	s.garbage = 0
+	return nil
+}
+
+// Load reads a document
+func (s *KVStore) Load(key string, v interface{}) (bool, error) {
+	s.mutex.RLock()
+	data, ok := s.documents[key]
+	s.mutex.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// Save replaces a document
+func (s *KVStore) Save(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.write(kvPut, key, data)
+}
+
+// Append adds a record to a log
+func (s *KVStore) Append(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.write(kvAppend, key, data)
+}
+
+// Scan calls fn with every record of a log. Records appended while scanning
+// aren't included.
+func (s *KVStore) Scan(key string, fn func(record []byte) error) error {
+	s.mutex.RLock()
+	records := s.logs[key]
+	s.mutex.RUnlock()
+
+	for _, record := range records {
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the database file
+func (s *KVStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,332 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"comfort-player-backend/config"
+)
+
+// openTestKVStore opens a key-value database, failing the test on error
+func openTestKVStore(t *testing.T, path string) *KVStore {
+	t.Helper()
+	store, err := OpenKVStore(path)
+	if err != nil {
+		t.Fatalf("OpenKVStore error: %v", err)
+	}
+	return store
+}
+
+// kvLog returns the records of a log as strings
+func kvLog(t *testing.T, store StateStore, key string) []string {
+	t.Helper()
+	var records []string
+	if err := store.Scan(key, func(record []byte) error {
+		records = append(records, string(record))
+		return nil
+	}); err != nil {
+		t.Fatalf("Scan error: %v", err)
+	}
+	return records
+}
+
+// kvDocument returns a document as a string, or "" if there is none
+func kvDocument(t *testing.T, store StateStore, key string) string {
+	t.Helper()
+	var document json.RawMessage
+	found, err := store.Load(key, &document)
+	if err != nil {
+		t.Fatalf("Load(%q) error: %v", key, err)
+	}
+	if !found {
+		return ""
+	}
+	return string(document)
+}
+
+func TestKVStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	store := openTestKVStore(t, path)
+
+	if err := store.Save("state", map[string]int{"position": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save("state", map[string]int{"position": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save("profiles", []string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range []string{"started", "finished"} {
+		if err := store.Append("history", event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(store *KVStore) {
+		t.Helper()
+		if got := kvDocument(t, store, "state"); got != `{"position":2}` {
+			t.Errorf("state = %s, want the last saved document", got)
+		}
+		if got := kvDocument(t, store, "profiles"); got != `["alice"]` {
+			t.Errorf("profiles = %s", got)
+		}
+		if got := kvDocument(t, store, "missing"); got != "" {
+			t.Errorf("missing document = %s, want none", got)
+		}
+		if got, want := kvLog(t, store, "history"), []string{`"started"`, `"finished"`}; !reflect.DeepEqual(got, want) {
+			t.Errorf("history = %q, want %q", got, want)
+		}
+	}
+	check(store)
+
+	// Everything comes back after reopening, and writing continues after it
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save("state", 1); err != errKVClosed {
+		t.Errorf("Save after Close error = %v, want %v", err, errKVClosed)
+	}
+	store = openTestKVStore(t, path)
+	check(store)
+	if err := store.Save("later", true); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store = openTestKVStore(t, path)
+	defer store.Close()
+	check(store)
+	if got := kvDocument(t, store, "later"); got != "true" {
+		t.Errorf("later = %s, want true", got)
+	}
+}
+
+func TestKVStoreDamagedTail(t *testing.T) {
+	lastRecord := int64(len(encodeKVRecord(kvAppend, "history", []byte(`"last"`))))
+
+	tests := []struct {
+		name   string
+		damage func(data []byte) []byte
+	}{
+		{name: "record cut short", damage: func(data []byte) []byte {
+			return data[:len(data)-3]
+		}},
+		{name: "header cut short", damage: func(data []byte) []byte {
+			return data[:len(data)-int(lastRecord)+5]
+		}},
+		{name: "checksum mismatch", damage: func(data []byte) []byte {
+			data[len(data)-2] ^= 0xFF
+			return data
+		}},
+		{name: "zero length record", damage: func(data []byte) []byte {
+			copy(data[len(data)-int(lastRecord):], make([]byte, 8))
+			return data
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.db")
+			store := openTestKVStore(t, path)
+			store.Save("state", "kept")
+			store.Append("history", "first")
+			store.Append("history", "last")
+			store.Close()
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			validSize := int64(len(data)) - lastRecord
+			if err := os.WriteFile(path, test.damage(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			store = openTestKVStore(t, path)
+			if got := kvDocument(t, store, "state"); got != `"kept"` {
+				t.Errorf("state = %s, want the document before the damage", got)
+			}
+			if got, want := kvLog(t, store, "history"), []string{`"first"`}; !reflect.DeepEqual(got, want) {
+				t.Errorf("history = %q, want %q", got, want)
+			}
+			if info, err := os.Stat(path); err != nil || info.Size() != validSize {
+				t.Errorf("file size = %v, want the damaged tail cut off at %d", info.Size(), validSize)
+			}
+
+			// Records written after the cut are read back
+			store.Append("history", "after")
+			store.Close()
+			store = openTestKVStore(t, path)
+			defer store.Close()
+			if got, want := kvLog(t, store, "history"), []string{`"first"`, `"after"`}; !reflect.DeepEqual(got, want) {
+				t.Errorf("history after reopening = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestKVStoreNotADatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	if err := os.WriteFile(path, []byte(`{"json": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenKVStore(path); err == nil {
+		t.Error("OpenKVStore of a JSON file succeeded")
+	}
+}
+
+func TestKVStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	store := openTestKVStore(t, path)
+
+	// Replacing a large document fills the file with old versions
+	large := strings.Repeat("x", 100<<10)
+	store.Save("profiles", []string{"alice"})
+	for i := 0; i < 3; i++ {
+		store.Append("history", i)
+	}
+	for i := 0; i < 15; i++ {
+		if err := store.Save("state", large+string(rune('a'+i))); err != nil {
+			t.Fatalf("Save %d error: %v", i, err)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != store.size || info.Size() > kvCompactMinSize {
+		t.Fatalf("file is %d bytes, want it compacted", info.Size())
+	}
+
+	check := func(store *KVStore) {
+		t.Helper()
+		if got, want := kvDocument(t, store, "state"), `"`+large+`o"`; got != want {
+			t.Errorf("state = %.20s... (%d bytes), want the last version", got, len(got))
+		}
+		if got := kvDocument(t, store, "profiles"); got != `["alice"]` {
+			t.Errorf("profiles = %s", got)
+		}
+		if got, want := kvLog(t, store, "history"), []string{"0", "1", "2"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("history = %q, want %q", got, want)
+		}
+	}
+	check(store)
+
+	// Writes go to the new file
+	store.Append("history", 3)
+	store.Close()
+	store = openTestKVStore(t, path)
+	defer store.Close()
+	if got, want := kvLog(t, store, "history"), []string{"0", "1", "2", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("history after reopening = %q, want %q", got, want)
+	}
+}
+
+func TestKVStoreFailedCompaction(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.db")
+	store := openTestKVStore(t, path)
+
+	// Compacting fails when the new file can't be created; point the store at a
+	// directory that doesn't exist to make that happen
+	store.path = filepath.Join(dir, "missing", "state.db")
+	large := strings.Repeat("x", 400<<10)
+	for i := 0; i < 6; i++ {
+		if err := store.Save("state", large+string(rune('a'+i))); err != nil {
+			t.Fatalf("Save %d error while compacting fails: %v", i, err)
+		}
+	}
+	if store.garbage*2 <= store.size {
+		t.Fatal("the store was compacted")
+	}
+	if got := kvDocument(t, store, "state"); !strings.HasPrefix(got, `"`+large+"f") {
+		t.Errorf("state = %.20s..., want the last document saved", got)
+	}
+
+	// The old file is still in use and has every record; once the new file can
+	// be created, the next write compacts it
+	store.path = path
+	if err := store.Save("after", true); err != nil {
+		t.Fatalf("Save after a failed compaction error: %v", err)
+	}
+	store.Close()
+	store = openTestKVStore(t, path)
+	defer store.Close()
+	if got := kvDocument(t, store, "after"); got != "true" {
+		t.Errorf("after = %s, want true", got)
+	}
+	if got := kvDocument(t, store, "state"); !strings.HasPrefix(got, `"`+large) {
+		t.Errorf("state = %.20s..., want the document written before compacting failed", got)
+	}
+}
+
+func TestImportKVStore(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"state.json":       `{"currentEpisodeId": "Show_S01E02"}`,
+		"state-other.json": `{"currentEpisodeId": "Other_S02E01"}`,
+		"progress.json":    `{"alice": {}}`,
+		"profiles.json":    `[{"id": "alice"`,
+		"history.jsonl":    "{\"event\": 1}\n{\"event\": 2}\n{\"event\"",
+		"unrelated.json":   `{"ignored": true}`,
+		"state.db.tmp":     "left over from an import that failed",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config.Config{StateFile: filepath.Join(dir, "state.json"), StateStore: StateStoreKV}
+	store, err := OpenStateStore(cfg)
+	if err != nil {
+		t.Fatalf("OpenStateStore error: %v", err)
+	}
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"state", `{"currentEpisodeId":"Show_S01E02"}`},
+		{"state-other", `{"currentEpisodeId":"Other_S02E01"}`},
+		{"progress", `{"alice":{}}`},
+		// Unreadable documents start over, as they do with the JSON files
+		{"profiles", ""},
+		{"unrelated", ""},
+	}
+	for _, test := range tests {
+		got := kvDocument(t, store, test.key)
+		var compacted bytes.Buffer
+		if got != "" {
+			json.Compact(&compacted, []byte(got))
+		}
+		if compacted.String() != test.want {
+			t.Errorf("%s = %s, want %s", test.key, compacted.String(), test.want)
+		}
+	}
+	if got, want := kvLog(t, store, "history"), []string{`{"event":1}`, `{"event":2}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("history = %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "state.db.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary database left behind: %v", err)
+	}
+
+	// The database isn't imported again once it has data
+	store.Save("state", "changed")
+	store.Close()
+	store, err = OpenStateStore(cfg)
+	if err != nil {
+		t.Fatalf("reopening error: %v", err)
+	}
+	defer store.Close()
+	if got := kvDocument(t, store, "state"); got != `"changed"` {
+		t.Errorf("state after reopening = %s, want the database's version", got)
+	}
+}
@@ -0,0 +1,199 @@
+package services
+
+import (
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"comfort-player-backend/media"
+	"comfort-player-backend/models"
+)
+
+// cachedMediaInfo is a probe result, kept until the file changes
+type cachedMediaInfo struct {
+	size    int64
+	modTime time.Time
+	info    *models.MediaInfo
+}
+
+// mediaInfoCache remembers probe results by file path, and which file each
+// episode was last probed from
+type mediaInfoCache struct {
+	entries  map[string]cachedMediaInfo
+	episodes map[string]string
+	mutex    sync.Mutex
+}
+
+// probeEpisode probes an episode's video file like probe and remembers it as
+// the episode's file
+func (c *mediaInfoCache) probeEpisode(episodeID, path string) (*models.MediaInfo, error) {
+	info, err := c.probe(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.episodes == nil {
+		c.episodes = make(map[string]string)
+	}
+	c.episodes[episodeID] = path
+	return info, nil
+}
+
+// cachedEpisode returns the last probe result of an episode's video file
+// without touching the disk. It reports false if the episode wasn't probed yet.
+func (c *mediaInfoCache) cachedEpisode(episodeID string) (*models.MediaInfo, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	path, ok := c.episodes[episodeID]
+	if !ok {
+		return nil, false
+	}
+	cached, ok := c.entries[path]
+	return cached.info, ok
+}
+
+// probe returns the media info of a file, probing it again only if it changed
+func (c *mediaInfoCache) probe(path string) (*models.MediaInfo, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	cached, ok := c.entries[path]
+	c.mutex.Unlock()
+	if ok && cached.size == stat.Size() && cached.modTime.Equal(stat.ModTime()) {
+		return cached.info, nil
+	}
+
+	probed, err := media.Probe(path)
+	if probed == nil {
+		return nil, err
+	}
+	if err != nil {
+		// The container is still known, only the track list is missing
+		log.Printf("mediaInfoCache.probe: %v", err)
+	}
+	info := mediaInfoFromProbe(probed)
+
+	c.mutex.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]cachedMediaInfo)
+	}
+	c.entries[path] = cachedMediaInfo{size: stat.Size(), modTime: stat.ModTime(), info: info}
+	c.mutex.Unlock()
+	return info, nil
+}
+
+// mediaInfoFromProbe converts a probe result to the info exposed in episode metadata
+func mediaInfoFromProbe(probed *media.Info) *models.MediaInfo {
+	info := &models.MediaInfo{
+		Container:       probed.Container,
+		MimeType:        probed.MimeType,
+		DurationSeconds: probed.DurationSeconds,
+	}
+
+	counts := make(map[string]int)
+	for _, track := range probed.Tracks {
+		info.Tracks = append(info.Tracks, models.MediaTrack{
+			Index:    counts[track.Type],
+			Type:     track.Type,
+			Codec:    track.Codec,
+			CodecID:  track.CodecID,
+			Language: track.Language,
+			Name:     track.Name,
+			Default:  track.Default,
+			Forced:   track.Forced,
+			Width:    track.Width,
+			Height:   track.Height,
+			Channels: track.Channels,
+		})
+		counts[track.Type]++
+
+		switch {
+		case track.Type == media.TrackVideo && info.VideoCodec == "":
+			info.VideoCodec = track.Codec
+		case track.Type == media.TrackAudio && track.Codec != "":
+			info.AudioCodecs = append(info.AudioCodecs, track.Codec)
+		}
+	}
+	return info
+}
+
+// GetEpisodeMediaInfo returns the container and track information of an episode's video file
+func (s *ShowService) GetEpisodeMediaInfo(episodeID string) (*models.MediaInfo, error) {
+	videoPath, err := s.GetEpisodeVideoPath(episodeID)
+	if err != nil {
+		return nil, err
+	}
+	return s.mediaInfo.probeEpisode(episodeID, videoPath)
+}
+
+// attachMediaInfo fills in the media info of episodes whose video file can be
+// found. Without probe, only episodes already probed get it, and the disk isn't
+// touched; the library scan probes every episode it finds.
+func (s *ShowService) attachMediaInfo(episodes []models.EpisodeInfo, probe bool) {
+	for i := range episodes {
+		if !probe {
+			if info, ok := s.mediaInfo.cachedEpisode(episodes[i].ID); ok {
+				episodes[i].Media = info
+			}
+			continue
+		}
+
+		info, err := s.GetEpisodeMediaInfo(episodes[i].ID)
+		if err != nil {
+			log.Printf("attachMediaInfo: No media info for %s: %v", episodes[i].ID, err)
+			continue
+		}
+		episodes[i].Media = info
+	}
+}
+
+// probeIndexed probes the video files found by the last library scan, so show
+// info can describe them without probing. The probes run in the background on
+// the worker pool, so the scan doesn't wait for them; once they're done,
+// clients are told to fetch the episodes again.
+func (s *ShowService) probeIndexed() {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.jobs.Err() != nil {
+		return
+	}
+	videoPaths := make(map[string]string, len(s.index))
+	for id, episode := range s.index {
+		videoPaths[id] = episode.VideoPath
+	}
+
+	// Probes only start while holding the lock, so StopJobs waits for any that do
+	s.probing.Add(1)
+	go func() {
+		defer s.probing.Done()
+
+		var probes sync.WaitGroup
+		var probed atomic.Int64
+		for id, path := range videoPaths {
+			if err := s.pool.Acquire(s.jobs); err != nil {
+				break
+			}
+			probes.Add(1)
+			go func(id, path string) {
+				defer probes.Done()
+				defer s.pool.Release()
+				if _, err := s.mediaInfo.probeEpisode(id, path); err != nil {
+					log.Printf("probeIndexed: No media info for %s: %v", id, err)
+					return
+				}
+				probed.Add(1)
+			}(id, path)
+		}
+		probes.Wait()
+
+		log.Printf("probeIndexed: Probed %d of %d video files", probed.Load(), len(videoPaths))
+		s.events.Publish(catalogEvent(s.location.ID, ""))
+	}()
+}
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+
+	"comfort-player-backend/models"
+)
+
+const (
+	// maxRecentEpisodes bounds the list of played episodes used to rewind in random modes
+	maxRecentEpisodes = 50
+	// favoriteWeight is how much more likely a favorite is picked in favorites-weighted mode
+	favoriteWeight = 4
+)
+
+// randomSource is what the random playback modes draw from; *rand.Rand is one
+type randomSource interface {
+	Intn(n int) int
+	Shuffle(n int, swap func(i, j int))
+}
+
+// globalRandom draws from math/rand's top-level functions, which are safe for
+// concurrent use
+type globalRandom struct{}
+
+func (globalRandom) Intn(n int) int                     { return rand.Intn(n) }
+func (globalRandom) Shuffle(n int, swap func(i, j int)) { rand.Shuffle(n, swap) }
+
+// playbackRandom is replaced by a seeded source in tests
+var playbackRandom randomSource = globalRandom{}
+
+// IsValidPlaybackMode reports whether mode is a known playback mode
+func IsValidPlaybackMode(mode string) bool {
+	switch mode {
+	case models.PlaybackModeSequential, models.PlaybackModeShuffle,
+		models.PlaybackModeShuffleNoRepeat, models.PlaybackModeFavoritesWeighted:
+		return true
+	}
+	return false
+}
+
+// PickNextEpisode returns the episode of episodes that follows the state's
+// current episode according to its playback mode, updating the state's shuffle
+// bookkeeping
+func PickNextEpisode(state *models.ServerState, episodes []models.EpisodeInfo) (string, error) {
+	if len(episodes) == 0 {
+		return "", ErrNoEpisodes
+	}
+
+	current := state.CurrentEpisodeID
+	var next string
+	var err error
+	switch state.PlaybackMode {
+	case "", models.PlaybackModeSequential:
+		next, err = nextEpisodeID(episodes, current)
+		if err != nil {
+			return "", err
+		}
+	case models.PlaybackModeShuffle:
+		next = pickWeightedEpisode(episodes, current, nil)
+	case models.PlaybackModeShuffleNoRepeat:
+		next = nextFromShuffleQueue(state, episodes)
+	case models.PlaybackModeFavoritesWeighted:
+		favorites := make(map[string]bool, len(state.Favorites))
+		for _, id := range state.Favorites {
+			favorites[id] = true
+		}
+		next = pickWeightedEpisode(episodes, current, favorites)
+	default:
+		return "", fmt.Errorf("unknown playback mode: %s", state.PlaybackMode)
+	}
+
+	// Remember where we came from so rewind can go back in random modes
+	if current != "" && current != next {
+		state.RecentEpisodes = append(state.RecentEpisodes, current)
+		if len(state.RecentEpisodes) > maxRecentEpisodes {
+			state.RecentEpisodes = state.RecentEpisodes[len(state.RecentEpisodes)-maxRecentEpisodes:]
+		}
+	}
+
+	log.Printf("PickNextEpisode: Mode %q picked %s after %s", state.PlaybackMode, next, current)
+	return next, nil
+}
+
+// PickPreviousEpisode returns the episode of episodes before the state's current
+// episode. Random modes go back to the previously played episode.
+func PickPreviousEpisode(state *models.ServerState, episodes []models.EpisodeInfo) (string, error) {
+	current := state.CurrentEpisodeID
+	if state.PlaybackMode == "" || state.PlaybackMode == models.PlaybackModeSequential {
+		return previousEpisodeID(episodes, current)
+	}
+
+	valid := make(map[string]bool, len(episodes))
+	for _, episode := range episodes {
+		valid[episode.ID] = true
+	}
+
+	for len(state.RecentEpisodes) > 0 {
+		last := len(state.RecentEpisodes) - 1
+		previous := state.RecentEpisodes[last]
+		state.RecentEpisodes = state.RecentEpisodes[:last]
+		if !valid[previous] || previous == current {
+			continue
+		}
+
+		// The current episode hasn't really been seen, so it comes back in this cycle
+		if state.PlaybackMode == models.PlaybackModeShuffleNoRepeat && current != "" {
+			state.ShuffleQueue = append([]string{current}, state.ShuffleQueue...)
+		}
+		log.Printf("PickPreviousEpisode: Mode %q going back to %s", state.PlaybackMode, previous)
+		return previous, nil
+	}
+
+	// Nothing to go back to, fall back to the sequential order
+	return previousEpisodeID(episodes, current)
+}
+
+// nextFromShuffleQueue pops the next unseen episode from the state's shuffle
+// queue, starting a new shuffled cycle once every episode has been seen
+func nextFromShuffleQueue(state *models.ServerState, episodes []models.EpisodeInfo) string {
+	valid := make(map[string]bool, len(episodes))
+	for _, episode := range episodes {
+		valid[episode.ID] = true
+	}
+
+	refilled := false
+	for {
+		for len(state.ShuffleQueue) > 0 {
+			next := state.ShuffleQueue[0]
+			state.ShuffleQueue = state.ShuffleQueue[1:]
+			// Skip episodes that were removed from the catalog
+			if valid[next] && next != state.CurrentEpisodeID {
+				return next
+			}
+		}
+		if refilled {
+			break
+		}
+
+		// Every episode was seen, start a new cycle
+		log.Printf("nextFromShuffleQueue: Starting a new shuffle cycle of %d episodes", len(episodes))
+		queue := make([]string, len(episodes))
+		for i, episode := range episodes {
+			queue[i] = episode.ID
+		}
+		playbackRandom.Shuffle(len(queue), func(i, j int) {
+			queue[i], queue[j] = queue[j], queue[i]
+		})
+		// The current episode stays in the new cycle, just not first, so it isn't skipped
+		if len(queue) > 1 && queue[0] == state.CurrentEpisodeID {
+			swap := 1 + playbackRandom.Intn(len(queue)-1)
+			queue[0], queue[swap] = queue[swap], queue[0]
+		}
+		state.ShuffleQueue = queue
+		refilled = true
+	}
+
+	// Only the current episode is left
+	return episodes[0].ID
+}
+
+// pickWeightedEpisode picks a random episode other than the current one.
+// Favorites are favoriteWeight times more likely to be picked.
+func pickWeightedEpisode(episodes []models.EpisodeInfo, current string, favorites map[string]bool) string {
+	var candidates []string
+	var weights []int
+	total := 0
+	for _, episode := range episodes {
+		if episode.ID == current && len(episodes) > 1 {
+			continue
+		}
+		weight := 1
+		if favorites[episode.ID] {
+			weight = favoriteWeight
+		}
+		candidates = append(candidates, episode.ID)
+		weights = append(weights, weight)
+		total += weight
+	}
+
+	pick := playbackRandom.Intn(total)
+	for i, weight := range weights {
+		if pick < weight {
+			return candidates[i]
+		}
+		pick -= weight
+	}
+	return candidates[len(candidates)-1]
+}
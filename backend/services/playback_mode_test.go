@@ -0,0 +1,208 @@
+package services
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"comfort-player-backend/models"
+)
+
+// seedPlaybackRandom makes the random playback modes repeatable for a test
+func seedPlaybackRandom(t *testing.T, seed int64) {
+	t.Helper()
+	playbackRandom = rand.New(rand.NewSource(seed))
+	t.Cleanup(func() {
+		playbackRandom = globalRandom{}
+	})
+}
+
+// testEpisodes returns episodes with the given IDs
+func testEpisodes(ids ...string) []models.EpisodeInfo {
+	episodes := make([]models.EpisodeInfo, len(ids))
+	for i, id := range ids {
+		episodes[i] = models.EpisodeInfo{ID: id}
+	}
+	return episodes
+}
+
+// pickNext moves state to the next episode, failing the test on error
+func pickNext(t *testing.T, state *models.ServerState, episodes []models.EpisodeInfo) string {
+	t.Helper()
+	next, err := PickNextEpisode(state, episodes)
+	if err != nil {
+		t.Fatalf("PickNextEpisode error: %v", err)
+	}
+	state.CurrentEpisodeID = next
+	return next
+}
+
+func TestPickSequential(t *testing.T) {
+	episodes := testEpisodes("E1", "E2", "E3")
+
+	tests := []struct {
+		current  string
+		next     string
+		previous string
+	}{
+		{current: "", next: "E1", previous: "E1"},
+		{current: "E1", next: "E2", previous: "E3"},
+		{current: "E2", next: "E3", previous: "E1"},
+		{current: "E3", next: "E1", previous: "E2"},
+		{current: "removed", next: "E1", previous: "E1"},
+	}
+
+	for _, test := range tests {
+		for _, mode := range []string{"", models.PlaybackModeSequential} {
+			next, err := PickNextEpisode(&models.ServerState{CurrentEpisodeID: test.current, PlaybackMode: mode}, episodes)
+			if err != nil || next != test.next {
+				t.Errorf("mode %q: next after %q = %q, %v; want %q", mode, test.current, next, err, test.next)
+			}
+			previous, err := PickPreviousEpisode(&models.ServerState{CurrentEpisodeID: test.current, PlaybackMode: mode}, episodes)
+			if err != nil || previous != test.previous {
+				t.Errorf("mode %q: previous before %q = %q, %v; want %q", mode, test.current, previous, err, test.previous)
+			}
+		}
+	}
+
+	if _, err := PickNextEpisode(&models.ServerState{}, nil); err != ErrNoEpisodes {
+		t.Errorf("PickNextEpisode without episodes error = %v, want %v", err, ErrNoEpisodes)
+	}
+	if _, err := PickNextEpisode(&models.ServerState{PlaybackMode: "backwards"}, episodes); err == nil {
+		t.Error("PickNextEpisode in an unknown mode succeeded")
+	}
+}
+
+func TestPickShuffle(t *testing.T) {
+	seedPlaybackRandom(t, 1)
+	episodes := testEpisodes("E1", "E2", "E3", "E4")
+
+	state := &models.ServerState{CurrentEpisodeID: "E1", PlaybackMode: models.PlaybackModeShuffle}
+	picked := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		current := state.CurrentEpisodeID
+		if next := pickNext(t, state, episodes); next == current {
+			t.Fatalf("pick %d repeated %s", i, current)
+		}
+		picked[state.CurrentEpisodeID]++
+	}
+	for _, episode := range episodes {
+		if picked[episode.ID] < 200 {
+			t.Errorf("%s picked %d times out of 1000, want about a quarter", episode.ID, picked[episode.ID])
+		}
+	}
+	if len(state.RecentEpisodes) != maxRecentEpisodes {
+		t.Errorf("%d recent episodes kept, want %d", len(state.RecentEpisodes), maxRecentEpisodes)
+	}
+
+	// A single episode plays again
+	single := &models.ServerState{CurrentEpisodeID: "E1", PlaybackMode: models.PlaybackModeShuffle}
+	if next := pickNext(t, single, episodes[:1]); next != "E1" {
+		t.Errorf("next of a single episode = %q, want E1", next)
+	}
+}
+
+func TestPickFavoritesWeighted(t *testing.T) {
+	seedPlaybackRandom(t, 2)
+	episodes := testEpisodes("E1", "E2", "E3", "E4")
+
+	// E1 is current, so E2 has weight 4 against 1 each for E3 and E4
+	picked := make(map[string]int)
+	const picks = 6000
+	for i := 0; i < picks; i++ {
+		state := &models.ServerState{CurrentEpisodeID: "E1", PlaybackMode: models.PlaybackModeFavoritesWeighted, Favorites: []string{"E1", "E2"}}
+		picked[pickNext(t, state, episodes)]++
+	}
+	if picked["E1"] != 0 {
+		t.Errorf("the current episode was picked %d times", picked["E1"])
+	}
+	want := map[string]int{"E2": picks * 4 / 6, "E3": picks / 6, "E4": picks / 6}
+	for id, count := range want {
+		if count-picks/20 > picked[id] || picked[id] > count+picks/20 {
+			t.Errorf("%s picked %d times, want about %d", id, picked[id], count)
+		}
+	}
+}
+
+func TestPickShuffleNoRepeat(t *testing.T) {
+	episodes := testEpisodes("E1", "E2", "E3", "E4", "E5")
+
+	for seed := int64(0); seed < 20; seed++ {
+		seedPlaybackRandom(t, seed)
+		state := &models.ServerState{CurrentEpisodeID: "E1", PlaybackMode: models.PlaybackModeShuffleNoRepeat}
+
+		for cycle := 0; cycle < 3; cycle++ {
+			var seen []string
+			for i := 0; i < len(episodes); i++ {
+				current := state.CurrentEpisodeID
+				if next := pickNext(t, state, episodes); next == current {
+					t.Fatalf("seed %d cycle %d: %s played twice in a row", seed, cycle, next)
+				}
+				seen = append(seen, state.CurrentEpisodeID)
+
+				// The queue is part of the saved state, so the cycle goes on
+				// after a restart
+				data, err := json.Marshal(state)
+				if err != nil {
+					t.Fatal(err)
+				}
+				state = &models.ServerState{}
+				if err := json.Unmarshal(data, state); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			sort.Strings(seen)
+			if want := []string{"E1", "E2", "E3", "E4", "E5"}; !reflect.DeepEqual(seen, want) {
+				t.Fatalf("seed %d cycle %d played %q, want every episode once", seed, cycle, seen)
+			}
+		}
+	}
+}
+
+func TestPickShuffleNoRepeatSkipsRemovedEpisodes(t *testing.T) {
+	seedPlaybackRandom(t, 3)
+	state := &models.ServerState{
+		CurrentEpisodeID: "E1",
+		PlaybackMode:     models.PlaybackModeShuffleNoRepeat,
+		ShuffleQueue:     []string{"removed", "E1", "E3"},
+	}
+	if next := pickNext(t, state, testEpisodes("E1", "E2", "E3")); next != "E3" {
+		t.Errorf("next = %q, want E3", next)
+	}
+	if len(state.ShuffleQueue) != 0 {
+		t.Errorf("queue = %q, want it used up", state.ShuffleQueue)
+	}
+}
+
+func TestPickPreviousInRandomModes(t *testing.T) {
+	episodes := testEpisodes("E1", "E2", "E3", "E4")
+
+	state := &models.ServerState{
+		CurrentEpisodeID: "E4",
+		PlaybackMode:     models.PlaybackModeShuffleNoRepeat,
+		ShuffleQueue:     []string{"E1"},
+		RecentEpisodes:   []string{"E2", "removed", "E3", "E4"},
+	}
+	previous, err := PickPreviousEpisode(state, episodes)
+	if err != nil || previous != "E3" {
+		t.Fatalf("PickPreviousEpisode = %q, %v; want E3", previous, err)
+	}
+	// The episode rewound from hasn't been seen, so it's next in the cycle
+	if want := []string{"E4", "E1"}; !reflect.DeepEqual(state.ShuffleQueue, want) {
+		t.Errorf("queue = %q, want %q", state.ShuffleQueue, want)
+	}
+
+	state.CurrentEpisodeID = previous
+	if previous, _ := PickPreviousEpisode(state, episodes); previous != "E2" {
+		t.Errorf("second PickPreviousEpisode = %q, want E2 past the removed episode", previous)
+	}
+
+	// With nothing to go back to, the sequential order is used
+	state = &models.ServerState{CurrentEpisodeID: "E3", PlaybackMode: models.PlaybackModeShuffle}
+	if previous, _ := PickPreviousEpisode(state, episodes); previous != "E2" {
+		t.Errorf("PickPreviousEpisode without history = %q, want E2", previous)
+	}
+}
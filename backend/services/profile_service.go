@@ -0,0 +1,196 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"comfort-player-backend/models"
+	"comfort-player-backend/subtitles"
+)
+
+var (
+	// ErrProfileExists is returned when creating a profile whose ID is taken
+	ErrProfileExists = errors.New("profile already exists")
+	// ErrProfileNotFound is returned when a profile ID is unknown
+	ErrProfileNotFound = errors.New("profile not found")
+	// ErrInvalidLanguage is returned for language tags that aren't a known language
+	ErrInvalidLanguage = errors.New("unknown language")
+)
+
+// ProfileService manages the named profiles, stored as the "profiles" document of the state store
+type ProfileService struct {
+	store    StateStore
+	profiles map[string]models.Profile
+	mutex    sync.RWMutex
+}
+
+// NewProfileService creates a new profile service
+func NewProfileService(store StateStore) *ProfileService {
+	service := &ProfileService{
+		store:    store,
+		profiles: make(map[string]models.Profile),
+	}
+
+	// Load existing profiles if there are any
+	service.loadProfiles()
+	return service
+}
+
+// List returns every profile sorted by ID
+func (s *ProfileService) List() []models.Profile {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	profiles := make([]models.Profile, 0, len(s.profiles))
+	for _, profile := range s.profiles {
+		profiles = append(profiles, profile)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].ID < profiles[j].ID
+	})
+	return profiles
+}
+
+// Get returns the profile with the given ID
+func (s *ProfileService) Get(profileID string) (models.Profile, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	profile, ok := s.profiles[profileID]
+	return profile, ok
+}
+
+// Create adds a profile. Its ID is derived from the name.
+func (s *ProfileService) Create(name, subtitleLanguage string) (models.Profile, error) {
+	profileID := slugify(name)
+	if profileID == "" {
+		return models.Profile{}, fmt.Errorf("invalid profile name: %q", name)
+	}
+	subtitleLanguage, err := normalizeSubtitleLanguage(subtitleLanguage)
+	if err != nil {
+		return models.Profile{}, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.profiles[profileID]; exists {
+		return models.Profile{}, ErrProfileExists
+	}
+
+	profile := models.Profile{
+		ID:               profileID,
+		Name:             name,
+		CreatedAt:        time.Now().Unix(),
+		SubtitleLanguage: subtitleLanguage,
+	}
+	s.profiles[profileID] = profile
+
+	log.Printf("Create: Created profile %s, saving profiles", profileID)
+	if err := s.saveProfiles(); err != nil {
+		delete(s.profiles, profileID)
+		return models.Profile{}, err
+	}
+	return profile, nil
+}
+
+// SetSubtitleLanguage changes a profile's preferred subtitle language. An empty
+// language clears the preference.
+func (s *ProfileService) SetSubtitleLanguage(profileID, language string) (models.Profile, error) {
+	language, err := normalizeSubtitleLanguage(language)
+	if err != nil {
+		return models.Profile{}, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	profile, exists := s.profiles[profileID]
+	if !exists {
+		return models.Profile{}, ErrProfileNotFound
+	}
+	previous := profile
+	profile.SubtitleLanguage = language
+	s.profiles[profileID] = profile
+
+	log.Printf("SetSubtitleLanguage: Profile %s prefers subtitles in %q, saving profiles", profileID, language)
+	if err := s.saveProfiles(); err != nil {
+		s.profiles[profileID] = previous
+		return models.Profile{}, err
+	}
+	return profile, nil
+}
+
+// normalizeSubtitleLanguage validates a subtitle language preference
+func normalizeSubtitleLanguage(language string) (string, error) {
+	if language == "" {
+		return "", nil
+	}
+	normalized, ok := subtitles.NormalizeLanguage(language)
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrInvalidLanguage, language)
+	}
+	return normalized, nil
+}
+
+// Delete removes a profile
+func (s *ProfileService) Delete(profileID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	profile, exists := s.profiles[profileID]
+	if !exists {
+		return ErrProfileNotFound
+	}
+	delete(s.profiles, profileID)
+
+	log.Printf("Delete: Deleted profile %s, saving profiles", profileID)
+	if err := s.saveProfiles(); err != nil {
+		s.profiles[profileID] = profile
+		return err
+	}
+	return nil
+}
+
+// saveProfiles writes the profiles to the store. Callers must hold the write lock.
+func (s *ProfileService) saveProfiles() error {
+	profiles := make([]models.Profile, 0, len(s.profiles))
+	for _, profile := range s.profiles {
+		profiles = append(profiles, profile)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].ID < profiles[j].ID
+	})
+
+	if err := s.store.Save(profilesKey, profiles); err != nil {
+		log.Printf("saveProfiles: Error saving profiles: %v", err)
+		return err
+	}
+	return nil
+}
+
+// loadProfiles loads the profiles from the store
+func (s *ProfileService) loadProfiles() {
+	log.Printf("loadProfiles: Loading profiles")
+
+	var profiles []models.Profile
+	found, err := s.store.Load(profilesKey, &profiles)
+	if err != nil {
+		log.Printf("loadProfiles: Error reading profiles: %v", err)
+		return
+	}
+	if !found {
+		log.Printf("loadProfiles: No profiles saved, starting without profiles")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, profile := range profiles {
+		s.profiles[profile.ID] = profile
+	}
+	log.Printf("loadProfiles: Loaded %d profiles", len(profiles))
+}
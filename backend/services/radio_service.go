@@ -0,0 +1,230 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"comfort-player-backend/config"
+	"comfort-player-backend/models"
+)
+
+const (
+	// radioProgressInterval is how often the radio saves the playback position
+	radioProgressInterval = 15 * time.Second
+	// radioMaxFailures is how many episodes in a row may fail before the radio gives up
+	radioMaxFailures = 5
+)
+
+// RadioResource is the resource a signed radio URL grants access to
+func RadioResource(showID, profileID string) string {
+	return "radio:" + showID + ":" + profileID
+}
+
+// RadioService streams a show's audio as one continuous MP3 stream, playing
+// episodes back to back and keeping the profile's playback state up to date
+type RadioService struct {
+	config         *config.Config
+	historyService *HistoryService
+	// Cancels the running stream of each show and profile, so only the newest listener drives the state
+	active map[string]*radioListener
+	mutex  sync.Mutex
+}
+
+// radioListener is a running radio stream
+type radioListener struct {
+	cancel context.CancelFunc
+}
+
+// NewRadioService creates a new radio service
+func NewRadioService(config *config.Config, historyService *HistoryService) *RadioService {
+	return &RadioService{
+		config:         config,
+		historyService: historyService,
+		active:         make(map[string]*radioListener),
+	}
+}
+
+// Stream writes the show's audio to w, starting at the profile's current
+// episode and position, until ctx is cancelled or no episode can be played
+func (s *RadioService) Stream(ctx context.Context, w io.Writer, show *RegisteredShow, profileID string) error {
+	ctx, done := s.takeOver(ctx, show.Show.ID(), profileID)
+	defer done()
+
+	// Resume where the profile left off, or start with the first episode
+	state := show.State.GetState(profileID)
+	episodeID := state.CurrentEpisodeID
+	offset := state.PlaybackTimeSeconds
+	if episodeID == "" {
+		first, err := show.Show.GetNextEpisodeID("")
+		if err != nil {
+			log.Printf("RadioService.Stream: No episode to start with: %v", err)
+			return err
+		}
+		episodeID = first
+		offset = 0
+		s.saveProgress(show, profileID, episodeID, 0, true)
+	}
+
+	log.Printf("RadioService.Stream: Starting radio for show %s, profile %q at %s+%ds", show.Show.ID(), profileID, episodeID, offset)
+
+	failures := 0
+	for {
+		err := s.playEpisode(ctx, w, show, profileID, episodeID, offset)
+		if ctx.Err() != nil {
+			log.Printf("RadioService.Stream: Radio for show %s, profile %q stopped", show.Show.ID(), profileID)
+			return nil
+		}
+		if err != nil {
+			log.Printf("RadioService.Stream: Error playing %s: %v", episodeID, err)
+			failures++
+			if failures >= radioMaxFailures {
+				return fmt.Errorf("%d episodes in a row failed to play: %w", failures, err)
+			}
+		} else {
+			failures = 0
+		}
+
+		// Move on to the next episode, the same way the player does
+		episodes, err := show.Show.GetAllEpisodes()
+		if err != nil {
+			log.Printf("RadioService.Stream: Error getting episodes: %v", err)
+			return err
+		}
+		next, err := show.State.MoveToEpisode(profileID, func(state *models.ServerState) (string, error) {
+			return nextEpisodeID(episodes, episodeID)
+		})
+		if err != nil {
+			log.Printf("RadioService.Stream: Error moving to the next episode: %v", err)
+			return err
+		}
+		episodeID = next.CurrentEpisodeID
+		offset = 0
+		s.recordProgress(show, profileID, episodeID, 0, false, true)
+	}
+}
+
+// takeOver registers a new stream for a show and profile, stopping the one
+// already playing. The returned function unregisters the stream.
+func (s *RadioService) takeOver(ctx context.Context, showID, profileID string) (context.Context, func()) {
+	key := RadioResource(showID, profileID)
+	ctx, cancel := context.WithCancel(ctx)
+	listener := &radioListener{cancel: cancel}
+
+	s.mutex.Lock()
+	if previous, ok := s.active[key]; ok {
+		log.Printf("RadioService.takeOver: Replacing the running radio for show %s, profile %q", showID, profileID)
+		previous.cancel()
+	}
+	s.active[key] = listener
+	s.mutex.Unlock()
+
+	return ctx, func() {
+		cancel()
+		s.mutex.Lock()
+		if s.active[key] == listener {
+			delete(s.active, key)
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// playEpisode streams one episode's audio from offset at playback speed, saving
+// the position as it goes
+func (s *RadioService) playEpisode(ctx context.Context, w io.Writer, show *RegisteredShow, profileID, episodeID string, offset int64) error {
+	videoPath, err := show.Show.GetEpisodeVideoPath(episodeID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("RadioService.playEpisode: Playing %s from %ds", episodeID, offset)
+
+	// -re keeps ffmpeg at playback speed, so the saved position follows what's heard
+	args := []string{"-re", "-ss", strconv.FormatInt(offset, 10), "-i", videoPath}
+	args = append(args, mp3Args...)
+	args = append(args, "pipe:1")
+
+	result := make(chan error, 1)
+	started := time.Now()
+	output := &countingWriter{w: w}
+	go func() {
+		err := runFFmpeg(ctx, s.config.FFmpegPath, args, output)
+		if err == nil && output.n == 0 {
+			// Don't race through episodes that have nothing to play
+			err = fmt.Errorf("no audio in %s", videoPath)
+		}
+		result <- err
+	}()
+
+	position := func() int64 {
+		return offset + int64(time.Since(started).Seconds())
+	}
+
+	ticker := time.NewTicker(radioProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.saveProgress(show, profileID, episodeID, position(), false)
+		case <-ctx.Done():
+			// The listener went away; remember where they stopped, then wait for
+			// ffmpeg so nothing writes to w after we return
+			s.saveProgress(show, profileID, episodeID, position(), false)
+			<-result
+			return ctx.Err()
+		case err := <-result:
+			if err != nil {
+				return err
+			}
+			s.recordProgress(show, profileID, episodeID, position(), true, false)
+			return nil
+		}
+	}
+}
+
+// saveProgress stores the playback position in the profile's state and watch history
+func (s *RadioService) saveProgress(show *RegisteredShow, profileID, episodeID string, position int64, episodeChanged bool) {
+	if _, _, err := show.State.UpdateState(profileID, episodeID, position, nil); err != nil {
+		log.Printf("RadioService.saveProgress: Error updating state: %v", err)
+	}
+	s.recordProgress(show, profileID, episodeID, position, false, episodeChanged)
+}
+
+// recordProgress records the playback position in the watch history
+func (s *RadioService) recordProgress(show *RegisteredShow, profileID, episodeID string, position int64, finished, episodeChanged bool) {
+	var duration int64
+	if info, err := show.Show.GetEpisodeMediaInfo(episodeID); err == nil && info.DurationSeconds > 0 {
+		duration = int64(info.DurationSeconds)
+	}
+	if finished && duration > 0 {
+		position = duration
+	}
+
+	if err := s.historyService.RecordProgress(PlaybackReport{
+		ShowID:          show.Show.ID(),
+		ProfileID:       profileID,
+		EpisodeID:       episodeID,
+		PositionSeconds: position,
+		DurationSeconds: duration,
+		Finished:        finished,
+		EpisodeChanged:  episodeChanged,
+	}); err != nil {
+		log.Printf("RadioService.recordProgress: Error recording history: %v", err)
+	}
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
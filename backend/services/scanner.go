@@ -0,0 +1,215 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"comfort-player-backend/models"
+	"comfort-player-backend/utils"
+)
+
+var (
+	// S01E02, s1e2, S01.E02
+	seasonEpisodePattern = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])s(\d{1,2})[ ._-]?e(\d{1,3})(?:[^0-9]|$)`)
+	// 1x02
+	crossEpisodePattern = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])(\d{1,2})x(\d{1,3})(?:[^0-9]|$)`)
+	// season-01/episode-02
+	seasonDirPattern   = regexp.MustCompile(`(?i)^season[ ._-]?(\d{1,2})$`)
+	episodeFilePattern = regexp.MustCompile(`(?i)^episode[ ._-]?(\d{1,3})(?:[^0-9]|$)`)
+	// Release tags that mark the end of a title in a file name
+	releaseTagPattern = regexp.MustCompile(`(?i)^(\d{3,4}p|bluray|blu-ray|brrip|bdrip|dvdrip|web|web-dl|webdl|webrip|hdtv|x264|x265|h264|h265|hevc|xvid|aac|ac3|dd5|proper|repack|internal)$`)
+)
+
+// scannedEpisode describes an episode found on disk by the library scanner
+type scannedEpisode struct {
+	ID           string
+	Season       int
+	Episode      int
+	Title        string
+	VideoPath    string
+	SubtitlePath string
+}
+
+// episodeKey identifies an episode by its season and episode numbers
+type episodeKey struct {
+	season  int
+	episode int
+}
+
+// parseEpisodeFileName extracts season, episode and title from a media file path.
+// It recognizes S01E02, 1x02 and season-01/episode-02 naming schemes.
+func parseEpisodeFileName(path string) (episodeKey, string, bool) {
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	// Try S01E02 first, then 1x02
+	for _, pattern := range []*regexp.Regexp{seasonEpisodePattern, crossEpisodePattern} {
+		if match := pattern.FindStringSubmatchIndex(base); match != nil {
+			season, _ := strconv.Atoi(base[match[2]:match[3]])
+			episode, _ := strconv.Atoi(base[match[4]:match[5]])
+			return episodeKey{season, episode}, titleFromFileName(base[match[5]:]), true
+		}
+	}
+
+	// Fall back to episode-02 inside a season-01 directory
+	match := episodeFilePattern.FindStringSubmatchIndex(base)
+	if match == nil {
+		return episodeKey{}, "", false
+	}
+	seasonMatch := seasonDirPattern.FindStringSubmatch(filepath.Base(filepath.Dir(path)))
+	if seasonMatch == nil {
+		return episodeKey{}, "", false
+	}
+	season, _ := strconv.Atoi(seasonMatch[1])
+	episode, _ := strconv.Atoi(base[match[2]:match[3]])
+	return episodeKey{season, episode}, titleFromFileName(base[match[3]:]), true
+}
+
+// titleFromFileName turns the remainder of a file name into a readable title
+func titleFromFileName(rest string) string {
+	rest = strings.NewReplacer(".", " ", "_", " ").Replace(rest)
+
+	var words []string
+	for _, word := range strings.Fields(rest) {
+		if releaseTagPattern.MatchString(word) || strings.HasPrefix(word, "[") {
+			break
+		}
+		words = append(words, word)
+	}
+
+	title := strings.Join(words, " ")
+	return strings.Trim(title, " -")
+}
+
+// scanMediaTree walks the given roots and returns the episodes it recognizes,
+// along with the media files it couldn't match to an episode
+func scanMediaTree(roots []string, idPrefix, videoPattern, subtitlePattern string) ([]scannedEpisode, []string, error) {
+	found := make(map[episodeKey]*scannedEpisode)
+	var unrecognized []string
+
+	for _, root := range roots {
+		if !utils.FileExists(root) {
+			log.Printf("scanMediaTree: Skipping missing directory: %s", root)
+			continue
+		}
+
+		log.Printf("scanMediaTree: Walking %s", root)
+
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+
+			isVideo := matchesPattern(info.Name(), videoPattern)
+			isSubtitle := matchesPattern(info.Name(), subtitlePattern)
+			if !isVideo && !isSubtitle {
+				return nil
+			}
+
+			// Language tags like ".en.forced" aren't part of the episode name
+			namePath := path
+			if isSubtitle && !isVideo {
+				stem, _ := parseSubtitleFileName(info.Name())
+				namePath = filepath.Join(filepath.Dir(path), stem+filepath.Ext(path))
+			}
+
+			key, title, ok := parseEpisodeFileName(namePath)
+			if !ok {
+				unrecognized = append(unrecognized, path)
+				return nil
+			}
+
+			episode, exists := found[key]
+			if !exists {
+				episode = &scannedEpisode{
+					ID:      fmt.Sprintf("%sS%02dE%02d", idPrefix, key.season, key.episode),
+					Season:  key.season,
+					Episode: key.episode,
+				}
+				found[key] = episode
+			}
+
+			if isVideo && episode.VideoPath == "" {
+				episode.VideoPath = path
+				if title != "" {
+					episode.Title = title
+				}
+			} else if isSubtitle && episode.SubtitlePath == "" {
+				episode.SubtitlePath = path
+			}
+			if episode.Title == "" {
+				episode.Title = title
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("scanMediaTree: Error walking %s: %v", root, err)
+			return nil, nil, fmt.Errorf("failed to scan %s: %w", root, err)
+		}
+	}
+
+	// Only keep entries that actually have a video file
+	var episodes []scannedEpisode
+	for _, episode := range found {
+		if episode.VideoPath == "" {
+			unrecognized = append(unrecognized, episode.SubtitlePath)
+			continue
+		}
+		episodes = append(episodes, *episode)
+	}
+	sort.Slice(episodes, func(i, j int) bool {
+		return episodes[i].ID < episodes[j].ID
+	})
+	sort.Strings(unrecognized)
+
+	log.Printf("scanMediaTree: Recognized %d episodes, %d unrecognized files", len(episodes), len(unrecognized))
+	return episodes, unrecognized, nil
+}
+
+// mergeScannedEpisodes adds the scanned episodes missing from the catalog and
+// returns how many were added. Existing entries are left exactly as they are.
+func mergeScannedEpisodes(c *catalog, episodes []scannedEpisode) int {
+	added := 0
+	for _, scanned := range episodes {
+		if existing, _ := c.find(scanned.ID); existing != nil {
+			continue
+		}
+		log.Printf("mergeScannedEpisodes: Adding new episode %s", scanned.ID)
+		c.add(fmt.Sprintf("season-%02d.json", scanned.Season), scanned.episodeInfo())
+		added++
+	}
+	return added
+}
+
+// episodeInfo converts a scanned episode to its catalog entry
+func (e scannedEpisode) episodeInfo() models.EpisodeInfo {
+	info := models.EpisodeInfo{
+		ID:       e.ID,
+		Title:    e.Title,
+		VideoURL: fmt.Sprintf("/api/episode/%s/video", e.ID),
+	}
+	if e.SubtitlePath != "" {
+		info.SubtitleURL = fmt.Sprintf("/api/episode/%s/subtitle", e.ID)
+	}
+	return info
+}
+
+// matchesPattern reports whether a file name matches any comma-separated glob,
+// ignoring case
+func matchesPattern(name, pattern string) bool {
+	name = strings.ToLower(name)
+	for _, p := range strings.Split(strings.ToLower(pattern), ",") {
+		if matched, _ := filepath.Match(strings.TrimSpace(p), name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"comfort-player-backend/config"
+
+	"comfort-player-backend/models"
+)
+
+func TestParseEpisodeFileName(t *testing.T) {
+	tests := []struct {
+		path  string
+		key   episodeKey
+		title string
+		ok    bool
+	}{
+		{path: "Show.S01E02.The.Pilot.720p.WEB-DL.mkv", key: episodeKey{1, 2}, title: "The Pilot", ok: true},
+		{path: "show s1e2 - Title.mp4", key: episodeKey{1, 2}, title: "Title", ok: true},
+		{path: "Show.S01.E02.mkv", key: episodeKey{1, 2}, ok: true},
+		{path: "Show_S02E105_Long_Run.avi", key: episodeKey{2, 105}, title: "Long Run", ok: true},
+		{path: "S03E04.mkv", key: episodeKey{3, 4}, ok: true},
+		{path: "Show 1x02 Title [group].avi", key: episodeKey{1, 2}, title: "Title", ok: true},
+		{path: "Show.1x02.x264.mkv", key: episodeKey{1, 2}, ok: true},
+		{path: "media/season-01/episode-02.mp4", key: episodeKey{1, 2}, ok: true},
+		{path: "media/Season_3/Episode 10 - Finale.mkv", key: episodeKey{3, 10}, title: "Finale", ok: true},
+		{path: "media/extras/episode-02.mp4"},
+		{path: "media/season-01/behind the scenes.mp4"},
+		{path: "Show.2021.1080p.mkv"},
+		{path: "Subtitles.mkv"},
+	}
+
+	for _, test := range tests {
+		key, title, ok := parseEpisodeFileName(filepath.FromSlash(test.path))
+		if key != test.key || title != test.title || ok != test.ok {
+			t.Errorf("parseEpisodeFileName(%q) = %v, %q, %v; want %v, %q, %v",
+				test.path, key, title, ok, test.key, test.title, test.ok)
+		}
+	}
+}
+
+func TestScanMediaTree(t *testing.T) {
+	seasonsDir := t.TempDir()
+	subtitlesDir := t.TempDir()
+	files := []string{
+		filepath.Join(seasonsDir, "season-01", "episode-01.mp4"),
+		filepath.Join(seasonsDir, "season-01", "episode-01.srt"),
+		filepath.Join(seasonsDir, "Show.S01E02.Second.mkv"),
+		filepath.Join(subtitlesDir, "Show.S01E02.en.forced.srt"),
+		filepath.Join(subtitlesDir, "Show.S01E03.srt"),
+		filepath.Join(seasonsDir, "season-01", "trailer.mp4"),
+		filepath.Join(seasonsDir, "season-01.json"),
+	}
+	for _, path := range files {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	episodes, unrecognized, err := scanMediaTree([]string{seasonsDir, subtitlesDir, filepath.Join(seasonsDir, "missing")}, "Show_", "*.mp4,*.mkv", "*.srt")
+	if err != nil {
+		t.Fatalf("scanMediaTree error: %v", err)
+	}
+	want := []scannedEpisode{
+		{ID: "Show_S01E01", Season: 1, Episode: 1, VideoPath: files[0], SubtitlePath: files[1]},
+		{ID: "Show_S01E02", Season: 1, Episode: 2, Title: "Second", VideoPath: files[2], SubtitlePath: files[3]},
+	}
+	if !reflect.DeepEqual(episodes, want) {
+		t.Errorf("episodes = %+v, want %+v", episodes, want)
+	}
+	// A subtitle without a video isn't an episode
+	if wantUnrecognized := []string{files[5], files[4]}; !reflect.DeepEqual(unrecognized, wantUnrecognized) {
+		t.Errorf("unrecognized = %q, want %q", unrecognized, wantUnrecognized)
+	}
+}
+
+func TestMergeScannedEpisodes(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"season-01.json": `[
+			{"id": "Show_S01E01", "title": "Written by hand", "videoUrl": "/custom/1.mp4"},
+			{"id": "Show_S01E03", "title": "Third"}
+		]`,
+		"specials.json": `[{"id": "Show_S02E01", "title": "Special"}]`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := loadCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := mergeScannedEpisodes(c, []scannedEpisode{
+		{ID: "Show_S01E01", Season: 1, Episode: 1, Title: "Scanned"},
+		{ID: "Show_S01E02", Season: 1, Episode: 2, Title: "Second", SubtitlePath: "episode-02.srt"},
+		{ID: "Show_S02E01", Season: 2, Episode: 1, Title: "Scanned"},
+		{ID: "Show_S03E01", Season: 3, Episode: 1},
+	})
+	if added != 2 {
+		t.Errorf("added %d episodes, want 2", added)
+	}
+	if _, err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Existing entries stay as they are, wherever they're stored, and new ones
+	// are inserted in order into the file of their season
+	c, err = loadCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]models.EpisodeInfo{
+		"season-01.json": {
+			{ID: "Show_S01E01", Title: "Written by hand", VideoURL: "/custom/1.mp4"},
+			{ID: "Show_S01E02", Title: "Second", VideoURL: "/api/episode/Show_S01E02/video", SubtitleURL: "/api/episode/Show_S01E02/subtitle"},
+			{ID: "Show_S01E03", Title: "Third"},
+		},
+		"season-03.json": {
+			{ID: "Show_S03E01", VideoURL: "/api/episode/Show_S03E01/video"},
+		},
+		"specials.json": {
+			{ID: "Show_S02E01", Title: "Special"},
+		},
+	}
+	got := make(map[string][]models.EpisodeInfo)
+	for _, file := range c.files {
+		got[filepath.Base(file.path)] = file.episodes
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("catalog = %+v, want %+v", got, want)
+	}
+}
+
+func TestScanLibraryProbesInBackground(t *testing.T) {
+	mediaDir := t.TempDir()
+	seasonsDir := filepath.Join(mediaDir, "shows")
+	for _, name := range []string{"episode-01.mkv", "episode-02.mkv", "episode-03.avi"} {
+		path := filepath.Join(seasonsDir, "season-01", name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte("not really a video"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &config.Config{
+		MediaDir:            mediaDir,
+		SeasonsDir:          seasonsDir,
+		DefaultShowID:       "default",
+		VideoFilePattern:    "*.mp4,*.mkv,*.avi",
+		SubtitleFilePattern: "*.srt",
+	}
+	show := NewShowRegistry(cfg, NewMemoryStore(), NewWorkerPool(2)).Default().Show
+
+	if _, err := show.ScanLibrary(); err != nil {
+		t.Fatalf("ScanLibrary error: %v", err)
+	}
+	show.probing.Wait()
+
+	info, err := show.GetShowInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	episodes := info.Episodes
+	if len(episodes) != 3 {
+		t.Fatalf("got %d episodes, want 3", len(episodes))
+	}
+	for _, episode := range episodes {
+		if episode.Media == nil || episode.Media.Container == "" {
+			t.Errorf("%s media = %+v, want the probed container", episode.ID, episode.Media)
+		}
+	}
+
+	// Scans after StopJobs don't start probes
+	show.StopJobs()
+	if _, err := show.ScanLibrary(); err != nil {
+		t.Fatalf("ScanLibrary after StopJobs error: %v", err)
+	}
+	show.probing.Wait()
+}
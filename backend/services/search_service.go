@@ -0,0 +1,512 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"comfort-player-backend/models"
+	"comfort-player-backend/subtitles"
+	"comfort-player-backend/utils"
+)
+
+// searchRefreshInterval is how long a search trusts the subtitle index before
+// looking for changed files in the background. Unchanged files aren't parsed again.
+const searchRefreshInterval = 30 * time.Second
+
+// Search limits
+const (
+	DefaultSearchLimit   = 20
+	MaxSearchLimit       = 100
+	DefaultSearchContext = 2
+	MaxSearchContext     = 10
+)
+
+// ErrEmptySearch is returned for queries without a single word to look for
+var ErrEmptySearch = errors.New("search query has no words")
+
+// SearchQuery describes a subtitle search
+type SearchQuery struct {
+	Text     string
+	ShowID   string // Only search this show
+	Language string // Only search tracks in this language
+	Limit    int
+	Context  int // Lines returned before and after each match
+}
+
+// SearchService indexes the subtitles of every show for full-text search
+type SearchService struct {
+	registry *ShowRegistry
+
+	// buildMutex serializes index builds and guards files
+	buildMutex sync.Mutex
+	files      map[string]*indexedSubtitle
+
+	mutex      sync.RWMutex
+	index      *searchIndex
+	builtAt    time.Time
+	refreshing bool // A background refresh is running
+}
+
+// indexedSubtitle is a parsed subtitle file, kept until the file changes
+type indexedSubtitle struct {
+	size    int64
+	modTime time.Time
+	cues    []searchCue // nil if the file couldn't be parsed
+}
+
+// searchCue is a subtitle line as indexed
+type searchCue struct {
+	start time.Duration
+	end   time.Duration
+	text  string   // Without markup, on a single line
+	terms []string // Normalized words, in order
+}
+
+// searchTrack is an indexed subtitle track of an episode
+type searchTrack struct {
+	show         *ShowService
+	episodeID    string
+	episodeTitle string
+	language     string
+	cues         []searchCue
+}
+
+// cueRef points at a cue of an indexed track
+type cueRef struct {
+	track int32
+	cue   int32
+}
+
+// searchIndex is an inverted index of subtitle words. It isn't changed once
+// built; refreshing the index builds a new one.
+type searchIndex struct {
+	tracks   []searchTrack
+	postings map[string][]cueRef // Cues containing each word, in track and cue order
+}
+
+// searchMatch is a cue matching a query, possibly together with the next cue
+type searchMatch struct {
+	ref   cueRef
+	lines int
+	score int
+}
+
+// NewSearchService creates a search service. The index is built on the first
+// search unless Rebuild is called before.
+func NewSearchService(registry *ShowRegistry) *SearchService {
+	return &SearchService{
+		registry: registry,
+		files:    make(map[string]*indexedSubtitle),
+	}
+}
+
+// Rebuild indexes the subtitle files of every show, parsing only files that
+// changed since the last build
+func (s *SearchService) Rebuild() {
+	s.buildMutex.Lock()
+	defer s.buildMutex.Unlock()
+	s.rebuild()
+}
+
+// rebuild builds a new index. The caller holds buildMutex.
+func (s *SearchService) rebuild() {
+	started := time.Now()
+	index := &searchIndex{postings: make(map[string][]cueRef)}
+	files := make(map[string]*indexedSubtitle)
+
+	for _, show := range s.registry.All() {
+		episodes, err := show.Show.GetAllEpisodes()
+		if err != nil {
+			log.Printf("SearchService.rebuild: Error listing episodes of %s: %v", show.Show.ID(), err)
+			continue
+		}
+
+		dirs := newDirCache()
+		for _, episode := range episodes {
+			for _, file := range show.Show.findSubtitleFiles(episode.ID, dirs, false) {
+				path := file.path
+				if file.embedded != nil {
+					// Embedded tracks are searchable once something has extracted them
+					cached, err := show.Show.extractedSubtitlePath(episode.ID, file)
+					if err != nil || !utils.FileExists(cached) {
+						continue
+					}
+					path = cached
+				}
+
+				subtitle := s.loadSubtitle(path)
+				if subtitle == nil {
+					continue
+				}
+				files[path] = subtitle
+				if len(subtitle.cues) > 0 {
+					index.add(searchTrack{
+						show:         show.Show,
+						episodeID:    episode.ID,
+						episodeTitle: episode.Title,
+						language:     file.track.Language,
+						cues:         subtitle.cues,
+					})
+				}
+			}
+		}
+	}
+
+	// Forget files that are gone
+	s.files = files
+
+	s.mutex.Lock()
+	s.index = index
+	s.builtAt = time.Now()
+	s.mutex.Unlock()
+
+	log.Printf("SearchService.rebuild: Indexed %d subtitle tracks, %d words in %v", len(index.tracks), len(index.postings), time.Since(started).Round(time.Millisecond))
+}
+
+// loadSubtitle returns the indexed form of a subtitle file, parsing it only if
+// it changed since the last build. It returns nil if the file can't be read.
+func (s *SearchService) loadSubtitle(path string) *indexedSubtitle {
+	stat, err := os.Stat(path)
+	if err != nil {
+		log.Printf("SearchService.loadSubtitle: Error reading %s: %v", path, err)
+		return nil
+	}
+	if cached, ok := s.files[path]; ok && cached.size == stat.Size() && cached.modTime.Equal(stat.ModTime()) {
+		return cached
+	}
+
+	// Files that fail to parse are remembered too, so they aren't retried until they change
+	subtitle := &indexedSubtitle{size: stat.Size(), modTime: stat.ModTime()}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("SearchService.loadSubtitle: Error reading %s: %v", path, err)
+		return nil
+	}
+	parsed, err := subtitles.Parse(data, subtitles.DetectFormat(path, data))
+	if err != nil {
+		log.Printf("SearchService.loadSubtitle: Skipping %s: %v", path, err)
+		return subtitle
+	}
+
+	for _, cue := range parsed.Cues {
+		text := strings.Join(strings.Fields(cue.PlainText()), " ")
+		terms := searchTerms(text)
+		if len(terms) == 0 {
+			continue
+		}
+		subtitle.cues = append(subtitle.cues, searchCue{start: cue.Start, end: cue.End, text: text, terms: terms})
+	}
+	return subtitle
+}
+
+// current returns the index. An index that is too old is still returned, and
+// refreshed in the background so searches never wait for it. Only the first
+// search waits, if no index has been built yet.
+func (s *SearchService) current() *searchIndex {
+	s.mutex.Lock()
+	index, builtAt := s.index, s.builtAt
+	if index != nil {
+		if time.Since(builtAt) >= searchRefreshInterval && !s.refreshing {
+			s.refreshing = true
+			go s.refresh()
+		}
+		s.mutex.Unlock()
+		return index
+	}
+	s.mutex.Unlock()
+
+	s.buildMutex.Lock()
+	defer s.buildMutex.Unlock()
+
+	// Another search or the startup build may have built the index while this one waited
+	s.mutex.RLock()
+	index = s.index
+	s.mutex.RUnlock()
+	if index != nil {
+		return index
+	}
+
+	s.rebuild()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.index
+}
+
+// refresh rebuilds the index in the background
+func (s *SearchService) refresh() {
+	s.Rebuild()
+
+	s.mutex.Lock()
+	s.refreshing = false
+	s.mutex.Unlock()
+}
+
+// Search finds the subtitle lines containing every word of the query. A match
+// may span two consecutive lines. Exact phrases rank first, then matches
+// within a single line; equal matches keep episode order.
+func (s *SearchService) Search(query SearchQuery) (*models.SearchResponse, error) {
+	terms := searchTerms(query.Text)
+	if len(terms) == 0 {
+		return nil, ErrEmptySearch
+	}
+	if query.Limit <= 0 {
+		query.Limit = DefaultSearchLimit
+	}
+	query.Limit = min(query.Limit, MaxSearchLimit)
+	query.Context = max(0, min(query.Context, MaxSearchContext))
+
+	index := s.current()
+
+	var matches []searchMatch
+	for _, match := range index.match(terms) {
+		track := index.tracks[match.ref.track]
+		if query.ShowID != "" && track.show.ID() != query.ShowID {
+			continue
+		}
+		if query.Language != "" && !subtitles.LanguageMatches(track.language, query.Language) {
+			continue
+		}
+		matches = append(matches, match)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		if a.ref.track != b.ref.track {
+			return a.ref.track < b.ref.track
+		}
+		return a.ref.cue < b.ref.cue
+	})
+
+	// The same line often shows up in several tracks of an episode, e.g. an
+	// untagged file and an English one
+	response := &models.SearchResponse{Query: query.Text, Results: []models.SearchResult{}}
+	seen := make(map[string]bool)
+	delays := make(map[string]time.Duration)
+	for _, match := range matches {
+		track := index.tracks[match.ref.track]
+		cue := track.cues[match.ref.cue]
+		key := fmt.Sprintf("%s|%d|%s", track.episodeID, cue.start/time.Second, strings.Join(cue.terms, " "))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		response.Total++
+		if len(response.Results) >= query.Limit {
+			continue
+		}
+
+		// Timestamps are where the line appears in the video, with the subtitle offset applied
+		delay, ok := delays[track.episodeID]
+		if !ok {
+			delay = track.show.SubtitleDelay(track.episodeID)
+			delays[track.episodeID] = delay
+		}
+		response.Results = append(response.Results, index.result(match, delay, query.Context))
+	}
+
+	log.Printf("Search: Found %d matches for %q", response.Total, query.Text)
+	return response, nil
+}
+
+// add indexes a subtitle track
+func (x *searchIndex) add(track searchTrack) {
+	trackIndex := int32(len(x.tracks))
+	x.tracks = append(x.tracks, track)
+	for i, cue := range track.cues {
+		ref := cueRef{track: trackIndex, cue: int32(i)}
+		for j, term := range cue.terms {
+			if !containsTerm(cue.terms[:j], term) {
+				x.postings[term] = append(x.postings[term], ref)
+			}
+		}
+	}
+}
+
+// match finds the cues matching every term
+func (x *searchIndex) match(terms []string) []searchMatch {
+	// Every match has the rarest term in its first or second line
+	rarest := ""
+	for _, term := range terms {
+		postings, ok := x.postings[term]
+		if !ok {
+			return nil
+		}
+		if rarest == "" || len(postings) < len(x.postings[rarest]) {
+			rarest = term
+		}
+	}
+
+	var matches []searchMatch
+	tried := make(map[cueRef]bool)
+	for _, ref := range x.postings[rarest] {
+		for _, start := range []cueRef{{ref.track, ref.cue - 1}, ref} {
+			if start.cue < 0 || tried[start] {
+				continue
+			}
+			tried[start] = true
+			if match, ok := x.matchAt(start, terms); ok {
+				matches = append(matches, match)
+			}
+		}
+	}
+	return matches
+}
+
+// matchAt checks whether the cue at ref, alone or with the next cue, has every
+// term. Two lines only match if neither does on its own.
+func (x *searchIndex) matchAt(ref cueRef, terms []string) (searchMatch, bool) {
+	cues := x.tracks[ref.track].cues
+	first := cues[ref.cue].terms
+	if containsAll(first, terms) {
+		score := 3
+		if containsPhrase(first, terms) {
+			score = 4
+		}
+		return searchMatch{ref: ref, lines: 1, score: score}, true
+	}
+
+	if int(ref.cue)+1 >= len(cues) || !containsAny(first, terms) {
+		return searchMatch{}, false
+	}
+	second := cues[ref.cue+1].terms
+	if containsAll(second, terms) {
+		return searchMatch{}, false
+	}
+	joined := append(append([]string{}, first...), second...)
+	if !containsAll(joined, terms) {
+		return searchMatch{}, false
+	}
+	score := 1
+	if containsPhrase(joined, terms) {
+		score = 2
+	}
+	return searchMatch{ref: ref, lines: 2, score: score}, true
+}
+
+// result turns a match into a search result with context lines around it
+func (x *searchIndex) result(match searchMatch, delay time.Duration, context int) models.SearchResult {
+	track := x.tracks[match.ref.track]
+	first, last := int(match.ref.cue), int(match.ref.cue)+match.lines-1
+
+	lines := make([]string, 0, match.lines)
+	for _, cue := range track.cues[first : last+1] {
+		lines = append(lines, cue.text)
+	}
+	start := max(0, track.cues[first].start+delay)
+	end := max(0, track.cues[last].end+delay)
+
+	result := models.SearchResult{
+		ShowID:              track.show.ID(),
+		EpisodeID:           track.episodeID,
+		EpisodeTitle:        track.episodeTitle,
+		Language:            track.language,
+		StartSeconds:        roundSeconds(start),
+		EndSeconds:          roundSeconds(end),
+		PlaybackTimeSeconds: int64(start / time.Second),
+		Text:                strings.Join(lines, " "),
+		Before:              []string{},
+		After:               []string{},
+		Score:               match.score,
+	}
+	for _, cue := range track.cues[max(0, first-context):first] {
+		result.Before = append(result.Before, cue.text)
+	}
+	for _, cue := range track.cues[last+1 : min(len(track.cues), last+1+context)] {
+		result.After = append(result.After, cue.text)
+	}
+	return result
+}
+
+// roundSeconds converts a duration to seconds, rounded to milliseconds
+func roundSeconds(d time.Duration) float64 {
+	return math.Round(d.Seconds()*1000) / 1000
+}
+
+// accentFolds maps accented letters to the letters searches match them with
+var accentFolds = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'æ': "ae",
+	'ç': "c", 'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ì': "i", 'í': "i",
+	'î': "i", 'ï': "i", 'ñ': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o",
+	'ö': "o", 'ø': "o", 'œ': "oe", 'ß': "ss", 'ù': "u", 'ú': "u", 'û': "u",
+	'ü': "u", 'ý': "y", 'ÿ': "y",
+}
+
+// searchTerms splits text into lower case words without accents. Apostrophes
+// are dropped, so "don't" and "dont" are the same word.
+func searchTerms(text string) []string {
+	var terms []string
+	var word strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\'' || r == '’':
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			r = unicode.ToLower(r)
+			if folded, ok := accentFolds[r]; ok {
+				word.WriteString(folded)
+			} else {
+				word.WriteRune(r)
+			}
+		case word.Len() > 0:
+			terms = append(terms, word.String())
+			word.Reset()
+		}
+	}
+	if word.Len() > 0 {
+		terms = append(terms, word.String())
+	}
+	return terms
+}
+
+// containsTerm reports whether words has term
+func containsTerm(words []string, term string) bool {
+	for _, word := range words {
+		if word == term {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAll reports whether words has every term
+func containsAll(words, terms []string) bool {
+	for _, term := range terms {
+		if !containsTerm(words, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsAny reports whether words has at least one of the terms
+func containsAny(words, terms []string) bool {
+	for _, term := range terms {
+		if containsTerm(words, term) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsPhrase reports whether the terms appear in words in a row
+func containsPhrase(words, terms []string) bool {
+	phrase := strings.Join(terms, " ")
+	for i := 0; i+len(terms) <= len(words); i++ {
+		if strings.Join(words[i:i+len(terms)], " ") == phrase {
+			return true
+		}
+	}
+	return false
+}
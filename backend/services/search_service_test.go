@@ -0,0 +1,253 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"comfort-player-backend/config"
+)
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{text: "Hello, world!", want: []string{"hello", "world"}},
+		{text: "  Where did you put\nthe remote?  ", want: []string{"where", "did", "you", "put", "the", "remote"}},
+		{text: "I don't know", want: []string{"i", "dont", "know"}},
+		{text: "I don’t know", want: []string{"i", "dont", "know"}},
+		{text: "Déjà vu", want: []string{"deja", "vu"}},
+		{text: "Ærø Straße œuvre", want: []string{"aero", "strasse", "oeuvre"}},
+		{text: "Room 101", want: []string{"room", "101"}},
+		{text: "well-known", want: []string{"well", "known"}},
+		{text: "...!?", want: nil},
+		{text: "", want: nil},
+	}
+
+	for _, test := range tests {
+		if got := searchTerms(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("searchTerms(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+// newTestSearchService creates a search service over a default show with two
+// episodes, the first of which has a two second subtitle offset
+func newTestSearchService(t *testing.T) *SearchService {
+	t.Helper()
+	mediaDir := t.TempDir()
+	seasonsDir := filepath.Join(mediaDir, "shows")
+	subtitlesDir := filepath.Join(mediaDir, "subtitles", "season-01")
+
+	english := "1\n00:00:01,000 --> 00:00:02,000\nHello there\n\n" +
+		"2\n00:00:10,000 --> 00:00:12,000\n<i>Where did you put</i>\nthe remote control?\n\n" +
+		"3\n00:00:13,000 --> 00:00:14,000\nI don't know.\n\n" +
+		"4\n00:00:15,000 --> 00:00:16,000\nCheck under the\n\n" +
+		"5\n00:00:16,500 --> 00:00:17,500\ncouch, maybe.\n\n" +
+		"6\n00:00:20,000 --> 00:00:21,000\nRemote? What remote.\n"
+	files := map[string]string{
+		filepath.Join(seasonsDir, "season-01.json"): `{"episodes": [
+			{"id": "Show_S01E01", "title": "Pilot", "subtitleOffsetSeconds": 2},
+			{"id": "Show_S01E02", "title": "Second"}
+		]}`,
+		// The untagged file repeats the English one, so its lines are found once
+		filepath.Join(subtitlesDir, "episode-01.srt"):    english,
+		filepath.Join(subtitlesDir, "episode-01.en.srt"): english,
+		filepath.Join(subtitlesDir, "episode-01.fr.srt"): "1\n00:00:01,000 --> 00:00:02,000\nDéjà vu\n",
+		filepath.Join(subtitlesDir, "episode-02.en.srt"): "1\n00:00:03,000 --> 00:00:04,000\nControl the remote.\n",
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config.Config{
+		MediaDir:            mediaDir,
+		SeasonsDir:          seasonsDir,
+		DefaultShowID:       "default",
+		CacheDir:            t.TempDir(),
+		VideoFilePattern:    "*.mp4,*.mkv,*.avi",
+		SubtitleFilePattern: "*.srt,*.vtt,*.ass,*.ssa",
+	}
+	service := NewSearchService(NewShowRegistry(cfg, NewMemoryStore(), NewWorkerPool(1)))
+	service.Rebuild()
+	return service
+}
+
+func TestSearch(t *testing.T) {
+	service := newTestSearchService(t)
+
+	type result struct {
+		episodeID string
+		language  string
+		start     float64
+		text      string
+		score     int
+	}
+	tests := []struct {
+		name  string
+		query SearchQuery
+		total int
+		want  []result
+	}{
+		{
+			name:  "phrase ranks before words on one line",
+			query: SearchQuery{Text: "remote control"},
+			total: 2,
+			want: []result{
+				{"Show_S01E01", "", 12, "Where did you put the remote control?", 4},
+				{"Show_S01E02", "en", 3, "Control the remote.", 3},
+			},
+		},
+		{
+			name:  "match across two lines",
+			query: SearchQuery{Text: "under the couch"},
+			total: 1,
+			want:  []result{{"Show_S01E01", "", 17, "Check under the couch, maybe.", 2}},
+		},
+		{
+			name:  "apostrophes ignored",
+			query: SearchQuery{Text: "DONT KNOW"},
+			total: 1,
+			want:  []result{{"Show_S01E01", "", 15, "I don't know.", 4}},
+		},
+		{
+			name:  "accents folded",
+			query: SearchQuery{Text: "deja"},
+			total: 1,
+			want:  []result{{"Show_S01E01", "fr", 3, "Déjà vu", 4}},
+		},
+		{
+			name:  "language filter",
+			query: SearchQuery{Text: "deja", Language: "en"},
+			total: 0,
+		},
+		{
+			name:  "show filter",
+			query: SearchQuery{Text: "remote", ShowID: "other"},
+			total: 0,
+		},
+		{
+			name:  "limit keeps the total",
+			query: SearchQuery{Text: "remote", Limit: 1},
+			total: 3,
+			want:  []result{{"Show_S01E01", "", 12, "Where did you put the remote control?", 4}},
+		},
+		{
+			name:  "unknown word",
+			query: SearchQuery{Text: "remote sofa"},
+			total: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := service.Search(test.query)
+			if err != nil {
+				t.Fatalf("Search error: %v", err)
+			}
+			if response.Total != test.total {
+				t.Errorf("Total = %d, want %d", response.Total, test.total)
+			}
+
+			var got []result
+			for _, r := range response.Results {
+				got = append(got, result{r.EpisodeID, r.Language, r.StartSeconds, r.Text, r.Score})
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Results = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSearchContext(t *testing.T) {
+	service := newTestSearchService(t)
+
+	response, err := service.Search(SearchQuery{Text: "know", Context: 2})
+	if err != nil {
+		t.Fatalf("Search error: %v", err)
+	}
+	if len(response.Results) != 1 {
+		t.Fatalf("got %d results, want 1", len(response.Results))
+	}
+	result := response.Results[0]
+	if want := []string{"Hello there", "Where did you put the remote control?"}; !reflect.DeepEqual(result.Before, want) {
+		t.Errorf("Before = %q, want %q", result.Before, want)
+	}
+	if want := []string{"Check under the", "couch, maybe."}; !reflect.DeepEqual(result.After, want) {
+		t.Errorf("After = %q, want %q", result.After, want)
+	}
+	if result.PlaybackTimeSeconds != 15 {
+		t.Errorf("PlaybackTimeSeconds = %d, want 15", result.PlaybackTimeSeconds)
+	}
+}
+
+func TestSearchEmptyQuery(t *testing.T) {
+	service := newTestSearchService(t)
+
+	for _, text := range []string{"", "   ", "?!"} {
+		if _, err := service.Search(SearchQuery{Text: text}); !errors.Is(err, ErrEmptySearch) {
+			t.Errorf("Search(%q) error = %v, want %v", text, err, ErrEmptySearch)
+		}
+	}
+}
+
+func TestSearchRefreshesInBackground(t *testing.T) {
+	service := newTestSearchService(t)
+
+	var path string
+	for file := range service.files {
+		if strings.HasSuffix(file, "episode-02.en.srt") {
+			path = file
+		}
+	}
+	if err := os.WriteFile(path, []byte("1\n00:00:03,000 --> 00:00:04,000\nOn the sofa.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path, future, future)
+
+	// A stale index still answers right away, and is refreshed behind it
+	service.mutex.Lock()
+	service.builtAt = time.Now().Add(-searchRefreshInterval)
+	service.mutex.Unlock()
+	response, err := service.Search(SearchQuery{Text: "sofa"})
+	if err != nil {
+		t.Fatalf("Search error: %v", err)
+	}
+	if response.Total != 0 {
+		t.Errorf("Total from the stale index = %d, want 0", response.Total)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		service.mutex.RLock()
+		refreshing := service.refreshing
+		service.mutex.RUnlock()
+		if !refreshing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the index wasn't refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	response, err = service.Search(SearchQuery{Text: "sofa"})
+	if err != nil {
+		t.Fatalf("Search error: %v", err)
+	}
+	if response.Total != 1 {
+		t.Errorf("Total after refreshing = %d, want 1", response.Total)
+	}
+}
@@ -0,0 +1,228 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"comfort-player-backend/config"
+	"comfort-player-backend/models"
+)
+
+// nonSlugPattern matches runs of characters that aren't allowed in show IDs
+var nonSlugPattern = regexp.MustCompile(`[^a-z0-9]+`)
+
+// RegisteredShow groups a show's catalog and its playback state
+type RegisteredShow struct {
+	Show  *ShowService
+	State *StateService
+}
+
+// ShowRegistry keeps track of every show in the library. The show configured by
+// SeasonsDir is the default show; every other directory under MediaDir is a show
+// of its own.
+type ShowRegistry struct {
+	config *config.Config
+	store  StateStore
+	events *EventBus
+	pool   *WorkerPool
+	shows  map[string]*RegisteredShow
+	mutex  sync.RWMutex
+}
+
+// NewShowRegistry creates a show registry and discovers the shows on disk. Each
+// show keeps its playback state in store and runs ffmpeg within pool.
+func NewShowRegistry(config *config.Config, store StateStore, pool *WorkerPool) *ShowRegistry {
+	registry := &ShowRegistry{
+		config: config,
+		store:  store,
+		events: NewEventBus(),
+		pool:   pool,
+		shows:  make(map[string]*RegisteredShow),
+	}
+
+	// The default show keeps the original layout and state file
+	registry.shows[config.DefaultShowID] = registry.newShow(ShowLocation{
+		ID:            config.DefaultShowID,
+		Name:          config.DefaultShowID,
+		SeasonsDir:    config.SeasonsDir,
+		SubtitlesDir:  filepath.Join(filepath.Dir(config.SeasonsDir), "subtitles"),
+		EpisodePrefix: defaultEpisodePrefix,
+	}, StateKey(config))
+
+	registry.Discover()
+	return registry
+}
+
+// Discover looks for show directories under MediaDir and registers new ones
+func (r *ShowRegistry) Discover() {
+	log.Printf("Discover: Looking for shows in %s", r.config.MediaDir)
+
+	entries, err := os.ReadDir(r.config.MediaDir)
+	if err != nil {
+		log.Printf("Discover: Error reading media directory: %v", err)
+		return
+	}
+
+	// Directories that belong to the default show
+	defaultSeasonsDir := filepath.Clean(r.config.SeasonsDir)
+	defaultSubtitlesDir := filepath.Join(filepath.Dir(defaultSeasonsDir), "subtitles")
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		showDir := filepath.Join(r.config.MediaDir, entry.Name())
+		if showDir == defaultSeasonsDir || showDir == defaultSubtitlesDir {
+			continue
+		}
+
+		showID := slugify(entry.Name())
+		if showID == "" {
+			log.Printf("Discover: Skipping directory with unusable name: %s", showDir)
+			continue
+		}
+		if _, exists := r.shows[showID]; exists {
+			continue
+		}
+
+		log.Printf("Discover: Registering show %s from %s", showID, showDir)
+		r.shows[showID] = r.newShow(ShowLocation{
+			ID:            showID,
+			Name:          entry.Name(),
+			SeasonsDir:    showDir,
+			SubtitlesDir:  filepath.Join(showDir, "subtitles"),
+			EpisodePrefix: showID + "_",
+		}, showStateKey(showID))
+	}
+}
+
+// newShow creates the services of a show, publishing their changes to the registry's events
+func (r *ShowRegistry) newShow(location ShowLocation, stateKey string) *RegisteredShow {
+	show := &RegisteredShow{
+		Show:  NewShowService(r.config, location),
+		State: NewStateService(r.store, stateKey),
+	}
+	show.Show.events = r.events
+	show.Show.pool = r.pool
+	show.State.events = r.events
+	show.State.showID = location.ID
+	return show
+}
+
+// Events returns the bus carrying every show's state and catalog changes
+func (r *ShowRegistry) Events() *EventBus {
+	return r.events
+}
+
+// Default returns the default show
+func (r *ShowRegistry) Default() *RegisteredShow {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.shows[r.config.DefaultShowID]
+}
+
+// Get returns the show with the given ID, or the default show if the ID is empty
+func (r *ShowRegistry) Get(showID string) (*RegisteredShow, bool) {
+	if showID == "" {
+		return r.Default(), true
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	show, ok := r.shows[showID]
+	return show, ok
+}
+
+// ForEpisode returns the show an episode ID belongs to, based on its prefix.
+// IDs that match no show prefix belong to the default show.
+func (r *ShowRegistry) ForEpisode(episodeID string) *RegisteredShow {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var match *RegisteredShow
+	for _, show := range r.shows {
+		prefix := show.Show.EpisodePrefix()
+		if !strings.HasPrefix(episodeID, prefix) {
+			continue
+		}
+		if match == nil || len(prefix) > len(match.Show.EpisodePrefix()) {
+			match = show
+		}
+	}
+
+	if match == nil {
+		return r.shows[r.config.DefaultShowID]
+	}
+	return match
+}
+
+// All returns every registered show, default show first and the rest by ID
+func (r *ShowRegistry) All() []*RegisteredShow {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	shows := make([]*RegisteredShow, 0, len(r.shows))
+	for _, show := range r.shows {
+		shows = append(shows, show)
+	}
+
+	defaultID := r.config.DefaultShowID
+	sort.Slice(shows, func(i, j int) bool {
+		if shows[i].Show.ID() == defaultID || shows[j].Show.ID() == defaultID {
+			return shows[i].Show.ID() == defaultID
+		}
+		return shows[i].Show.ID() < shows[j].Show.ID()
+	})
+	return shows
+}
+
+// IsDefault reports whether a show is the default show
+func (r *ShowRegistry) IsDefault(show *RegisteredShow) bool {
+	return show.Show.ID() == r.config.DefaultShowID
+}
+
+// ScanAll discovers new show directories and scans every show's media tree
+func (r *ShowRegistry) ScanAll() ([]*models.LibraryScanResult, error) {
+	r.Discover()
+
+	var results []*models.LibraryScanResult
+	var failed []string
+	for _, show := range r.All() {
+		result, err := show.Show.ScanLibrary()
+		if err != nil {
+			log.Printf("ScanAll: Error scanning show %s: %v", show.Show.ID(), err)
+			failed = append(failed, fmt.Sprintf("%s: %v", show.Show.ID(), err))
+		}
+		if result != nil {
+			results = append(results, result)
+		}
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("failed to scan %s", strings.Join(failed, "; "))
+	}
+	return results, nil
+}
+
+// StopJobs stops the background work of every show and waits for it to end
+func (r *ShowRegistry) StopJobs() {
+	for _, show := range r.All() {
+		show.Show.StopJobs()
+	}
+}
+
+// slugify turns a directory name into a show ID
+func slugify(name string) string {
+	slug := nonSlugPattern.ReplaceAllString(strings.ToLower(name), "-")
+	return strings.Trim(slug, "-")
+}
@@ -1,29 +1,110 @@
 package services
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"comfort-player-backend/config"
 	"comfort-player-backend/models"
 	"comfort-player-backend/utils"
 )
 
+// ErrEpisodeNotFound is returned when an episode ID is not in the catalog
+var ErrEpisodeNotFound = errors.New("episode not found")
+
+// ErrNoEpisodes is returned when a show has no episodes to pick from
+var ErrNoEpisodes = errors.New("no episodes found")
+
+// episodeNumberPattern matches the season and episode part of an episode ID
+var episodeNumberPattern = regexp.MustCompile(`^S(\d+)E(\d+)$`)
+
+// defaultEpisodePrefix is the prefix of the default show's episode IDs, e.g. "Show_S01E01"
+const defaultEpisodePrefix = "Show_"
+
+// ShowLocation describes where a show's files live on disk
+type ShowLocation struct {
+	ID            string
+	Name          string
+	SeasonsDir    string
+	SubtitlesDir  string
+	EpisodePrefix string
+}
+
 // ShowService handles show-related operations
 type ShowService struct {
-	config *config.Config
+	config   *config.Config
+	location ShowLocation
+	index    map[string]scannedEpisode
+	mutex    sync.RWMutex
+	// catalogMutex serializes writes to the season JSON files
+	catalogMutex sync.Mutex
+	mediaInfo    mediaInfoCache
+	// extractJobs holds the embedded subtitle extractions running, by output path
+	extractJobs  map[string]*extractJob
+	extractMutex sync.Mutex
+	extracting   sync.WaitGroup
+	// probing tracks the background probes started by library scans
+	probing sync.WaitGroup
+	// pool bounds how many ffmpeg processes run at once
+	pool *WorkerPool
+	// jobs is cancelled by StopJobs to stop work that outlives requests
+	jobs     context.Context
+	stopJobs context.CancelFunc
+	// events receives catalog changes
+	events *EventBus
 }
 
 // NewShowService creates a new show service
-func NewShowService(config *config.Config) *ShowService {
+func NewShowService(config *config.Config, location ShowLocation) *ShowService {
+	jobs, stopJobs := context.WithCancel(context.Background())
 	return &ShowService{
-		config: config,
+		config:   config,
+		location: location,
+		index:    make(map[string]scannedEpisode),
+		jobs:     jobs,
+		stopJobs: stopJobs,
+
+		extractJobs: make(map[string]*extractJob),
 	}
 }
 
+// StopJobs stops the show's background work, such as subtitle extraction and
+// probing, and waits for it to end. Later jobs fail right away.
+func (s *ShowService) StopJobs() {
+	s.stopJobs()
+
+	// Extractions and probes only start while holding these locks, so none starts after this
+	s.extractMutex.Lock()
+	s.extractMutex.Unlock()
+	s.mutex.Lock()
+	s.mutex.Unlock()
+	s.extracting.Wait()
+	s.probing.Wait()
+}
+
+// ID returns the show's identifier
+func (s *ShowService) ID() string {
+	return s.location.ID
+}
+
+// Name returns the show's display name
+func (s *ShowService) Name() string {
+	return s.location.Name
+}
+
+// EpisodePrefix returns the prefix shared by the show's episode IDs
+func (s *ShowService) EpisodePrefix() string {
+	return s.location.EpisodePrefix
+}
+
 // GetShowInfo returns the show information including all episodes
 func (s *ShowService) GetShowInfo() (*models.ShowInfoResponse, error) {
 	log.Printf("GetShowInfo: Getting all episodes")
@@ -41,51 +122,40 @@ func (s *ShowService) GetShowInfo() (*models.ShowInfoResponse, error) {
 		return episodes[i].ID < episodes[j].ID
 	})
 
+	// Describe each video file so clients know whether they can play it. Only
+	// what the library scan probed is used, so listing the show stays cheap.
+	s.attachMediaInfo(episodes, false)
+	s.attachSubtitleTracks(episodes, false)
+
 	return &models.ShowInfoResponse{
+		ShowID:   s.location.ID,
 		Episodes: episodes,
 	}, nil
 }
 
-// GetAllEpisodes returns all episodes from all seasons by reading JSON files
+// GetAllEpisodes returns all episodes from all seasons by reading JSON files.
+// Episodes found by the last library scan but missing from the JSON files are
+// included as well.
 func (s *ShowService) GetAllEpisodes() ([]models.EpisodeInfo, error) {
-	log.Printf("GetAllEpisodes: Searching for episodes in %s", s.config.SeasonsDir)
-	
-	var allEpisodes []models.EpisodeInfo
+	log.Printf("GetAllEpisodes: Searching for episodes in %s", s.location.SeasonsDir)
 
-	// Check if seasons directory exists
-	if !utils.FileExists(s.config.SeasonsDir) {
-		log.Printf("GetAllEpisodes: Seasons directory not found: %s", s.config.SeasonsDir)
-		return allEpisodes, nil // Return empty list if directory doesn't exist
+	c, err := loadCatalog(s.location.SeasonsDir)
+	if err != nil {
+		log.Printf("GetAllEpisodes: Error loading catalog: %v", err)
+		return nil, err
 	}
 
-	// Find all JSON files in the seasons directory
-	jsonFiles, err := utils.FindFiles(s.config.SeasonsDir, "*.json")
-	if err != nil {
-		log.Printf("GetAllEpisodes: Error finding JSON files: %v", err)
-		return nil, fmt.Errorf("failed to find JSON files: %w", err)
-	}
-	
-	log.Printf("GetAllEpisodes: Found %d JSON files", len(jsonFiles))
-
-	// Process each JSON file
-	for _, jsonFile := range jsonFiles {
-		log.Printf("GetAllEpisodes: Processing JSON file: %s", jsonFile)
-		
-		var episodes []models.EpisodeInfo
-		
-		// Read JSON file
-		if err := utils.ReadJSON(jsonFile, &episodes); err != nil {
-			log.Printf("GetAllEpisodes: Error reading JSON file %s: %v", jsonFile, err)
-			// Skip files that can't be read or parsed
-			continue
+	allEpisodes := c.episodes()
+
+	// Add scanned episodes that haven't been written to the catalog
+	s.mutex.RLock()
+	for _, scanned := range s.index {
+		if existing, _ := c.find(scanned.ID); existing == nil {
+			allEpisodes = append(allEpisodes, scanned.episodeInfo())
 		}
-		
-		log.Printf("GetAllEpisodes: Found %d episodes in %s", len(episodes), jsonFile)
-		
-		// Add episodes to the list
-		allEpisodes = append(allEpisodes, episodes...)
 	}
-	
+	s.mutex.RUnlock()
+
 	log.Printf("GetAllEpisodes: Total episodes found: %d", len(allEpisodes))
 
 	// Sort episodes by ID to ensure consistent order
@@ -96,6 +166,73 @@ func (s *ShowService) GetAllEpisodes() ([]models.EpisodeInfo, error) {
 	return allEpisodes, nil
 }
 
+// ScanLibrary walks the show's media tree, merges recognized episodes into the
+// season JSON files and refreshes the in-memory index of episode files. The
+// tree is the show's SeasonsDir and SubtitlesDir rather than all of MediaDir:
+// every other directory under MediaDir is a show of its own, whose files
+// would otherwise be merged into this show.
+func (s *ShowService) ScanLibrary() (*models.LibraryScanResult, error) {
+	// Subtitles usually live next to the seasons, or inside the show directory
+	roots := []string{s.location.SeasonsDir}
+	if !strings.HasPrefix(s.location.SubtitlesDir, s.location.SeasonsDir+string(filepath.Separator)) {
+		roots = append(roots, s.location.SubtitlesDir)
+	}
+	log.Printf("ScanLibrary: Scanning %v for show %s", roots, s.location.ID)
+
+	scanned, unrecognized, err := scanMediaTree(roots, s.location.EpisodePrefix, s.config.VideoFilePattern, s.config.SubtitleFilePattern)
+	if err != nil {
+		log.Printf("ScanLibrary: Error scanning media tree: %v", err)
+		return nil, err
+	}
+
+	// Refresh the index so scanned files can be served even if the catalog can't be written
+	index := make(map[string]scannedEpisode, len(scanned))
+	for _, episode := range scanned {
+		index[episode.ID] = episode
+	}
+	s.mutex.Lock()
+	s.index = index
+	s.mutex.Unlock()
+	s.probeIndexed()
+
+	// Clients fetch the episodes again, whether or not the catalog can be written
+	defer s.events.Publish(catalogEvent(s.location.ID, ""))
+
+	s.catalogMutex.Lock()
+	defer s.catalogMutex.Unlock()
+
+	c, err := loadCatalog(s.location.SeasonsDir)
+	if err != nil {
+		log.Printf("ScanLibrary: Error loading catalog: %v", err)
+		return nil, err
+	}
+
+	added := mergeScannedEpisodes(c, scanned)
+	result := &models.LibraryScanResult{
+		ShowID:        s.location.ID,
+		EpisodesFound: len(scanned),
+		Added:         added,
+		Unrecognized:  unrecognized,
+	}
+
+	written, err := c.save()
+	result.FilesWritten = written
+	if err != nil {
+		log.Printf("ScanLibrary: Error saving catalog: %v", err)
+		return result, err
+	}
+
+	log.Printf("ScanLibrary: Found %d episodes, added %d, wrote %d files", len(scanned), added, len(written))
+	return result, nil
+}
+
+// indexedEpisode returns the scanned files for an episode, if the last scan found it
+func (s *ShowService) indexedEpisode(episodeID string) (scannedEpisode, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	episode, ok := s.index[episodeID]
+	return episode, ok
+}
 
 // GetNextEpisodeID returns the ID of the next episode in sequence
 func (s *ShowService) GetNextEpisodeID(currentEpisodeID string) (string, error) {
@@ -106,17 +243,21 @@ func (s *ShowService) GetNextEpisodeID(currentEpisodeID string) (string, error)
 		log.Printf("GetNextEpisodeID: Error getting episodes: %v", err)
 		return "", err
 	}
+	return nextEpisodeID(episodes, currentEpisodeID)
+}
 
+// nextEpisodeID returns the ID of the episode after currentEpisodeID in episodes
+func nextEpisodeID(episodes []models.EpisodeInfo, currentEpisodeID string) (string, error) {
 	if len(episodes) == 0 {
-		log.Printf("GetNextEpisodeID: No episodes found")
-		return "", fmt.Errorf("no episodes found")
+		log.Printf("nextEpisodeID: No episodes found")
+		return "", ErrNoEpisodes
 	}
 	
-	log.Printf("GetNextEpisodeID: Found %d episodes", len(episodes))
+	log.Printf("nextEpisodeID: Found %d episodes", len(episodes))
 
 	// If there's only one episode, return it
 	if len(episodes) == 1 {
-		log.Printf("GetNextEpisodeID: Only one episode, returning %s", episodes[0].ID)
+		log.Printf("nextEpisodeID: Only one episode, returning %s", episodes[0].ID)
 		return episodes[0].ID, nil
 	}
 
@@ -125,32 +266,164 @@ func (s *ShowService) GetNextEpisodeID(currentEpisodeID string) (string, error)
 	for i, episode := range episodes {
 		if episode.ID == currentEpisodeID {
 			currentIndex = i
-			log.Printf("GetNextEpisodeID: Found current episode at index %d", currentIndex)
+			log.Printf("nextEpisodeID: Found current episode at index %d", currentIndex)
 			break
 		}
 	}
 
 	// If current episode not found or it's the last episode, loop back to first
 	if currentIndex == -1 || currentIndex == len(episodes)-1 {
-		log.Printf("GetNextEpisodeID: Current episode not found or is last, returning first episode %s", episodes[0].ID)
+		log.Printf("nextEpisodeID: Current episode not found or is last, returning first episode %s", episodes[0].ID)
 		return episodes[0].ID, nil
 	}
 
 	// Return next episode
 	nextEpisodeID := episodes[currentIndex+1].ID
-	log.Printf("GetNextEpisodeID: Returning next episode %s", nextEpisodeID)
+	log.Printf("nextEpisodeID: Returning next episode %s", nextEpisodeID)
 	return nextEpisodeID, nil
 }
 
+// GetPreviousEpisodeID returns the ID of the previous episode in sequence
+func (s *ShowService) GetPreviousEpisodeID(currentEpisodeID string) (string, error) {
+	log.Printf("GetPreviousEpisodeID: Finding previous episode before %s", currentEpisodeID)
+
+	episodes, err := s.GetAllEpisodes()
+	if err != nil {
+		log.Printf("GetPreviousEpisodeID: Error getting episodes: %v", err)
+		return "", err
+	}
+	return previousEpisodeID(episodes, currentEpisodeID)
+}
+
+// previousEpisodeID returns the ID of the episode before currentEpisodeID in episodes
+func previousEpisodeID(episodes []models.EpisodeInfo, currentEpisodeID string) (string, error) {
+	if len(episodes) == 0 {
+		log.Printf("previousEpisodeID: No episodes found")
+		return "", ErrNoEpisodes
+	}
+
+	// Find current episode index
+	currentIndex := -1
+	for i, episode := range episodes {
+		if episode.ID == currentEpisodeID {
+			currentIndex = i
+			break
+		}
+	}
+
+	// If current episode not found, start from the first episode
+	if currentIndex == -1 {
+		log.Printf("previousEpisodeID: Current episode not found, returning first episode %s", episodes[0].ID)
+		return episodes[0].ID, nil
+	}
+
+	// If it's the first episode, loop back to the last
+	if currentIndex == 0 {
+		previousEpisodeID := episodes[len(episodes)-1].ID
+		log.Printf("previousEpisodeID: Current episode is first, returning last episode %s", previousEpisodeID)
+		return previousEpisodeID, nil
+	}
+
+	previousEpisodeID := episodes[currentIndex-1].ID
+	log.Printf("previousEpisodeID: Returning previous episode %s", previousEpisodeID)
+	return previousEpisodeID, nil
+}
+
+// GetEpisode returns the information of a single episode
+func (s *ShowService) GetEpisode(episodeID string) (models.EpisodeInfo, error) {
+	episodes, err := s.GetAllEpisodes()
+	if err != nil {
+		return models.EpisodeInfo{}, err
+	}
+
+	for i := range episodes {
+		if episodes[i].ID == episodeID {
+			s.attachMediaInfo(episodes[i:i+1], true)
+			s.attachSubtitleTracks(episodes[i:i+1], true)
+			return episodes[i], nil
+		}
+	}
+	return models.EpisodeInfo{}, fmt.Errorf("%w: %s", ErrEpisodeNotFound, episodeID)
+}
+
+// UpdateEpisodeMarkers replaces an episode's markers in the season JSON files.
+// Episodes only known from the last library scan are added to the catalog.
+func (s *ShowService) UpdateEpisodeMarkers(episodeID string, markers *models.EpisodeMarkers) (models.EpisodeInfo, error) {
+	log.Printf("UpdateEpisodeMarkers: Updating markers for episode %s", episodeID)
+
+	episode, err := s.editCatalogEpisode(episodeID, func(episode *models.EpisodeInfo) {
+		episode.Markers = markers
+	})
+	if err != nil {
+		log.Printf("UpdateEpisodeMarkers: Error updating episode %s: %v", episodeID, err)
+		return models.EpisodeInfo{}, err
+	}
+	return episode, nil
+}
+
+// EpisodeNumbers returns the season and episode numbers encoded in an episode ID
+func (s *ShowService) EpisodeNumbers(episodeID string) (season, episode int, ok bool) {
+	match := episodeNumberPattern.FindStringSubmatch(strings.TrimPrefix(episodeID, s.location.EpisodePrefix))
+	if match == nil {
+		return 0, 0, false
+	}
+	season, _ = strconv.Atoi(match[1])
+	episode, _ = strconv.Atoi(match[2])
+	return season, episode, true
+}
+
+// editCatalogEpisode applies edit to an episode's catalog entry and saves the season file
+func (s *ShowService) editCatalogEpisode(episodeID string, edit func(episode *models.EpisodeInfo)) (models.EpisodeInfo, error) {
+	return s.editCatalog(episodeID, func(episode *models.EpisodeInfo, file *catalogFile) error {
+		edit(episode)
+		return nil
+	})
+}
+
+// editCatalog applies edit to an episode's catalog entry and the season file
+// holding it, then saves the file. Nothing is saved if edit fails.
+func (s *ShowService) editCatalog(episodeID string, edit func(episode *models.EpisodeInfo, file *catalogFile) error) (models.EpisodeInfo, error) {
+	s.catalogMutex.Lock()
+	defer s.catalogMutex.Unlock()
+
+	c, err := loadCatalog(s.location.SeasonsDir)
+	if err != nil {
+		return models.EpisodeInfo{}, err
+	}
+
+	episode, file := c.find(episodeID)
+	if episode == nil {
+		// Write scanned episodes to the catalog so the edit has somewhere to live
+		scanned, ok := s.indexedEpisode(episodeID)
+		if !ok {
+			return models.EpisodeInfo{}, fmt.Errorf("%w: %s", ErrEpisodeNotFound, episodeID)
+		}
+		c.add(fmt.Sprintf("season-%02d.json", scanned.Season), scanned.episodeInfo())
+		episode, file = c.find(episodeID)
+	}
+
+	if err := edit(episode, file); err != nil {
+		return models.EpisodeInfo{}, err
+	}
+	file.dirty = true
+	if _, err := c.save(); err != nil {
+		return models.EpisodeInfo{}, err
+	}
+	s.events.Publish(catalogEvent(s.location.ID, episodeID))
+	return *episode, nil
+}
+
 // GetEpisodeVideoPath returns the file path for an episode's video
 func (s *ShowService) GetEpisodeVideoPath(episodeID string) (string, error) {
 	log.Printf("GetEpisodeVideoPath: Finding video path for episode %s", episodeID)
 	
-	// This is a simplified implementation
-	// In a real implementation, you would have a more sophisticated way to map
-	// episode IDs to file paths, possibly using a database or index file
-	
-	// For now, we'll search for the video file
+	// Use the file found by the library scanner if there is one
+	if episode, ok := s.indexedEpisode(episodeID); ok {
+		log.Printf("GetEpisodeVideoPath: Found indexed video path %s", episode.VideoPath)
+		return episode.VideoPath, nil
+	}
+
+	// Otherwise guess the path from the episode ID
 	path, err := s.findEpisodeVideoFile(episodeID)
 	if err != nil {
 		log.Printf("GetEpisodeVideoPath: Error finding video path for %s: %v", episodeID, err)
@@ -165,8 +438,8 @@ func (s *ShowService) GetEpisodeVideoPath(episodeID string) (string, error) {
 func (s *ShowService) findEpisodeVideoFile(episodeID string) (string, error) {
 	log.Printf("findEpisodeVideoFile: Searching for video file for episode %s", episodeID)
 	
-	// Remove "Show_" prefix from episode ID
-	trimmedID := strings.TrimPrefix(episodeID, "Show_")
+	// Remove the show prefix ("Show_") from episode ID
+	trimmedID := strings.TrimPrefix(episodeID, s.location.EpisodePrefix)
 	
 	// Extract season and episode numbers from format S01E01
 	if len(trimmedID) < 6 {
@@ -201,7 +474,7 @@ func (s *ShowService) findEpisodeVideoFile(episodeID string) (string, error) {
 	log.Printf("findEpisodeVideoFile: Looking for season %s, episode %s", seasonDirName, episodeFileName)
 	
 	// Construct expected file path
-	seasonDir := filepath.Join(s.config.SeasonsDir, seasonDirName)
+	seasonDir := filepath.Join(s.location.SeasonsDir, seasonDirName)
 	if !utils.FileExists(seasonDir) {
 		log.Printf("findEpisodeVideoFile: Season directory not found: %s", seasonDir)
 		return "", fmt.Errorf("season directory not found: %s", seasonDir)
@@ -244,9 +517,21 @@ func (s *ShowService) findEpisodeVideoFile(episodeID string) (string, error) {
 // GetEpisodeSubtitlePath returns the file path for an episode's subtitle
 func (s *ShowService) GetEpisodeSubtitlePath(episodeID string) (string, error) {
 	log.Printf("GetEpisodeSubtitlePath: Finding subtitle path for episode %s", episodeID)
+
+	// Use the default track if the episode has language-tagged or embedded subtitles
+	if file, ok := pickSubtitleFile(s.findSubtitleFiles(episodeID, newDirCache(), true), ""); ok {
+		log.Printf("GetEpisodeSubtitlePath: Found subtitle track %s", file.track.ID)
+		return s.subtitleFilePath(episodeID, file)
+	}
+
+	// Use the file found by the library scanner if there is one
+	if episode, ok := s.indexedEpisode(episodeID); ok && episode.SubtitlePath != "" {
+		log.Printf("GetEpisodeSubtitlePath: Found indexed subtitle path %s", episode.SubtitlePath)
+		return episode.SubtitlePath, nil
+	}
 	
-	// Remove "Show_" prefix from episode ID
-	trimmedID := strings.TrimPrefix(episodeID, "Show_")
+	// Remove the show prefix ("Show_") from episode ID
+	trimmedID := strings.TrimPrefix(episodeID, s.location.EpisodePrefix)
 	
 	// Extract season and episode numbers from format S01E01
 	if len(trimmedID) < 6 {
@@ -279,8 +564,7 @@ func (s *ShowService) GetEpisodeSubtitlePath(episodeID string) (string, error) {
 	log.Printf("GetEpisodeSubtitlePath: Looking for season %s, episode %s", seasonDirName, episodeFileName)
 	
 	// Construct subtitle file path in subtitles directory
-	subtitlesDir := filepath.Join(filepath.Dir(s.config.SeasonsDir), "subtitles")
-	seasonSubtitleDir := filepath.Join(subtitlesDir, seasonDirName)
+	seasonSubtitleDir := filepath.Join(s.location.SubtitlesDir, seasonDirName)
 	
 	if !utils.FileExists(seasonSubtitleDir) {
 		log.Printf("GetEpisodeSubtitlePath: Subtitle directory not found: %s", seasonSubtitleDir)
@@ -288,7 +572,7 @@ func (s *ShowService) GetEpisodeSubtitlePath(episodeID string) (string, error) {
 	}
 	
 	// Try different subtitle extensions
-	extensions := []string{".srt", ".vtt"}
+	extensions := []string{".srt", ".vtt", ".ass", ".ssa"}
 	for _, ext := range extensions {
 		filePath := filepath.Join(seasonSubtitleDir, episodeFileName+ext)
 		if utils.FileExists(filePath) {
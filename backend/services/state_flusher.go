@@ -0,0 +1,99 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"comfort-player-backend/models"
+)
+
+// StateFlusher writes playback state and resume points that changed in memory
+// to the state store on an interval
+type StateFlusher struct {
+	registry       *ShowRegistry
+	historyService *HistoryService
+	interval       time.Duration
+	stop           chan struct{}
+	done           chan struct{}
+}
+
+// NewStateFlusher creates a state flusher. Call Start to begin flushing.
+func NewStateFlusher(registry *ShowRegistry, historyService *HistoryService, interval time.Duration) *StateFlusher {
+	return &StateFlusher{
+		registry:       registry,
+		historyService: historyService,
+		interval:       interval,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+}
+
+// Start flushes in the background every interval until Stop is called
+func (f *StateFlusher) Start() {
+	log.Printf("StateFlusher.Start: Flushing state every %v", f.interval)
+	go func() {
+		defer close(f.done)
+
+		ticker := time.NewTicker(f.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := f.Flush(); err != nil {
+					log.Printf("StateFlusher: Error flushing state: %v", err)
+				}
+			case <-f.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops flushing in the background and writes whatever is still pending
+func (f *StateFlusher) Stop() error {
+	close(f.stop)
+	<-f.done
+
+	log.Printf("StateFlusher.Stop: Writing pending state")
+	return f.Flush()
+}
+
+// Flush writes every show's state and the resume points that changed since
+// they were last written
+func (f *StateFlusher) Flush() error {
+	var failed []string
+	for _, show := range f.registry.All() {
+		if err := show.State.Flush(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", show.Show.ID(), err))
+		}
+	}
+	if err := f.historyService.Flush(); err != nil {
+		failed = append(failed, fmt.Sprintf("progress: %v", err))
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to flush %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Status reports when state was last written and how much is waiting to be
+func (f *StateFlusher) Status() models.StateFlushStatus {
+	status := models.StateFlushStatus{FlushIntervalSeconds: int64(f.interval / time.Second)}
+	add := func(lastFlushed time.Time, pending bool) {
+		if !lastFlushed.IsZero() && lastFlushed.Unix() > status.LastFlushed {
+			status.LastFlushed = lastFlushed.Unix()
+		}
+		if pending {
+			status.Pending++
+		}
+	}
+
+	for _, show := range f.registry.All() {
+		add(show.State.FlushStatus())
+	}
+	add(f.historyService.FlushStatus())
+	return status
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"comfort-player-backend/config"
+	"comfort-player-backend/models"
+)
+
+func TestStateFlusherHoldsPositionUpdates(t *testing.T) {
+	mediaDir := t.TempDir()
+	cfg := &config.Config{
+		MediaDir:      mediaDir,
+		SeasonsDir:    filepath.Join(mediaDir, "shows"),
+		StateFile:     filepath.Join(t.TempDir(), "state.json"),
+		DefaultShowID: "default",
+	}
+	store := NewMemoryStore()
+	registry := NewShowRegistry(cfg, store, NewWorkerPool(1))
+	history := NewHistoryService(store)
+	show := registry.Default()
+
+	// Flushing on the interval stays out of the way
+	flusher := NewStateFlusher(registry, history, time.Hour)
+	flusher.Start()
+
+	saved := func() (models.ServerState, models.EpisodeProgress) {
+		t.Helper()
+		var state models.PersistedState
+		if _, err := store.Load(StateKey(cfg), &state); err != nil {
+			t.Fatal(err)
+		}
+		var progress map[string]map[string]models.EpisodeProgress
+		if _, err := store.Load(progressKey, &progress); err != nil {
+			t.Fatal(err)
+		}
+		return state.ServerState, progress[""]["Show_S01E01"]
+	}
+	update := func(position int64, episodeChanged bool) {
+		t.Helper()
+		if _, _, err := show.State.UpdateState("", "Show_S01E01", position, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := history.RecordProgress(PlaybackReport{
+			EpisodeID:       "Show_S01E01",
+			PositionSeconds: position,
+			EpisodeChanged:  episodeChanged,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Starting an episode is written right away
+	update(10, true)
+	if state, progress := saved(); state.PlaybackTimeSeconds != 10 || progress.PositionSeconds != 10 {
+		t.Fatalf("saved position = %d, resume point %d; want the new episode written", state.PlaybackTimeSeconds, progress.PositionSeconds)
+	}
+	if status := flusher.Status(); status.Pending != 0 || status.LastFlushed == 0 {
+		t.Errorf("Status after a change of episode = %+v, want nothing pending", status)
+	}
+
+	// Position updates are only held in memory
+	update(120, false)
+	if state, progress := saved(); state.PlaybackTimeSeconds != 10 || progress.PositionSeconds != 10 {
+		t.Errorf("saved position = %d, resume point %d; want the update held in memory", state.PlaybackTimeSeconds, progress.PositionSeconds)
+	}
+	if got := show.State.GetState("").PlaybackTimeSeconds; got != 120 {
+		t.Errorf("position in memory = %d, want 120", got)
+	}
+	if status := flusher.Status(); status.Pending != 2 {
+		t.Errorf("Status after a position update = %+v, want the state and resume points pending", status)
+	}
+
+	// Stopping writes them
+	if err := flusher.Stop(); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+	if state, progress := saved(); state.PlaybackTimeSeconds != 120 || progress.PositionSeconds != 120 {
+		t.Errorf("saved position after Stop = %d, resume point %d; want 120", state.PlaybackTimeSeconds, progress.PositionSeconds)
+	}
+	if status := flusher.Status(); status.Pending != 0 {
+		t.Errorf("Status after Stop = %+v, want nothing pending", status)
+	}
+}
@@ -1,26 +1,46 @@
 package services
 
 import (
+	"encoding/json"
+	"errors"
 	"log"
+	"sort"
 	"sync"
 	"time"
 
 	"comfort-player-backend/models"
-	"comfort-player-backend/utils"
 )
 
-// StateService handles the current playback state
+// ErrStateConflict is returned when an update is based on an older revision of the state
+var ErrStateConflict = errors.New("playback state has changed")
+
+// StateService handles the current playback state of every profile. Playback
+// position updates are kept in memory and written on Flush; changes of episode
+// and other actions are written right away.
 type StateService struct {
-	stateFile string
-	state     models.ServerState
-	mutex     sync.RWMutex
+	store  StateStore
+	key    string
+	state  models.PersistedState
+	mutex  sync.RWMutex
+	writes *writeBehind
+	// revisionEpoch is the lowest revision this process hands out. Revisions
+	// made since the last flush are lost in a crash, so the next process
+	// starts above them rather than handing them out again.
+	revisionEpoch int64
+	// Changes are published to events as the state of showID
+	events *EventBus
+	showID string
 }
 
-// NewStateService creates a new state service
-func NewStateService(stateFile string) *StateService {
+// NewStateService creates a new state service that keeps its state in store under key
+func NewStateService(store StateStore, key string) *StateService {
 	service := &StateService{
-		stateFile: stateFile,
-		state:     models.ServerState{},
+		store:  store,
+		key:    key,
+		state:  models.PersistedState{},
+		writes: newWriteBehind(store, key),
+
+		revisionEpoch: time.Now().UnixMilli(),
 	}
 
 	// Load existing state if it exists
@@ -28,60 +48,250 @@ func NewStateService(stateFile string) *StateService {
 	return service
 }
 
-// GetState returns the current server state
-func (s *StateService) GetState() models.ServerState {
+// GetState returns the server state of a profile. An empty profile ID is the default profile.
+func (s *StateService) GetState(profileID string) models.ServerState {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
-	return s.state
+	return s.profileState(profileID)
 }
 
-// UpdateState updates the server state
-func (s *StateService) UpdateState(episodeID string, playbackTimeSeconds int64) error {
-	log.Printf("UpdateState: Updating state - EpisodeID: %s, PlaybackTime: %d", episodeID, playbackTimeSeconds)
+// UpdateState updates the server state of a profile and returns the new state
+// and whether the update switched episodes. If baseRevision is set and the state has changed since that revision, the
+// current state is returned with ErrStateConflict. A new playback position is
+// only kept in memory until the next flush; switching episodes is written
+// right away.
+func (s *StateService) UpdateState(profileID, episodeID string, playbackTimeSeconds int64, baseRevision *int64) (models.ServerState, bool, error) {
+	log.Printf("UpdateState: Updating state - Profile: %q, EpisodeID: %s, PlaybackTime: %d", profileID, episodeID, playbackTimeSeconds)
 	
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	state := s.profileState(profileID)
+	if baseRevision != nil && *baseRevision != state.Revision {
+		s.mutex.Unlock()
+		log.Printf("UpdateState: Update based on revision %d, state is at %d", *baseRevision, state.Revision)
+		return state, false, ErrStateConflict
+	}
+	episodeChanged := state.CurrentEpisodeID != episodeID
+	if episodeChanged && len(state.ShuffleQueue) > 0 {
+		// An episode picked by hand counts as seen in the current shuffle cycle
+		queue := make([]string, 0, len(state.ShuffleQueue))
+		for _, id := range state.ShuffleQueue {
+			if id != episodeID {
+				queue = append(queue, id)
+			}
+		}
+		state.ShuffleQueue = queue
+	}
+	state.CurrentEpisodeID = episodeID
+	state.PlaybackTimeSeconds = playbackTimeSeconds
+	state.LastUpdated = time.Now().Unix()
+	state.Revision = s.nextRevision(state.Revision)
+	s.setProfileState(profileID, state)
+	s.writes.changed()
+	s.publish(profileID, state, episodeChanged)
+	s.mutex.Unlock()
+
+	if !episodeChanged {
+		log.Printf("UpdateState: State updated in memory, %s is saved on the next flush", s.key)
+		return state, false, nil
+	}
 
-	s.state.CurrentEpisodeID = episodeID
-	s.state.PlaybackTimeSeconds = playbackTimeSeconds
-	s.state.LastUpdated = time.Now().Unix()
+	// Don't lose a change of episode to a crash
+	log.Printf("UpdateState: Episode changed, saving %s", s.key)
+	if err := s.Flush(); err != nil {
+		log.Printf("UpdateState: Error saving state: %v", err)
+		return state, true, err
+	}
 	
-	log.Printf("UpdateState: State updated in memory, saving to file: %s", s.stateFile)
+	log.Printf("UpdateState: State saved successfully")
+	return state, true, nil
+}
+
+// Flush writes the state to the store if it changed since it was last written
+func (s *StateService) Flush() error {
+	s.writes.writeMutex.Lock()
+	defer s.writes.writeMutex.Unlock()
 
-	// Save to file
-	err := utils.WriteJSON(s.stateFile, s.state)
+	if !s.writes.take() {
+		return nil
+	}
+
+	// Snapshot the state, so updates don't wait for the disk
+	s.mutex.RLock()
+	data, err := json.Marshal(s.state)
+	s.mutex.RUnlock()
 	if err != nil {
-		log.Printf("UpdateState: Error saving state to file: %v", err)
 		return err
 	}
-	
-	log.Printf("UpdateState: State saved successfully")
-	return nil
+	return s.writes.save(json.RawMessage(data))
+}
+
+// FlushStatus returns when the state was last written and whether it has changed since
+func (s *StateService) FlushStatus() (time.Time, bool) {
+	return s.writes.status()
+}
+
+// MoveToEpisode atomically replaces a profile's current episode with the one
+// returned by pick and resets the playback time. pick may also update the
+// profile's shuffle bookkeeping. It runs while the state is locked, so the
+// episodes it picks from should be loaded before.
+func (s *StateService) MoveToEpisode(profileID string, pick func(state *models.ServerState) (string, error)) (models.ServerState, error) {
+	return s.modifyState(profileID, func(state *models.ServerState) error {
+		episodeID, err := pick(state)
+		if err != nil {
+			log.Printf("MoveToEpisode: Error picking episode after %s: %v", state.CurrentEpisodeID, err)
+			return err
+		}
+
+		log.Printf("MoveToEpisode: Moving profile %q from %s to %s", profileID, state.CurrentEpisodeID, episodeID)
+		state.CurrentEpisodeID = episodeID
+		state.PlaybackTimeSeconds = 0
+		state.LastUpdated = time.Now().Unix()
+		return nil
+	})
 }
 
-// loadState loads the state from file
+// SetPlaybackMode changes how a profile advances to the next episode
+func (s *StateService) SetPlaybackMode(profileID, mode string) (models.ServerState, error) {
+	return s.modifyState(profileID, func(state *models.ServerState) error {
+		log.Printf("SetPlaybackMode: Profile %q mode %q -> %q", profileID, state.PlaybackMode, mode)
+		if state.PlaybackMode != mode {
+			// Start a fresh shuffle cycle in the new mode
+			state.ShuffleQueue = nil
+		}
+		state.PlaybackMode = mode
+		return nil
+	})
+}
+
+// SetFavorite adds an episode to, or removes it from, a profile's favorites
+func (s *StateService) SetFavorite(profileID, episodeID string, favorite bool) (models.ServerState, error) {
+	return s.modifyState(profileID, func(state *models.ServerState) error {
+		favorites := make([]string, 0, len(state.Favorites)+1)
+		for _, id := range state.Favorites {
+			if id != episodeID {
+				favorites = append(favorites, id)
+			}
+		}
+		if favorite {
+			favorites = append(favorites, episodeID)
+			sort.Strings(favorites)
+		}
+		state.Favorites = favorites
+		return nil
+	})
+}
+
+// modifyState applies fn to a copy of a profile's state and saves it. The
+// previous state is kept if fn fails or the state can't be saved.
+func (s *StateService) modifyState(profileID string, fn func(state *models.ServerState) error) (models.ServerState, error) {
+	s.writes.writeMutex.Lock()
+	defer s.writes.writeMutex.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := s.profileState(profileID)
+	state := cloneServerState(previous)
+	if err := fn(&state); err != nil {
+		return previous, err
+	}
+	state.Revision = s.nextRevision(state.Revision)
+
+	// Pending position updates are written along with the change
+	s.setProfileState(profileID, state)
+	s.writes.take()
+	if err := s.writes.save(s.state); err != nil {
+		log.Printf("modifyState: Error saving state: %v", err)
+		s.setProfileState(profileID, previous)
+		return previous, err
+	}
+	s.publish(profileID, state, state.CurrentEpisodeID != previous.CurrentEpisodeID)
+	return state, nil
+}
+
+// nextRevision returns the revision following revision. The first change made
+// by this process jumps to the process's epoch, the time it started in
+// milliseconds, so revisions never repeat across restarts.
+func (s *StateService) nextRevision(revision int64) int64 {
+	return max(revision+1, s.revisionEpoch)
+}
+
+// publish announces a profile's new state to the clients following it.
+// Callers must hold the write lock, so events go out in order.
+func (s *StateService) publish(profileID string, state models.ServerState, episodeChanged bool) {
+	eventType := models.ShowEventState
+	if episodeChanged {
+		eventType = models.ShowEventEpisode
+	}
+	s.events.Publish(StateEvent(eventType, s.showID, profileID, state))
+}
+
+// DeleteProfile removes the saved state of a profile
+func (s *StateService) DeleteProfile(profileID string) error {
+	s.writes.writeMutex.Lock()
+	defer s.writes.writeMutex.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.state.Profiles[profileID]; !exists {
+		return nil
+	}
+
+	log.Printf("DeleteProfile: Removing state for profile %s from %s", profileID, s.key)
+	delete(s.state.Profiles, profileID)
+	s.writes.take()
+	return s.writes.save(s.state)
+}
+
+// profileState returns the state of a profile. Callers must hold the mutex.
+func (s *StateService) profileState(profileID string) models.ServerState {
+	if profileID == "" {
+		return s.state.ServerState
+	}
+	return s.state.Profiles[profileID]
+}
+
+// setProfileState stores the state of a profile. Callers must hold the write lock.
+func (s *StateService) setProfileState(profileID string, state models.ServerState) {
+	if profileID == "" {
+		s.state.ServerState = state
+		return
+	}
+	if s.state.Profiles == nil {
+		s.state.Profiles = make(map[string]models.ServerState)
+	}
+	s.state.Profiles[profileID] = state
+}
+
+// cloneServerState returns a copy of a state that shares no slices with the original
+func cloneServerState(state models.ServerState) models.ServerState {
+	state.ShuffleQueue = append([]string(nil), state.ShuffleQueue...)
+	state.RecentEpisodes = append([]string(nil), state.RecentEpisodes...)
+	state.Favorites = append([]string(nil), state.Favorites...)
+	return state
+}
+
+// loadState loads the state from the store. State that can't be read is
+// logged and replaced with an empty state; the JSON store keeps the damaged
+// file aside.
 func (s *StateService) loadState() {
-	log.Printf("loadState: Loading state from file: %s", s.stateFile)
+	log.Printf("loadState: Loading state %s", s.key)
 	
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	if utils.FileExists(s.stateFile) {
-		err := utils.ReadJSON(s.stateFile, &s.state)
-		if err != nil {
-			log.Printf("loadState: Error reading state file, initializing with default values: %v", err)
-			// If there's an error reading the state file, initialize with default values
-			s.state = models.ServerState{}
-		} else {
-			log.Printf("loadState: State loaded successfully - EpisodeID: %s, PlaybackTime: %d", s.state.CurrentEpisodeID, s.state.PlaybackTimeSeconds)
-		}
-	} else {
-		log.Printf("loadState: State file not found, initializing with default values")
+	found, err := s.store.Load(s.key, &s.state)
+	switch {
+	case err != nil:
+		log.Printf("loadState: ERROR: State %s is unreadable, starting with default values: %v", s.key, err)
+		s.state = models.PersistedState{}
+	case found:
+		log.Printf("loadState: State loaded successfully - EpisodeID: %s, PlaybackTime: %d, Profiles: %d", s.state.CurrentEpisodeID, s.state.PlaybackTimeSeconds, len(s.state.Profiles))
+	default:
+		log.Printf("loadState: State not found, initializing with default values")
 		// Initialize with default values
-		s.state = models.ServerState{}
-		err := utils.WriteJSON(s.stateFile, s.state)
-		if err != nil {
-			log.Printf("UpdateState: Error initializing state to file: %v", err)
+		s.state = models.PersistedState{}
+		if err := s.store.Save(s.key, s.state); err != nil {
+			log.Printf("loadState: Error initializing state: %v", err)
 		}
 	}
 }
@@ -0,0 +1,124 @@
+package services
+
+import "testing"
+
+func TestUpdateStateEpisodeChanged(t *testing.T) {
+	service := NewStateService(NewMemoryStore(), "state")
+
+	tests := []struct {
+		name      string
+		episodeID string
+		position  int64
+		changed   bool
+	}{
+		{name: "first episode", episodeID: "Show_S01E01", position: 10, changed: true},
+		{name: "position only", episodeID: "Show_S01E01", position: 20, changed: false},
+		{name: "other episode", episodeID: "Show_S01E02", position: 0, changed: true},
+		{name: "back to the start", episodeID: "Show_S01E02", position: 0, changed: false},
+	}
+
+	for _, test := range tests {
+		state, changed, err := service.UpdateState("", test.episodeID, test.position, nil)
+		if err != nil {
+			t.Fatalf("%s: UpdateState error: %v", test.name, err)
+		}
+		if changed != test.changed {
+			t.Errorf("%s: episode changed = %v, want %v", test.name, changed, test.changed)
+		}
+		if state.CurrentEpisodeID != test.episodeID || state.PlaybackTimeSeconds != test.position {
+			t.Errorf("%s: state = %s at %d, want %s at %d", test.name, state.CurrentEpisodeID, state.PlaybackTimeSeconds, test.episodeID, test.position)
+		}
+	}
+
+	// Profiles switch episodes independently
+	if _, changed, err := service.UpdateState("alice", "Show_S01E02", 0, nil); err != nil || !changed {
+		t.Errorf("UpdateState for another profile = %v, %v; want a change of episode", changed, err)
+	}
+}
+
+func TestUpdateStateRevisionConflict(t *testing.T) {
+	service := NewStateService(NewMemoryStore(), "state")
+
+	first, _, err := service.UpdateState("", "Show_S01E01", 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Revision < service.revisionEpoch {
+		t.Errorf("first revision %d is below the epoch %d", first.Revision, service.revisionEpoch)
+	}
+
+	// An update based on the current revision goes through
+	second, _, err := service.UpdateState("", "Show_S01E01", 20, &first.Revision)
+	if err != nil {
+		t.Fatalf("UpdateState on the current revision error: %v", err)
+	}
+	if second.Revision != first.Revision+1 {
+		t.Errorf("revision = %d, want %d", second.Revision, first.Revision+1)
+	}
+
+	// One based on an older revision gets the current state back
+	state, changed, err := service.UpdateState("", "Show_S01E02", 0, &first.Revision)
+	if err != ErrStateConflict {
+		t.Fatalf("UpdateState on an old revision error = %v, want %v", err, ErrStateConflict)
+	}
+	if changed || state.Revision != second.Revision || state.CurrentEpisodeID != "Show_S01E01" || state.PlaybackTimeSeconds != 20 {
+		t.Errorf("conflicting update returned %+v, changed %v; want the state at revision %d", state, changed, second.Revision)
+	}
+	if got := service.GetState(""); got.Revision != second.Revision || got.PlaybackTimeSeconds != 20 {
+		t.Errorf("state after the conflict = %+v, want it unchanged", got)
+	}
+
+	// Other changes move the revision on too
+	moved, err := service.SetPlaybackMode("", "shuffle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Revision != second.Revision+1 {
+		t.Errorf("revision after SetPlaybackMode = %d, want %d", moved.Revision, second.Revision+1)
+	}
+	if _, _, err := service.UpdateState("", "Show_S01E01", 30, &second.Revision); err != ErrStateConflict {
+		t.Errorf("UpdateState on the revision before SetPlaybackMode error = %v, want %v", err, ErrStateConflict)
+	}
+}
+
+func TestRevisionsAcrossRestarts(t *testing.T) {
+	store := NewMemoryStore()
+
+	// start simulates a process starting at the given epoch
+	start := func(epoch int64) *StateService {
+		service := NewStateService(store, "state")
+		service.revisionEpoch = epoch
+		return service
+	}
+	update := func(service *StateService, position, want int64) {
+		t.Helper()
+		state, _, err := service.UpdateState("", "Show_S01E01", position, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Revision != want {
+			t.Errorf("revision = %d, want %d", state.Revision, want)
+		}
+	}
+
+	// The first process starts at its epoch and counts up from there
+	service := start(1000)
+	update(service, 10, 1000)
+	update(service, 20, 1001)
+	if err := service.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A clock set back doesn't hand out the saved revisions again
+	service = start(500)
+	update(service, 30, 1002)
+	update(service, 40, 1003)
+
+	// Position updates since the last flush are lost in a crash, but the next
+	// process's epoch is above their revisions
+	service = start(2000)
+	if got := service.GetState("").Revision; got != 1001 {
+		t.Errorf("revision after the crash = %d, want the last saved 1001", got)
+	}
+	update(service, 50, 2000)
+}
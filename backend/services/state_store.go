@@ -0,0 +1,385 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"comfort-player-backend/config"
+	"comfort-player-backend/utils"
+)
+
+// State store backends, selected with STATE_STORE
+const (
+	StateStoreJSON = "json"
+	StateStoreKV   = "kv"
+)
+
+// Keys of the documents and logs kept in the state store. Each show's playback
+// state is a document of its own, see StateKey.
+const (
+	profilesKey = "profiles"
+	progressKey = "progress"
+	historyKey  = "history"
+)
+
+// StateStore persists named JSON documents, such as the playback state of each
+// show, the profiles and the resume points, and append-only logs such as the
+// watch history
+type StateStore interface {
+	// Load reads the document stored under key into v. It reports false if there is none.
+	Load(key string, v interface{}) (bool, error)
+	// Save replaces the document stored under key
+	Save(key string, v interface{}) error
+	// Append adds a record to the log stored under key
+	Append(key string, v interface{}) error
+	// Scan calls fn with every record of the log stored under key, oldest first
+	Scan(key string, fn func(record []byte) error) error
+	// Close releases the store; it can't be used afterwards
+	Close() error
+}
+
+// OpenStateStore opens the store selected by the configuration. Both backends
+// keep their files next to the state file. A new key-value database starts
+// with the contents of the JSON files, so switching backends keeps the state.
+func OpenStateStore(cfg *config.Config) (StateStore, error) {
+	dir := filepath.Dir(cfg.StateFile)
+	switch cfg.StateStore {
+	case "", StateStoreJSON:
+		log.Printf("OpenStateStore: Using JSON files in %s", dir)
+		return NewFileStore(dir), nil
+	case StateStoreKV:
+		path := filepath.Join(dir, "state.db")
+		log.Printf("OpenStateStore: Using key-value database %s", path)
+		if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+			if err := importKVStore(path, NewFileStore(dir), StateKey(cfg)); err != nil {
+				return nil, fmt.Errorf("failed to import JSON state: %w", err)
+			}
+		}
+		store, err := OpenKVStore(path)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, fmt.Errorf("unknown state store %q, use %q or %q", cfg.StateStore, StateStoreJSON, StateStoreKV)
+}
+
+// StateKey returns the key of the default show's playback state: the name of
+// the state file without its extension
+func StateKey(cfg *config.Config) string {
+	name := filepath.Base(cfg.StateFile)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// showStateKey returns the key of a non-default show's playback state
+func showStateKey(showID string) string {
+	return "state-" + showID
+}
+
+// importKVStore creates the key-value database at path from the JSON files. It's
+// built next to path and only renamed into place once complete, so an import
+// that fails is started over on the next start.
+func importKVStore(path string, files *FileStore, stateKey string) error {
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	store, err := OpenKVStore(tmp)
+	if err != nil {
+		return err
+	}
+	err = importFileStore(store, files, stateKey)
+	if closeErr := store.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// importFileStore copies the documents and logs of the JSON files into another store
+func importFileStore(store StateStore, files *FileStore, stateKey string) error {
+	keys := []string{stateKey, profilesKey, progressKey}
+	if matches, err := filepath.Glob(filepath.Join(files.dir, showStateKey("*")+".json")); err == nil {
+		for _, match := range matches {
+			keys = append(keys, strings.TrimSuffix(filepath.Base(match), ".json"))
+		}
+	}
+
+	for _, key := range keys {
+		var document json.RawMessage
+		found, err := files.Load(key, &document)
+		if err != nil {
+			// As when the JSON files are used directly, an unreadable document starts over
+			log.Printf("importFileStore: Skipping unreadable %s: %v", key, err)
+			continue
+		}
+		if !found {
+			continue
+		}
+		log.Printf("importFileStore: Importing %s", key)
+		if err := store.Save(key, document); err != nil {
+			return err
+		}
+	}
+
+	count := 0
+	err := files.Scan(historyKey, func(record []byte) error {
+		count++
+		return store.Append(historyKey, json.RawMessage(record))
+	})
+	if count > 0 {
+		log.Printf("importFileStore: Imported %d %s records", count, historyKey)
+	}
+	return err
+}
+
+// FileStore keeps each document in a JSON file named after its key and each
+// log in a JSON Lines file. Documents are replaced atomically and the previous
+// generation is kept as a .bak file, which is read if the current one is
+// missing or damaged.
+type FileStore struct {
+	dir string
+	// logMutex serializes appends to the log files
+	logMutex sync.Mutex
+}
+
+// NewFileStore creates a JSON file store in dir
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+// documentPath returns the file holding a document
+func (s *FileStore) documentPath(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
+
+// logPath returns the file holding a log
+func (s *FileStore) logPath(key string) string {
+	return filepath.Join(s.dir, key+".jsonl")
+}
+
+// Load reads a document, falling back to its backup. A damaged file is renamed
+// to .corrupt so it's still there for someone to look at. If neither
+// generation can be read an error is returned.
+func (s *FileStore) Load(key string, v interface{}) (bool, error) {
+	path := s.documentPath(key)
+	backup := path + ".bak"
+
+	data, err := readJSONFile(path)
+	if err == nil {
+		return true, json.Unmarshal(data, v)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("FileStore.Load: Error reading %s: %v", path, err)
+	}
+	primaryErr := err
+
+	data, err = readJSONFile(backup)
+	if err == nil {
+		log.Printf("FileStore.Load: Recovered %s from %s", key, backup)
+		s.moveAside(path, primaryErr)
+		return true, json.Unmarshal(data, v)
+	}
+	if errors.Is(primaryErr, os.ErrNotExist) && errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	log.Printf("FileStore.Load: Error reading %s: %v", backup, err)
+
+	s.moveAside(path, primaryErr)
+	return false, fmt.Errorf("failed to read %s: %w", path, primaryErr)
+}
+
+// moveAside renames a damaged document to .corrupt, so the next save doesn't
+// keep it as the backup
+func (s *FileStore) moveAside(path string, readErr error) {
+	if errors.Is(readErr, os.ErrNotExist) {
+		return
+	}
+	if err := os.Rename(path, path+".corrupt"); err != nil {
+		log.Printf("FileStore.moveAside: Error moving %s aside: %v", path, err)
+	}
+}
+
+// readJSONFile reads a file and checks that it holds valid JSON
+func readJSONFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(data) {
+		return nil, errors.New("invalid JSON")
+	}
+	return data, nil
+}
+
+// Save writes a document, keeping the previous generation as a backup
+func (s *FileStore) Save(key string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.documentPath(key), append(data, '\n'), true)
+}
+
+// Append adds a line to a log file and syncs it to disk
+func (s *FileStore) Append(key string, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.logMutex.Lock()
+	defer s.logMutex.Unlock()
+
+	if err := utils.EnsureDir(s.dir); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.logPath(key), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// A crash can leave the last line cut short. End it first, so the new
+	// record starts a line of its own instead of joining the broken one.
+	terminated, err := endsWithNewline(file)
+	if err != nil {
+		return err
+	}
+	if !terminated {
+		line = append([]byte{'\n'}, line...)
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// endsWithNewline reports whether a file is empty or ends with a newline
+func endsWithNewline(file *os.File) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 {
+		return true, nil
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return false, err
+	}
+	return last[0] == '\n', nil
+}
+
+// Scan reads a log file line by line. A line cut short by a crash is skipped.
+func (s *FileStore) Scan(key string, fn func(record []byte) error) error {
+	file, err := os.Open(s.logPath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if !json.Valid(scanner.Bytes()) {
+			log.Printf("FileStore.Scan: Skipping unreadable line in %s", s.logPath(key))
+			continue
+		}
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Close does nothing; every write is complete when it returns
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// MemoryStore keeps documents and logs in memory only. The command-line tools
+// use it, since they don't touch playback state and mustn't write to a store
+// the server has open.
+type MemoryStore struct {
+	documents map[string][]byte
+	logs      map[string][][]byte
+	mutex     sync.RWMutex
+}
+
+// NewMemoryStore creates an empty memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		documents: make(map[string][]byte),
+		logs:      make(map[string][][]byte),
+	}
+}
+
+// Load reads a document
+func (s *MemoryStore) Load(key string, v interface{}) (bool, error) {
+	s.mutex.RLock()
+	data, ok := s.documents[key]
+	s.mutex.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// Save replaces a document
+func (s *MemoryStore) Save(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.documents[key] = data
+	return nil
+}
+
+// Append adds a record to a log
+func (s *MemoryStore) Append(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.logs[key] = append(s.logs[key], data)
+	return nil
+}
+
+// Scan calls fn with every record of a log
+func (s *MemoryStore) Scan(key string, fn func(record []byte) error) error {
+	s.mutex.RLock()
+	records := s.logs[key]
+	s.mutex.RUnlock()
+	for _, record := range records {
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close does nothing
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readTestFile returns a file's content, or "" if it doesn't exist
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileStoreBackup(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(dir)
+	path := filepath.Join(dir, "state.json")
+
+	for _, value := range []string{"first", "second", "third"} {
+		if err := store.Save("state", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readTestFile(t, path); got != "\"third\"\n" {
+		t.Errorf("state.json = %q, want the last save", got)
+	}
+	if got := readTestFile(t, path+".bak"); got != "\"second\"\n" {
+		t.Errorf("state.json.bak = %q, want the save before", got)
+	}
+}
+
+func TestFileStoreLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		primary string
+		backup  string
+		want    string
+		found   bool
+		err     bool
+		corrupt bool
+	}{
+		{name: "primary", primary: `"current"`, backup: `"older"`, want: "current", found: true},
+		{name: "missing primary", backup: `"older"`, want: "older", found: true},
+		{name: "damaged primary", primary: `"cut sho`, backup: `"older"`, want: "older", found: true, corrupt: true},
+		{name: "both damaged", primary: `"cut sho`, backup: `{`, err: true, corrupt: true},
+		{name: "neither exists"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "state.json")
+			if test.primary != "" {
+				os.WriteFile(path, []byte(test.primary), 0644)
+			}
+			if test.backup != "" {
+				os.WriteFile(path+".bak", []byte(test.backup), 0644)
+			}
+
+			var got string
+			found, err := NewFileStore(dir).Load("state", &got)
+			if (err != nil) != test.err {
+				t.Fatalf("Load error = %v, want error: %v", err, test.err)
+			}
+			if found != test.found || got != test.want {
+				t.Errorf("Load = %q, %v; want %q, %v", got, found, test.want, test.found)
+			}
+			if corrupt := readTestFile(t, path+".corrupt"); (corrupt != "") != test.corrupt {
+				t.Errorf("state.json.corrupt = %q, want it only for a damaged primary", corrupt)
+			}
+		})
+	}
+}
+
+func TestFileStoreKeepsBackupAfterRecovery(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	os.WriteFile(path, []byte(`"cut sho`), 0644)
+	os.WriteFile(path+".bak", []byte(`"older"`), 0644)
+	store := NewFileStore(dir)
+
+	// Recovering moves the damaged file aside, leaving no primary
+	var recovered string
+	if _, err := store.Load("state", &recovered); err != nil || recovered != "older" {
+		t.Fatalf("Load = %q, %v; want the backup", recovered, err)
+	}
+
+	// Without a primary to take its place, the backup stays
+	if err := store.Save("state", "newer"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, path+".bak"); got != `"older"` {
+		t.Errorf("state.json.bak = %q, want the recovered backup kept", got)
+	}
+	if got := readTestFile(t, path); got != "\"newer\"\n" {
+		t.Errorf("state.json = %q, want the new save", got)
+	}
+
+	// Once there's a primary again, it becomes the backup
+	if err := store.Save("state", "newest"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, path+".bak"); got != "\"newer\"\n" {
+		t.Errorf("state.json.bak = %q, want the previous save", got)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, ".*")); len(matches) > 0 {
+		t.Errorf("temporary files left behind: %q", matches)
+	}
+}
+
+func TestFileStoreAppendAfterTruncatedLine(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(dir)
+	path := filepath.Join(dir, "history.jsonl")
+
+	// A crash cut off the last record
+	if err := os.WriteFile(path, []byte("{\"event\": 1}\n{\"event\""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append("history", map[string]int{"event": 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []string
+	err := store.Scan("history", func(record []byte) error {
+		records = append(records, string(record))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{`{"event": 1}`, `{"event":2}`}; !reflect.DeepEqual(records, want) {
+		t.Errorf("records = %q, want %q", records, want)
+	}
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"comfort-player-backend/models"
+)
+
+// maxSubtitleOffsetSeconds bounds subtitle offsets, which only fix small sync problems
+const maxSubtitleOffsetSeconds = 600
+
+// ErrInvalidSubtitleOffset is returned for offsets outside ±maxSubtitleOffsetSeconds
+var ErrInvalidSubtitleOffset = errors.New("invalid subtitle offset")
+
+// GetSubtitleOffset returns the offset applied to an episode's subtitles: the
+// episode's own offset, or else its season's
+func (s *ShowService) GetSubtitleOffset(episodeID string) (models.SubtitleOffset, error) {
+	c, err := loadCatalog(s.location.SeasonsDir)
+	if err != nil {
+		return models.SubtitleOffset{}, err
+	}
+
+	offset := models.SubtitleOffset{EpisodeID: episodeID}
+	if episode, file := c.find(episodeID); episode != nil {
+		offset.EpisodeOffsetSeconds = episode.SubtitleOffsetSeconds
+		offset.SeasonOffsetSeconds = file.subtitleOffset
+	} else if scanned, ok := s.indexedEpisode(episodeID); ok {
+		// Scanned episodes go to their season's file once edited, so its default applies
+		if file := c.fileNamed(fmt.Sprintf("season-%02d.json", scanned.Season)); file != nil {
+			offset.SeasonOffsetSeconds = file.subtitleOffset
+		}
+	} else {
+		return models.SubtitleOffset{}, fmt.Errorf("%w: %s", ErrEpisodeNotFound, episodeID)
+	}
+
+	offset.OffsetSeconds = effectiveSubtitleOffset(offset.EpisodeOffsetSeconds, offset.SeasonOffsetSeconds)
+	return offset, nil
+}
+
+// SubtitleDelay returns the offset applied to an episode's subtitles as a duration.
+// Episodes that aren't in the catalog have none.
+func (s *ShowService) SubtitleDelay(episodeID string) time.Duration {
+	offset, err := s.GetSubtitleOffset(episodeID)
+	if err != nil {
+		log.Printf("SubtitleDelay: No subtitle offset for %s: %v", episodeID, err)
+		return 0
+	}
+	return time.Duration(math.Round(offset.OffsetSeconds*1000)) * time.Millisecond
+}
+
+// SetSubtitleOffset sets an episode's subtitle offset, or with season set the
+// default of the season file holding the episode. A nil offset clears it.
+func (s *ShowService) SetSubtitleOffset(episodeID string, seconds *float64, season bool) (models.SubtitleOffset, error) {
+	if seconds != nil {
+		rounded, err := roundSubtitleOffset(*seconds)
+		if err != nil {
+			return models.SubtitleOffset{}, err
+		}
+		seconds = &rounded
+	}
+
+	log.Printf("SetSubtitleOffset: Setting subtitle offset of %s (season: %v)", episodeID, season)
+	_, err := s.editCatalog(episodeID, func(episode *models.EpisodeInfo, file *catalogFile) error {
+		if season {
+			file.subtitleOffset = seconds
+		} else {
+			episode.SubtitleOffsetSeconds = seconds
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("SetSubtitleOffset: Error updating episode %s: %v", episodeID, err)
+		return models.SubtitleOffset{}, err
+	}
+	return s.GetSubtitleOffset(episodeID)
+}
+
+// NudgeSubtitleOffset moves an episode's subtitles by delta seconds from where
+// they are now, storing the result as the episode's own offset
+func (s *ShowService) NudgeSubtitleOffset(episodeID string, delta float64) (models.SubtitleOffset, error) {
+	log.Printf("NudgeSubtitleOffset: Moving subtitles of %s by %.3fs", episodeID, delta)
+	_, err := s.editCatalog(episodeID, func(episode *models.EpisodeInfo, file *catalogFile) error {
+		current := effectiveSubtitleOffset(episode.SubtitleOffsetSeconds, file.subtitleOffset)
+		rounded, err := roundSubtitleOffset(current + delta)
+		if err != nil {
+			return err
+		}
+		episode.SubtitleOffsetSeconds = &rounded
+		return nil
+	})
+	if err != nil {
+		log.Printf("NudgeSubtitleOffset: Error updating episode %s: %v", episodeID, err)
+		return models.SubtitleOffset{}, err
+	}
+	return s.GetSubtitleOffset(episodeID)
+}
+
+// effectiveSubtitleOffset picks the episode offset over the season default
+func effectiveSubtitleOffset(episode, season *float64) float64 {
+	if episode != nil {
+		return *episode
+	}
+	if season != nil {
+		return *season
+	}
+	return 0
+}
+
+// roundSubtitleOffset rounds an offset to milliseconds, so repeated nudges
+// don't accumulate floating point noise, and checks its range
+func roundSubtitleOffset(seconds float64) (float64, error) {
+	if math.IsNaN(seconds) || math.Abs(seconds) > maxSubtitleOffsetSeconds {
+		return 0, fmt.Errorf("%w: %v seconds, must be within ±%d", ErrInvalidSubtitleOffset, seconds, maxSubtitleOffsetSeconds)
+	}
+	return math.Round(seconds*1000) / 1000, nil
+}
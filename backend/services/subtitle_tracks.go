@@ -0,0 +1,284 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"comfort-player-backend/models"
+	"comfort-player-backend/subtitles"
+)
+
+// ErrSubtitleNotFound is returned when an episode has no matching subtitle track
+var ErrSubtitleNotFound = errors.New("subtitle not found")
+
+// untaggedTrackID is the track ID of subtitle files without a language tag
+const untaggedTrackID = "und"
+
+// subtitleFile is a subtitle track found on disk, or embedded in the video file
+type subtitleFile struct {
+	path     string // Empty for embedded tracks until they're extracted
+	track    models.SubtitleTrack
+	embedded *embeddedSubtitle
+}
+
+// parseSubtitleFileName splits the language and flag tags off a subtitle file
+// name: "episode-01.fr.forced.srt" has the stem "episode-01", language "fr"
+// and the forced flag. Tags are only recognized at the end of the name.
+func parseSubtitleFileName(name string) (string, models.SubtitleTrack) {
+	ext := filepath.Ext(name)
+	parts := strings.Split(strings.TrimSuffix(name, ext), ".")
+
+	track := models.SubtitleTrack{Format: strings.ToLower(strings.TrimPrefix(ext, "."))}
+	for len(parts) > 1 {
+		tag := parts[len(parts)-1]
+		switch strings.ToLower(tag) {
+		case "forced":
+			track.Forced = true
+		case "sdh", "cc":
+			track.SDH = true
+		default:
+			language, ok := subtitles.NormalizeLanguage(tag)
+			if !ok || track.Language != "" {
+				return strings.Join(parts, "."), finishTrack(track)
+			}
+			track.Language = language
+		}
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, "."), finishTrack(track)
+}
+
+// finishTrack fills in a track's ID and label from its language and flags
+func finishTrack(track models.SubtitleTrack) models.SubtitleTrack {
+	track.ID = track.Language
+	track.Label = subtitles.LanguageName(track.Language)
+	if track.Language == "" {
+		track.ID = untaggedTrackID
+		track.Label = "Subtitles"
+	}
+	if track.Forced {
+		track.ID += ".forced"
+		track.Label += " (Forced)"
+	}
+	if track.SDH {
+		track.ID += ".sdh"
+		track.Label += " (SDH)"
+	}
+	return track
+}
+
+// GetEpisodeSubtitleTrackPath returns the file of the subtitle track with the
+// given ID. A bare language such as "fr" also picks the best track in that language.
+func (s *ShowService) GetEpisodeSubtitleTrackPath(episodeID, trackID string) (string, error) {
+	log.Printf("GetEpisodeSubtitleTrackPath: Finding subtitle track %s for episode %s", trackID, episodeID)
+
+	files := s.findSubtitleFiles(episodeID, newDirCache(), true)
+	for _, file := range files {
+		if strings.EqualFold(file.track.ID, trackID) {
+			return s.subtitleFilePath(episodeID, file)
+		}
+	}
+
+	if language, ok := subtitles.NormalizeLanguage(trackID); ok {
+		// Only tracks in that language will do, forced ones included
+		var inLanguage []subtitleFile
+		for _, file := range files {
+			if file.track.Language != "" && subtitles.LanguageMatches(file.track.Language, language) {
+				inLanguage = append(inLanguage, file)
+			}
+		}
+		if file, ok := pickSubtitleFile(inLanguage, language); ok {
+			return s.subtitleFilePath(episodeID, file)
+		}
+	}
+
+	log.Printf("GetEpisodeSubtitleTrackPath: No subtitle track %s for episode %s", trackID, episodeID)
+	return "", fmt.Errorf("%w: %s for episode %s", ErrSubtitleNotFound, trackID, episodeID)
+}
+
+// attachSubtitleTracks fills in the subtitle tracks of episodes
+func (s *ShowService) attachSubtitleTracks(episodes []models.EpisodeInfo, probe bool) {
+	dirs := newDirCache()
+	for i := range episodes {
+		files := s.findSubtitleFiles(episodes[i].ID, dirs, probe)
+		if len(files) == 0 {
+			continue
+		}
+		episodes[i].Subtitles = make([]models.SubtitleTrack, len(files))
+		for j, file := range files {
+			episodes[i].Subtitles[j] = file.track
+		}
+	}
+}
+
+// SelectSubtitleTrack marks the episode's full track in the preferred language
+// as the default and points SubtitleURL at it. Without a preference, or a full
+// track in that language, the first full (not forced) track is the default.
+func SelectSubtitleTrack(episode *models.EpisodeInfo, language string) {
+	if len(episode.Subtitles) == 0 {
+		return
+	}
+
+	files := make([]subtitleFile, len(episode.Subtitles))
+	for i, track := range episode.Subtitles {
+		files[i] = subtitleFile{track: track}
+		episode.Subtitles[i].Default = false
+	}
+
+	picked, ok := pickSubtitleFile(files, language)
+	if !ok {
+		return
+	}
+	for i := range episode.Subtitles {
+		if episode.Subtitles[i].ID != picked.track.ID {
+			continue
+		}
+		episode.Subtitles[i].Default = true
+		if episode.SubtitleURL == "" || (language != "" && picked.track.Language != "") {
+			episode.SubtitleURL = episode.Subtitles[i].URL
+		}
+	}
+}
+
+// pickSubtitleFile picks the track to show for a language. Full tracks come
+// before forced ones, which only cover foreign dialogue, whatever their
+// language; then tracks in the language, untagged ones, and regular ones over
+// SDH. Forced tracks are only picked when nothing else is there, or by ID.
+func pickSubtitleFile(files []subtitleFile, language string) (subtitleFile, bool) {
+	best := -1
+	bestScore := 0
+	for i, file := range files {
+		score := 1
+		if !file.track.Forced {
+			score += 16
+		}
+		if language != "" && file.track.Language != "" && subtitles.LanguageMatches(file.track.Language, language) {
+			score += 8
+		}
+		if file.track.Language == "" {
+			score += 4
+		}
+		if !file.track.SDH {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if best < 0 {
+		return subtitleFile{}, false
+	}
+	return files[best], true
+}
+
+// findSubtitleFiles lists the subtitle files of an episode: files named after
+// the episode in its video directory and in the subtitles tree, then the text
+// tracks embedded in the video file. Tracks are sorted untagged first, then by
+// language, full before forced before SDH, separate files before embedded tracks.
+// Without probe, embedded tracks are only listed if the video was probed before.
+func (s *ShowService) findSubtitleFiles(episodeID string, dirs *dirCache, probe bool) []subtitleFile {
+	season, number, ok := s.EpisodeNumbers(episodeID)
+	if !ok {
+		return nil
+	}
+	key := episodeKey{season, number}
+
+	// Look next to the video, where the scanner found the subtitle, and in the subtitles tree
+	candidates := []string{filepath.Join(s.location.SubtitlesDir, fmt.Sprintf("season-%02d", season))}
+	videoPath := ""
+	if episode, ok := s.indexedEpisode(episodeID); ok {
+		videoPath = episode.VideoPath
+		candidates = append(candidates, filepath.Dir(episode.VideoPath))
+		if episode.SubtitlePath != "" {
+			candidates = append(candidates, filepath.Dir(episode.SubtitlePath))
+		}
+	} else if path, err := s.findEpisodeVideoFile(episodeID); err == nil {
+		videoPath = path
+		candidates = append(candidates, filepath.Dir(path))
+	}
+
+	var files []subtitleFile
+	seenDirs := make(map[string]bool)
+	seenTracks := make(map[string]bool)
+	for _, dir := range candidates {
+		dir = filepath.Clean(dir)
+		if seenDirs[dir] {
+			continue
+		}
+		seenDirs[dir] = true
+
+		for _, name := range dirs.list(dir) {
+			if !matchesPattern(name, s.config.SubtitleFilePattern) {
+				continue
+			}
+			stem, track := parseSubtitleFileName(name)
+			fileKey, _, ok := parseEpisodeFileName(filepath.Join(dir, stem+filepath.Ext(name)))
+			if !ok || fileKey != key {
+				continue
+			}
+
+			// Keep the first file of each track, e.g. the .srt over a .vtt with the same tags
+			if seenTracks[track.ID] {
+				log.Printf("findSubtitleFiles: Skipping duplicate %s track %s", track.ID, filepath.Join(dir, name))
+				continue
+			}
+			seenTracks[track.ID] = true
+
+			track.URL = fmt.Sprintf("/api/episode/%s/subtitle/%s", episodeID, track.ID)
+			files = append(files, subtitleFile{path: filepath.Join(dir, name), track: track})
+		}
+	}
+	if videoPath != "" {
+		files = append(files, s.embeddedSubtitleFiles(episodeID, videoPath, probe)...)
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i].track, files[j].track
+		if a.Language != b.Language {
+			return a.Language < b.Language
+		}
+		if a.Forced != b.Forced {
+			return !a.Forced
+		}
+		if a.SDH != b.SDH {
+			return !a.SDH
+		}
+		return !a.Embedded && b.Embedded
+	})
+	return files
+}
+
+// dirCache remembers directory listings while subtitles are looked up for many episodes
+type dirCache struct {
+	entries map[string][]string
+}
+
+// newDirCache creates an empty directory cache
+func newDirCache() *dirCache {
+	return &dirCache{entries: make(map[string][]string)}
+}
+
+// list returns the sorted names of the files in dir
+func (c *dirCache) list(dir string) []string {
+	if names, ok := c.entries[dir]; ok {
+		return names
+	}
+
+	var names []string
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("dirCache.list: Error reading %s: %v", dir, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	c.entries[dir] = names
+	return names
+}
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+
+	"comfort-player-backend/models"
+)
+
+func TestParseSubtitleFileName(t *testing.T) {
+	tests := []struct {
+		name  string
+		stem  string
+		track models.SubtitleTrack
+	}{
+		{
+			name:  "episode-01.srt",
+			stem:  "episode-01",
+			track: models.SubtitleTrack{ID: "und", Label: "Subtitles", Format: "srt"},
+		},
+		{
+			name:  "episode-01.fr.forced.srt",
+			stem:  "episode-01",
+			track: models.SubtitleTrack{ID: "fr.forced", Language: "fr", Label: "French (Forced)", Format: "srt", Forced: true},
+		},
+		{
+			name:  "episode-01.en.sdh.srt",
+			stem:  "episode-01",
+			track: models.SubtitleTrack{ID: "en.sdh", Language: "en", Label: "English (SDH)", Format: "srt", SDH: true},
+		},
+		{
+			name:  "episode-01.ENG.CC.VTT",
+			stem:  "episode-01",
+			track: models.SubtitleTrack{ID: "en.sdh", Language: "en", Label: "English (SDH)", Format: "vtt", SDH: true},
+		},
+		{
+			name:  "Show.S01E02.pt-br.ass",
+			stem:  "Show.S01E02",
+			track: models.SubtitleTrack{ID: "pt-BR", Language: "pt-BR", Label: "Portuguese (BR)", Format: "ass"},
+		},
+		{
+			// A number isn't a language, so it stays part of the name
+			name:  "episode.01.srt",
+			stem:  "episode.01",
+			track: models.SubtitleTrack{ID: "und", Label: "Subtitles", Format: "srt"},
+		},
+		{
+			// Only the last language tag counts; anything before it is the name
+			name:  "episode-01.en.fr.srt",
+			stem:  "episode-01.en",
+			track: models.SubtitleTrack{ID: "fr", Language: "fr", Label: "French", Format: "srt"},
+		},
+		{
+			// Tags are only recognized at the end of the name
+			name:  "episode-01.forced.final.srt",
+			stem:  "episode-01.forced.final",
+			track: models.SubtitleTrack{ID: "und", Label: "Subtitles", Format: "srt"},
+		},
+		{
+			name:  "forced.srt",
+			stem:  "forced",
+			track: models.SubtitleTrack{ID: "und", Label: "Subtitles", Format: "srt"},
+		},
+	}
+
+	for _, test := range tests {
+		stem, track := parseSubtitleFileName(test.name)
+		if stem != test.stem || !reflect.DeepEqual(track, test.track) {
+			t.Errorf("parseSubtitleFileName(%q) = %q, %+v; want %q, %+v", test.name, stem, track, test.stem, test.track)
+		}
+	}
+}
+
+// subtitleTrack returns the track parsed from a file name, with a URL naming it
+func subtitleTrack(name string) models.SubtitleTrack {
+	_, track := parseSubtitleFileName(name)
+	track.URL = "/" + track.ID
+	return track
+}
+
+func TestSelectSubtitleTrack(t *testing.T) {
+	full := []models.SubtitleTrack{
+		subtitleTrack("episode-01.srt"),
+		subtitleTrack("episode-01.en.sdh.srt"),
+		subtitleTrack("episode-01.en.srt"),
+		subtitleTrack("episode-01.fr.forced.srt"),
+		subtitleTrack("episode-01.fr.srt"),
+		subtitleTrack("episode-01.pt-br.srt"),
+	}
+
+	tests := []struct {
+		name     string
+		tracks   []models.SubtitleTrack
+		language string
+		want     string
+	}{
+		{name: "no preference picks untagged", tracks: full, want: "und"},
+		{name: "language", tracks: full, language: "fr", want: "fr"},
+		{name: "regular over SDH", tracks: full, language: "en", want: "en"},
+		{name: "region matches the base language", tracks: full, language: "pt", want: "pt-BR"},
+		{name: "missing language picks untagged", tracks: full, language: "de", want: "und"},
+		{
+			name:     "SDH when it's the only track in the language",
+			tracks:   []models.SubtitleTrack{subtitleTrack("episode-01.de.srt"), subtitleTrack("episode-01.en.sdh.srt")},
+			language: "en",
+			want:     "en.sdh",
+		},
+		{
+			name:     "full track in another language over a forced one",
+			tracks:   []models.SubtitleTrack{subtitleTrack("episode-01.en.srt"), subtitleTrack("episode-01.fr.forced.srt")},
+			language: "fr",
+			want:     "en",
+		},
+		{
+			name:     "forced when nothing else is there",
+			tracks:   []models.SubtitleTrack{subtitleTrack("episode-01.fr.forced.srt")},
+			language: "en",
+			want:     "fr.forced",
+		},
+		{
+			name:   "first full track without a preference",
+			tracks: []models.SubtitleTrack{subtitleTrack("episode-01.de.srt"), subtitleTrack("episode-01.en.srt")},
+			want:   "de",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			episode := models.EpisodeInfo{Subtitles: append([]models.SubtitleTrack(nil), test.tracks...)}
+			episode.Subtitles[0].Default = true
+			SelectSubtitleTrack(&episode, test.language)
+
+			var defaults []string
+			for _, track := range episode.Subtitles {
+				if track.Default {
+					defaults = append(defaults, track.ID)
+				}
+			}
+			if !reflect.DeepEqual(defaults, []string{test.want}) {
+				t.Errorf("default tracks = %q, want %q", defaults, test.want)
+			}
+			if episode.SubtitleURL != "/"+test.want {
+				t.Errorf("SubtitleURL = %q, want /%s", episode.SubtitleURL, test.want)
+			}
+		})
+	}
+}
+
+func TestSelectSubtitleTrackKeepsSubtitleURL(t *testing.T) {
+	// Without a preference, an episode's own subtitle URL is left alone
+	episode := models.EpisodeInfo{
+		SubtitleURL: "/api/episode/Show_S01E01/subtitle",
+		Subtitles:   []models.SubtitleTrack{subtitleTrack("episode-01.de.srt"), subtitleTrack("episode-01.en.srt")},
+	}
+	SelectSubtitleTrack(&episode, "")
+	if episode.SubtitleURL != "/api/episode/Show_S01E01/subtitle" {
+		t.Errorf("SubtitleURL = %q, want it unchanged", episode.SubtitleURL)
+	}
+	if !episode.Subtitles[0].Default {
+		t.Error("first full track isn't the default")
+	}
+
+	// A preference in a language there is a track for points it there
+	SelectSubtitleTrack(&episode, "en")
+	if episode.SubtitleURL != "/en" || episode.Subtitles[0].Default || !episode.Subtitles[1].Default {
+		t.Errorf("SubtitleURL = %q, tracks %+v; want the English track", episode.SubtitleURL, episode.Subtitles)
+	}
+}
@@ -0,0 +1,395 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"comfort-player-backend/config"
+	"comfort-player-backend/utils"
+)
+
+// TranscodeProfile is a named set of ffmpeg output options for devices that
+// can't play a source file directly. The output format must be streamable,
+// since it's sent to the client while it's written.
+type TranscodeProfile struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	ContentType string   `json:"contentType"`
+	Extension   string   `json:"-"`
+	Args        []string `json:"-"`
+}
+
+// mp3Args makes ffmpeg write the first audio track as a plain MP3 stream. Without
+// ID3 or Xing headers, streams of several episodes can be concatenated.
+var mp3Args = []string{
+	"-map", "0:a:0", "-vn",
+	"-c:a", "libmp3lame", "-b:a", "128k", "-ac", "2", "-ar", "44100",
+	"-id3v2_version", "0", "-write_xing", "0",
+	"-f", "mp3",
+}
+
+// AudioProfile is the profile used to serve episode audio
+const AudioProfile = "audio-mp3"
+
+// transcodeProfiles lists the available profiles
+var transcodeProfiles = []TranscodeProfile{
+	{
+		Name:        "720p-h264",
+		Description: "H.264 video up to 720p with stereo AAC audio",
+		ContentType: "video/mp4",
+		Extension:   ".mp4",
+		Args: []string{
+			"-map", "0:v:0", "-map", "0:a:0?",
+			"-vf", "scale=-2:'min(720,ih)'",
+			"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-profile:v", "high", "-level", "4.0", "-pix_fmt", "yuv420p",
+			"-c:a", "aac", "-ac", "2", "-b:a", "160k",
+			"-f", "mp4", "-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		},
+	},
+	{
+		Name:        "1080p-h264",
+		Description: "H.264 video up to 1080p with stereo AAC audio",
+		ContentType: "video/mp4",
+		Extension:   ".mp4",
+		Args: []string{
+			"-map", "0:v:0", "-map", "0:a:0?",
+			"-vf", "scale=-2:'min(1080,ih)'",
+			"-c:v", "libx264", "-preset", "veryfast", "-crf", "21", "-profile:v", "high", "-level", "4.1", "-pix_fmt", "yuv420p",
+			"-c:a", "aac", "-ac", "2", "-b:a", "192k",
+			"-f", "mp4", "-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		},
+	},
+	{
+		Name:        "audio-only",
+		Description: "Stereo AAC audio without video",
+		ContentType: "audio/mp4",
+		Extension:   ".m4a",
+		Args: []string{
+			"-map", "0:a:0", "-vn",
+			"-c:a", "aac", "-ac", "2", "-b:a", "128k",
+			"-f", "mp4", "-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		},
+	},
+	{
+		Name:        AudioProfile,
+		Description: "Stereo MP3 audio without video",
+		ContentType: "audio/mpeg",
+		Extension:   ".mp3",
+		Args:        mp3Args,
+	},
+}
+
+// TranscodeProfiles returns the available transcoding profiles
+func TranscodeProfiles() []TranscodeProfile {
+	return transcodeProfiles
+}
+
+// LookupTranscodeProfile returns the profile with the given name
+func LookupTranscodeProfile(name string) (TranscodeProfile, bool) {
+	for _, profile := range transcodeProfiles {
+		if profile.Name == name {
+			return profile, true
+		}
+	}
+	return TranscodeProfile{}, false
+}
+
+// TranscodeService transcodes episodes with ffmpeg while streaming them to the
+// client. Finished transcodes are cached on disk; the cache is trimmed to a
+// maximum size, least recently used first.
+type TranscodeService struct {
+	config   *config.Config
+	pool     *WorkerPool
+	pruner   *CachePruner
+	cacheDir string
+	// jobs holds the transcodes running, by cache path
+	jobs    map[string]*transcodeJob
+	mutex   sync.Mutex
+	running sync.WaitGroup
+}
+
+// transcodeJob is a transcode being written to a temporary file. Every client
+// asking for the same transcode reads that file as it grows; the transcode is
+// stopped once they have all gone away.
+type transcodeJob struct {
+	tmpPath string
+	cancel  context.CancelFunc
+	viewers int // Guarded by the service's mutex
+
+	mutex    sync.Mutex
+	changed  *sync.Cond // Signalled when written or finished change
+	written  int64
+	finished bool
+	err      error
+}
+
+// NewTranscodeService creates a new transcode service
+func NewTranscodeService(config *config.Config, pool *WorkerPool, pruner *CachePruner) *TranscodeService {
+	s := &TranscodeService{
+		config:   config,
+		pool:     pool,
+		pruner:   pruner,
+		cacheDir: filepath.Join(config.CacheDir, transcodeCacheName),
+		jobs:     make(map[string]*transcodeJob),
+	}
+	s.removeLeftovers()
+	return s
+}
+
+// removeLeftovers deletes the temporary files of transcodes that were running
+// when the server last stopped. Pruning skips them, so they would stay forever.
+func (s *TranscodeService) removeLeftovers() {
+	filepath.WalkDir(s.cacheDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		if matched, _ := filepath.Match("transcode-*.tmp", entry.Name()); !matched {
+			return nil
+		}
+		log.Printf("removeLeftovers: Removing unfinished transcode %s", path)
+		if err := os.Remove(path); err != nil {
+			log.Printf("removeLeftovers: Error removing %s: %v", path, err)
+		}
+		return nil
+	})
+}
+
+// Cached returns the path of a finished transcode, if there is one
+func (s *TranscodeService) Cached(episodeID, videoPath string, profile TranscodeProfile) (string, bool) {
+	path, err := s.cachePath(episodeID, videoPath, profile)
+	if err != nil || !utils.FileExists(path) {
+		return "", false
+	}
+
+	// Mark the transcode as recently used so pruning keeps it
+	touchCached(path)
+	return path, true
+}
+
+// Stream transcodes a video file with profile and writes the result to w as it's
+// produced. Clients asking for a transcode that's already running share it. A
+// transcode waits for a free worker, stops when every client sharing it has
+// gone away, and is cached once it completes.
+func (s *TranscodeService) Stream(ctx context.Context, w io.Writer, episodeID, videoPath string, profile TranscodeProfile) error {
+	path, err := s.cachePath(episodeID, videoPath, profile)
+	if err != nil {
+		return err
+	}
+
+	job, output, err := s.joinTranscode(path, episodeID, videoPath, profile)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	defer s.leaveTranscode(path, job)
+
+	return job.follow(ctx, output, w)
+}
+
+// joinTranscode returns the running transcode for a cache path, starting it if
+// there is none, and counts the caller as one of its viewers. The returned file
+// reads the transcode's output from the start.
+func (s *TranscodeService) joinTranscode(path, episodeID, videoPath string, profile TranscodeProfile) (*transcodeJob, *os.File, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// The job's file is only moved once the job has left the map, so it can be opened
+	if job, ok := s.jobs[path]; ok {
+		output, err := os.Open(job.tmpPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("joinTranscode: Joining the running transcode of %s with %s", episodeID, profile.Name)
+		job.viewers++
+		return job, output, nil
+	}
+
+	if err := utils.EnsureDir(filepath.Dir(path)); err != nil {
+		return nil, nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "transcode-*.tmp")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create cache file: %w", err)
+	}
+	output, err := os.Open(tmp.Name())
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &transcodeJob{tmpPath: tmp.Name(), cancel: cancel, viewers: 1}
+	job.changed = sync.NewCond(&job.mutex)
+	s.jobs[path] = job
+
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		defer cancel()
+		s.runTranscode(ctx, job, tmp, path, episodeID, videoPath, profile)
+	}()
+	return job, output, nil
+}
+
+// leaveTranscode stops counting a client as a viewer of a transcode, and stops
+// the transcode if it was the last one
+func (s *TranscodeService) leaveTranscode(path string, job *transcodeJob) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	job.viewers--
+	if job.viewers > 0 {
+		return
+	}
+	// Later clients start over rather than join a transcode that's stopping
+	if s.jobs[path] == job {
+		delete(s.jobs, path)
+	}
+	job.cancel()
+}
+
+// runTranscode runs ffmpeg for a job, writing its output to tmp, and caches
+// the result once it completes
+func (s *TranscodeService) runTranscode(ctx context.Context, job *transcodeJob, tmp *os.File, path, episodeID, videoPath string, profile TranscodeProfile) {
+	err := func() error {
+		defer tmp.Close()
+
+		log.Printf("runTranscode: Waiting for a worker to transcode %s with %s", episodeID, profile.Name)
+		if err := s.pool.Acquire(ctx); err != nil {
+			return err
+		}
+		defer s.pool.Release()
+
+		log.Printf("runTranscode: Transcoding %s with %s", episodeID, profile.Name)
+		args := append([]string{"-i", videoPath}, profile.Args...)
+		args = append(args, "pipe:1")
+
+		if err := runFFmpeg(ctx, s.config.FFmpegPath, args, &jobWriter{job: job, file: tmp}); err != nil {
+			log.Printf("runTranscode: Transcode of %s with %s stopped: %v", episodeID, profile.Name, err)
+			return err
+		}
+
+		if err := tmp.Close(); err != nil {
+			return fmt.Errorf("failed to write cache file: %w", err)
+		}
+		return nil
+	}()
+
+	// Clients that already opened the file keep reading it after it's moved
+	s.mutex.Lock()
+	if s.jobs[path] == job {
+		delete(s.jobs, path)
+	}
+	if err == nil {
+		if renameErr := os.Rename(tmp.Name(), path); renameErr != nil {
+			err = fmt.Errorf("failed to cache transcode: %w", renameErr)
+		} else {
+			log.Printf("runTranscode: Cached %s", path)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	s.mutex.Unlock()
+
+	job.mutex.Lock()
+	job.finished = true
+	job.err = err
+	job.changed.Broadcast()
+	job.mutex.Unlock()
+
+	if err == nil {
+		s.pruner.Prune()
+	}
+}
+
+// StopJobs stops the transcodes still running and waits for them to end
+func (s *TranscodeService) StopJobs() {
+	s.mutex.Lock()
+	for path, job := range s.jobs {
+		job.cancel()
+		delete(s.jobs, path)
+	}
+	s.mutex.Unlock()
+	s.running.Wait()
+}
+
+// jobWriter writes a transcode's output to its temporary file and wakes the
+// clients following it
+type jobWriter struct {
+	job  *transcodeJob
+	file *os.File
+}
+
+// Write appends p to the file and tells the clients following the job
+func (w *jobWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.job.mutex.Lock()
+	w.job.written += int64(n)
+	w.job.changed.Broadcast()
+	w.job.mutex.Unlock()
+	return n, err
+}
+
+// follow copies the transcode's output from file to w, waiting for more output
+// until the transcode finishes or ctx is cancelled
+func (j *transcodeJob) follow(ctx context.Context, file *os.File, w io.Writer) error {
+	// Wake up the wait below when the client goes away
+	stop := context.AfterFunc(ctx, func() {
+		j.mutex.Lock()
+		j.changed.Broadcast()
+		j.mutex.Unlock()
+	})
+	defer stop()
+
+	var offset int64
+	buffer := make([]byte, 32<<10)
+	for {
+		j.mutex.Lock()
+		for j.written == offset && !j.finished && ctx.Err() == nil {
+			j.changed.Wait()
+		}
+		written, finished, jobErr := j.written, j.finished, j.err
+		j.mutex.Unlock()
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for offset < written {
+			n, err := file.ReadAt(buffer[:min(int64(len(buffer)), written-offset)], offset)
+			if n > 0 {
+				if _, err := w.Write(buffer[:n]); err != nil {
+					return err
+				}
+				offset += int64(n)
+			}
+			if err != nil && err != io.EOF {
+				return err
+			}
+		}
+		if finished && offset == written {
+			return jobErr
+		}
+	}
+}
+
+// cachePath returns where the transcode of a video file with a profile is
+// cached. The name changes when the source file does.
+func (s *TranscodeService) cachePath(episodeID, videoPath string, profile TranscodeProfile) (string, error) {
+	stat, err := os.Stat(videoPath)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", videoPath, stat.Size(), stat.ModTime().UnixNano())))
+	name := fmt.Sprintf("%s-%s%s", hex.EncodeToString(hash[:8]), profile.Name, profile.Extension)
+	return filepath.Join(s.cacheDir, episodeID, name), nil
+}
@@ -0,0 +1,322 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"comfort-player-backend/config"
+	"comfort-player-backend/utils"
+)
+
+// fakeFFmpeg stands in for ffmpeg. It writes "start-" as soon as it runs, then
+// "end" once a VIDEO.done file exists, VIDEO being its input. It fails instead
+// if VIDEO.fail exists too. Each run adds a line to VIDEO.started.
+const fakeFFmpeg = `#!/bin/sh
+while [ "$1" != "-i" ]; do shift; done
+video=$2
+echo run >> "$video.started"
+printf 'start-'
+while [ ! -e "$video.done" ]; do sleep 0.01; done
+if [ -e "$video.fail" ]; then echo "bad input" >&2; exit 1; fi
+printf 'end'
+`
+
+// newFakeTranscodeService creates a transcode service running fakeFFmpeg with
+// the given number of workers
+func newFakeTranscodeService(t *testing.T, workers int) *TranscodeService {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ffmpeg is a shell script")
+	}
+
+	dir := t.TempDir()
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(ffmpeg, []byte(fakeFFmpeg), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{FFmpegPath: ffmpeg, CacheDir: filepath.Join(dir, "cache")}
+	service := NewTranscodeService(cfg, NewWorkerPool(workers), NewCachePruner(cfg))
+	t.Cleanup(service.StopJobs)
+	return service
+}
+
+// fakeVideo creates a source file for fakeFFmpeg
+func fakeVideo(t *testing.T, name string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte("video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// finishVideo lets fakeFFmpeg finish transcoding a video
+func finishVideo(t *testing.T, video string) {
+	t.Helper()
+	if err := os.WriteFile(video+".done", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// transcodeRuns returns how many times fakeFFmpeg started transcoding a video
+func transcodeRuns(video string) int {
+	data, _ := os.ReadFile(video + ".started")
+	return strings.Count(string(data), "\n")
+}
+
+// waitFor polls condition until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// tmpFiles lists the temporary files left in the transcode cache
+func tmpFiles(service *TranscodeService) []string {
+	files, _ := filepath.Glob(filepath.Join(service.cacheDir, "*", "*.tmp"))
+	return files
+}
+
+// syncBuffer is a buffer a viewer writes to while the test reads it
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+// viewer is a client streaming a transcode in the background
+type viewer struct {
+	output syncBuffer
+	cancel context.CancelFunc
+	done   chan error
+}
+
+// startViewer streams the transcode of a video until it ends or the viewer is
+// cancelled
+func startViewer(service *TranscodeService, episodeID, video string) *viewer {
+	ctx, cancel := context.WithCancel(context.Background())
+	v := &viewer{cancel: cancel, done: make(chan error, 1)}
+	go func() {
+		v.done <- service.Stream(ctx, &v.output, episodeID, video, transcodeProfiles[0])
+	}()
+	return v
+}
+
+// wait returns the error the viewer's stream ended with
+func (v *viewer) wait(t *testing.T) error {
+	t.Helper()
+	select {
+	case err := <-v.done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream didn't end")
+		return nil
+	}
+}
+
+func TestTranscodeStreamCaches(t *testing.T) {
+	service := newFakeTranscodeService(t, 1)
+	video := fakeVideo(t, "episode-01.mkv")
+	finishVideo(t, video)
+
+	var output bytes.Buffer
+	if err := service.Stream(context.Background(), &output, "Show_S01E01", video, transcodeProfiles[0]); err != nil {
+		t.Fatalf("Stream error: %v", err)
+	}
+	if output.String() != "start-end" {
+		t.Errorf("output = %q, want %q", output.String(), "start-end")
+	}
+
+	// The temporary file is moved into the cache
+	path, ok := service.Cached("Show_S01E01", video, transcodeProfiles[0])
+	if !ok {
+		t.Fatal("transcode not cached")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "start-end" {
+		t.Errorf("cached transcode = %q, want %q", data, "start-end")
+	}
+	if files := tmpFiles(service); len(files) != 0 {
+		t.Errorf("temporary files left: %v", files)
+	}
+}
+
+func TestTranscodeStreamFailure(t *testing.T) {
+	service := newFakeTranscodeService(t, 1)
+	video := fakeVideo(t, "episode-01.mkv")
+	finishVideo(t, video)
+	if err := os.WriteFile(video+".fail", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := service.Stream(context.Background(), &bytes.Buffer{}, "Show_S01E01", video, transcodeProfiles[0])
+	if err == nil || !strings.Contains(err.Error(), "bad input") {
+		t.Errorf("Stream error = %v, want ffmpeg's error", err)
+	}
+	if _, ok := service.Cached("Show_S01E01", video, transcodeProfiles[0]); ok {
+		t.Error("failed transcode cached")
+	}
+	if files := tmpFiles(service); len(files) != 0 {
+		t.Errorf("temporary files left: %v", files)
+	}
+}
+
+func TestTranscodeShared(t *testing.T) {
+	service := newFakeTranscodeService(t, 1)
+	video := fakeVideo(t, "episode-01.mkv")
+
+	first := startViewer(service, "Show_S01E01", video)
+	waitFor(t, "the first viewer's output", func() bool { return first.output.String() == "start-" })
+
+	// A second viewer joins the running transcode and gets its output from the start
+	second := startViewer(service, "Show_S01E01", video)
+	waitFor(t, "the second viewer's output", func() bool { return second.output.String() == "start-" })
+
+	// The transcode goes on while a viewer is left
+	first.cancel()
+	if err := first.wait(t); !errors.Is(err, context.Canceled) {
+		t.Errorf("first viewer error = %v, want %v", err, context.Canceled)
+	}
+	finishVideo(t, video)
+	if err := second.wait(t); err != nil {
+		t.Fatalf("second viewer error: %v", err)
+	}
+	if second.output.String() != "start-end" {
+		t.Errorf("second viewer output = %q, want %q", second.output.String(), "start-end")
+	}
+
+	if runs := transcodeRuns(video); runs != 1 {
+		t.Errorf("ffmpeg ran %d times, want 1", runs)
+	}
+	if _, ok := service.Cached("Show_S01E01", video, transcodeProfiles[0]); !ok {
+		t.Error("shared transcode not cached")
+	}
+}
+
+func TestTranscodeStoppedWithoutViewers(t *testing.T) {
+	service := newFakeTranscodeService(t, 1)
+	video := fakeVideo(t, "episode-01.mkv")
+
+	first := startViewer(service, "Show_S01E01", video)
+	waitFor(t, "the viewer's output", func() bool { return first.output.String() == "start-" })
+	first.cancel()
+	if err := first.wait(t); !errors.Is(err, context.Canceled) {
+		t.Errorf("viewer error = %v, want %v", err, context.Canceled)
+	}
+
+	// fakeFFmpeg never finishes on its own, so the transcode only ends if it's killed
+	stopped := make(chan struct{})
+	go func() {
+		service.running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("transcode still running after its last viewer left")
+	}
+	if _, ok := service.Cached("Show_S01E01", video, transcodeProfiles[0]); ok {
+		t.Error("stopped transcode cached")
+	}
+	if files := tmpFiles(service); len(files) != 0 {
+		t.Errorf("temporary files left: %v", files)
+	}
+
+	// The next viewer starts over
+	finishVideo(t, video)
+	next := startViewer(service, "Show_S01E01", video)
+	if err := next.wait(t); err != nil {
+		t.Fatalf("next viewer error: %v", err)
+	}
+	if next.output.String() != "start-end" {
+		t.Errorf("next viewer output = %q, want %q", next.output.String(), "start-end")
+	}
+	if runs := transcodeRuns(video); runs != 2 {
+		t.Errorf("ffmpeg ran %d times, want 2", runs)
+	}
+}
+
+func TestTranscodeWorkerPool(t *testing.T) {
+	service := newFakeTranscodeService(t, 1)
+	first := fakeVideo(t, "episode-01.mkv")
+	second := fakeVideo(t, "episode-02.mkv")
+	third := fakeVideo(t, "episode-03.mkv")
+
+	running := startViewer(service, "Show_S01E01", first)
+	waitFor(t, "the first transcode", func() bool { return transcodeRuns(first) == 1 })
+
+	// Other transcodes wait for the only worker
+	waiting := startViewer(service, "Show_S01E02", second)
+	leaving := startViewer(service, "Show_S01E03", third)
+	time.Sleep(100 * time.Millisecond)
+	if runs := transcodeRuns(second); runs != 0 {
+		t.Fatalf("second transcode ran %d times while the worker was busy", runs)
+	}
+
+	// A viewer leaving stops waiting for a worker
+	leaving.cancel()
+	if err := leaving.wait(t); !errors.Is(err, context.Canceled) {
+		t.Errorf("leaving viewer error = %v, want %v", err, context.Canceled)
+	}
+
+	finishVideo(t, first)
+	if err := running.wait(t); err != nil {
+		t.Fatalf("first viewer error: %v", err)
+	}
+	finishVideo(t, second)
+	if err := waiting.wait(t); err != nil {
+		t.Fatalf("second viewer error: %v", err)
+	}
+	if waiting.output.String() != "start-end" {
+		t.Errorf("second viewer output = %q, want %q", waiting.output.String(), "start-end")
+	}
+	if runs := transcodeRuns(third); runs != 0 {
+		t.Errorf("transcode without viewers ran %d times", runs)
+	}
+}
+
+func TestNewTranscodeServiceRemovesLeftovers(t *testing.T) {
+	cfg := &config.Config{CacheDir: t.TempDir()}
+	dir := filepath.Join(cfg.CacheDir, transcodeCacheName, "Show_S01E01")
+	leftover := filepath.Join(dir, "transcode-123.tmp")
+	cached := filepath.Join(dir, "0123456789abcdef-720p-h264.mp4")
+	if err := utils.EnsureDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{leftover, cached} {
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	NewTranscodeService(cfg, NewWorkerPool(1), NewCachePruner(cfg))
+	if utils.FileExists(leftover) {
+		t.Error("unfinished transcode left in the cache")
+	}
+	if !utils.FileExists(cached) {
+		t.Error("cached transcode removed")
+	}
+}
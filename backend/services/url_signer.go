@@ -0,0 +1,132 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"comfort-player-backend/utils"
+)
+
+// Query parameters carrying a stream URL signature
+const (
+	SignatureExpiresParam = "expires"
+	SignatureParam        = "sig"
+)
+
+var (
+	// ErrSignatureMissing is returned when a URL carries no signature
+	ErrSignatureMissing = errors.New("signature missing")
+	// ErrSignatureInvalid is returned when a signature doesn't match the resource
+	ErrSignatureInvalid = errors.New("signature invalid")
+	// ErrSignatureExpired is returned when a signature is past its expiry time
+	ErrSignatureExpired = errors.New("signature expired")
+)
+
+// URLSigner signs stream URLs so players that can't send an
+// Authorization header can still fetch them. Signatures are an HMAC of the
+// resource (an episode ID or radio stream) and an expiry time.
+type URLSigner struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewURLSigner creates a URL signer. If secret is empty, a random secret is
+// generated once and kept in secretFile so signed URLs survive restarts.
+func NewURLSigner(secret, secretFile string, ttl time.Duration) (*URLSigner, error) {
+	if secret == "" {
+		loaded, err := loadOrCreateSecret(secretFile)
+		if err != nil {
+			return nil, err
+		}
+		secret = loaded
+	}
+
+	return &URLSigner{
+		secret: []byte(secret),
+		ttl:    ttl,
+	}, nil
+}
+
+// SignURL adds an expiry and signature for resource to a URL
+func (s *URLSigner) SignURL(rawURL, resource string) string {
+	return s.SignURLWithTTL(rawURL, resource, s.ttl)
+}
+
+// SignURLWithTTL signs a URL like SignURL, but for ttl instead of the usual time
+func (s *URLSigner) SignURLWithTTL(rawURL, resource string, ttl time.Duration) string {
+	expires := time.Now().Add(ttl).Unix()
+
+	separator := "?"
+	if strings.Contains(rawURL, "?") {
+		separator = "&"
+	}
+	return fmt.Sprintf("%s%s%s=%d&%s=%s", rawURL, separator,
+		SignatureExpiresParam, expires, SignatureParam, s.signature(resource, expires))
+}
+
+// Verify checks the signature in a request's query string against resource
+func (s *URLSigner) Verify(query url.Values, resource string) error {
+	expiresValue := query.Get(SignatureExpiresParam)
+	signature := query.Get(SignatureParam)
+	if expiresValue == "" && signature == "" {
+		return ErrSignatureMissing
+	}
+
+	expires, err := strconv.ParseInt(expiresValue, 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+
+	// Compare the signature before the expiry so a bad signature is always reported as such
+	expected := s.signature(resource, expires)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrSignatureInvalid
+	}
+	if time.Now().Unix() > expires {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+// signature returns the hex HMAC-SHA256 of a resource and expiry time
+func (s *URLSigner) signature(resource string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\n%d", resource, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// loadOrCreateSecret reads the signing secret from path, generating it if needed
+func loadOrCreateSecret(path string) (string, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		if secret := strings.TrimSpace(string(data)); secret != "" {
+			return secret, nil
+		}
+	}
+
+	log.Printf("loadOrCreateSecret: Generating stream signing secret in %s", path)
+
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", fmt.Errorf("failed to generate signing secret: %w", err)
+	}
+	secret := hex.EncodeToString(buffer)
+
+	if err := utils.EnsureDir(filepath.Dir(path)); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to write signing secret: %w", err)
+	}
+	return secret, nil
+}
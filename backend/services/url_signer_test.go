@@ -0,0 +1,132 @@
+package services
+
+import (
+	"errors"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// signedQuery signs a URL for resource and returns its query string
+func signedQuery(t *testing.T, signer *URLSigner, resource string, ttl time.Duration) url.Values {
+	t.Helper()
+	parsed, err := url.Parse(signer.SignURLWithTTL("/api/episode/"+resource+"/video?quality=720p", resource, ttl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Query()
+}
+
+func TestURLSignerVerify(t *testing.T) {
+	signer, err := NewURLSigner("test-secret", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewURLSigner("other-secret", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		query    func() url.Values
+		resource string
+		err      error
+	}{
+		{name: "valid", query: func() url.Values {
+			return signedQuery(t, signer, "Show_S01E01", time.Hour)
+		}, resource: "Show_S01E01"},
+		{name: "missing", query: func() url.Values {
+			return url.Values{"quality": {"720p"}}
+		}, resource: "Show_S01E01", err: ErrSignatureMissing},
+		{name: "other resource", query: func() url.Values {
+			return signedQuery(t, signer, "Show_S01E01", time.Hour)
+		}, resource: "Show_S01E02", err: ErrSignatureInvalid},
+		{name: "other secret", query: func() url.Values {
+			return signedQuery(t, other, "Show_S01E01", time.Hour)
+		}, resource: "Show_S01E01", err: ErrSignatureInvalid},
+		{name: "tampered signature", query: func() url.Values {
+			query := signedQuery(t, signer, "Show_S01E01", time.Hour)
+			signature := []byte(query.Get(SignatureParam))
+			signature[0] ^= 1
+			query.Set(SignatureParam, string(signature))
+			return query
+		}, resource: "Show_S01E01", err: ErrSignatureInvalid},
+		{name: "extended expiry", query: func() url.Values {
+			query := signedQuery(t, signer, "Show_S01E01", time.Hour)
+			expires, _ := strconv.ParseInt(query.Get(SignatureExpiresParam), 10, 64)
+			query.Set(SignatureExpiresParam, strconv.FormatInt(expires+3600, 10))
+			return query
+		}, resource: "Show_S01E01", err: ErrSignatureInvalid},
+		{name: "signature without expiry", query: func() url.Values {
+			query := signedQuery(t, signer, "Show_S01E01", time.Hour)
+			query.Del(SignatureExpiresParam)
+			return query
+		}, resource: "Show_S01E01", err: ErrSignatureInvalid},
+		{name: "malformed expiry", query: func() url.Values {
+			return url.Values{SignatureExpiresParam: {"soon"}, SignatureParam: {"abc"}}
+		}, resource: "Show_S01E01", err: ErrSignatureInvalid},
+		{name: "expired", query: func() url.Values {
+			return signedQuery(t, signer, "Show_S01E01", -time.Minute)
+		}, resource: "Show_S01E01", err: ErrSignatureExpired},
+		{name: "expired for another resource", query: func() url.Values {
+			return signedQuery(t, signer, "Show_S01E01", -time.Minute)
+		}, resource: "Show_S01E02", err: ErrSignatureInvalid},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := signer.Verify(test.query(), test.resource); !errors.Is(err, test.err) {
+				t.Errorf("Verify error = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestURLSignerKeepsURL(t *testing.T) {
+	signer, err := NewURLSigner("test-secret", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := signedQuery(t, signer, "Show_S01E01", time.Hour)
+	if query.Get("quality") != "720p" {
+		t.Errorf("signed query = %v, want the original parameters kept", query)
+	}
+	parsed, err := url.Parse(signer.SignURL("/api/episode/Show_S01E01/subtitle", "Show_S01E01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Path != "/api/episode/Show_S01E01/subtitle" || signer.Verify(parsed.Query(), "Show_S01E01") != nil {
+		t.Errorf("SignURL = %s, want a verifiable signature on the same path", parsed)
+	}
+}
+
+func TestURLSignerGeneratedSecret(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "data", "signing.key")
+	signer, err := NewURLSigner("", secretFile, time.Hour)
+	if err != nil {
+		t.Fatalf("NewURLSigner error: %v", err)
+	}
+	query := signedQuery(t, signer, "Show_S01E01", time.Hour)
+
+	// Signed URLs stay valid across restarts
+	restarted, err := NewURLSigner("", secretFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Verify(query, "Show_S01E01"); err != nil {
+		t.Errorf("Verify after a restart error: %v", err)
+	}
+
+	// A configured secret takes the place of the generated one
+	configured, err := NewURLSigner("test-secret", secretFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := configured.Verify(query, "Show_S01E01"); !errors.Is(err, ErrSignatureInvalid) {
+		t.Errorf("Verify with a configured secret error = %v, want %v", err, ErrSignatureInvalid)
+	}
+}
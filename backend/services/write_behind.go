@@ -0,0 +1,64 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// writeBehind tracks a document that's updated in memory and written to the
+// state store later. The owner marks it changed under its own lock and writes
+// it with save, holding writeMutex, so snapshots reach the store in order.
+type writeBehind struct {
+	store StateStore
+	key   string
+	// writeMutex serializes writes of the document. Take it before the owner's lock.
+	writeMutex sync.Mutex
+
+	mutex       sync.Mutex
+	dirty       bool
+	lastFlushed time.Time
+}
+
+// newWriteBehind creates a write-behind tracker for the document stored under key
+func newWriteBehind(store StateStore, key string) *writeBehind {
+	return &writeBehind{store: store, key: key}
+}
+
+// changed marks the document as changed since it was last written
+func (w *writeBehind) changed() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.dirty = true
+}
+
+// take reports whether the document changed and marks it written. Take a
+// snapshot afterwards, so changes made meanwhile are written next time.
+func (w *writeBehind) take() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	dirty := w.dirty
+	w.dirty = false
+	return dirty
+}
+
+// save writes a snapshot of the document. If that fails the document stays
+// changed, so the next flush tries again. Callers must hold writeMutex.
+func (w *writeBehind) save(v interface{}) error {
+	err := w.store.Save(w.key, v)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err != nil {
+		w.dirty = true
+		return err
+	}
+	w.lastFlushed = time.Now()
+	return nil
+}
+
+// status returns when the document was last written and whether it has changed since
+func (w *writeBehind) status() (time.Time, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.lastFlushed, w.dirty
+}
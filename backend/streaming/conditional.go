@@ -0,0 +1,111 @@
+package streaming
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// conditionResult is the outcome of evaluating a request's preconditions
+type conditionResult int
+
+const (
+	conditionPassed             conditionResult = iota // Serve the content as usual
+	conditionNotModified                               // Reply 304 Not Modified
+	conditionPreconditionFailed                        // Reply 412 Precondition Failed
+)
+
+// checkPreconditions evaluates If-Match, If-Unmodified-Since, If-None-Match and
+// If-Modified-Since in the order given by RFC 7232 section 6
+func checkPreconditions(r *http.Request, etag string, modTime time.Time) conditionResult {
+	// If-Match takes precedence over If-Unmodified-Since
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !etagListMatches(ifMatch, etag, true) {
+			return conditionPreconditionFailed
+		}
+	} else if since, ok := parseHTTPDate(r.Header.Get("If-Unmodified-Since")); ok && !modTime.IsZero() {
+		if truncate(modTime).After(since) {
+			return conditionPreconditionFailed
+		}
+	}
+
+	safe := r.Method == http.MethodGet || r.Method == http.MethodHead
+
+	// If-None-Match takes precedence over If-Modified-Since
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etagListMatches(ifNoneMatch, etag, false) {
+			if safe {
+				return conditionNotModified
+			}
+			return conditionPreconditionFailed
+		}
+	} else if since, ok := parseHTTPDate(r.Header.Get("If-Modified-Since")); ok && safe && !modTime.IsZero() {
+		if !truncate(modTime).After(since) {
+			return conditionNotModified
+		}
+	}
+
+	return conditionPassed
+}
+
+// rangeApplies reports whether the Range header should be honoured given the
+// request's If-Range header (RFC 7233 section 3.2). A stale validator means the
+// client gets the whole, current representation instead.
+func rangeApplies(r *http.Request, etag string, modTime time.Time) bool {
+	ifRange := strings.TrimSpace(r.Header.Get("If-Range"))
+	if ifRange == "" {
+		return true
+	}
+
+	// Entity tags are quoted, dates aren't
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etagMatches(ifRange, etag, true)
+	}
+
+	// A date only validates if it exactly matches Last-Modified
+	date, ok := parseHTTPDate(ifRange)
+	return ok && !modTime.IsZero() && truncate(modTime).Equal(date)
+}
+
+// etagListMatches reports whether any entity tag in a comma-separated header
+// list matches etag. "*" matches any current representation.
+func etagListMatches(list, etag string, strong bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return etag != ""
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		if etagMatches(strings.TrimSpace(candidate), etag, strong) {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatches compares two entity tags. Strong comparison never matches weak
+// tags; weak comparison ignores the W/ prefix (RFC 7232 section 2.3.2).
+func etagMatches(a, b string, strong bool) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	if strong {
+		return !strings.HasPrefix(a, "W/") && !strings.HasPrefix(b, "W/") && a == b
+	}
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// parseHTTPDate parses an HTTP date header value
+func parseHTTPDate(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+// truncate drops sub-second precision, which HTTP dates can't carry
+func truncate(t time.Time) time.Time {
+	return t.Truncate(time.Second)
+}
@@ -0,0 +1,146 @@
+package streaming
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxRanges is the most ranges served in one multipart response. Requests with
+// more ranges (after merging) get the whole file instead, as RFC 7233 allows.
+const maxRanges = 32
+
+var (
+	// errMalformedRange means the Range header isn't a valid bytes range set and must be ignored
+	errMalformedRange = errors.New("malformed range")
+	// errUnsatisfiableRange means no range in the set overlaps the content
+	errUnsatisfiableRange = errors.New("unsatisfiable range")
+)
+
+// byteRange is a satisfiable byte range, with start and length clamped to the content
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+// end returns the last byte position of the range
+func (b byteRange) end() int64 {
+	return b.start + b.length - 1
+}
+
+// contentRange returns the Content-Range header value for the range
+func (b byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", b.start, b.end(), size)
+}
+
+// parseRange parses a Range header against content of the given size, following
+// RFC 7233 section 2.1. Suffix ranges (bytes=-500) count from the end, ends past
+// the content are clamped, and ranges that start past the end are dropped. The
+// result is sorted and overlapping or adjacent ranges are merged.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, errMalformedRange
+	}
+
+	var ranges []byteRange
+	specs := strings.Split(header[len(prefix):], ",")
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			// Empty list elements are allowed by the list syntax
+			continue
+		}
+
+		dash := strings.IndexByte(spec, '-')
+		if dash < 0 {
+			return nil, errMalformedRange
+		}
+		first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+		if first == "" {
+			// Suffix range: the last N bytes
+			suffix, err := parseBytePos(last)
+			if err != nil {
+				return nil, err
+			}
+			if suffix == 0 || size == 0 {
+				continue
+			}
+			suffix = min(suffix, size)
+			ranges = append(ranges, byteRange{start: size - suffix, length: suffix})
+			continue
+		}
+
+		start, err := parseBytePos(first)
+		if err != nil {
+			return nil, err
+		}
+		end := size - 1
+		if last != "" {
+			end, err = parseBytePos(last)
+			if err != nil {
+				return nil, err
+			}
+			if end < start {
+				return nil, errMalformedRange
+			}
+			end = min(end, size-1)
+		}
+		if start >= size {
+			// Not satisfiable, but other ranges in the set may be
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+
+	if len(ranges) == 0 {
+		if len(strings.TrimSpace(strings.Join(specs, ""))) == 0 {
+			return nil, errMalformedRange
+		}
+		return nil, errUnsatisfiableRange
+	}
+	return mergeRanges(ranges), nil
+}
+
+// parseBytePos parses a non-negative byte position
+func parseBytePos(value string) (int64, error) {
+	if value == "" || strings.TrimLeft(value, "0123456789") != "" {
+		return 0, errMalformedRange
+	}
+	pos, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errMalformedRange
+	}
+	return pos, nil
+}
+
+// mergeRanges sorts ranges by start and merges the ones that overlap or touch,
+// so clients can't make the server send the same bytes many times over
+func mergeRanges(ranges []byteRange) []byteRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+
+	merged := ranges[:1]
+	for _, next := range ranges[1:] {
+		current := &merged[len(merged)-1]
+		if next.start <= current.end()+1 {
+			current.length = max(current.end(), next.end()) - current.start + 1
+			continue
+		}
+		merged = append(merged, next)
+	}
+	return merged
+}
+
+// totalLength returns the number of bytes covered by the ranges
+func totalLength(ranges []byteRange) int64 {
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	return total
+}
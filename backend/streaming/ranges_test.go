@@ -0,0 +1,123 @@
+package streaming
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		size   int64
+		want   []byteRange
+		err    error
+	}{
+		{name: "single", header: "bytes=0-99", size: 1000, want: []byteRange{{0, 100}}},
+		{name: "open end", header: "bytes=900-", size: 1000, want: []byteRange{{900, 100}}},
+		{name: "end clamped", header: "bytes=900-5000", size: 1000, want: []byteRange{{900, 100}}},
+		{name: "suffix", header: "bytes=-100", size: 1000, want: []byteRange{{900, 100}}},
+		{name: "suffix longer than content", header: "bytes=-5000", size: 1000, want: []byteRange{{0, 1000}}},
+		{name: "zero suffix", header: "bytes=-0", size: 1000, err: errUnsatisfiableRange},
+		{name: "suffix of empty content", header: "bytes=-100", size: 0, err: errUnsatisfiableRange},
+		{name: "multiple", header: "bytes=0-9, 20-29", size: 1000, want: []byteRange{{0, 10}, {20, 10}}},
+		{name: "multiple with suffix", header: "bytes=0-9,-10", size: 1000, want: []byteRange{{0, 10}, {990, 10}}},
+		{name: "multiple sorted", header: "bytes=500-509,0-9", size: 1000, want: []byteRange{{0, 10}, {500, 10}}},
+		{name: "overlapping merged", header: "bytes=0-49,25-99", size: 1000, want: []byteRange{{0, 100}}},
+		{name: "adjacent merged", header: "bytes=0-49,50-99", size: 1000, want: []byteRange{{0, 100}}},
+		{name: "suffix overlapping merged", header: "bytes=950-,-100", size: 1000, want: []byteRange{{900, 100}}},
+		{name: "unsatisfiable part dropped", header: "bytes=0-9,2000-2999", size: 1000, want: []byteRange{{0, 10}}},
+		{name: "empty elements", header: "bytes=,0-9,,", size: 1000, want: []byteRange{{0, 10}}},
+		{name: "past the end", header: "bytes=1000-", size: 1000, err: errUnsatisfiableRange},
+		{name: "other unit", header: "items=0-9", size: 1000, err: errMalformedRange},
+		{name: "no dash", header: "bytes=100", size: 1000, err: errMalformedRange},
+		{name: "end before start", header: "bytes=100-50", size: 1000, err: errMalformedRange},
+		{name: "negative", header: "bytes=-5-10", size: 1000, err: errMalformedRange},
+		{name: "no ranges", header: "bytes=, ,", size: 1000, err: errMalformedRange},
+		{name: "malformed part spoils the set", header: "bytes=0-9,x-y", size: 1000, err: errMalformedRange},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseRange(test.header, test.size)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("parseRange(%q, %d) error = %v, want %v", test.header, test.size, err, test.err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseRange(%q, %d) = %v, want %v", test.header, test.size, got, test.want)
+			}
+		})
+	}
+}
+
+func TestServeMultipleRanges(t *testing.T) {
+	body := "0123456789abcdefghijklmnopqrstuvwxyz"
+	content := Content{Name: "test", ContentType: "text/plain", Size: int64(len(body))}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Range", "bytes=0-3,10-12,-2")
+	w := httptest.NewRecorder()
+	Serve(w, r, content, strings.NewReader(body))
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusPartialContent)
+	}
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type = %q, want multipart/byteranges", w.Header().Get("Content-Type"))
+	}
+	if got, want := w.Header().Get("Content-Length"), strconv.Itoa(w.Body.Len()); got != want {
+		t.Errorf("Content-Length = %s, body has %s bytes", got, want)
+	}
+
+	wantParts := []struct {
+		contentRange string
+		data         string
+	}{
+		{"bytes 0-3/36", "0123"},
+		{"bytes 10-12/36", "abc"},
+		{"bytes 34-35/36", "yz"},
+	}
+	reader := multipart.NewReader(w.Body, params["boundary"])
+	for i, want := range wantParts {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		if got := part.Header.Get("Content-Range"); got != want.contentRange {
+			t.Errorf("part %d Content-Range = %q, want %q", i, got, want.contentRange)
+		}
+		if got := part.Header.Get("Content-Type"); got != content.ContentType {
+			t.Errorf("part %d Content-Type = %q, want %q", i, got, content.ContentType)
+		}
+		data, _ := io.ReadAll(part)
+		if string(data) != want.data {
+			t.Errorf("part %d = %q, want %q", i, data, want.data)
+		}
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Errorf("expected %d parts, next part error = %v", len(wantParts), err)
+	}
+}
+
+func TestServeUnsatisfiableRange(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Range", "bytes=100-")
+	w := httptest.NewRecorder()
+	Serve(w, r, Content{Name: "test", Size: 10}, strings.NewReader("0123456789"))
+
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusRequestedRangeNotSatisfiable)
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes */10" {
+		t.Errorf("Content-Range = %q, want %q", got, "bytes */10")
+	}
+}
@@ -0,0 +1,238 @@
+// Package streaming serves media files over HTTP with byte range, conditional
+// request and HEAD support (RFC 7232 and RFC 7233).
+package streaming
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Content describes the representation being served
+type Content struct {
+	Name        string // Used in log messages
+	ContentType string
+	Size        int64
+	ModTime     time.Time
+	ETag        string // Quoted entity tag, empty for none
+}
+
+// FileETag returns a strong entity tag for a file, derived from its size and
+// modification time
+func FileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// ServeFile serves the file at path with the given content type
+func ServeFile(w http.ResponseWriter, r *http.Request, path, contentType string) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("ServeFile: File not found at %s", path)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("ServeFile: Error opening file %s: %v", path, err)
+		http.Error(w, "Failed to open file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		log.Printf("ServeFile: Error getting file info for %s: %v", path, err)
+		http.Error(w, "Failed to get file info", http.StatusInternalServerError)
+		return
+	}
+	if info.IsDir() {
+		log.Printf("ServeFile: Path is a directory: %s", path)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	Serve(w, r, Content{
+		Name:        path,
+		ContentType: contentType,
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+		ETag:        FileETag(info),
+	}, file)
+}
+
+// Serve writes content read from body, honouring conditional headers, Range
+// and If-Range. HEAD requests get the same headers as GET, without a body.
+func Serve(w http.ResponseWriter, r *http.Request, content Content, body io.ReadSeeker) {
+	header := w.Header()
+
+	// Validators are sent with every response, including 304 and 416
+	header.Set("Accept-Ranges", "bytes")
+	if content.ETag != "" {
+		header.Set("ETag", content.ETag)
+	}
+	if !content.ModTime.IsZero() {
+		header.Set("Last-Modified", content.ModTime.UTC().Format(http.TimeFormat))
+	}
+
+	// Evaluate preconditions before looking at the range
+	switch checkPreconditions(r, content.ETag, content.ModTime) {
+	case conditionNotModified:
+		log.Printf("Serve: %s not modified", content.Name)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	case conditionPreconditionFailed:
+		log.Printf("Serve: Precondition failed for %s", content.Name)
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+
+	// Work out which ranges to send
+	var ranges []byteRange
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && rangeApplies(r, content.ETag, content.ModTime) {
+		parsed, err := parseRange(rangeHeader, content.Size)
+		switch {
+		case errors.Is(err, errUnsatisfiableRange):
+			log.Printf("Serve: Unsatisfiable range %q for %s of size %d", rangeHeader, content.Name, content.Size)
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", content.Size))
+			http.Error(w, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		case err != nil:
+			// A Range header we can't parse is ignored and the whole file is sent
+			log.Printf("Serve: Ignoring malformed range %q", rangeHeader)
+		case len(parsed) > maxRanges:
+			log.Printf("Serve: Ignoring range with %d parts", len(parsed))
+		default:
+			ranges = parsed
+		}
+	}
+
+	switch len(ranges) {
+	case 0:
+		serveWhole(w, r, content, body)
+	case 1:
+		serveSingleRange(w, r, content, body, ranges[0])
+	default:
+		serveMultipleRanges(w, r, content, body, ranges)
+	}
+}
+
+// serveWhole sends the full content with a 200 status
+func serveWhole(w http.ResponseWriter, r *http.Request, content Content, body io.ReadSeeker) {
+	log.Printf("serveWhole: Serving %d bytes of %s", content.Size, content.Name)
+
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		log.Printf("serveWhole: Error seeking %s: %v", content.Name, err)
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", content.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(content.Size, 10))
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+	copyBody(w, body, content.Size, content.Name)
+}
+
+// serveSingleRange sends one range with a 206 status
+func serveSingleRange(w http.ResponseWriter, r *http.Request, content Content, body io.ReadSeeker, part byteRange) {
+	log.Printf("serveSingleRange: Serving bytes %d-%d of %s", part.start, part.end(), content.Name)
+
+	if _, err := body.Seek(part.start, io.SeekStart); err != nil {
+		log.Printf("serveSingleRange: Error seeking %s to %d: %v", content.Name, part.start, err)
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", content.ContentType)
+	w.Header().Set("Content-Range", part.contentRange(content.Size))
+	w.Header().Set("Content-Length", strconv.FormatInt(part.length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+	copyBody(w, body, part.length, content.Name)
+}
+
+// serveMultipleRanges sends several ranges as a multipart/byteranges body with a 206 status
+func serveMultipleRanges(w http.ResponseWriter, r *http.Request, content Content, body io.ReadSeeker, ranges []byteRange) {
+	log.Printf("serveMultipleRanges: Serving %d ranges (%d bytes) of %s", len(ranges), totalLength(ranges), content.Name)
+
+	// Write the part headers once to count the body length
+	counter := &countingWriter{}
+	boundary := multipart.NewWriter(counter).Boundary()
+	measure := multipart.NewWriter(counter)
+	measure.SetBoundary(boundary)
+	for _, part := range ranges {
+		measure.CreatePart(partHeader(content, part))
+	}
+	measure.Close()
+	length := counter.n + totalLength(ranges)
+
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	writer := multipart.NewWriter(w)
+	writer.SetBoundary(boundary)
+	for _, part := range ranges {
+		partWriter, err := writer.CreatePart(partHeader(content, part))
+		if err != nil {
+			log.Printf("serveMultipleRanges: Error writing part header: %v", err)
+			return
+		}
+		if _, err := body.Seek(part.start, io.SeekStart); err != nil {
+			// The status is already sent, so all we can do is stop
+			log.Printf("serveMultipleRanges: Error seeking %s to %d: %v", content.Name, part.start, err)
+			return
+		}
+		if !copyBody(partWriter, body, part.length, content.Name) {
+			return
+		}
+	}
+	if err := writer.Close(); err != nil {
+		log.Printf("serveMultipleRanges: Error closing multipart body: %v", err)
+	}
+}
+
+// partHeader returns the MIME header of one part of a multipart/byteranges body
+func partHeader(content Content, part byteRange) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {part.contentRange(content.Size)},
+		"Content-Type":  {content.ContentType},
+	}
+}
+
+// copyBody copies length bytes to the response and reports whether it succeeded.
+// Failures usually mean the client went away, so they're only logged.
+func copyBody(w io.Writer, body io.Reader, length int64, name string) bool {
+	written, err := io.CopyN(w, body, length)
+	if err != nil {
+		log.Printf("copyBody: Stopped after %d of %d bytes of %s: %v", written, length, name, err)
+		return false
+	}
+	return true
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
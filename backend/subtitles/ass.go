@@ -0,0 +1,199 @@
+package subtitles
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// parseASS reads the dialogue lines of an ASS or SSA file. Styles and
+// positioning are dropped; italic, bold and underline overrides are kept.
+func parseASS(text string) ([]Cue, error) {
+	var cues []Cue
+	var section string
+	var fields []string
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(line)
+			continue
+		}
+		if section != "[events]" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "format":
+			fields = nil
+			for _, field := range strings.Split(value, ",") {
+				fields = append(fields, strings.ToLower(strings.TrimSpace(field)))
+			}
+		case "dialogue":
+			if fields == nil {
+				return nil, fmt.Errorf("dialogue line before the events format line")
+			}
+			// Text is always the last field and may contain commas
+			values := strings.SplitN(value, ",", len(fields))
+			if len(values) != len(fields) {
+				continue
+			}
+			cue, ok := assCue(fields, values)
+			if ok {
+				cues = append(cues, cue)
+			}
+		}
+	}
+
+	if fields == nil {
+		return nil, fmt.Errorf("no [Events] format line found")
+	}
+	return cues, nil
+}
+
+// assCue builds a cue from the fields of a dialogue line
+func assCue(fields, values []string) (Cue, bool) {
+	var cue Cue
+	var hasStart, hasEnd bool
+	for i, field := range fields {
+		value := strings.TrimSpace(values[i])
+		switch field {
+		case "start":
+			cue.Start, hasStart = parseTimestamp(value)
+		case "end":
+			cue.End, hasEnd = parseTimestamp(value)
+		case "text":
+			cue.Text = assText(values[i])
+		}
+	}
+	return cue, hasStart && hasEnd && cue.Text != ""
+}
+
+// assText converts ASS dialogue text to cue markup. Override blocks such as
+// {\i1} become tags where there is one and are dropped otherwise; drawings are
+// skipped.
+func assText(text string) string {
+	var b strings.Builder
+	open := map[string]bool{}
+	drawing := false
+
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '{':
+			end := strings.IndexByte(text[i:], '}')
+			if end < 0 {
+				// An unclosed brace doesn't start an override block; keep the rest as text
+				if !drawing {
+					b.WriteString(text[i:])
+				}
+				i = len(text)
+				break
+			}
+			for _, override := range strings.Split(text[i+1:i+end], `\`) {
+				switch {
+				case override == "":
+				case override[0] == 'p' && len(override) > 1 && override[1] >= '0' && override[1] <= '9':
+					drawing = override[1:] != "0"
+				case len(override) >= 2 && strings.ContainsRune("ibu", rune(override[0])) && override[1] >= '0' && override[1] <= '9':
+					// \b may also carry a font weight, so anything but 0 turns it on
+					tag := override[:1]
+					on := override[1:] != "0"
+					if on != open[tag] {
+						open[tag] = on
+						if on {
+							b.WriteString("<" + tag + ">")
+						} else {
+							b.WriteString("</" + tag + ">")
+						}
+					}
+				}
+			}
+			i += end
+		case drawing:
+		case c == '\\' && i+1 < len(text) && (text[i+1] == 'N' || text[i+1] == 'n'):
+			b.WriteByte('\n')
+			i++
+		case c == '\\' && i+1 < len(text) && text[i+1] == 'h':
+			b.WriteString("\u00a0")
+			i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	// Close tags left open at the end of the line
+	for _, tag := range []string{"u", "b", "i"} {
+		if open[tag] {
+			b.WriteString("</" + tag + ">")
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// shiftASS delays the dialogue lines of an ASS or SSA file by offset, leaving
+// everything else as it is. Lines that would end before the start are dropped.
+func shiftASS(text string, offset time.Duration) string {
+	lines := strings.Split(text, "\n")
+	kept := lines[:0]
+	var section string
+	var fields []string
+
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			section = strings.ToLower(trimmed)
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if section != "[events]" || !ok {
+			kept = append(kept, line)
+			continue
+		}
+
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "format":
+			fields = nil
+			for _, field := range strings.Split(value, ",") {
+				fields = append(fields, strings.ToLower(strings.TrimSpace(field)))
+			}
+		case "dialogue", "comment":
+			values := strings.SplitN(value, ",", len(fields))
+			if fields == nil || len(values) != len(fields) {
+				break
+			}
+			var dropped bool
+			for i, field := range fields {
+				if field != "start" && field != "end" {
+					continue
+				}
+				at, ok := parseTimestamp(values[i])
+				if !ok {
+					continue
+				}
+				at += offset
+				if field == "end" && at <= 0 {
+					dropped = true
+				}
+				values[i] = formatASSTimestamp(at)
+			}
+			if dropped {
+				continue
+			}
+			line = key + ":" + strings.Join(values, ",")
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\n")
+}
+
+// formatASSTimestamp writes a timestamp as H:MM:SS.cc. Negative times are written as zero.
+func formatASSTimestamp(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	cs := int64(d / (10 * time.Millisecond))
+	return fmt.Sprintf("%d:%02d:%02d.%02d", cs/360000, cs/6000%60, cs/100%60, cs%100)
+}
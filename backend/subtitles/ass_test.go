@@ -0,0 +1,97 @@
+package subtitles
+
+import (
+	"testing"
+	"time"
+)
+
+func TestASSText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "plain", text: "Hello there", want: "Hello there"},
+		{name: "line breaks", text: `One\NTwo\nThree`, want: "One\nTwo\nThree"},
+		{name: "hard space", text: `a\hb`, want: "a\u00a0b"},
+		{name: "italics", text: `{\i1}Hello{\i0} there`, want: "<i>Hello</i> there"},
+		{name: "tags closed at the end", text: `{\b1\u1}Loud`, want: "<b><u>Loud</u></b>"},
+		{name: "font weight", text: `{\b700}Bold{\b0}`, want: "<b>Bold</b>"},
+		{name: "repeated tag", text: `{\i1}a{\i1}b`, want: "<i>ab</i>"},
+		{name: "other overrides dropped", text: `{\pos(10,20)\fs12}Placed`, want: "Placed"},
+		{name: "comment block dropped", text: `{note}Text`, want: "Text"},
+		{name: "drawing skipped", text: `{\p1}m 0 0 l 100 0{\p0}Text`, want: "Text"},
+		{name: "unclosed brace", text: `Hello {world`, want: "Hello {world"},
+		{name: "unclosed brace at the end", text: `Hello {`, want: "Hello {"},
+		{name: "unclosed brace after override", text: `{\i1}Hi{\i0} there {x`, want: "<i>Hi</i> there {x"},
+		{name: "unclosed brace in a drawing", text: `{\p1}m 0 0 {l`, want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := assText(test.text); got != test.want {
+				t.Errorf("assText(%q) = %q, want %q", test.text, got, test.want)
+			}
+		})
+	}
+}
+
+func TestShiftASS(t *testing.T) {
+	header := "[Script Info]\nTitle: Start: 0:00:01.00\n\n[Events]\nFormat: Layer, Start, End, Style, Text\n"
+	file := header +
+		"Dialogue: 0,0:00:01.00,0:00:02.00,Default,Ends before zero\n" +
+		"Comment: 0,0:00:02.50,0:00:04.00,Default,Starts before zero\n" +
+		"Dialogue: 0,0:00:10.00,0:00:12.50,Default,{\\i1}Later{\\i0}, with commas, kept\n" +
+		"Dialogue: broken line\n"
+
+	tests := []struct {
+		name   string
+		offset time.Duration
+		want   string
+	}{
+		{
+			name:   "later",
+			offset: 1500 * time.Millisecond,
+			want: header +
+				"Dialogue: 0,0:00:02.50,0:00:03.50,Default,Ends before zero\n" +
+				"Comment: 0,0:00:04.00,0:00:05.50,Default,Starts before zero\n" +
+				"Dialogue: 0,0:00:11.50,0:00:14.00,Default,{\\i1}Later{\\i0}, with commas, kept\n" +
+				"Dialogue: broken line\n",
+		},
+		{
+			// Only dialogue timings change; the header line that looks like one is left alone
+			name:   "earlier",
+			offset: -3 * time.Second,
+			want: header +
+				"Comment: 0,0:00:00.00,0:00:01.00,Default,Starts before zero\n" +
+				"Dialogue: 0,0:00:07.00,0:00:09.50,Default,{\\i1}Later{\\i0}, with commas, kept\n" +
+				"Dialogue: broken line\n",
+		},
+		{
+			name:   "past an hour",
+			offset: time.Hour,
+			want: header +
+				"Dialogue: 0,1:00:01.00,1:00:02.00,Default,Ends before zero\n" +
+				"Comment: 0,1:00:02.50,1:00:04.00,Default,Starts before zero\n" +
+				"Dialogue: 0,1:00:10.00,1:00:12.50,Default,{\\i1}Later{\\i0}, with commas, kept\n" +
+				"Dialogue: broken line\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := shiftASS(file, test.offset); got != test.want {
+				t.Errorf("shiftASS =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+
+	// Converting an ASS file with an offset shifts it in place
+	got, err := Convert([]byte(file), FormatASS, FormatSSA, time.Second)
+	if err != nil {
+		t.Fatalf("Convert error: %v", err)
+	}
+	if want := shiftASS(file, time.Second); string(got) != want {
+		t.Errorf("Convert =\n%s\nwant\n%s", got, want)
+	}
+}
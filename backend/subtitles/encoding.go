@@ -0,0 +1,65 @@
+package subtitles
+
+import (
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// windows1252 maps the bytes 0x80-0x9F of Windows-1252 to Unicode. The other
+// bytes above 0x7F are the same as in Latin-1. Unassigned bytes map to U+FFFD.
+var windows1252 = [32]rune{
+	'€', '\uFFFD', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '\uFFFD', 'Ž', '\uFFFD',
+	'\uFFFD', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '\uFFFD', 'ž', 'Ÿ',
+}
+
+// DecodeText converts subtitle file contents to a string. It honours UTF-8 and
+// UTF-16 byte order marks, treats other text that isn't valid UTF-8 as
+// Windows-1252, and normalizes line endings to "\n".
+func DecodeText(data []byte) string {
+	var text string
+	switch {
+	case len(data) >= 3 && data[0] == 0xEF && data[1] == 0xBB && data[2] == 0xBF:
+		text = string(data[3:])
+	case len(data) >= 2 && data[0] == 0xFF && data[1] == 0xFE:
+		text = decodeUTF16(data[2:], false)
+	case len(data) >= 2 && data[0] == 0xFE && data[1] == 0xFF:
+		text = decodeUTF16(data[2:], true)
+	case utf8.Valid(data):
+		text = string(data)
+	default:
+		text = decodeWindows1252(data)
+	}
+
+	return strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(text)
+}
+
+// decodeUTF16 decodes UTF-16 text without its byte order mark
+func decodeUTF16(data []byte, bigEndian bool) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// decodeWindows1252 decodes Windows-1252 text
+func decodeWindows1252(data []byte) string {
+	var b strings.Builder
+	b.Grow(len(data))
+	for _, c := range data {
+		switch {
+		case c < 0x80:
+			b.WriteByte(c)
+		case c < 0xA0:
+			b.WriteRune(windows1252[c-0x80])
+		default:
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
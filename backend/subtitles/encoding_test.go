@@ -0,0 +1,83 @@
+package subtitles
+
+import (
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// encodeUTF16 encodes text as UTF-16 with a byte order mark
+func encodeUTF16(text string, bigEndian bool) []byte {
+	units := append([]uint16{0xFEFF}, utf16.Encode([]rune(text))...)
+	data := make([]byte, 0, 2*len(units))
+	for _, unit := range units {
+		if bigEndian {
+			data = append(data, byte(unit>>8), byte(unit))
+		} else {
+			data = append(data, byte(unit), byte(unit>>8))
+		}
+	}
+	return data
+}
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "plain UTF-8", data: []byte("Déjà vu"), want: "Déjà vu"},
+		{name: "UTF-8 BOM", data: []byte("\xEF\xBB\xBFDéjà vu"), want: "Déjà vu"},
+		{name: "UTF-8 BOM only", data: []byte("\xEF\xBB\xBF"), want: ""},
+		{name: "UTF-16 little endian", data: encodeUTF16("Déjà vu ♪", false), want: "Déjà vu ♪"},
+		{name: "UTF-16 big endian", data: encodeUTF16("Déjà vu ♪", true), want: "Déjà vu ♪"},
+		{name: "UTF-16 surrogate pair", data: encodeUTF16("🎬 action", false), want: "🎬 action"},
+		{name: "UTF-16 odd trailing byte", data: append(encodeUTF16("ab", false), 'c'), want: "ab"},
+		{name: "UTF-16 line endings", data: encodeUTF16("one\r\ntwo\rthree", true), want: "one\ntwo\nthree"},
+		{name: "Windows-1252", data: []byte("D\xE9j\xE0 vu \x93quoted\x94 \x80"), want: "Déjà vu “quoted” €"},
+		{name: "Windows-1252 unassigned byte", data: []byte("a\x81b\xFF"), want: "a\uFFFDbÿ"},
+		{name: "CRLF line endings", data: []byte("one\r\ntwo\r\n"), want: "one\ntwo\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := DecodeText(test.data); got != test.want {
+				t.Errorf("DecodeText(% x) = %q, want %q", test.data, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseEncodedSRT(t *testing.T) {
+	srt := "1\r\n00:00:01,000 --> 00:00:02,500\r\nÇa va?\r\n\r\n2\r\n00:00:03,000 --> 00:00:04,000\r\n<i>Très bien</i>\r\n"
+	want := []Cue{
+		{Start: time.Second, End: 2500 * time.Millisecond, Text: "Ça va?"},
+		{Start: 3 * time.Second, End: 4 * time.Second, Text: "<i>Très bien</i>"},
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "UTF-8 BOM", data: append([]byte("\xEF\xBB\xBF"), srt...)},
+		{name: "UTF-16 little endian", data: encodeUTF16(srt, false)},
+		{name: "UTF-16 big endian", data: encodeUTF16(srt, true)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subtitle, err := Parse(test.data, FormatSRT)
+			if err != nil {
+				t.Fatalf("Parse error: %v", err)
+			}
+			if len(subtitle.Cues) != len(want) {
+				t.Fatalf("Parse returned %d cues, want %d: %+v", len(subtitle.Cues), len(want), subtitle.Cues)
+			}
+			for i, cue := range subtitle.Cues {
+				if cue != want[i] {
+					t.Errorf("cue %d = %+v, want %+v", i, cue, want[i])
+				}
+			}
+		})
+	}
+}
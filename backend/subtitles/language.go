@@ -0,0 +1,81 @@
+package subtitles
+
+import (
+	"strings"
+)
+
+// languages maps ISO 639-1 codes to English language names
+var languages = map[string]string{
+	"ar": "Arabic", "bg": "Bulgarian", "ca": "Catalan", "cs": "Czech",
+	"da": "Danish", "de": "German", "el": "Greek", "en": "English",
+	"es": "Spanish", "et": "Estonian", "eu": "Basque", "fa": "Persian",
+	"fi": "Finnish", "fr": "French", "he": "Hebrew", "hi": "Hindi",
+	"hr": "Croatian", "hu": "Hungarian", "id": "Indonesian", "is": "Icelandic",
+	"it": "Italian", "ja": "Japanese", "ko": "Korean", "lt": "Lithuanian",
+	"lv": "Latvian", "ms": "Malay", "nb": "Norwegian Bokmål", "nl": "Dutch",
+	"no": "Norwegian", "pl": "Polish", "pt": "Portuguese", "ro": "Romanian",
+	"ru": "Russian", "sk": "Slovak", "sl": "Slovenian", "sr": "Serbian",
+	"sv": "Swedish", "th": "Thai", "tr": "Turkish", "uk": "Ukrainian",
+	"vi": "Vietnamese", "zh": "Chinese",
+}
+
+// iso639_2 maps ISO 639-2 codes, as used by Matroska and many release names,
+// to their ISO 639-1 equivalents
+var iso639_2 = map[string]string{
+	"ara": "ar", "bul": "bg", "cat": "ca", "ces": "cs", "cze": "cs",
+	"dan": "da", "deu": "de", "ger": "de", "ell": "el", "gre": "el",
+	"eng": "en", "spa": "es", "est": "et", "eus": "eu", "baq": "eu",
+	"fas": "fa", "per": "fa", "fin": "fi", "fra": "fr", "fre": "fr",
+	"heb": "he", "hin": "hi", "hrv": "hr", "hun": "hu", "ind": "id",
+	"isl": "is", "ice": "is", "ita": "it", "jpn": "ja", "kor": "ko",
+	"lit": "lt", "lav": "lv", "msa": "ms", "may": "ms", "nob": "nb",
+	"nld": "nl", "dut": "nl", "nor": "no", "pol": "pl", "por": "pt",
+	"ron": "ro", "rum": "ro", "rus": "ru", "slk": "sk", "slo": "sk",
+	"slv": "sl", "srp": "sr", "swe": "sv", "tha": "th", "tur": "tr",
+	"ukr": "uk", "vie": "vi", "zho": "zh", "chi": "zh",
+}
+
+// NormalizeLanguage turns a language tag such as "EN", "eng" or "pt-br" into
+// its canonical form ("en", "en", "pt-BR"). It reports false for tags that
+// aren't a known language.
+func NormalizeLanguage(tag string) (string, bool) {
+	base, region, hasRegion := strings.Cut(strings.ToLower(tag), "-")
+	if code, ok := iso639_2[base]; ok {
+		base = code
+	}
+	if _, ok := languages[base]; !ok {
+		return "", false
+	}
+
+	if !hasRegion {
+		return base, true
+	}
+	if len(region) < 2 || len(region) > 4 {
+		return "", false
+	}
+	return base + "-" + strings.ToUpper(region), true
+}
+
+// LanguageName returns the English name of a normalized language tag, with its
+// region if it has one, e.g. "Portuguese (BR)"
+func LanguageName(language string) string {
+	base, region, hasRegion := strings.Cut(language, "-")
+	name, ok := languages[base]
+	if !ok {
+		return strings.ToUpper(language)
+	}
+	if hasRegion {
+		return name + " (" + region + ")"
+	}
+	return name
+}
+
+// LanguageMatches reports whether a track's language satisfies a wanted
+// language. A wanted language without region matches every region.
+func LanguageMatches(language, wanted string) bool {
+	if language == wanted {
+		return true
+	}
+	base, _, _ := strings.Cut(language, "-")
+	return !strings.Contains(wanted, "-") && base == wanted
+}
@@ -0,0 +1,116 @@
+package subtitles
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseCues reads the cues of a SubRip or WebVTT file. Cues start at their
+// timing line and run until a blank line, so numbering, cue identifiers and
+// WebVTT NOTE and STYLE blocks are skipped. Missing blank lines between cues
+// are tolerated.
+func parseCues(text string, unescape func(string) string) []Cue {
+	lines := strings.Split(text, "\n")
+
+	var cues []Cue
+	for i := 0; i < len(lines); i++ {
+		if !strings.Contains(lines[i], "-->") {
+			continue
+		}
+		start, end, ok := parseTiming(lines[i])
+		if !ok {
+			continue
+		}
+
+		var textLines []string
+		for i+1 < len(lines) {
+			next := strings.TrimRight(lines[i+1], " \t")
+			if next == "" || strings.Contains(next, "-->") {
+				break
+			}
+			// A cue number directly followed by a timing line starts the next cue
+			if isCueNumber(next) && i+2 < len(lines) && strings.Contains(lines[i+2], "-->") {
+				break
+			}
+			textLines = append(textLines, unescape(next))
+			i++
+		}
+
+		cues = append(cues, Cue{Start: start, End: end, Text: strings.Join(textLines, "\n")})
+	}
+	return cues
+}
+
+// isCueNumber reports whether a line is a SubRip cue number
+func isCueNumber(line string) bool {
+	_, err := strconv.Atoi(strings.TrimSpace(line))
+	return err == nil
+}
+
+// parseSRT reads a SubRip file
+func parseSRT(text string) ([]Cue, error) {
+	cues := parseCues(text, func(s string) string { return s })
+	if len(cues) == 0 && strings.TrimSpace(text) != "" {
+		return nil, fmt.Errorf("no SubRip cues found")
+	}
+	return cues, nil
+}
+
+// writeSRT writes cues as a SubRip file
+func writeSRT(buf *bytes.Buffer, cues []Cue) {
+	for i, cue := range cues {
+		fmt.Fprintf(buf, "%d\n%s --> %s\n", i+1, formatTimestamp(cue.Start, ','), formatTimestamp(cue.End, ','))
+		buf.WriteString(rewriteTags(cue.Text, srtTags, false))
+		buf.WriteString("\n\n")
+	}
+}
+
+// srtTags are the tags SubRip players understand
+var srtTags = map[string]bool{"i": true, "b": true, "u": true, "font": true}
+
+// rewriteTags keeps the markup tags named in keep and drops every other tag.
+// With escape set, text outside tags is escaped for WebVTT.
+func rewriteTags(text string, keep map[string]bool, escape bool) string {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if c == '<' {
+			if end := strings.IndexByte(text[i:], '>'); end > 0 {
+				tag := text[i : i+end+1]
+				if keep[tagName(tag)] {
+					b.WriteString(tag)
+				}
+				i += end
+				continue
+			}
+		}
+
+		if escape {
+			switch c {
+			case '&':
+				b.WriteString("&amp;")
+				continue
+			case '<':
+				b.WriteString("&lt;")
+				continue
+			case '>':
+				b.WriteString("&gt;")
+				continue
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// tagName returns the lower case name of a markup tag such as "<i>", "</b>",
+// "<font color=red>" or "<c.yellow>"
+func tagName(tag string) string {
+	name := strings.TrimPrefix(strings.Trim(tag, "<>"), "/")
+	if i := strings.IndexAny(name, " \t.="); i >= 0 {
+		name = name[:i]
+	}
+	return strings.ToLower(name)
+}
@@ -0,0 +1,225 @@
+// Package subtitles reads SubRip, WebVTT and ASS/SSA subtitle files and writes
+// them back out as SubRip or WebVTT.
+package subtitles
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subtitle formats
+const (
+	FormatSRT = "srt"
+	FormatVTT = "vtt"
+	FormatASS = "ass"
+	FormatSSA = "ssa"
+)
+
+// Cue is a piece of text shown between two points in time. Text uses SubRip
+// style markup: lines separated by "\n", with <i>, <b> and <u> tags.
+type Cue struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+// PlainText returns the cue's text without markup
+func (c Cue) PlainText() string {
+	return rewriteTags(c.Text, nil, false)
+}
+
+// Subtitle is a parsed subtitle file
+type Subtitle struct {
+	Format string
+	Cues   []Cue
+}
+
+// ErrUnsupportedFormat is returned for formats that can't be read or written
+type ErrUnsupportedFormat struct {
+	Format string
+}
+
+func (e ErrUnsupportedFormat) Error() string {
+	return fmt.Sprintf("unsupported subtitle format: %q", e.Format)
+}
+
+// IsWritable reports whether subtitles can be converted to format
+func IsWritable(format string) bool {
+	return format == FormatSRT || format == FormatVTT
+}
+
+// DetectFormat returns the format of a subtitle file from its extension, or
+// from its content if the extension isn't a known one
+func DetectFormat(name string, data []byte) string {
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".srt", ".vtt", ".ass", ".ssa":
+		return ext[1:]
+	}
+
+	text := strings.TrimLeft(DecodeText(data), " \t\n")
+	switch {
+	case strings.HasPrefix(text, "WEBVTT"):
+		return FormatVTT
+	case strings.HasPrefix(text, "[Script Info]"):
+		if strings.Contains(text, "[V4+ Styles]") {
+			return FormatASS
+		}
+		return FormatSSA
+	}
+	return FormatSRT
+}
+
+// ContentType returns the MIME type of a subtitle format, as UTF-8 text
+func ContentType(format string) string {
+	switch format {
+	case FormatVTT:
+		return "text/vtt; charset=utf-8"
+	case FormatSRT:
+		return "application/x-subrip; charset=utf-8"
+	case FormatASS, FormatSSA:
+		return "text/x-ssa; charset=utf-8"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// mediaTypes maps the MIME types clients ask for to subtitle formats
+var mediaTypes = map[string]string{
+	"text/vtt":             FormatVTT,
+	"application/x-subrip": FormatSRT,
+	"application/srt":      FormatSRT,
+	"text/srt":             FormatSRT,
+	"text/x-srt":           FormatSRT,
+	"text/x-ssa":           FormatSSA,
+	"text/x-ass":           FormatASS,
+}
+
+// Negotiate picks the offered format the Accept header prefers. It returns ""
+// if the header names none of them, including when it only has wildcards.
+func Negotiate(accept string, offers []string) string {
+	best := ""
+	bestQuality := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		format, ok := mediaTypes[mediaType]
+		if !ok || !offered(format, offers) {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality > bestQuality {
+			best, bestQuality = format, quality
+		}
+	}
+	return best
+}
+
+// offered reports whether format is in offers. ASS and SSA stand in for each other.
+func offered(format string, offers []string) bool {
+	for _, offer := range offers {
+		if offer == format || (isASS(offer) && isASS(format)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isASS reports whether format is ASS or SSA
+func isASS(format string) bool {
+	return format == FormatASS || format == FormatSSA
+}
+
+// Parse reads a subtitle file in the given format. The data may be UTF-8,
+// UTF-16 with a byte order mark, or Windows-1252.
+func Parse(data []byte, format string) (*Subtitle, error) {
+	text := DecodeText(data)
+
+	var cues []Cue
+	var err error
+	switch format {
+	case FormatSRT:
+		cues, err = parseSRT(text)
+	case FormatVTT:
+		cues, err = parseVTT(text)
+	case FormatASS, FormatSSA:
+		cues, err = parseASS(text)
+	default:
+		return nil, ErrUnsupportedFormat{format}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Players expect cues in order of their start time
+	sort.SliceStable(cues, func(i, j int) bool {
+		return cues[i].Start < cues[j].Start
+	})
+	return &Subtitle{Format: format, Cues: cues}, nil
+}
+
+// Encode writes the subtitle in the given format as UTF-8
+func (s *Subtitle) Encode(format string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case FormatSRT:
+		writeSRT(&buf, s.Cues)
+	case FormatVTT:
+		writeVTT(&buf, s.Cues)
+	default:
+		return nil, ErrUnsupportedFormat{format}
+	}
+	return buf.Bytes(), nil
+}
+
+// Shift delays every cue by offset; negative offsets show them earlier. Cues
+// that would end before the start are dropped, and ones that would start
+// before it are cut.
+func (s *Subtitle) Shift(offset time.Duration) {
+	cues := s.Cues[:0]
+	for _, cue := range s.Cues {
+		cue.Start += offset
+		cue.End += offset
+		if cue.End <= 0 {
+			continue
+		}
+		if cue.Start < 0 {
+			cue.Start = 0
+		}
+		cues = append(cues, cue)
+	}
+	s.Cues = cues
+}
+
+// Convert turns a subtitle file from one format into another, returning UTF-8
+// text, and delays its cues by offset. Files already in the wanted format are
+// only re-encoded as UTF-8 unless they need shifting, so styling the
+// conversion would drop is kept.
+func Convert(data []byte, from, to string, offset time.Duration) ([]byte, error) {
+	sameFormat := from == to || (isASS(from) && isASS(to))
+	if sameFormat && offset == 0 {
+		return []byte(DecodeText(data)), nil
+	}
+	if sameFormat && isASS(from) {
+		return []byte(shiftASS(DecodeText(data), offset)), nil
+	}
+
+	subtitle, err := Parse(data, from)
+	if err != nil {
+		return nil, err
+	}
+	subtitle.Shift(offset)
+	return subtitle.Encode(to)
+}
@@ -0,0 +1,243 @@
+package subtitles
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// assFile is an ASS file with a style section and two dialogue lines
+const assFile = "[Script Info]\n" +
+	"Title: Test\n" +
+	"\n" +
+	"[V4+ Styles]\n" +
+	"Format: Name, Fontname, Fontsize\n" +
+	"Style: Default,Arial,20\n" +
+	"\n" +
+	"[Events]\n" +
+	"Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n" +
+	"Dialogue: 0,0:00:03.50,0:00:05.00,Default,,0,0,0,,Second line\n" +
+	"Dialogue: 0,0:00:01.00,0:00:02.25,Default,,0,0,0,,{\\i1}Hello{\\i0}, world\\NNew line\n"
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		from, to string
+		want     string
+	}{
+		{
+			name: "SRT to VTT",
+			data: "1\n00:00:01,000 --> 00:00:02,500\n<i>Hello</i> <font color=\"red\">there</font>\n\n" +
+				"2\n00:00:03,000 --> 00:00:04,000\nTom & Jerry -> <b>home</b>\n",
+			from: FormatSRT, to: FormatVTT,
+			want: "WEBVTT\n\n" +
+				"00:00:01.000 --> 00:00:02.500\n<i>Hello</i> there\n\n" +
+				"00:00:03.000 --> 00:00:04.000\nTom &amp; Jerry -&gt; <b>home</b>\n\n",
+		},
+		{
+			name: "arrow in cue text escaped",
+			data: "[Events]\nFormat: Start, End, Text\nDialogue: 0:00:01.00,0:00:02.00,He said --> no, <then> left\n",
+			from: FormatASS, to: FormatVTT,
+			// The unknown tag is dropped, and the arrow's ">" escaped so it can't end the cue text
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHe said --&gt; no,  left\n\n",
+		},
+		{
+			name: "SRT out of order sorted",
+			data: "2\n00:00:05,000 --> 00:00:06,000\nLater\n\n1\n00:00:01,000 --> 00:00:02,000\nEarlier\n",
+			from: FormatSRT, to: FormatVTT,
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nEarlier\n\n00:00:05.000 --> 00:00:06.000\nLater\n\n",
+		},
+		{
+			name: "ASS to VTT",
+			data: assFile,
+			from: FormatASS, to: FormatVTT,
+			want: "WEBVTT\n\n" +
+				"00:00:01.000 --> 00:00:02.250\n<i>Hello</i>, world\nNew line\n\n" +
+				"00:00:03.500 --> 00:00:05.000\nSecond line\n\n",
+		},
+		{
+			name: "VTT to SRT",
+			data: "WEBVTT\n\nNOTE a comment\n\nSTYLE\n::cue { color: red }\n\n" +
+				"intro\n00:01.000 --> 00:02.000 align:start\n<c.yellow>Fish &amp; chips</c> &lt;3\n\n" +
+				"01:00:00.500 --> 01:00:01.000\n<v Alice>Hi</v>\n",
+			from: FormatVTT, to: FormatSRT,
+			want: "1\n00:00:01,000 --> 00:00:02,000\nFish & chips <3\n\n" +
+				"2\n01:00:00,500 --> 01:00:01,000\nHi\n\n",
+		},
+		{
+			name: "same format kept as is",
+			data: "WEBVTT\n\n00:01.000 --> 00:02.000 line:0\n<c.yellow>Styled</c>\n",
+			from: FormatVTT, to: FormatVTT,
+			want: "WEBVTT\n\n00:01.000 --> 00:02.000 line:0\n<c.yellow>Styled</c>\n",
+		},
+		{
+			name: "same format re-encoded as UTF-8",
+			data: "1\r\n00:00:01,000 --> 00:00:02,000\r\nD\xE9j\xE0 vu\r\n",
+			from: FormatSRT, to: FormatSRT,
+			want: "1\n00:00:01,000 --> 00:00:02,000\nDéjà vu\n",
+		},
+		{
+			name: "SSA served as ASS kept as is",
+			data: assFile,
+			from: FormatSSA, to: FormatASS,
+			want: assFile,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Convert([]byte(test.data), test.from, test.to, 0)
+			if err != nil {
+				t.Fatalf("Convert error: %v", err)
+			}
+			if string(got) != test.want {
+				t.Errorf("Convert =\n%q\nwant\n%q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	if _, err := Convert([]byte("1\n00:00:01,000 --> 00:00:02,000\nHi\n"), FormatSRT, FormatASS, 0); err == nil {
+		t.Error("Convert to ASS succeeded, want an unsupported format error")
+	}
+	if _, err := Convert([]byte("not subtitles"), FormatSRT, FormatVTT, 0); err == nil {
+		t.Error("Convert of a file without cues succeeded")
+	}
+	if _, err := Convert([]byte("Dialogue: 0,0:00:01.00,0:00:02.00,,,0,0,0,,Hi"), FormatASS, FormatVTT, 0); err == nil {
+		t.Error("Convert of an ASS file without an events section succeeded")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	all := []string{FormatVTT, FormatSRT, FormatASS}
+	tests := []struct {
+		name   string
+		accept string
+		offers []string
+		want   string
+	}{
+		{name: "empty", accept: "", offers: all, want: ""},
+		{name: "VTT", accept: "text/vtt", offers: all, want: FormatVTT},
+		{name: "SubRip alias", accept: "application/srt", offers: all, want: FormatSRT},
+		{name: "first of equal quality", accept: "application/x-subrip, text/vtt", offers: all, want: FormatSRT},
+		{name: "highest quality", accept: "application/x-subrip;q=0.5, text/vtt;q=0.9", offers: all, want: FormatVTT},
+		{name: "parameters", accept: "text/vtt; charset=utf-8", offers: all, want: FormatVTT},
+		{name: "wildcards only", accept: "*/*, text/*", offers: all, want: ""},
+		{name: "wildcard and a format", accept: "*/*;q=0.1, text/vtt", offers: all, want: FormatVTT},
+		{name: "not offered", accept: "text/x-ssa", offers: []string{FormatVTT, FormatSRT}, want: ""},
+		{name: "SSA stands in for ASS", accept: "text/x-ssa", offers: all, want: FormatSSA},
+		{name: "unknown type", accept: "application/json", offers: all, want: ""},
+		{name: "bad quality skipped", accept: "text/vtt;q=high, application/x-subrip;q=0.2", offers: all, want: FormatSRT},
+		{name: "malformed part skipped", accept: "text/, text/vtt", offers: all, want: FormatVTT},
+		{name: "zero quality", accept: "text/vtt;q=0", offers: all, want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Negotiate(test.accept, test.offers); got != test.want {
+				t.Errorf("Negotiate(%q) = %q, want %q", test.accept, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{name: "episode.VTT", want: FormatVTT},
+		{name: "episode.ssa", want: FormatSSA},
+		{name: "track.sub", data: "\n WEBVTT\n\n00:01.000 --> 00:02.000\nHi\n", want: FormatVTT},
+		{name: "track", data: "[Script Info]\n[V4+ Styles]\n", want: FormatASS},
+		{name: "track", data: "[Script Info]\n[V4 Styles]\n", want: FormatSSA},
+		{name: "track", data: "1\n00:00:01,000 --> 00:00:02,000\nHi\n", want: FormatSRT},
+	}
+
+	for _, test := range tests {
+		if got := DetectFormat(test.name, []byte(test.data)); got != test.want {
+			t.Errorf("DetectFormat(%q, %q) = %q, want %q", test.name, test.data, got, test.want)
+		}
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	cue := Cue{Start: time.Second, End: 2 * time.Second, Text: "<i>Fish</i> & <font color=red>chips</font>\n<3"}
+	if got, want := cue.PlainText(), "Fish & chips\n<3"; got != want {
+		t.Errorf("PlainText = %q, want %q", got, want)
+	}
+}
+
+func TestShift(t *testing.T) {
+	cues := func() []Cue {
+		return []Cue{
+			{Start: 1 * time.Second, End: 2 * time.Second, Text: "ends before zero"},
+			{Start: 2 * time.Second, End: 3 * time.Second, Text: "ends at zero"},
+			{Start: 2500 * time.Millisecond, End: 4 * time.Second, Text: "starts before zero"},
+			{Start: 10 * time.Second, End: 12 * time.Second, Text: "later"},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		offset time.Duration
+		want   []Cue
+	}{
+		{name: "none", offset: 0, want: cues()},
+		{
+			name:   "later",
+			offset: 1500 * time.Millisecond,
+			want: []Cue{
+				{Start: 2500 * time.Millisecond, End: 3500 * time.Millisecond, Text: "ends before zero"},
+				{Start: 3500 * time.Millisecond, End: 4500 * time.Millisecond, Text: "ends at zero"},
+				{Start: 4 * time.Second, End: 5500 * time.Millisecond, Text: "starts before zero"},
+				{Start: 11500 * time.Millisecond, End: 13500 * time.Millisecond, Text: "later"},
+			},
+		},
+		{
+			// Cues that end by the start are dropped, and ones that start before it are cut
+			name:   "earlier",
+			offset: -3 * time.Second,
+			want: []Cue{
+				{Start: 0, End: 1 * time.Second, Text: "starts before zero"},
+				{Start: 7 * time.Second, End: 9 * time.Second, Text: "later"},
+			},
+		},
+		{name: "past the end", offset: -time.Minute, want: []Cue{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subtitle := &Subtitle{Format: FormatSRT, Cues: cues()}
+			subtitle.Shift(test.offset)
+			if !reflect.DeepEqual(subtitle.Cues, test.want) {
+				t.Errorf("Cues = %+v, want %+v", subtitle.Cues, test.want)
+			}
+		})
+	}
+}
+
+func TestConvertWithOffset(t *testing.T) {
+	srt := "1\n00:00:01,000 --> 00:00:02,000\nFirst\n\n2\n00:00:02,500 --> 00:00:04,000\nSecond\n"
+
+	got, err := Convert([]byte(srt), FormatSRT, FormatVTT, -2*time.Second)
+	if err != nil {
+		t.Fatalf("Convert error: %v", err)
+	}
+	if want := "WEBVTT\n\n00:00:00.500 --> 00:00:02.000\nSecond\n\n"; string(got) != want {
+		t.Errorf("Convert to VTT =\n%q\nwant\n%q", got, want)
+	}
+
+	// Files in the wanted format are shifted too
+	got, err = Convert([]byte(srt), FormatSRT, FormatSRT, 90*time.Minute)
+	if err != nil {
+		t.Fatalf("Convert error: %v", err)
+	}
+	want := "1\n01:30:01,000 --> 01:30:02,000\nFirst\n\n2\n01:30:02,500 --> 01:30:04,000\nSecond\n\n"
+	if string(got) != want {
+		t.Errorf("Convert to SRT =\n%q\nwant\n%q", got, want)
+	}
+}
@@ -0,0 +1,81 @@
+package subtitles
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseTimestamp reads "HH:MM:SS,mmm" (SubRip), "[HH:]MM:SS.mmm" (WebVTT) or
+// "H:MM:SS.cc" (ASS) timestamps
+func parseTimestamp(s string) (time.Duration, bool) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+
+	// Split the fraction off the seconds
+	seconds := parts[len(parts)-1]
+	fraction := ""
+	if i := strings.IndexAny(seconds, ",."); i >= 0 {
+		seconds, fraction = seconds[:i], seconds[i+1:]
+	}
+
+	var total time.Duration
+	units := []time.Duration{time.Hour, time.Minute, time.Second}[3-len(parts):]
+	values := append(parts[:len(parts)-1:len(parts)-1], seconds)
+	for i, value := range values {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		total += time.Duration(n) * units[i]
+	}
+
+	// The fraction may have any number of digits: ".5", ".34" and ".345" are all fine
+	if fraction != "" {
+		n, err := strconv.Atoi(fraction)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		scale := time.Second
+		for range fraction {
+			scale /= 10
+		}
+		total += time.Duration(n) * scale
+	}
+	return total, true
+}
+
+// formatTimestamp writes a timestamp as HH:MM:SS followed by sep and milliseconds.
+// Negative times are written as zero.
+func formatTimestamp(d time.Duration, sep byte) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := int64(d / time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d%c%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
+
+// parseTiming reads a "start --> end [settings]" cue timing line
+func parseTiming(line string) (time.Duration, time.Duration, bool) {
+	parts := strings.SplitN(line, "-->", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	endFields := strings.Fields(parts[1])
+	if len(endFields) == 0 {
+		return 0, 0, false
+	}
+
+	start, ok := parseTimestamp(parts[0])
+	if !ok {
+		return 0, 0, false
+	}
+	end, ok := parseTimestamp(endFields[0])
+	if !ok {
+		return 0, 0, false
+	}
+	return start, end, true
+}
@@ -0,0 +1,39 @@
+package subtitles
+
+import (
+	"bytes"
+	"strings"
+)
+
+// vttEntities are the character references WebVTT cue text may use
+var vttEntities = strings.NewReplacer(
+	"&lt;", "<",
+	"&gt;", ">",
+	"&nbsp;", "\u00a0",
+	"&lrm;", "\u200e",
+	"&rlm;", "\u200f",
+	"&amp;", "&",
+)
+
+// parseVTT reads a WebVTT file
+func parseVTT(text string) ([]Cue, error) {
+	return parseCues(text, vttEntities.Replace), nil
+}
+
+// vttTags are the tags kept when writing WebVTT. Others, like SubRip's <font>,
+// aren't valid WebVTT and are dropped.
+var vttTags = map[string]bool{"i": true, "b": true, "u": true}
+
+// writeVTT writes cues as a WebVTT file
+func writeVTT(buf *bytes.Buffer, cues []Cue) {
+	buf.WriteString("WEBVTT\n\n")
+	for _, cue := range cues {
+		buf.WriteString(formatTimestamp(cue.Start, '.'))
+		buf.WriteString(" --> ")
+		buf.WriteString(formatTimestamp(cue.End, '.'))
+		buf.WriteString("\n")
+		// "-->" may not appear in cue text, and escaping its ">" takes care of that
+		buf.WriteString(rewriteTags(cue.Text, vttTags, true))
+		buf.WriteString("\n\n")
+	}
+}
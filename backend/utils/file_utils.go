@@ -31,23 +31,81 @@ func ReadJSON(path string, v interface{}) error {
 	return decoder.Decode(v)
 }
 
-// WriteJSON writes data to a JSON file
+// WriteJSON writes data to a JSON file. The file is replaced atomically, so a
+// crash leaves either the old or the new content.
 func WriteJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, append(data, '\n'), false)
+}
+
+// WriteFileAtomic replaces a file with data by writing a temporary file, syncing
+// it to disk and renaming it over the original. With keepBackup set the
+// previous content is kept as path + ".bak".
+func WriteFileAtomic(path string, data []byte, keepBackup bool) error {
 	// Ensure directory exists
 	dir := filepath.Dir(path)
 	if err := EnsureDir(dir); err != nil {
 		return err
 	}
 
-	file, err := os.Create(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(v)
+	if keepBackup && FileExists(path) {
+		// Link the current file as the backup; the rename below then leaves it
+		// untouched. The old backup is replaced by a rename, so there's always
+		// one, and it's kept while there's no current file to take its place.
+		backup := path + ".bak"
+		newBackup := tmp.Name() + ".bak"
+		if err := os.Link(path, newBackup); err != nil {
+			// Not every file system supports hard links
+			if err := CopyFile(path, newBackup); err != nil {
+				os.Remove(newBackup)
+				return err
+			}
+		}
+		if err := os.Rename(newBackup, backup); err != nil {
+			os.Remove(newBackup)
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	SyncDir(dir)
+	return nil
+}
+
+// SyncDir flushes a directory entry change such as a rename to disk. Some
+// platforms can't sync directories, so errors are ignored.
+func SyncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
 }
 
 // FindFiles finds files matching the given pattern in a directory
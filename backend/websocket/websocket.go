@@ -0,0 +1,301 @@
+// Package websocket implements the server side of the WebSocket protocol
+// (RFC 6455), as much as is needed to push text messages to clients. Messages
+// from clients are read and discarded; pings are answered.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acceptGUID is appended to the client's key to compute Sec-WebSocket-Accept
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Frame opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close status codes
+const (
+	CloseNormal      = 1000
+	CloseGoingAway   = 1001
+	CloseProtocol    = 1002
+	CloseTooLarge    = 1009
+	CloseServerError = 1011
+)
+
+// maxMessageSize is the largest message accepted from a client
+const maxMessageSize = 64 << 10
+
+// writeTimeout bounds how long a write to the client may take
+const writeTimeout = 10 * time.Second
+
+// ErrClosed is returned when writing to a closed connection
+var ErrClosed = errors.New("websocket connection closed")
+
+// IsUpgrade reports whether a request asks to switch to the WebSocket protocol
+func IsUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+// headerHasToken reports whether a comma-separated header lists token, ignoring case
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Conn is a WebSocket connection. Writes may be made from several goroutines.
+type Conn struct {
+	conn net.Conn
+	// writeMutex keeps frames from interleaving
+	writeMutex sync.Mutex
+	closed     bool
+	// done is closed once the client has gone away or closed the connection
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// Upgrade completes the WebSocket handshake and takes over the connection. If
+// the request isn't a valid handshake, an error response is written and an
+// error returned.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet || !IsUpgrade(r) {
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return nil, errors.New("not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "Invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("invalid websocket key")
+	}
+
+	netConn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("failed to take over connection: %w", err)
+	}
+
+	// The handshake is written by hand, since the connection no longer belongs to net/http
+	netConn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := netConn.Write([]byte(response)); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	c := &Conn{conn: netConn, done: make(chan struct{})}
+	go c.readLoop(rw.Reader)
+	return c, nil
+}
+
+// acceptKey returns the Sec-WebSocket-Accept value for a client's key
+func acceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Done is closed once the client closes the connection or it fails
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// WriteText sends a text message
+func (c *Conn) WriteText(message []byte) error {
+	return c.writeFrame(opText, message)
+}
+
+// Ping sends a ping, which the client answers, to keep the connection alive
+func (c *Conn) Ping() error {
+	return c.writeFrame(opPing, nil)
+}
+
+// Close sends a close frame with a status code and closes the connection
+func (c *Conn) Close(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	err := c.writeFrame(opClose, payload)
+
+	c.writeMutex.Lock()
+	c.closed = true
+	c.writeMutex.Unlock()
+	c.finish()
+	if closeErr := c.conn.Close(); err == nil && !errors.Is(closeErr, net.ErrClosed) {
+		err = closeErr
+	}
+	return err
+}
+
+// finish marks the connection as done
+func (c *Conn) finish() {
+	c.doneOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// writeFrame sends a single unmasked frame
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode // Final fragment
+	switch length := len(payload); {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		// The connection is unusable; close it so it doesn't outlive the handler
+		c.closed = true
+		c.finish()
+		c.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// readLoop reads frames from the client until the connection ends, answering
+// pings and close frames and discarding messages
+func (c *Conn) readLoop(r *bufio.Reader) {
+	defer c.finish()
+
+	messageSize := 0
+	for {
+		opcode, payload, err := readFrame(r)
+		if err != nil {
+			if errors.Is(err, errFrameTooLarge) {
+				c.Close(CloseTooLarge, "message too large")
+			} else if errors.Is(err, errProtocol) {
+				c.Close(CloseProtocol, "protocol error")
+			} else {
+				c.conn.Close()
+			}
+			return
+		}
+
+		switch opcode {
+		case opPing:
+			c.writeFrame(opPong, payload)
+		case opPong:
+		case opClose:
+			// Echo the status code back, as the protocol asks
+			code := CloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.Close(code, "")
+			return
+		case opText, opBinary, opContinuation:
+			if opcode != opContinuation {
+				messageSize = 0
+			}
+			messageSize += len(payload)
+			if messageSize > maxMessageSize {
+				c.Close(CloseTooLarge, "message too large")
+				return
+			}
+		default:
+			c.Close(CloseProtocol, "unknown opcode")
+			return
+		}
+	}
+}
+
+var (
+	errProtocol      = errors.New("websocket protocol error")
+	errFrameTooLarge = errors.New("websocket frame too large")
+)
+
+// readFrame reads a frame sent by a client and unmasks its payload
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0F
+	if header[0]&0x70 != 0 {
+		// No extensions were negotiated, so the reserved bits must be clear
+		return 0, nil, errProtocol
+	}
+	if header[1]&0x80 == 0 {
+		// Clients must mask every frame
+		return 0, nil, errProtocol
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if opcode >= opClose && (length > 125 || header[0]&0x80 == 0) {
+		// Control frames are short and never fragmented
+		return 0, nil, errProtocol
+	}
+	if length > maxMessageSize {
+		return 0, nil, errFrameTooLarge
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
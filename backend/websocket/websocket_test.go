@@ -0,0 +1,206 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// clientFrame encodes a frame as a client would send it. Length is written in
+// the given form (7, 16 or 64 bits) so non-minimal encodings can be tested.
+func clientFrame(first byte, payload []byte, lengthBits int, masked bool) []byte {
+	frame := []byte{first, 0}
+	switch lengthBits {
+	case 7:
+		frame[1] = byte(len(payload))
+	case 16:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	case 64:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+
+	frame[1] |= 0x80
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// frameHeader encodes just a masked frame header claiming a 64 bit length
+func frameHeader(first byte, length uint64) []byte {
+	header := binary.BigEndian.AppendUint64([]byte{first, 0x80 | 127}, length)
+	return append(header, 0, 0, 0, 0)
+}
+
+func TestReadFrame(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 70000)
+	tests := []struct {
+		name    string
+		input   []byte
+		opcode  byte
+		payload []byte
+		err     error
+	}{
+		{name: "7 bit length", input: clientFrame(0x81, []byte("hello"), 7, true), opcode: opText, payload: []byte("hello")},
+		{name: "empty", input: clientFrame(0x81, nil, 7, true), opcode: opText, payload: []byte{}},
+		{name: "16 bit length", input: clientFrame(0x82, large[:300], 16, true), opcode: opBinary, payload: large[:300]},
+		{name: "16 bit length at the limit", input: clientFrame(0x82, large[:maxMessageSize-1], 16, true), opcode: opBinary, payload: large[:maxMessageSize-1]},
+		{name: "64 bit length", input: clientFrame(0x82, large[:maxMessageSize], 64, true), opcode: opBinary, payload: large[:maxMessageSize]},
+		{name: "64 bit length for a short payload", input: clientFrame(0x01, []byte("hi"), 64, true), opcode: opText, payload: []byte("hi")},
+		{name: "64 bit length over the limit", input: clientFrame(0x82, large, 64, true), err: errFrameTooLarge},
+		{name: "64 bit length of terabytes", input: frameHeader(0x82, 1<<40), err: errFrameTooLarge},
+		{name: "64 bit length with the top bit set", input: frameHeader(0x82, 1<<63), err: errFrameTooLarge},
+		{name: "unmasked", input: clientFrame(0x81, []byte("hello"), 7, false), err: errProtocol},
+		{name: "unmasked with 64 bit length", input: clientFrame(0x81, []byte("hello"), 64, false), err: errProtocol},
+		{name: "unmasked ping", input: clientFrame(0x89, nil, 7, false), err: errProtocol},
+		{name: "reserved bits", input: clientFrame(0xC1, []byte("hello"), 7, true), err: errProtocol},
+		{name: "long control frame", input: clientFrame(0x89, bytes.Repeat([]byte("x"), 126), 16, true), err: errProtocol},
+		{name: "fragmented control frame", input: clientFrame(0x09, nil, 7, true), err: errProtocol},
+		{name: "truncated length", input: []byte{0x81, 0x80 | 127, 0, 0}, err: io.ErrUnexpectedEOF},
+		{name: "truncated payload", input: clientFrame(0x81, []byte("hello"), 7, true)[:8], err: io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opcode, payload, err := readFrame(bufio.NewReader(bytes.NewReader(test.input)))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("readFrame error = %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if opcode != test.opcode {
+				t.Errorf("opcode = %x, want %x", opcode, test.opcode)
+			}
+			if !bytes.Equal(payload, test.payload) {
+				t.Errorf("payload = %.20q (%d bytes), want %.20q (%d bytes)", payload, len(payload), test.payload, len(test.payload))
+			}
+		})
+	}
+}
+
+func TestWriteFrameLengths(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		header []byte
+	}{
+		{name: "7 bit", size: 125, header: []byte{0x81, 125}},
+		{name: "16 bit", size: 126, header: []byte{0x81, 126, 0, 126}},
+		{name: "16 bit maximum", size: 0xFFFF, header: []byte{0x81, 126, 0xFF, 0xFF}},
+		{name: "64 bit", size: 0x10000, header: []byte{0x81, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			conn := &Conn{conn: server, done: make(chan struct{})}
+
+			payload := bytes.Repeat([]byte("x"), test.size)
+			written := make(chan error, 1)
+			go func() {
+				written <- conn.WriteText(payload)
+			}()
+
+			frame := make([]byte, len(test.header)+test.size)
+			if _, err := io.ReadFull(client, frame); err != nil {
+				t.Fatalf("reading frame: %v", err)
+			}
+			if err := <-written; err != nil {
+				t.Fatalf("WriteText error: %v", err)
+			}
+			if !bytes.Equal(frame[:len(test.header)], test.header) {
+				t.Errorf("header = % x, want % x", frame[:len(test.header)], test.header)
+			}
+			if !bytes.Equal(frame[len(test.header):], payload) {
+				t.Errorf("payload differs from what was written")
+			}
+		})
+	}
+}
+
+func TestUnmaskedFrameClosesConnection(t *testing.T) {
+	upgraded := make(chan *Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			t.Errorf("Upgrade error: %v", err)
+			return
+		}
+		upgraded <- conn
+	}))
+	defer server.Close()
+
+	client, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	request := "GET / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + key + "\r\n\r\n"
+	if _, err := client.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(client)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want %d", response.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if got, want := response.Header.Get("Sec-WebSocket-Accept"), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("Sec-WebSocket-Accept = %q, want %q", got, want)
+	}
+	conn := <-upgraded
+
+	if _, err := client.Write(clientFrame(0x81, []byte("hello"), 7, false)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server answers with a protocol error close frame and hangs up
+	frame := make([]byte, 2)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		t.Fatalf("reading close frame: %v", err)
+	}
+	if frame[0] != 0x80|opClose {
+		t.Fatalf("frame opcode byte = %x, want close", frame[0])
+	}
+	payload := make([]byte, frame[1])
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	if code := binary.BigEndian.Uint16(payload); code != CloseProtocol {
+		t.Errorf("close code = %d, want %d", code, CloseProtocol)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("connection still open after close frame, read error = %v", err)
+	}
+
+	select {
+	case <-conn.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("Done not closed after the protocol error")
+	}
+	if err := conn.WriteText([]byte("late")); !errors.Is(err, ErrClosed) {
+		t.Errorf("WriteText after close error = %v, want %v", err, ErrClosed)
+	}
+}